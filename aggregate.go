@@ -0,0 +1,329 @@
+package embedtsdb
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// AggregateFunc is a function to aggregate data points within each step.
+type AggregateFunc string
+
+const (
+	AggregateAvg   AggregateFunc = "avg"
+	AggregateMin   AggregateFunc = "min"
+	AggregateMax   AggregateFunc = "max"
+	AggregateSum   AggregateFunc = "sum"
+	AggregateCount AggregateFunc = "count"
+	AggregateFirst AggregateFunc = "first"
+	AggregateLast  AggregateFunc = "last"
+
+	// The maximum number of buckets a single query can produce per series.
+	maxAggregateBuckets = 1 << 20
+)
+
+// AggregateQuery describes a query that downsamples series into one value per step.
+type AggregateQuery struct {
+	// Matchers select series to be aggregated. At least one matcher must be given.
+	Matchers []*Matcher
+	// Start is inclusive, End is exclusive.
+	Start int64
+	End   int64
+	// Step is the width of each bucket, in the same precision as timestamps.
+	// Buckets are aligned to Start, and each bucket is given back as a data point timestamped with its beginning.
+	Step int64
+	Func AggregateFunc
+	// GroupBy aggregates series having the same values of the given label names into one,
+	// similar to "sum by (host)". Data points of grouped series are aggregated as if they belonged to a single series.
+	GroupBy []string
+	// Group aggregates all series into one when no GroupBy is given, similar to "sum(...)".
+	Group bool
+}
+
+func (q *AggregateQuery) validate() error {
+	if len(q.Matchers) == 0 {
+		return fmt.Errorf("at least one matcher must be given")
+	}
+	if q.Start >= q.End {
+		return fmt.Errorf("the given start is greater than end")
+	}
+	if q.Step <= 0 {
+		return fmt.Errorf("step must be positive")
+	}
+	if q.End-q.Start <= 0 {
+		// Bucket indexes would overflow.
+		return fmt.Errorf("the range between start and end is too wide")
+	}
+	if (q.End-q.Start-1)/q.Step+1 > maxAggregateBuckets {
+		return fmt.Errorf("too many buckets: step %d is too small for the range", q.Step)
+	}
+	switch q.Func {
+	case AggregateAvg, AggregateMin, AggregateMax, AggregateSum, AggregateCount, AggregateFirst, AggregateLast:
+	default:
+		return fmt.Errorf("unknown aggregate function %q given", q.Func)
+	}
+	return nil
+}
+
+func (q *AggregateQuery) numBuckets() int {
+	return int((q.End-q.Start-1)/q.Step + 1)
+}
+
+// bucket gives back the index of the bucket the given timestamp falls into.
+func (q *AggregateQuery) bucket(timestamp int64) int {
+	return int((timestamp - q.Start) / q.Step)
+}
+
+func (q *AggregateQuery) grouped() bool {
+	return q.Group || len(q.GroupBy) > 0
+}
+
+// aggregation accumulates data points. Two aggregations can be merged regardless of their order.
+type aggregation struct {
+	count    int64
+	sum      float64
+	min      float64
+	max      float64
+	firstT   int64
+	firstV   float64
+	lastT    int64
+	lastV    float64
+	hasValue bool
+}
+
+func (a *aggregation) add(timestamp int64, value float64) {
+	if !a.hasValue {
+		*a = aggregation{
+			count:    1,
+			sum:      value,
+			min:      value,
+			max:      value,
+			firstT:   timestamp,
+			firstV:   value,
+			lastT:    timestamp,
+			lastV:    value,
+			hasValue: true,
+		}
+		return
+	}
+	a.count++
+	a.sum += value
+	a.min = math.Min(a.min, value)
+	a.max = math.Max(a.max, value)
+	if timestamp < a.firstT {
+		a.firstT, a.firstV = timestamp, value
+	}
+	if timestamp >= a.lastT {
+		a.lastT, a.lastV = timestamp, value
+	}
+}
+
+func (a *aggregation) merge(b *aggregation) {
+	if !b.hasValue {
+		return
+	}
+	if !a.hasValue {
+		*a = *b
+		return
+	}
+	a.count += b.count
+	a.sum += b.sum
+	a.min = math.Min(a.min, b.min)
+	a.max = math.Max(a.max, b.max)
+	if b.firstT < a.firstT {
+		a.firstT, a.firstV = b.firstT, b.firstV
+	}
+	if b.lastT >= a.lastT {
+		a.lastT, a.lastV = b.lastT, b.lastV
+	}
+}
+
+// finite tells if all accumulated values can be represented in JSON.
+func (a *aggregation) finite() bool {
+	for _, v := range []float64{a.sum, a.min, a.max, a.firstV, a.lastV} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *aggregation) value(fn AggregateFunc) float64 {
+	switch fn {
+	case AggregateAvg:
+		return a.sum / float64(a.count)
+	case AggregateMin:
+		return a.min
+	case AggregateMax:
+		return a.max
+	case AggregateSum:
+		return a.sum
+	case AggregateCount:
+		return float64(a.count)
+	case AggregateFirst:
+		return a.firstV
+	case AggregateLast:
+		return a.lastV
+	default:
+		return math.NaN()
+	}
+}
+
+// aggregateGroup holds buckets of series that are aggregated into one.
+type aggregateGroup struct {
+	metric string
+	// mixed tells if series of different metrics are grouped.
+	mixed   bool
+	labels  []Label
+	buckets []aggregation
+}
+
+func (g *aggregateGroup) series(q *AggregateQuery) *Series {
+	series := &Series{Labels: g.labels}
+	if !g.mixed {
+		series.Metric = g.metric
+	}
+	for i := range g.buckets {
+		if !g.buckets[i].hasValue {
+			continue
+		}
+		series.Points = append(series.Points, &DataPoint{
+			Timestamp: q.Start + int64(i)*q.Step,
+			Value:     g.buckets[i].value(q.Func),
+		})
+	}
+	return series
+}
+
+func (s *storage) Aggregate(query AggregateQuery) ([]*Series, error) {
+	q := &query
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	partitions, err := s.overlappingPartitions(q.Start, q.End)
+	if err != nil {
+		return nil, err
+	}
+	defer releasePartitions(partitions)
+	// Disk partitions are served by the rollup tier if any fits the query.
+	var blocks []*rollupBlock
+	if tier := s.rollupTierFor(q); tier != nil {
+		partitions, blocks, err = tier.selectBlocks(partitions, q.Start, q.End)
+		if err != nil {
+			return nil, fmt.Errorf("failed to select rollups: %w", err)
+		}
+	}
+	names, err := matchSeriesNames(partitions, q.Matchers)
+	if err != nil {
+		return nil, err
+	}
+	// Series may remain only in rollups after their raw data points expired.
+	// The order of names doesn't matter as results get sorted at last.
+	if len(blocks) > 0 {
+		seen := make(map[string]struct{}, len(names))
+		for _, name := range names {
+			seen[name] = struct{}{}
+		}
+		for _, b := range blocks {
+			for _, name := range b.matchSeries(q.Matchers) {
+				if _, ok := seen[name]; ok {
+					continue
+				}
+				seen[name] = struct{}{}
+				names = append(names, name)
+			}
+		}
+	}
+
+	groups := make(map[string]*aggregateGroup)
+	order := make([]string, 0)
+	for _, name := range names {
+		seriesMetric, seriesLabels := unmarshalMetricName(name)
+		metric, labels := seriesMetric, seriesLabels
+		if q.grouped() {
+			metric, labels = "", groupLabels(labels, q.GroupBy)
+		}
+		key := marshalMetricName(metric, labels)
+		g, ok := groups[key]
+		if !ok {
+			g = &aggregateGroup{
+				metric:  seriesMetric,
+				labels:  labels,
+				buckets: make([]aggregation, q.numBuckets()),
+			}
+			groups[key] = g
+			order = append(order, key)
+		}
+		if g.metric != seriesMetric {
+			g.mixed = true
+		}
+		// Aggregations are merged regardless of the order, so each partition can be aggregated on its own.
+		for _, part := range partitions {
+			err := aggregatePartition(part, name, q, g.buckets)
+			if errors.Is(err, ErrNoDataPoints) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to aggregate data points: %w", err)
+			}
+		}
+		for _, b := range blocks {
+			b.aggregate(name, q, g.buckets)
+		}
+	}
+
+	result := make([]*Series, 0, len(groups))
+	for _, key := range order {
+		series := groups[key].series(q)
+		if len(series.Points) == 0 {
+			continue
+		}
+		result = append(result, series)
+	}
+	if len(result) == 0 {
+		return nil, ErrNoDataPoints
+	}
+	sortSeries(result)
+	return result, nil
+}
+
+// summarizer is implemented by partitions that keep precomputed summaries of data points,
+// which let them aggregate without decoding every data point.
+type summarizer interface {
+	aggregate(name string, q *AggregateQuery, buckets []aggregation) error
+}
+
+// aggregatePartition accumulates data points of the given series in the given partition into the buckets.
+func aggregatePartition(part partition, name string, q *AggregateQuery, buckets []aggregation) error {
+	if sm, ok := part.(summarizer); ok {
+		return sm.aggregate(name, q, buckets)
+	}
+	it, err := part.selectIterator(name, q.Start, q.End)
+	if err != nil {
+		return err
+	}
+	return aggregateIterator(it, q, buckets)
+}
+
+// aggregateIterator accumulates data points while decoding them.
+func aggregateIterator(it Iterator, q *AggregateQuery, buckets []aggregation) error {
+	for it.Next() {
+		timestamp, value := it.At()
+		buckets[q.bucket(timestamp)].add(timestamp, value)
+	}
+	return it.Err()
+}
+
+// groupLabels gives back labels whose names are one of the given ones, sorted by name.
+func groupLabels(labels []Label, names []string) []Label {
+	grouped := make([]Label, 0, len(names))
+	for i := range labels {
+		for _, name := range names {
+			if labels[i].Name == name {
+				grouped = append(grouped, labels[i])
+				break
+			}
+		}
+	}
+	return grouped
+}
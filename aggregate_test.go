@@ -0,0 +1,129 @@
+package embedtsdb
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_Aggregate(t *testing.T) {
+	rows := []Row{
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}, {Name: "region", Value: "us"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 1}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}, {Name: "region", Value: "us"}}, DataPoint: DataPoint{Timestamp: 1600000005, Value: 3}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}, {Name: "region", Value: "us"}}, DataPoint: DataPoint{Timestamp: 1600000010, Value: 5}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}, {Name: "region", Value: "us"}}, DataPoint: DataPoint{Timestamp: 1600000001, Value: 10}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}, {Name: "region", Value: "us"}}, DataPoint: DataPoint{Timestamp: 1600000012, Value: 20}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "c"}, {Name: "region", Value: "eu"}}, DataPoint: DataPoint{Timestamp: 1600000002, Value: 100}},
+	}
+	cpu := MustNewMatcher(MatchEqual, MetricNameLabel, "cpu")
+	tests := []struct {
+		name    string
+		query   AggregateQuery
+		want    []*Series
+		wantErr bool
+	}{
+		{
+			name:  "avg of each series",
+			query: AggregateQuery{Matchers: []*Matcher{cpu, MustNewMatcher(MatchEqual, "host", "a")}, Start: 1600000000, End: 1600000020, Step: 10, Func: AggregateAvg},
+			want: []*Series{
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}, {Name: "region", Value: "us"}}, Points: []*DataPoint{
+					{Timestamp: 1600000000, Value: 2},
+					{Timestamp: 1600000010, Value: 5},
+				}},
+			},
+		},
+		{
+			name:  "last with partial buckets",
+			query: AggregateQuery{Matchers: []*Matcher{cpu, MustNewMatcher(MatchEqual, "host", "a")}, Start: 1600000001, End: 1600000011, Step: 3, Func: AggregateLast},
+			want: []*Series{
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}, {Name: "region", Value: "us"}}, Points: []*DataPoint{
+					{Timestamp: 1600000004, Value: 3},
+					{Timestamp: 1600000010, Value: 5},
+				}},
+			},
+		},
+		{
+			name:  "sum by region",
+			query: AggregateQuery{Matchers: []*Matcher{cpu}, Start: 1600000000, End: 1600000020, Step: 10, Func: AggregateSum, GroupBy: []string{"region"}},
+			want: []*Series{
+				{Metric: "cpu", Labels: []Label{{Name: "region", Value: "eu"}}, Points: []*DataPoint{
+					{Timestamp: 1600000000, Value: 100},
+				}},
+				{Metric: "cpu", Labels: []Label{{Name: "region", Value: "us"}}, Points: []*DataPoint{
+					{Timestamp: 1600000000, Value: 14},
+					{Timestamp: 1600000010, Value: 25},
+				}},
+			},
+		},
+		{
+			name:  "max across all series",
+			query: AggregateQuery{Matchers: []*Matcher{cpu}, Start: 1600000000, End: 1600000020, Step: 10, Func: AggregateMax, Group: true},
+			want: []*Series{
+				{Metric: "cpu", Labels: []Label{}, Points: []*DataPoint{
+					{Timestamp: 1600000000, Value: 100},
+					{Timestamp: 1600000010, Value: 20},
+				}},
+			},
+		},
+		{
+			name:  "count by missing label",
+			query: AggregateQuery{Matchers: []*Matcher{cpu}, Start: 1600000000, End: 1600000020, Step: 20, Func: AggregateCount, GroupBy: []string{"zone"}},
+			want: []*Series{
+				{Metric: "cpu", Labels: []Label{}, Points: []*DataPoint{
+					{Timestamp: 1600000000, Value: 6},
+				}},
+			},
+		},
+		{
+			name:    "no data points",
+			query:   AggregateQuery{Matchers: []*Matcher{cpu}, Start: 1500000000, End: 1500000020, Step: 10, Func: AggregateSum},
+			wantErr: true,
+		},
+		{
+			name:    "no matchers",
+			query:   AggregateQuery{Start: 1600000000, End: 1600000020, Step: 10, Func: AggregateSum},
+			wantErr: true,
+		},
+		{
+			name:    "invalid step",
+			query:   AggregateQuery{Matchers: []*Matcher{cpu}, Start: 1600000000, End: 1600000020, Step: 0, Func: AggregateSum},
+			wantErr: true,
+		},
+		{
+			name:    "overflowing range",
+			query:   AggregateQuery{Matchers: []*Matcher{cpu}, Start: math.MinInt64, End: math.MaxInt64, Step: math.MaxInt64, Func: AggregateSum},
+			wantErr: true,
+		},
+		{
+			name:    "unknown function",
+			query:   AggregateQuery{Matchers: []*Matcher{cpu}, Start: 1600000000, End: 1600000020, Step: 10, Func: "median"},
+			wantErr: true,
+		},
+	}
+
+	tmpDir := t.TempDir()
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows(rows))
+	for _, tt := range tests {
+		t.Run("memory/"+tt.name, func(t *testing.T) {
+			got, err := s.Aggregate(tt.query)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	require.NoError(t, s.Close())
+
+	s, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	for _, tt := range tests {
+		t.Run("disk/"+tt.name, func(t *testing.T) {
+			got, err := s.Aggregate(tt.query)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package embedtsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+)
+
+// castagnoliTable is used to compute CRC32C checksums of chunks, meta files and WAL records.
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumError is given back when data doesn't match its checksum, which means it got corrupted on disk.
+// Use errors.As to tell it from other errors.
+type ChecksumError struct {
+	// Path is the file having the corrupted data.
+	Path string
+	// Offset is where the corrupted data begins in the file.
+	Offset   int64
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch in %q at offset %d: expected %08x but got %08x", e.Path, e.Offset, e.Expected, e.Actual)
+}
+
+// verifyChunk checks the checksum of the given chunk in the data file.
+// Chunks flushed before checksums were introduced aren't checked.
+func verifyChunk(data []byte, c *diskChunk, path string) error {
+	if c.Length == 0 {
+		return nil
+	}
+	end := c.Offset + c.Length
+	if c.Offset < 0 || end > int64(len(data)) || end < c.Offset {
+		return fmt.Errorf("chunk at offset %d having %d bytes is out of range in %q", c.Offset, c.Length, path)
+	}
+	if sum := crc32.Checksum(data[c.Offset:end], castagnoliTable); sum != c.Checksum {
+		return &ChecksumError{Path: path, Offset: c.Offset, Expected: c.Checksum, Actual: sum}
+	}
+	return nil
+}
+
+// The checksum of a meta file is put at the end of the JSON object, covering everything before it.
+var metaChecksumKey = []byte(`,"checksum":`)
+
+// encodeMeta encodes the meta file along with its checksum.
+func encodeMeta(m *meta) ([]byte, error) {
+	m.Version = metaVersion
+	m.Checksum = 0
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return appendJSONChecksum(b), nil
+}
+
+// appendJSONChecksum replaces the closing brace of the given JSON object with the checksum field covering everything before it.
+func appendJSONChecksum(b []byte) []byte {
+	b = b[:len(b)-1]
+	sum := crc32.Checksum(b, castagnoliTable)
+	b = append(b, metaChecksumKey...)
+	b = strconv.AppendUint(b, uint64(sum), 10)
+	return append(b, '}')
+}
+
+// verifyJSONChecksum verifies the given JSON object read from the given path against the checksum decoded from it.
+func verifyJSONChecksum(b []byte, checksum uint32, path string) error {
+	i := bytes.LastIndex(b, metaChecksumKey)
+	if i < 0 {
+		return fmt.Errorf("checksum of %q not found", path)
+	}
+	if sum := crc32.Checksum(b[:i], castagnoliTable); sum != checksum {
+		return &ChecksumError{Path: path, Expected: checksum, Actual: sum}
+	}
+	return nil
+}
+
+// decodeMeta decodes the meta file read from the given path, verifying its checksum if it has.
+func decodeMeta(b []byte, path string) (*meta, error) {
+	m := &meta{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("failed to decode metadata: %w", err)
+	}
+	if m.Version < metaVersion {
+		// Meta files of version 1 don't have the checksum.
+		return m, nil
+	}
+	if err := verifyJSONChecksum(b, m.Checksum, path); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
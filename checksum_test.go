@@ -0,0 +1,136 @@
+package embedtsdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_encodeMeta_decodeMeta(t *testing.T) {
+	m := &meta{
+		MinTimestamp:  1,
+		MaxTimestamp:  2,
+		NumDataPoints: 2,
+		Metrics: map[string]diskMetric{
+			"metric1": {Name: "metric1", MinTimestamp: 1, MaxTimestamp: 2, NumDataPoints: 2},
+		},
+		CreatedAt: time.Unix(1600000000, 0).UTC(),
+	}
+	b, err := encodeMeta(m)
+	require.NoError(t, err)
+
+	got, err := decodeMeta(b, "meta.json")
+	require.NoError(t, err)
+	assert.Equal(t, metaVersion, got.Version)
+	assert.Equal(t, crc32.Checksum(b[:bytes.LastIndex(b, metaChecksumKey)], castagnoliTable), got.Checksum)
+	got.Checksum = 0
+	assert.Equal(t, m, got)
+
+	// Encoding a decoded meta file gives back the same bytes.
+	again, err := encodeMeta(got)
+	require.NoError(t, err)
+	assert.Equal(t, b, again)
+}
+
+func Test_decodeMeta(t *testing.T) {
+	valid, err := encodeMeta(&meta{MinTimestamp: 1, MaxTimestamp: 2, NumDataPoints: 1})
+	require.NoError(t, err)
+	legacy, err := json.Marshal(&meta{MinTimestamp: 1, MaxTimestamp: 2, NumDataPoints: 1})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		b            []byte
+		wantChecksum bool
+		wantErr      bool
+	}{
+		{
+			name: "valid",
+			b:    valid,
+		},
+		{
+			name: "version 1 without checksum",
+			b:    legacy,
+		},
+		{
+			name:         "tampered",
+			b:            bytes.Replace(valid, []byte(`"maxTimestamp":2`), []byte(`"maxTimestamp":3`), 1),
+			wantChecksum: true,
+			wantErr:      true,
+		},
+		{
+			name:    "missing checksum",
+			b:       []byte(`{"version":2,"minTimestamp":1}`),
+			wantErr: true,
+		},
+		{
+			name:    "broken",
+			b:       valid[:len(valid)-1],
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := decodeMeta(tt.b, "meta.json")
+			if !tt.wantErr {
+				require.NoError(t, err)
+				assert.Equal(t, int64(2), m.MaxTimestamp)
+				return
+			}
+			require.Error(t, err)
+			var checksumErr *ChecksumError
+			assert.Equal(t, tt.wantChecksum, errors.As(err, &checksumErr))
+		})
+	}
+}
+
+func Test_verifyChunk(t *testing.T) {
+	data := []byte("0123456789")
+	tests := []struct {
+		name         string
+		chunk        diskChunk
+		wantChecksum bool
+		wantErr      bool
+	}{
+		{
+			name:  "valid",
+			chunk: diskChunk{Offset: 2, Length: 3, Checksum: crc32.Checksum([]byte("234"), castagnoliTable)},
+		},
+		{
+			name:  "without checksum",
+			chunk: diskChunk{Offset: 2},
+		},
+		{
+			name:         "mismatch",
+			chunk:        diskChunk{Offset: 2, Length: 3, Checksum: crc32.Checksum([]byte("235"), castagnoliTable)},
+			wantChecksum: true,
+			wantErr:      true,
+		},
+		{
+			name:    "out of range",
+			chunk:   diskChunk{Offset: 8, Length: 3},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyChunk(data, &tt.chunk, "data")
+			if !tt.wantErr {
+				assert.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			var checksumErr *ChecksumError
+			if assert.Equal(t, tt.wantChecksum, errors.As(err, &checksumErr)) && tt.wantChecksum {
+				assert.Equal(t, "data", checksumErr.Path)
+				assert.Equal(t, tt.chunk.Offset, checksumErr.Offset)
+			}
+		})
+	}
+}
@@ -0,0 +1,536 @@
+// Command embedtsdb inspects and operates a data directory given to embedtsdb.WithDataPath.
+//
+// Usage:
+//
+//	embedtsdb <command> -data <dir> [flags] [args]
+//
+// The commands are:
+//
+//	partitions  list disk partitions along with their metadata
+//	series      list series that satisfy a selector
+//	dump        print data points of series that satisfy a selector
+//	query       evaluate a PromQL query
+//	export      write data points of series that satisfy a selector as CSV or NDJSON
+//	import      insert data points written by export
+//	verify      check the integrity of partitions and the write-ahead log, optionally repairing them
+//	wal         print records in the write-ahead log
+//
+// Except for partitions, verify and wal, which work on files, commands open the directory as a storage.
+// Data points left in the write-ahead log are then flushed into a disk partition when the command finishes,
+// so don't run them against a directory used by another process.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yudaprama/embedtsdb"
+	"github.com/yudaprama/embedtsdb/promql"
+)
+
+// Retention used to open a storage, so that no partition is hidden or removed as expired.
+const retention = 100 * 365 * 24 * time.Hour
+
+// The selector matching all series.
+const allSeries = `{__name__=~".+"}`
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string, stdin io.Reader, stdout io.Writer) error
+}
+
+var commands = []command{
+	{"partitions", "list disk partitions along with their metadata", runPartitions},
+	{"series", "list series that satisfy a selector", runSeries},
+	{"dump", "print data points of series that satisfy a selector", runDump},
+	{"query", "evaluate a PromQL query", runQuery},
+	{"export", "write data points of series that satisfy a selector as CSV or NDJSON", runExport},
+	{"import", "insert data points written by export", runImport},
+	{"verify", "check the integrity of partitions and the write-ahead log, optionally repairing them", runVerify},
+	{"wal", "print records in the write-ahead log", runWAL},
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "embedtsdb: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage())
+	}
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:], stdin, stdout)
+		}
+	}
+	return fmt.Errorf("unknown command %q\n%s", args[0], usage())
+}
+
+func usage() string {
+	var b strings.Builder
+	b.WriteString("usage: embedtsdb <command> -data <dir> [flags] [args]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(&b, "  %-11s %s\n", c.name, c.usage)
+	}
+	b.WriteString("\nrun \"embedtsdb <command> -h\" for the flags of each command")
+	return b.String()
+}
+
+// commonFlags are flags every command has.
+type commonFlags struct {
+	dataPath          string
+	precision         string
+	partitionDuration time.Duration
+}
+
+func newFlagSet(name string) (*flag.FlagSet, *commonFlags) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	c := &commonFlags{}
+	fs.StringVar(&c.dataPath, "data", "", "path to the data directory (required)")
+	fs.StringVar(&c.precision, "precision", "ns", "timestamp precision of the storage: ns, us, ms or s")
+	fs.DurationVar(&c.partitionDuration, "partition-duration", time.Hour, "partition duration of the storage")
+	return fs, c
+}
+
+// parse parses the given arguments, and validates the common flags.
+func (c *commonFlags) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if c.dataPath == "" {
+		return fmt.Errorf("-data is required")
+	}
+	if _, err := c.timestampPrecision(); err != nil {
+		return err
+	}
+	info, err := os.Stat(c.dataPath)
+	if err != nil {
+		return fmt.Errorf("failed to open data directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", c.dataPath)
+	}
+	return nil
+}
+
+func (c *commonFlags) timestampPrecision() (embedtsdb.TimestampPrecision, error) {
+	switch c.precision {
+	case "ns":
+		return embedtsdb.Nanoseconds, nil
+	case "us":
+		return embedtsdb.Microseconds, nil
+	case "ms":
+		return embedtsdb.Milliseconds, nil
+	case "s":
+		return embedtsdb.Seconds, nil
+	default:
+		return "", fmt.Errorf("unknown precision %q", c.precision)
+	}
+}
+
+func (c *commonFlags) openStorage() (embedtsdb.Storage, error) {
+	precision, _ := c.timestampPrecision()
+	return embedtsdb.NewStorage(
+		embedtsdb.WithDataPath(c.dataPath),
+		embedtsdb.WithTimestampPrecision(precision),
+		embedtsdb.WithPartitionDuration(c.partitionDuration),
+		embedtsdb.WithRetention(retention),
+	)
+}
+
+// parseTime parses a timestamp in the precision, an RFC 3339 time, or "now".
+func (c *commonFlags) parseTime(s string) (int64, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ts, nil
+	}
+	t := time.Now()
+	if s != "now" {
+		var err error
+		if t, err = time.Parse(time.RFC3339Nano, s); err != nil {
+			return 0, fmt.Errorf("invalid time %q: must be a timestamp, an RFC 3339 time or \"now\"", s)
+		}
+	}
+	precision, _ := c.timestampPrecision()
+	switch precision {
+	case embedtsdb.Microseconds:
+		return t.UnixMicro(), nil
+	case embedtsdb.Milliseconds:
+		return t.UnixMilli(), nil
+	case embedtsdb.Seconds:
+		return t.Unix(), nil
+	default:
+		return t.UnixNano(), nil
+	}
+}
+
+// rangeFlags are flags to specify a time range.
+type rangeFlags struct {
+	start, end string
+}
+
+func addRangeFlags(fs *flag.FlagSet) *rangeFlags {
+	r := &rangeFlags{}
+	fs.StringVar(&r.start, "start", "", "inclusive start of the range; a timestamp, an RFC 3339 time or \"now\" (default: the beginning)")
+	fs.StringVar(&r.end, "end", "", "exclusive end of the range; a timestamp, an RFC 3339 time or \"now\" (default: the end)")
+	return r
+}
+
+func (r *rangeFlags) parse(c *commonFlags) (start, end int64, err error) {
+	start, end = math.MinInt64, math.MaxInt64
+	if r.start != "" {
+		if start, err = c.parseTime(r.start); err != nil {
+			return 0, 0, err
+		}
+	}
+	if r.end != "" {
+		if end, err = c.parseTime(r.end); err != nil {
+			return 0, 0, err
+		}
+	}
+	return start, end, nil
+}
+
+func parseFormat(s string) (embedtsdb.Format, error) {
+	switch s {
+	case "csv":
+		return embedtsdb.FormatCSV, nil
+	case "ndjson", "jsonl":
+		return embedtsdb.FormatNDJSON, nil
+	default:
+		return 0, fmt.Errorf("unknown format %q", s)
+	}
+}
+
+func runPartitions(args []string, _ io.Reader, stdout io.Writer) error {
+	fs, c := newFlagSet("partitions")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	partitions, err := embedtsdb.ListPartitions(c.dataPath)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PARTITION\tMIN TIMESTAMP\tMAX TIMESTAMP\tDATA POINTS\tSERIES\tCREATED AT")
+	for _, p := range partitions {
+		name := p.Path[len(c.dataPath):]
+		name = strings.TrimLeft(name, string(os.PathSeparator))
+		if p.Err != nil {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\terror: %v\n", name, p.Err)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%s\n", name, p.MinTimestamp, p.MaxTimestamp, p.NumDataPoints, p.NumSeries, p.CreatedAt.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func runSeries(args []string, _ io.Reader, stdout io.Writer) error {
+	fs, c := newFlagSet("series")
+	selector := fs.String("match", allSeries, "selector of series")
+	r := addRangeFlags(fs)
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	return withSeriesSet(c, *selector, r, func(set embedtsdb.SeriesSet) error {
+		w := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SERIES\tDATA POINTS")
+		for set.Next() {
+			series := set.At()
+			n := 0
+			for series.Next() {
+				n++
+			}
+			if err := series.Err(); err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "%s\t%d\n", formatSeries(series.Metric(), series.Labels()), n)
+		}
+		if err := set.Err(); err != nil {
+			return err
+		}
+		return w.Flush()
+	})
+}
+
+func runDump(args []string, _ io.Reader, stdout io.Writer) error {
+	fs, c := newFlagSet("dump")
+	selector := fs.String("match", allSeries, "selector of series")
+	r := addRangeFlags(fs)
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	return withSeriesSet(c, *selector, r, func(set embedtsdb.SeriesSet) error {
+		for set.Next() {
+			series := set.At()
+			name := formatSeries(series.Metric(), series.Labels())
+			for series.Next() {
+				ts, v := series.At()
+				fmt.Fprintf(stdout, "%s %s %d\n", name, formatValue(v), ts)
+			}
+			if err := series.Err(); err != nil {
+				return err
+			}
+		}
+		return set.Err()
+	})
+}
+
+// withSeriesSet opens the storage, and calls fn with the series that satisfy the given selector.
+func withSeriesSet(c *commonFlags, selector string, r *rangeFlags, fn func(set embedtsdb.SeriesSet) error) error {
+	matchers, err := promql.ParseSelector(selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector: %w", err)
+	}
+	start, end, err := r.parse(c)
+	if err != nil {
+		return err
+	}
+	storage, err := c.openStorage()
+	if err != nil {
+		return err
+	}
+	set, err := storage.SelectSeriesSet(matchers, start, end)
+	if err != nil {
+		storage.Close()
+		return err
+	}
+	if err := fn(set); err != nil {
+		set.Close()
+		storage.Close()
+		return err
+	}
+	if err := set.Close(); err != nil {
+		storage.Close()
+		return err
+	}
+	return storage.Close()
+}
+
+func runQuery(args []string, _ io.Reader, stdout io.Writer) error {
+	fs, c := newFlagSet("query")
+	at := fs.String("time", "now", "evaluation time of an instant query")
+	r := addRangeFlags(fs)
+	step := fs.Int64("step", 0, "step of a range query in the precision; giving it makes a range query over -start and -end")
+	lookback := fs.Duration("lookback-delta", 5*time.Minute, "how far back instant vector selectors look for data points")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("exactly one query must be given")
+	}
+	var start, end int64
+	if *step > 0 {
+		if r.start == "" || r.end == "" {
+			return fmt.Errorf("-start and -end are required for a range query")
+		}
+		var err error
+		if start, end, err = r.parse(c); err != nil {
+			return err
+		}
+	} else {
+		ts, err := c.parseTime(*at)
+		if err != nil {
+			return err
+		}
+		start, end, *step = ts, ts+1, 1
+	}
+
+	storage, err := c.openStorage()
+	if err != nil {
+		return err
+	}
+	engine := promql.NewEngine(storage, promql.WithLookbackDelta(*lookback))
+	result, err := engine.RangeQuery(fs.Arg(0), start, end, *step)
+	if err != nil {
+		storage.Close()
+		return err
+	}
+	for _, s := range result {
+		name := formatSeries(s.Metric, s.Labels)
+		for _, p := range s.Points {
+			fmt.Fprintf(stdout, "%s %s %d\n", name, formatValue(p.Value), p.Timestamp)
+		}
+	}
+	return storage.Close()
+}
+
+func runExport(args []string, _ io.Reader, stdout io.Writer) error {
+	fs, c := newFlagSet("export")
+	selector := fs.String("match", allSeries, "selector of series")
+	r := addRangeFlags(fs)
+	formatName := fs.String("format", "csv", "output format: csv or ndjson")
+	output := fs.String("o", "", "file to write into (default: the standard output)")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	format, err := parseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	matchers, err := promql.ParseSelector(*selector)
+	if err != nil {
+		return fmt.Errorf("invalid selector: %w", err)
+	}
+	start, end, err := r.parse(c)
+	if err != nil {
+		return err
+	}
+
+	w := stdout
+	var file *os.File
+	if *output != "" {
+		if file, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	storage, err := c.openStorage()
+	if err != nil {
+		return err
+	}
+	if err := storage.Export(w, matchers, start, end, format); err != nil {
+		storage.Close()
+		return err
+	}
+	if err := storage.Close(); err != nil {
+		return err
+	}
+	if file != nil {
+		return file.Close()
+	}
+	return nil
+}
+
+func runImport(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs, c := newFlagSet("import")
+	formatName := fs.String("format", "csv", "input format: csv or ndjson")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	format, err := parseFormat(*formatName)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 1 {
+		return fmt.Errorf("at most one file can be given")
+	}
+	r := stdin
+	if fs.NArg() == 1 && fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	storage, err := c.openStorage()
+	if err != nil {
+		return err
+	}
+	if err := storage.Import(r, format); err != nil {
+		storage.Close()
+		return err
+	}
+	return storage.Close()
+}
+
+func runVerify(args []string, _ io.Reader, stdout io.Writer) error {
+	fs, c := newFlagSet("verify")
+	repair := fs.Bool("repair", false, "rebuild broken meta files, quarantine partitions that can't be rebuilt and truncate corrupted WAL segments")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	var opts []embedtsdb.VerifyOption
+	if *repair {
+		opts = append(opts, embedtsdb.WithRepair())
+	}
+	report, err := embedtsdb.Verify(c.dataPath, opts...)
+	if err != nil {
+		return err
+	}
+
+	var numSeries, numPoints, numRecords int
+	for _, p := range report.Partitions {
+		numSeries += p.NumSeries
+		numPoints += p.NumDataPoints
+		for _, problem := range p.Problems {
+			fmt.Fprintf(stdout, "%s: %v\n", p.Path, problem)
+		}
+		if p.Action != "" {
+			fmt.Fprintf(stdout, "%s: %s\n", p.Path, p.Action)
+		}
+	}
+	for _, seg := range report.WALSegments {
+		numRecords += seg.NumRecords
+		switch {
+		case seg.Err != nil:
+			fmt.Fprintf(stdout, "%s: corrupted record at offset %d: %v\n", seg.Path, seg.Offset, seg.Err)
+		case seg.Torn:
+			fmt.Fprintf(stdout, "%s: torn record at offset %d\n", seg.Path, seg.Offset)
+		}
+		if seg.Action != "" {
+			fmt.Fprintf(stdout, "%s: %s\n", seg.Path, seg.Action)
+		}
+	}
+	fmt.Fprintf(stdout, "decoded %d data points of %d series in %d partitions, and %d records in %d WAL segments\n",
+		numPoints, numSeries, len(report.Partitions), numRecords, len(report.WALSegments))
+	if !report.OK() && !*repair {
+		return fmt.Errorf("problems found; run with -repair to fix them")
+	}
+	return nil
+}
+
+func runWAL(args []string, _ io.Reader, stdout io.Writer) error {
+	fs, c := newFlagSet("wal")
+	if err := c.parse(fs, args); err != nil {
+		return err
+	}
+	return embedtsdb.ReadWAL(c.dataPath, func(rec *embedtsdb.WALRecord) error {
+		_, err := fmt.Fprintf(stdout, "%s: %s %s %d\n", rec.Segment, formatSeries(rec.Metric, rec.Labels), formatValue(rec.Value), rec.Timestamp)
+		return err
+	})
+}
+
+// formatSeries formats the series like `metric{name="value"}`, in the same manner as the text exposition format.
+func formatSeries(metric string, labels []embedtsdb.Label) string {
+	if len(labels) == 0 {
+		if metric == "" {
+			return "{}"
+		}
+		return metric
+	}
+	sorted := make([]embedtsdb.Label, len(labels))
+	copy(sorted, labels)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	var b strings.Builder
+	b.WriteString(metric)
+	b.WriteByte('{')
+	for i, l := range sorted {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.Name)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l.Value))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
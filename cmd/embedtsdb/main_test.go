@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+// newDataDir gives back a data directory holding a disk partition.
+func newDataDir(t *testing.T) string {
+	dataPath := t.TempDir()
+	s, err := embedtsdb.NewStorage(embedtsdb.WithDataPath(dataPath), embedtsdb.WithTimestampPrecision(embedtsdb.Seconds))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]embedtsdb.Row{
+		{Metric: "cpu", Labels: []embedtsdb.Label{{Name: "host", Value: "a"}}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000, Value: 1}},
+		{Metric: "cpu", Labels: []embedtsdb.Label{{Name: "host", Value: "a"}}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000060, Value: 2}},
+		{Metric: "cpu", Labels: []embedtsdb.Label{{Name: "host", Value: "b"}}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000, Value: 3}},
+		{Metric: "mem", DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000, Value: 4}},
+	}))
+	require.NoError(t, s.Close())
+	return dataPath
+}
+
+func runCommand(t *testing.T, stdin string, args ...string) (string, error) {
+	var stdout bytes.Buffer
+	err := run(args, strings.NewReader(stdin), &stdout)
+	return stdout.String(), err
+}
+
+func TestRun(t *testing.T) {
+	dataPath := newDataDir(t)
+	tests := []struct {
+		name     string
+		args     []string
+		contains []string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "partitions",
+			args:     []string{"partitions", "-data", dataPath},
+			contains: []string{"p-1600000000-1600000060", "1600000000", "1600000060"},
+		},
+		{
+			name: "series",
+			args: []string{"series", "-data", dataPath, "-precision", "s"},
+			want: `SERIES         DATA POINTS
+cpu{host="a"}  2
+cpu{host="b"}  1
+mem            1
+`,
+		},
+		{
+			name: "dump",
+			args: []string{"dump", "-data", dataPath, "-precision", "s", "-match", `cpu{host="a"}`, "-start", "1600000000", "-end", "2020-09-13T12:27:41Z"},
+			want: `cpu{host="a"} 1 1600000000
+cpu{host="a"} 2 1600000060
+`,
+		},
+		{
+			name: "instant query",
+			args: []string{"query", "-data", dataPath, "-precision", "s", "-time", "1600000060", "sum(cpu)"},
+			want: "{} 5 1600000060\n",
+		},
+		{
+			name: "range query",
+			args: []string{"query", "-data", dataPath, "-precision", "s", "-start", "1600000000", "-end", "1600000061", "-step", "60", `cpu{host="a"}`},
+			want: `cpu{host="a"} 1 1600000000
+cpu{host="a"} 2 1600000060
+`,
+		},
+		{
+			name: "export",
+			args: []string{"export", "-data", dataPath, "-precision", "s", "-match", "mem", "-format", "ndjson"},
+			want: `{"metric":"mem","labels":{},"timestamp":1600000000,"value":4}` + "\n",
+		},
+		{
+			name: "verify",
+			args: []string{"verify", "-data", dataPath, "-precision", "s"},
+			want: "decoded 4 data points of 3 series in 1 partitions, and 0 records in 0 WAL segments\n",
+		},
+		{name: "no command", wantErr: true},
+		{name: "unknown command", args: []string{"foo"}, wantErr: true},
+		{name: "missing data path", args: []string{"series"}, wantErr: true},
+		{name: "nonexistent data path", args: []string{"series", "-data", filepath.Join(dataPath, "missing")}, wantErr: true},
+		{name: "unknown precision", args: []string{"series", "-data", dataPath, "-precision", "m"}, wantErr: true},
+		{name: "invalid selector", args: []string{"dump", "-data", dataPath, "-match", "cpu["}, wantErr: true},
+		{name: "invalid time", args: []string{"dump", "-data", dataPath, "-start", "yesterday"}, wantErr: true},
+		{name: "missing query", args: []string{"query", "-data", dataPath}, wantErr: true},
+		{name: "range query without start", args: []string{"query", "-data", dataPath, "-step", "60", "cpu"}, wantErr: true},
+		{name: "unknown format", args: []string{"export", "-data", dataPath, "-format", "xml"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := runCommand(t, "", tt.args...)
+			assert.Equal(t, tt.wantErr, err != nil)
+			if tt.wantErr {
+				return
+			}
+			if tt.contains != nil {
+				for _, s := range tt.contains {
+					assert.Contains(t, got, s)
+				}
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRun_import(t *testing.T) {
+	dataPath := t.TempDir()
+	_, err := runCommand(t, "cpu,\"{\"\"host\"\":\"\"a\"\"}\",1600000000,1\n", "import", "-data", dataPath, "-precision", "s")
+	require.NoError(t, err)
+
+	input := filepath.Join(t.TempDir(), "mem.ndjson")
+	require.NoError(t, os.WriteFile(input, []byte(`{"metric":"mem","timestamp":1600003600,"value":2}`+"\n"), 0644))
+	_, err = runCommand(t, "", "import", "-data", dataPath, "-precision", "s", "-format", "ndjson", input)
+	require.NoError(t, err)
+
+	got, err := runCommand(t, "", "dump", "-data", dataPath, "-precision", "s")
+	require.NoError(t, err)
+	assert.Equal(t, `cpu{host="a"} 1 1600000000
+mem 2 1600003600
+`, got)
+
+	_, err = runCommand(t, "not,a,valid,row\n", "import", "-data", dataPath, "-precision", "s")
+	assert.Error(t, err)
+}
+
+func TestRun_wal(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := embedtsdb.NewStorage(embedtsdb.WithDataPath(dataPath), embedtsdb.WithWALBufferedSize(0))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]embedtsdb.Row{
+		{Metric: "cpu", Labels: []embedtsdb.Label{{Name: "host", Value: "a"}}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000, Value: 1.5}},
+	}))
+
+	got, err := runCommand(t, "", "wal", "-data", dataPath)
+	require.NoError(t, err)
+	assert.Equal(t, "0: cpu{host=\"a\"} 1.5 1600000000\n", got)
+}
+
+func TestRun_verifyBrokenPartition(t *testing.T) {
+	dataPath := newDataDir(t)
+	require.NoError(t, os.Mkdir(filepath.Join(dataPath, "p-1-2"), 0755))
+	got, err := runCommand(t, "", "verify", "-data", dataPath)
+	assert.Error(t, err)
+	assert.Contains(t, got, "p-1-2")
+
+	got, err = runCommand(t, "", "verify", "-data", dataPath, "-repair")
+	assert.NoError(t, err)
+	assert.Contains(t, got, "p-1-2: quarantined")
+	_, err = runCommand(t, "", "verify", "-data", dataPath)
+	assert.NoError(t, err)
+}
+
+func TestRun_exportToFile(t *testing.T) {
+	dataPath := newDataDir(t)
+	output := filepath.Join(t.TempDir(), "cpu.csv")
+	_, err := runCommand(t, "", "export", "-data", dataPath, "-precision", "s", "-match", `cpu{host="b"}`, "-o", output)
+	require.NoError(t, err)
+	b, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, "metric,labels,timestamp,value\ncpu,\"{\"\"host\"\":\"\"b\"\"}\",1600000000,3\n", string(b))
+}
@@ -0,0 +1,331 @@
+package embedtsdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// compactingDirPrefix is put to the directory a compacted partition is written into,
+// which is renamed to the partition directory once it's complete.
+const compactingDirPrefix = "compacting-"
+
+// compactionMeta tells what partitions a compacted partition was merged from.
+type compactionMeta struct {
+	// Sources are the directory names of the merged partitions. They're removed on startup
+	// if left behind by a crash right after the compacted partition was written.
+	Sources []string `json:"sources"`
+	// Flushed are the time ranges of the partitions originally flushed from memory,
+	// which rollups produced when flushing are named after.
+	Flushed [][2]int64 `json:"flushed"`
+}
+
+// compactPartitions merges adjacent disk partitions which lie in the same block of a compaction range into one,
+// from the smallest range to the largest. A block is compacted only once no in-memory partition can have
+// data points in it anymore, so that it's never compacted again at the same range.
+func (s *storage) compactPartitions() error {
+	if s.inMemoryMode() || len(s.compactionRanges) == 0 {
+		return nil
+	}
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	if atomic.LoadInt32(&s.shutdown) != 0 {
+		return nil
+	}
+	for _, r := range s.compactionRanges {
+		for _, group := range s.compactionGroups(toPrecision(r, s.timestampPrecision)) {
+			if err := s.compactGroup(group); err != nil {
+				return fmt.Errorf("failed to compact partitions: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// compactionGroups gives back runs of adjacent disk partitions whose minimum timestamps fall in the same block
+// of the given width, each of which is ordered from the newest one like the partition list.
+func (s *storage) compactionGroups(width int64) [][]*diskPartition {
+	partitions := make([]partition, 0, s.partitionList.size())
+	// Blocks ending after the oldest in-memory partition begins can still get more partitions.
+	limit := int64(math.MaxInt64)
+	iterator := s.partitionList.newIterator()
+	for iterator.next() {
+		part := iterator.value()
+		partitions = append(partitions, part)
+		if _, ok := part.(*memoryPartition); ok && part.size() > 0 && part.minTimestamp() < limit {
+			limit = part.minTimestamp()
+		}
+	}
+
+	groups := make([][]*diskPartition, 0)
+	var (
+		group []*diskPartition
+		block int64
+	)
+	cut := func() {
+		if len(group) > 1 {
+			groups = append(groups, group)
+		}
+		group = nil
+	}
+	for _, part := range partitions {
+		d, ok := part.(*diskPartition)
+		if !ok || d.expired() {
+			cut()
+			continue
+		}
+		b := alignTimestamp(d.minTimestamp(), width)
+		if b > limit-width {
+			cut()
+			continue
+		}
+		if len(group) > 0 && b != block {
+			cut()
+		}
+		block = b
+		group = append(group, d)
+	}
+	cut()
+	return groups
+}
+
+// compactGroup merges the given partitions into a new one, and swaps them for it in the partition list.
+func (s *storage) compactGroup(group []*diskPartition) error {
+	m := &meta{
+		MinTimestamp: group[0].minTimestamp(),
+		MaxTimestamp: group[0].maxTimestamp(),
+		Compaction:   &compactionMeta{},
+	}
+	for _, d := range group {
+		if d.minTimestamp() < m.MinTimestamp {
+			m.MinTimestamp = d.minTimestamp()
+		}
+		if d.maxTimestamp() > m.MaxTimestamp {
+			m.MaxTimestamp = d.maxTimestamp()
+		}
+		// Keep the retention of the newest one, so that no data points get removed earlier than before.
+		if d.meta.CreatedAt.After(m.CreatedAt) {
+			m.CreatedAt = d.meta.CreatedAt
+		}
+		m.Compaction.Sources = append(m.Compaction.Sources, filepath.Base(d.dirPath))
+		if d.meta.Compaction != nil {
+			m.Compaction.Flushed = append(m.Compaction.Flushed, d.meta.Compaction.Flushed...)
+		} else {
+			m.Compaction.Flushed = append(m.Compaction.Flushed, [2]int64{d.minTimestamp(), d.maxTimestamp()})
+		}
+	}
+	sort.Strings(m.Compaction.Sources)
+	sort.Slice(m.Compaction.Flushed, func(i, j int) bool {
+		return m.Compaction.Flushed[i][0] < m.Compaction.Flushed[j][0]
+	})
+
+	name := fmt.Sprintf("p-%d-%d", m.MinTimestamp, m.MaxTimestamp)
+	dir := filepath.Join(s.dataPath, name)
+	if _, err := os.Stat(dir); err == nil {
+		s.logger.Printf("skipped compacting partitions into %s since it already exists\n", dir)
+		return nil
+	}
+	tmpDir := filepath.Join(s.dataPath, compactingDirPrefix+name)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", tmpDir, err)
+	}
+	if err := writeCompacted(tmpDir, group, m); err != nil {
+		os.RemoveAll(tmpDir)
+		return fmt.Errorf("failed to write %s: %w", dir, err)
+	}
+
+	var newPart partition
+	if m.NumDataPoints == 0 {
+		// All data points have been deleted.
+		if err := os.RemoveAll(tmpDir); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", tmpDir, err)
+		}
+	} else {
+		if err := os.Rename(tmpDir, dir); err != nil {
+			return fmt.Errorf("failed to rename %s: %w", tmpDir, err)
+		}
+		// Make sure the compacted partition survives a crash before its sources are removed.
+		if err := syncDir(s.dataPath); err != nil {
+			return err
+		}
+		part, err := openDiskPartition(dir, s.retention)
+		if err != nil {
+			return fmt.Errorf("failed to open compacted partition %s: %w", dir, err)
+		}
+		newPart = part
+	}
+
+	olds := make([]partition, 0, len(group))
+	for _, d := range group {
+		olds = append(olds, d)
+	}
+	if err := s.rewriteRollups(olds); err != nil {
+		return err
+	}
+	s.flushMu.Lock()
+	err := s.partitionList.replace(olds, newPart)
+	s.flushMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to swap partitions: %w", err)
+	}
+	// They're removed once queries in progress are done with them.
+	for _, d := range group {
+		if err := d.clean(); err != nil {
+			return fmt.Errorf("failed to remove compacted partition %s: %w", d.dirPath, err)
+		}
+	}
+	return nil
+}
+
+// writeCompacted merges all series in the given partitions except for deleted data points, and writes them
+// into the given directory along with the given meta, of which the number of data points is filled.
+func writeCompacted(dirPath string, group []*diskPartition, m *meta) error {
+	if err := os.MkdirAll(dirPath, fs.ModePerm); err != nil {
+		return fmt.Errorf("failed to make directory %q: %w", dirPath, err)
+	}
+	f, err := os.Create(filepath.Join(dirPath, dataFileName))
+	if err != nil {
+		return fmt.Errorf("failed to create file %q: %w", dirPath, err)
+	}
+	defer f.Close()
+	bw := bufio.NewWriter(f)
+	w := &countingWriter{w: bw}
+	encoder := newSeriesEncoder(w)
+	defer putSeriesEncoder(encoder)
+
+	sources := make([]partition, 0, len(group))
+	seen := make(map[string]struct{})
+	names := make([]string, 0)
+	for _, d := range group {
+		sources = append(sources, d)
+		for name := range d.meta.Metrics {
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	m.Metrics = make(map[string]diskMetric, len(names))
+	index := newPostingsIndex()
+	for _, name := range names {
+		it, err := selectIterator(sources, name, math.MinInt64, math.MaxInt64)
+		if err != nil {
+			return err
+		}
+		chunked := newChunkedEncoder(encoder, w)
+		for it.Next() {
+			timestamp, value := it.At()
+			if err := chunked.encodePoint(&DataPoint{Timestamp: timestamp, Value: value}); err != nil {
+				return fmt.Errorf("failed to encode a data point that metric is %q: %w", name, err)
+			}
+		}
+		if err := it.Err(); err != nil {
+			return err
+		}
+		if err := chunked.flush(); err != nil {
+			return fmt.Errorf("failed to flush data points that metric is %q: %w", name, err)
+		}
+		if len(chunked.chunks) == 0 {
+			continue
+		}
+		var numPoints int64
+		for _, c := range chunked.chunks {
+			numPoints += c.NumDataPoints
+		}
+		m.NumDataPoints += int(numPoints)
+		m.Metrics[name] = diskMetric{
+			Name:          name,
+			Offset:        chunked.chunks[0].Offset,
+			MinTimestamp:  chunked.chunks[0].MinTimestamp,
+			MaxTimestamp:  chunked.chunks[len(chunked.chunks)-1].MaxTimestamp,
+			NumDataPoints: numPoints,
+			Chunks:        chunked.chunks,
+		}
+		index.add(name)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write data file: %w", err)
+	}
+	if m.NumDataPoints == 0 {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync data file: %w", err)
+	}
+
+	indexFile, err := os.Create(filepath.Join(dirPath, indexFileName))
+	if err != nil {
+		return fmt.Errorf("failed to create index file: %w", err)
+	}
+	defer indexFile.Close()
+	if err := index.writeTo(indexFile, m.Metrics); err != nil {
+		return err
+	}
+	if err := indexFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync index file: %w", err)
+	}
+
+	b, err := encodeMeta(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	// Write the meta file at last as flushing does.
+	metaPath := filepath.Join(dirPath, metaFileName)
+	if err := writeFileSync(metaPath, b); err != nil {
+		return fmt.Errorf("failed to write metadata to %s: %w", metaPath, err)
+	}
+	return syncDir(dirPath)
+}
+
+// removeCompactedSources removes partitions merged into others, which are left behind by a crash in the middle of
+// compaction, along with directories where compacted partitions were being written into.
+func removeCompactedSources(dataPath string, partitions []partition) ([]partition, error) {
+	compacted := make(map[string]time.Time)
+	for _, part := range partitions {
+		d, ok := part.(*diskPartition)
+		if !ok || d.meta.Compaction == nil {
+			continue
+		}
+		for _, name := range d.meta.Compaction.Sources {
+			compacted[name] = d.meta.CreatedAt
+		}
+	}
+	kept := partitions[:0]
+	for _, part := range partitions {
+		d, ok := part.(*diskPartition)
+		if ok {
+			// A partition flushed later with the same name isn't the source.
+			if createdAt, found := compacted[filepath.Base(d.dirPath)]; found && !d.meta.CreatedAt.After(createdAt) {
+				if err := d.clean(); err != nil {
+					return nil, fmt.Errorf("failed to remove compacted partition: %w", err)
+				}
+				continue
+			}
+		}
+		kept = append(kept, part)
+	}
+
+	entries, err := os.ReadDir(dataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data directory: %w", err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), compactingDirPrefix) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dataPath, e.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove incomplete compacted partition: %w", err)
+		}
+	}
+	return kept, nil
+}
@@ -0,0 +1,189 @@
+package embedtsdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_compactPartitions(t *testing.T) {
+	_, err := NewStorage(WithCompactionRanges(time.Hour, 0))
+	assert.Error(t, err)
+
+	tmpDir := t.TempDir()
+	opts := []Option{
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(10 * time.Second),
+		WithCompactionRanges(200*time.Second, 100*time.Second),
+		WithRollupTiers(RollupTier{Resolution: 10 * time.Second}),
+	}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	want := make([]*DataPoint, 0)
+	for i := int64(0); i < 160; i++ {
+		p := DataPoint{Timestamp: 1600000000 + i, Value: float64(i)}
+		require.NoError(t, s.InsertRows([]Row{
+			{Metric: "metric1", DataPoint: p},
+			{Metric: "metric2", DataPoint: p},
+		}))
+		want = append(want, &p)
+	}
+	require.NoError(t, s.Close())
+
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	dirs, err := filepath.Glob(filepath.Join(tmpDir, "p-*"))
+	require.NoError(t, err)
+	require.Greater(t, len(dirs), 2)
+	query := AggregateQuery{
+		Matchers: []*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "metric1")},
+		Start:    1600000000,
+		End:      1600000160,
+		Step:     40,
+		Func:     AggregateSum,
+	}
+	wantAggregated, err := s.Aggregate(query)
+	require.NoError(t, err)
+	require.NoError(t, s.Delete([]*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "metric2")}, 1600000000, 1600000150))
+
+	// Partitions are merged into blocks of 100s, and then the blocks are merged into one of 200s.
+	require.NoError(t, s.(*storage).compactPartitions())
+	compacted, err := filepath.Glob(filepath.Join(tmpDir, "p-*"))
+	require.NoError(t, err)
+	require.Equal(t, []string{filepath.Join(tmpDir, "p-1600000000-1600000159")}, compacted)
+	m, err := readMeta(compacted[0])
+	require.NoError(t, err)
+	assert.Equal(t, 170, m.NumDataPoints)
+	require.NotNil(t, m.Compaction)
+	assert.Len(t, m.Compaction.Sources, 2)
+	assert.Len(t, m.Compaction.Flushed, len(dirs))
+	assert.Equal(t, 2, s.(*storage).partitionList.size())
+
+	assertCompacted := func(t *testing.T, s Storage) {
+		got, err := s.Select("metric1", nil, 1600000000, 1600000160)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+		got, err = s.Select("metric2", nil, 1600000000, 1600000160)
+		require.NoError(t, err)
+		assert.Equal(t, want[150:], got)
+		// Rollups of the merged partitions stand in for the compacted one.
+		aggregated, err := s.Aggregate(query)
+		require.NoError(t, err)
+		assert.Equal(t, wantAggregated, aggregated)
+	}
+	assertCompacted(t, s)
+	require.NoError(t, s.Close())
+
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	assertCompacted(t, s)
+}
+
+func Test_storage_compactPartitions_crash(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := []Option{
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(10 * time.Second),
+		WithCompactionRanges(100 * time.Second),
+	}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	want := make([]*DataPoint, 0)
+	for i := int64(0); i < 30; i++ {
+		p := DataPoint{Timestamp: 1600000000 + i, Value: float64(i)}
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: p}}))
+		want = append(want, &p)
+	}
+	require.NoError(t, s.Close())
+
+	// Crash right after writing the compacted partition, and in the middle of writing another.
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	groups := s.(*storage).compactionGroups(100)
+	require.Len(t, groups, 1)
+	m := &meta{MinTimestamp: 1600000000, MaxTimestamp: 1600000029, CreatedAt: time.Now(), Compaction: &compactionMeta{}}
+	for _, d := range groups[0] {
+		m.Compaction.Sources = append(m.Compaction.Sources, filepath.Base(d.dirPath))
+	}
+	require.NoError(t, writeCompacted(filepath.Join(tmpDir, "p-1600000000-1600000029"), groups[0], m))
+	require.NoError(t, os.MkdirAll(filepath.Join(tmpDir, compactingDirPrefix+"p-1600000000-1600000099"), 0755))
+
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.Select("metric1", nil, 1600000000, 1600000030)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	entries, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	assert.ElementsMatch(t, []string{"p-1600000000-1600000029", walDirName}, names)
+}
+
+func Test_storage_compactPartitions_iterator(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := []Option{
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(10 * time.Second),
+		WithCompactionRanges(100 * time.Second),
+	}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	want := make([]DataPoint, 0)
+	for i := int64(0); i < 30; i++ {
+		p := DataPoint{Timestamp: 1600000000 + i, Value: float64(i)}
+		require.NoError(t, s.InsertRows([]Row{
+			{Metric: "metric1", DataPoint: p},
+			{Metric: "metric2", DataPoint: p},
+		}))
+		want = append(want, p)
+	}
+	require.NoError(t, s.Close())
+
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	sources, err := filepath.Glob(filepath.Join(tmpDir, "p-*"))
+	require.NoError(t, err)
+	require.Greater(t, len(sources), 1)
+	it, err := s.SelectIterator("metric1", nil, 1600000000, 1600000030)
+	require.NoError(t, err)
+	require.True(t, it.Next())
+	set, err := s.SelectSeriesSet([]*Matcher{MustNewMatcher(MatchRegexp, MetricNameLabel, "metric.")}, 1600000000, 1600000030)
+	require.NoError(t, err)
+	require.True(t, set.Next())
+
+	// Partitions being read are kept until they're released, however many times compaction runs.
+	require.NoError(t, s.(*storage).compactPartitions())
+	require.NoError(t, s.(*storage).compactPartitions())
+	for _, dir := range sources {
+		assert.DirExists(t, dir)
+	}
+	timestamp, value := it.At()
+	got := append([]DataPoint{{Timestamp: timestamp, Value: value}}, collectPoints(t, it)...)
+	assert.Equal(t, want, got)
+	assert.Equal(t, want, collectPoints(t, set.At()))
+	for _, dir := range sources {
+		assert.DirExists(t, dir)
+	}
+
+	// The set is given up halfway.
+	require.NoError(t, set.Close())
+	for _, dir := range sources {
+		assert.NoDirExists(t, dir)
+	}
+	points, err := s.Select("metric2", nil, 1600000000, 1600000030)
+	require.NoError(t, err)
+	assert.Len(t, points, len(want))
+}
@@ -0,0 +1,140 @@
+package embedtsdb
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Rate gives back the per-second average rate of increase of a counter within [start, end),
+// in the same manner as Prometheus's rate() does.
+// Counter resets are detected as a drop of the value, and the increase is extrapolated to the edges of the window.
+// Points are usually given back by Select, and may span multiple partitions.
+// The precision must be the one the storage has been opened with.
+//
+// ErrNoDataPoints is given back if less than two data points lie within the window.
+func Rate(points []*DataPoint, start, end int64, precision TimestampPrecision) (float64, error) {
+	v, err := extrapolatedDelta(points, start, end, true)
+	if err != nil {
+		return 0, err
+	}
+	return v / toSeconds(end-start, precision), nil
+}
+
+// Increase gives back the increase of a counter within [start, end), extrapolated to the edges of the window.
+// It is Rate multiplied by the length of the window, as Prometheus's increase() is.
+//
+// ErrNoDataPoints is given back if less than two data points lie within the window.
+func Increase(points []*DataPoint, start, end int64) (float64, error) {
+	return extrapolatedDelta(points, start, end, true)
+}
+
+// Delta gives back the difference between the first and last values of a gauge within [start, end),
+// extrapolated to the edges of the window. Unlike Increase, a drop of the value is not treated as a reset.
+//
+// ErrNoDataPoints is given back if less than two data points lie within the window.
+func Delta(points []*DataPoint, start, end int64) (float64, error) {
+	return extrapolatedDelta(points, start, end, false)
+}
+
+// IRate gives back the per-second instant rate of a counter, calculated from the last two data points within [start, end).
+// It follows short-term changes more closely than Rate does.
+//
+// ErrNoDataPoints is given back if less than two data points lie within the window.
+func IRate(points []*DataPoint, start, end int64, precision TimestampPrecision) (float64, error) {
+	window, err := windowPoints(points, start, end)
+	if err != nil {
+		return 0, err
+	}
+	last, prev := window[len(window)-1], window[len(window)-2]
+	delta := last.Value - prev.Value
+	if last.Value < prev.Value {
+		// The counter has been reset, so the last value is the increase from zero.
+		delta = last.Value
+	}
+	return delta / toSeconds(last.Timestamp-prev.Timestamp, precision), nil
+}
+
+// extrapolatedDelta implements the extrapolation of Prometheus.
+// The sampled difference is extended to the window edges by the average interval between data points at most,
+// and a counter is never extrapolated below zero.
+func extrapolatedDelta(points []*DataPoint, start, end int64, isCounter bool) (float64, error) {
+	window, err := windowPoints(points, start, end)
+	if err != nil {
+		return 0, err
+	}
+	first, last := window[0], window[len(window)-1]
+	result := last.Value - first.Value
+	if isCounter {
+		for i := 1; i < len(window); i++ {
+			if window[i].Value < window[i-1].Value {
+				result += window[i-1].Value
+			}
+		}
+	}
+
+	sampledInterval := float64(last.Timestamp - first.Timestamp)
+	durationToStart := float64(first.Timestamp - start)
+	durationToEnd := float64(end - last.Timestamp)
+	averageInterval := sampledInterval / float64(len(window)-1)
+
+	if isCounter && result > 0 && first.Value >= 0 {
+		// The counter would have been zero at this duration before the first data point.
+		durationToZero := sampledInterval * (first.Value / result)
+		if durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+
+	// Extrapolate to the edge only if it's close enough, otherwise by half of the average interval
+	// since the series likely began or ended in between.
+	threshold := averageInterval * 1.1
+	extrapolated := sampledInterval
+	if durationToStart < threshold {
+		extrapolated += durationToStart
+	} else {
+		extrapolated += averageInterval / 2
+	}
+	if durationToEnd < threshold {
+		extrapolated += durationToEnd
+	} else {
+		extrapolated += averageInterval / 2
+	}
+	return result * (extrapolated / sampledInterval), nil
+}
+
+// windowPoints gives back data points within [start, end) sorted by timestamp.
+// Of data points sharing a timestamp, such as ones inserted again by a retrying client, only the last one is kept.
+func windowPoints(points []*DataPoint, start, end int64) ([]*DataPoint, error) {
+	if start >= end {
+		return nil, fmt.Errorf("the given start is greater than end")
+	}
+	window := make([]*DataPoint, 0, len(points))
+	for _, p := range points {
+		if p.Timestamp >= start && p.Timestamp < end {
+			window = append(window, p)
+		}
+	}
+	// Points from overlapping partitions may come out of order.
+	sort.SliceStable(window, func(i, j int) bool {
+		return window[i].Timestamp < window[j].Timestamp
+	})
+	deduped := window[:0]
+	for _, p := range window {
+		if n := len(deduped); n > 0 && deduped[n-1].Timestamp == p.Timestamp {
+			deduped[n-1] = p
+			continue
+		}
+		deduped = append(deduped, p)
+	}
+	window = deduped
+	if len(window) < 2 {
+		return nil, ErrNoDataPoints
+	}
+	return window, nil
+}
+
+// toSeconds converts the given duration in the timestamp precision into seconds.
+func toSeconds(d int64, precision TimestampPrecision) float64 {
+	return float64(d) / float64(toPrecision(time.Second, precision))
+}
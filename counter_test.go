@@ -0,0 +1,180 @@
+package embedtsdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounterFunctions(t *testing.T) {
+	steady := []*DataPoint{
+		{Timestamp: 0, Value: 0},
+		{Timestamp: 10, Value: 10},
+		{Timestamp: 20, Value: 20},
+		{Timestamp: 30, Value: 30},
+	}
+	reset := []*DataPoint{
+		{Timestamp: 0, Value: 5},
+		{Timestamp: 10, Value: 10},
+		{Timestamp: 20, Value: 2},
+		{Timestamp: 30, Value: 7},
+	}
+	tests := []struct {
+		name    string
+		fn      func(points []*DataPoint, start, end int64) (float64, error)
+		points  []*DataPoint
+		start   int64
+		end     int64
+		want    float64
+		wantErr error
+	}{
+		{
+			name:   "increase extrapolated to the end",
+			fn:     Increase,
+			points: steady,
+			start:  0,
+			end:    40,
+			want:   40,
+		},
+		{
+			name:   "increase with a counter reset",
+			fn:     Increase,
+			points: reset,
+			start:  0,
+			end:    40,
+			// (7 - 5 + 10) * 40 / 30
+			want: 16,
+		},
+		{
+			name: "increase not extrapolated below zero",
+			fn:   Increase,
+			points: []*DataPoint{
+				{Timestamp: 20, Value: 10},
+				{Timestamp: 30, Value: 20},
+			},
+			start: 0,
+			end:   40,
+			// The counter would have been zero at 10, and the end is close enough.
+			want: 30,
+		},
+		{
+			name: "increase extrapolated by half of the interval to far edges",
+			fn:   Increase,
+			points: []*DataPoint{
+				{Timestamp: 40, Value: 100},
+				{Timestamp: 50, Value: 110},
+			},
+			start: 0,
+			end:   100,
+			want:  20,
+		},
+		{
+			name: "delta of a gauge",
+			fn:   Delta,
+			points: []*DataPoint{
+				{Timestamp: 0, Value: 10},
+				{Timestamp: 10, Value: 4},
+				{Timestamp: 20, Value: 6},
+			},
+			start: 0,
+			end:   30,
+			want:  -6,
+		},
+		{
+			name:   "points outside the window are ignored",
+			fn:     Increase,
+			points: steady,
+			start:  10,
+			end:    30,
+			want:   20,
+		},
+		{
+			name:   "unordered points",
+			fn:     Increase,
+			points: []*DataPoint{steady[2], steady[0], steady[3], steady[1]},
+			start:  0,
+			end:    40,
+			want:   40,
+		},
+		{
+			name:    "single data point",
+			fn:      Increase,
+			points:  steady,
+			start:   0,
+			end:     10,
+			wantErr: ErrNoDataPoints,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.fn(tt.points, tt.start, tt.end)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.InDelta(t, tt.want, got, 1e-9)
+		})
+	}
+
+	_, err := Increase(steady, 40, 0)
+	assert.Error(t, err)
+}
+
+func TestRate(t *testing.T) {
+	got, err := Rate([]*DataPoint{
+		{Timestamp: 0, Value: 0},
+		{Timestamp: 10000, Value: 10},
+		{Timestamp: 20000, Value: 20},
+		{Timestamp: 30000, Value: 30},
+	}, 0, 40000, Milliseconds)
+	require.NoError(t, err)
+	assert.InDelta(t, 1.0, got, 1e-9)
+}
+
+func TestIRate(t *testing.T) {
+	tests := []struct {
+		name    string
+		points  []*DataPoint
+		want    float64
+		wantErr error
+	}{
+		{
+			name:   "last two data points",
+			points: []*DataPoint{{Timestamp: 0, Value: 1}, {Timestamp: 10, Value: 5}, {Timestamp: 20, Value: 10}},
+			want:   0.5,
+		},
+		{
+			name:   "counter reset",
+			points: []*DataPoint{{Timestamp: 0, Value: 5}, {Timestamp: 10, Value: 10}, {Timestamp: 20, Value: 2}},
+			want:   0.2,
+		},
+		{
+			name:   "duplicate data points",
+			points: []*DataPoint{{Timestamp: 0, Value: 1}, {Timestamp: 10, Value: 5}, {Timestamp: 20, Value: 10}, {Timestamp: 20, Value: 10}},
+			want:   0.5,
+		},
+		{
+			name:    "same timestamps",
+			points:  []*DataPoint{{Timestamp: 10, Value: 1}, {Timestamp: 10, Value: 2}},
+			wantErr: ErrNoDataPoints,
+		},
+		{
+			name:    "single data point",
+			points:  []*DataPoint{{Timestamp: 10, Value: 1}},
+			wantErr: ErrNoDataPoints,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := IRate(tt.points, 0, 30, Seconds)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.InDelta(t, tt.want, got, 1e-9)
+		})
+	}
+}
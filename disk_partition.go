@@ -1,13 +1,15 @@
 package embedtsdb
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/yudaprama/embedtsdb/internal/syscall"
@@ -16,6 +18,13 @@ import (
 const (
 	dataFileName = "data"
 	metaFileName = "meta.json"
+
+	// metaVersion is the version of the meta file format. Version 2 added checksums of chunks and the meta file itself.
+	// Meta files without the version are of version 1.
+	metaVersion = 2
+
+	// The maximum number of data points encoded into a chunk.
+	maxPointsPerChunk = 120
 )
 
 var (
@@ -32,18 +41,34 @@ type diskPartition struct {
 	f *os.File
 	// memory-mapped file backed by f
 	mappedFile []byte
+	// inverted index to look up metric names by labels
+	index *postingsIndex
 	// duration to store data
 	retention time.Duration
+	// deleted data points, which are dropped when compacting
+	tombstones *tombstones
+	// deleteMu serializes writes of the tombstones file.
+	deleteMu sync.Mutex
+	// refs is the number of references to the partition, one of which is held by the partition list and the
+	// others by queries reading it lazily. The data file is unmapped once all of them are released.
+	refs int64
+	// removed tells if the files are removed as well once all references are released.
+	removed int32
 }
 
 // meta is a mapper for a meta file, which is put for each partition.
 // Note that the CreatedAt is surely timestamped by embedtsdb but Min/Max Timestamps are likely to do by other process.
 type meta struct {
+	Version       int                   `json:"version,omitempty"`
 	MinTimestamp  int64                 `json:"minTimestamp"`
 	MaxTimestamp  int64                 `json:"maxTimestamp"`
 	NumDataPoints int                   `json:"numDataPoints"`
 	Metrics       map[string]diskMetric `json:"metrics"`
 	CreatedAt     time.Time             `json:"createdAt"`
+	// Compaction is set if the partition was merged from others.
+	Compaction *compactionMeta `json:"compaction,omitempty"`
+	// Checksum is the CRC32C of the encoded meta file preceding it. See encodeMeta.
+	Checksum uint32 `json:"checksum,omitempty"`
 }
 
 // diskMetric holds meta data to access actual data from the memory-mapped file.
@@ -53,6 +78,152 @@ type diskMetric struct {
 	MinTimestamp  int64  `json:"minTimestamp"`
 	MaxTimestamp  int64  `json:"maxTimestamp"`
 	NumDataPoints int64  `json:"numDataPoints"`
+	// Chunks are sorted by timestamp. Partitions flushed before chunks were introduced don't have it;
+	// the whole series is encoded as a single stream starting at Offset.
+	Chunks []diskChunk `json:"chunks,omitempty"`
+}
+
+// diskChunk is an independently decodable piece of a series.
+type diskChunk struct {
+	Offset        int64 `json:"offset"`
+	MinTimestamp  int64 `json:"minTimestamp"`
+	MaxTimestamp  int64 `json:"maxTimestamp"`
+	NumDataPoints int64 `json:"numDataPoints"`
+	// Length and Checksum are the size and the CRC32C of the encoded chunk.
+	// Chunks flushed before checksums were introduced don't have them.
+	Length   int64  `json:"length,omitempty"`
+	Checksum uint32 `json:"checksum,omitempty"`
+	// Summary is precomputed when flushing, so that aggregations over the whole chunk
+	// don't need to decode it. It's missing if the chunk has non-finite values, which JSON can't represent.
+	Summary *chunkSummary `json:"summary,omitempty"`
+}
+
+// chunkSummary holds aggregated values of all data points in a chunk.
+type chunkSummary struct {
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	First float64 `json:"first"`
+	Last  float64 `json:"last"`
+}
+
+// aggregation gives back the summary as an aggregation, which can be merged into buckets.
+func (c *diskChunk) aggregation() *aggregation {
+	return &aggregation{
+		count:    c.NumDataPoints,
+		sum:      c.Summary.Sum,
+		min:      c.Summary.Min,
+		max:      c.Summary.Max,
+		firstT:   c.MinTimestamp,
+		firstV:   c.Summary.First,
+		lastT:    c.MaxTimestamp,
+		lastV:    c.Summary.Last,
+		hasValue: true,
+	}
+}
+
+// chunks gives back the chunks which may have data points within the given range.
+func (m *diskMetric) chunks(start, end int64) []diskChunk {
+	if len(m.Chunks) == 0 {
+		if m.MaxTimestamp < start || m.MinTimestamp >= end {
+			return nil
+		}
+		return []diskChunk{{
+			Offset:        m.Offset,
+			MinTimestamp:  m.MinTimestamp,
+			MaxTimestamp:  m.MaxTimestamp,
+			NumDataPoints: m.NumDataPoints,
+		}}
+	}
+	// Use binary search because chunks are in-order.
+	i := sort.Search(len(m.Chunks), func(i int) bool {
+		return m.Chunks[i].MaxTimestamp >= start
+	})
+	j := sort.Search(len(m.Chunks), func(i int) bool {
+		return m.Chunks[i].MinTimestamp >= end
+	})
+	if i >= j {
+		return nil
+	}
+	return m.Chunks[i:j]
+}
+
+// chunkedEncoder is a seriesEncoder that cuts a series into chunks having maxPointsPerChunk data points
+// at most, and records where each chunk is.
+type chunkedEncoder struct {
+	encoder seriesEncoder
+	// w must be the writer the encoder writes into.
+	w *countingWriter
+
+	chunks  []diskChunk
+	current diskChunk
+	summary aggregation
+}
+
+func newChunkedEncoder(encoder seriesEncoder, w *countingWriter) *chunkedEncoder {
+	return &chunkedEncoder{
+		encoder: encoder,
+		w:       w,
+		chunks:  make([]diskChunk, 0, 1),
+	}
+}
+
+func (c *chunkedEncoder) encodePoint(point *DataPoint) error {
+	if c.current.NumDataPoints == 0 {
+		c.current.Offset = c.w.n
+		c.current.MinTimestamp = point.Timestamp
+		c.w.crc = 0
+	}
+	if err := c.encoder.encodePoint(point); err != nil {
+		return err
+	}
+	c.current.MaxTimestamp = point.Timestamp
+	c.current.NumDataPoints++
+	c.summary.add(point.Timestamp, point.Value)
+	if c.current.NumDataPoints >= maxPointsPerChunk {
+		return c.flush()
+	}
+	return nil
+}
+
+// flush cuts the current chunk.
+func (c *chunkedEncoder) flush() error {
+	if c.current.NumDataPoints == 0 {
+		return nil
+	}
+	if err := c.encoder.flush(); err != nil {
+		return err
+	}
+	c.current.Length = c.w.n - c.current.Offset
+	c.current.Checksum = c.w.crc
+	if c.summary.finite() {
+		c.current.Summary = &chunkSummary{
+			Sum:   c.summary.sum,
+			Min:   c.summary.min,
+			Max:   c.summary.max,
+			First: c.summary.firstV,
+			Last:  c.summary.lastV,
+		}
+	}
+	c.chunks = append(c.chunks, c.current)
+	c.current = diskChunk{}
+	c.summary = aggregation{}
+	return nil
+}
+
+// countingWriter counts the bytes written so far, which is the offset in the file.
+// It also computes the CRC32C of the bytes written since crc was reset.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	crc uint32
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.crc = crc32.Update(c.crc, castagnoliTable, p[:n])
+	return n, err
 }
 
 // openDiskPartition first maps the data file into memory with memory-mapping.
@@ -88,79 +259,271 @@ func openDiskPartition(dirPath string, retention time.Duration) (partition, erro
 	}
 
 	// Read metadata to the heap
-	m := meta{}
-	mf, err := os.Open(metaFilePath)
+	b, err := os.ReadFile(metaFilePath)
 	if err != nil {
+		syscall.Munmap(mapped)
+		f.Close()
 		return nil, fmt.Errorf("failed to read metadata: %w", err)
 	}
-	defer mf.Close()
-	decoder := json.NewDecoder(mf)
-	if err := decoder.Decode(&m); err != nil {
-		return nil, fmt.Errorf("failed to decode metadata: %w", err)
+	m, err := decodeMeta(b, metaFilePath)
+	if err != nil {
+		syscall.Munmap(mapped)
+		f.Close()
+		return nil, err
+	}
+	index, err := openIndex(dirPath, m)
+	if err != nil {
+		syscall.Munmap(mapped)
+		f.Close()
+		return nil, err
+	}
+	tombstones, err := readTombstones(dirPath)
+	if err != nil {
+		syscall.Munmap(mapped)
+		f.Close()
+		return nil, err
 	}
 	return &diskPartition{
 		dirPath:    dirPath,
-		meta:       m,
+		meta:       *m,
 		f:          f,
 		mappedFile: mapped,
+		index:      index,
 		retention:  retention,
+		tombstones: tombstones,
+		refs:       1,
 	}, nil
 }
 
+// openIndex reads the index file. Partitions flushed before the index was introduced
+// don't have it, so it builds the index from the metadata for them.
+func openIndex(dirPath string, m *meta) (*postingsIndex, error) {
+	b, err := os.ReadFile(filepath.Join(dirPath, indexFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		names := make([]string, 0, len(m.Metrics))
+		for name := range m.Metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		index := newPostingsIndex()
+		for _, name := range names {
+			index.add(name)
+		}
+		return index, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	index, err := readPostingsIndex(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index in %q: %w", dirPath, err)
+	}
+	return index, nil
+}
+
 func (d *diskPartition) insertRows(_ []Row) ([]Row, error) {
 	return nil, fmt.Errorf("can't insert rows into disk partition")
 }
 
+// delete records tombstones of the matched series which have data points within the range,
+// and then persists them into the tombstones file.
+func (d *diskPartition) delete(matchers []*Matcher, start, end int64) error {
+	if d.expired() {
+		return nil
+	}
+	d.deleteMu.Lock()
+	defer d.deleteMu.Unlock()
+	var added bool
+	for _, name := range d.index.match(matchers) {
+		mt, ok := d.meta.Metrics[name]
+		if !ok || mt.MaxTimestamp < start || mt.MinTimestamp >= end {
+			continue
+		}
+		if d.tombstones.add(name, timeRange{min: start, max: end - 1}) {
+			added = true
+		}
+	}
+	if !added {
+		return nil
+	}
+	if err := d.tombstones.write(d.dirPath); err != nil {
+		return fmt.Errorf("failed to delete from partition %q: %w", d.dirPath, err)
+	}
+	return nil
+}
+
 func (d *diskPartition) selectDataPoints(metric string, labels []Label, start, end int64) ([]*DataPoint, error) {
 	if d.expired() {
 		return nil, fmt.Errorf("this partition is expired: %w", ErrNoDataPoints)
 	}
 	name := marshalMetricName(metric, labels)
+	if _, ok := d.meta.Metrics[name]; !ok {
+		return nil, ErrNoDataPoints
+	}
+	it, err := d.selectIterator(name, start, end)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]*DataPoint, 0)
+	for it.Next() {
+		timestamp, value := it.At()
+		points = append(points, &DataPoint{Timestamp: timestamp, Value: value})
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return points, nil
+}
+
+func (d *diskPartition) selectIterator(name string, start, end int64) (Iterator, error) {
+	if d.expired() {
+		return nil, fmt.Errorf("this partition is expired: %w", ErrNoDataPoints)
+	}
+	return d.iterator(name, start, end)
+}
+
+// iterator gives back an iterator over data points of the given series within the given range,
+// even if the partition is expired.
+func (d *diskPartition) iterator(name string, start, end int64) (Iterator, error) {
 	mt, ok := d.meta.Metrics[name]
 	if !ok {
-		return nil, ErrNoDataPoints
+		return emptyIterator{}, nil
 	}
-	r := bytes.NewReader(d.mappedFile)
-	if _, err := r.Seek(mt.Offset, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("failed to seek: %w", err)
+	chunks := mt.chunks(start, end)
+	if len(chunks) == 0 {
+		return emptyIterator{}, nil
 	}
-	decoder, err := newSeriesDecoder(r)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate decoder for metric %q in %q: %w", name, d.dirPath, err)
-	}
-	defer putSeriesDecoder(decoder)
-
-	// TODO: Divide fixed-lengh chunks when flushing, and index it.
-	points := dataPointSlicePool.Get().([]*DataPoint)
-	points = points[:0] // Reset length but keep capacity
-	defer dataPointSlicePool.Put(points)
-	for i := 0; i < int(mt.NumDataPoints); i++ {
-		point := dataPointPool.Get().(*DataPoint)
-		if err := decoder.decodePoint(point); err != nil {
-			dataPointPool.Put(point)
-			return nil, fmt.Errorf("failed to decode point of metric %q in %q: %w", name, d.dirPath, err)
-		}
-		if point.Timestamp < start {
-			dataPointPool.Put(point)
+	for _, chunk := range chunks {
+		if chunk.Offset < 0 || chunk.Offset > int64(len(d.mappedFile)) {
+			return nil, fmt.Errorf("offset %d of metric %q is out of range in %q", chunk.Offset, name, d.dirPath)
+		}
+	}
+	// Decode lazily from the memory-mapped file.
+	return withTombstones(&diskIterator{
+		mappedFile: d.mappedFile,
+		chunks:     chunks,
+		start:      start,
+		end:        end,
+		name:       name,
+		dirPath:    d.dirPath,
+	}, d.tombstones.get(name)), nil
+}
+
+// aggregate accumulates data points of the given series into the buckets. Chunks that fit in a bucket
+// are accumulated using their summaries without decoding, unless some of their data points are deleted.
+func (d *diskPartition) aggregate(name string, q *AggregateQuery, buckets []aggregation) error {
+	if d.expired() {
+		return fmt.Errorf("this partition is expired: %w", ErrNoDataPoints)
+	}
+	mt, ok := d.meta.Metrics[name]
+	if !ok {
+		return nil
+	}
+	ranges := d.tombstones.get(name)
+	for _, chunk := range mt.chunks(q.Start, q.End) {
+		if chunk.Summary != nil && chunk.MinTimestamp >= q.Start && chunk.MaxTimestamp < q.End &&
+			q.bucket(chunk.MinTimestamp) == q.bucket(chunk.MaxTimestamp) &&
+			!overlapping(ranges, chunk.MinTimestamp, chunk.MaxTimestamp) {
+			buckets[q.bucket(chunk.MinTimestamp)].merge(chunk.aggregation())
 			continue
 		}
-		if point.Timestamp >= end {
-			dataPointPool.Put(point)
-			break
+		if chunk.Offset < 0 || chunk.Offset > int64(len(d.mappedFile)) {
+			return fmt.Errorf("offset %d of metric %q is out of range in %q", chunk.Offset, name, d.dirPath)
+		}
+		it := withTombstones(&diskIterator{
+			mappedFile: d.mappedFile,
+			chunks:     []diskChunk{chunk},
+			start:      q.Start,
+			end:        q.End,
+			name:       name,
+			dirPath:    d.dirPath,
+		}, ranges)
+		if err := aggregateIterator(it, q, buckets); err != nil {
+			return err
 		}
-		points = append(points, point)
 	}
-	// Create a new slice and copy DataPoint values (not pointers)
-	result := make([]*DataPoint, len(points))
-	for i, p := range points {
-		newPoint := &DataPoint{
-			Timestamp: p.Timestamp,
-			Value:     p.Value,
+	return nil
+}
+
+func (d *diskPartition) matchSeries(matchers []*Matcher) ([]string, error) {
+	if d.expired() {
+		return nil, fmt.Errorf("this partition is expired: %w", ErrNoDataPoints)
+	}
+	names := d.index.match(matchers)
+	if d.tombstones.empty() {
+		return names, nil
+	}
+	// Leave out series all of whose data points are deleted.
+	kept := names[:0]
+	for _, name := range names {
+		if mt, ok := d.meta.Metrics[name]; ok && covering(d.tombstones.get(name), mt.MinTimestamp, mt.MaxTimestamp) {
+			continue
 		}
-		result[i] = newPoint
-		dataPointPool.Put(p) // Return pooled DataPoint
+		kept = append(kept, name)
 	}
-	return result, nil
+	return kept, nil
+}
+
+// diskIterator decodes data points of a series one by one as it advances, chunk by chunk.
+type diskIterator struct {
+	mappedFile []byte
+	// chunks not decoded yet
+	chunks  []diskChunk
+	decoder seriesDecoder
+	// the number of data points in the current chunk not decoded yet
+	remaining  int64
+	start, end int64
+	cur        DataPoint
+	err        error
+
+	name    string
+	dirPath string
+}
+
+func (it *diskIterator) Next() bool {
+	for it.err == nil {
+		if it.remaining == 0 {
+			if len(it.chunks) == 0 {
+				return false
+			}
+			chunk := it.chunks[0]
+			it.chunks = it.chunks[1:]
+			if err := verifyChunk(it.mappedFile, &chunk, filepath.Join(it.dirPath, dataFileName)); err != nil {
+				it.err = fmt.Errorf("failed to read chunk of metric %q: %w", it.name, err)
+				return false
+			}
+			it.decoder = newBytesSeriesDecoder(it.mappedFile[chunk.Offset:])
+			it.remaining = chunk.NumDataPoints
+			continue
+		}
+		it.remaining--
+		if err := it.decoder.decodePoint(&it.cur); err != nil {
+			it.err = fmt.Errorf("failed to decode point of metric %q in %q: %w", it.name, it.dirPath, err)
+			return false
+		}
+		if it.cur.Timestamp < it.start {
+			continue
+		}
+		if it.cur.Timestamp >= it.end {
+			it.remaining = 0
+			it.chunks = nil
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+func (it *diskIterator) At() (int64, float64) {
+	return it.cur.Timestamp, it.cur.Value
+}
+
+func (it *diskIterator) Err() error {
+	return it.err
+}
+
+func (it *diskIterator) Close() error {
+	return nil
 }
 
 func (d *diskPartition) minTimestamp() int64 {
@@ -180,7 +543,36 @@ func (d *diskPartition) active() bool {
 	return false
 }
 
+// acquire takes a reference to the partition, which keeps the data file mapped until it's released.
+// It gives back false if all references have been released already.
+func (d *diskPartition) acquire() bool {
+	for {
+		refs := atomic.LoadInt64(&d.refs)
+		if refs <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&d.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// release drops a reference to the partition, and unmaps the data file once no one refers to it.
+func (d *diskPartition) release() error {
+	if atomic.AddInt64(&d.refs, -1) > 0 {
+		return nil
+	}
+	return d.close()
+}
+
+// clean drops the reference held by the partition list, and removes the files once queries reading
+// the partition have released it as well.
 func (d *diskPartition) clean() error {
+	atomic.StoreInt32(&d.removed, 1)
+	return d.release()
+}
+
+func (d *diskPartition) close() error {
 	// Unmap memory first
 	if d.mappedFile != nil {
 		if err := syscall.Munmap(d.mappedFile); err != nil {
@@ -197,6 +589,9 @@ func (d *diskPartition) clean() error {
 		d.f = nil
 	}
 
+	if atomic.LoadInt32(&d.removed) == 0 {
+		return nil
+	}
 	// Remove files
 	if err := os.RemoveAll(d.dirPath); err != nil {
 		return fmt.Errorf("failed to remove all files inside the partition (%d~%d): %w", d.minTimestamp(), d.maxTimestamp(), err)
@@ -1,10 +1,17 @@
 package embedtsdb
 
 import (
+	"bytes"
+	"encoding/json"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestOpenDiskPartition(t *testing.T) {
@@ -36,3 +43,288 @@ func TestOpenDiskPartition(t *testing.T) {
 		})
 	}
 }
+
+func Test_diskPartition_matchSeries(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "p-1-2")
+	mem := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+	_, err := mem.insertRows([]Row{
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}, DataPoint: DataPoint{Timestamp: 2}},
+	})
+	require.NoError(t, err)
+	s := &storage{logger: &nopLogger{}}
+	require.NoError(t, s.flush(dir, mem))
+
+	matchers := []*Matcher{
+		MustNewMatcher(MatchEqual, MetricNameLabel, "cpu"),
+		MustNewMatcher(MatchEqual, "host", "b"),
+	}
+	want := []string{marshalMetricName("cpu", []Label{{Name: "host", Value: "b"}})}
+
+	part, err := openDiskPartition(dir, 24*time.Hour)
+	require.NoError(t, err)
+	got, err := part.matchSeries(matchers)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	require.NoError(t, part.(*diskPartition).f.Close())
+
+	// Partitions flushed without the index file build it from the metadata.
+	require.NoError(t, os.Remove(filepath.Join(dir, indexFileName)))
+	part, err = openDiskPartition(dir, 24*time.Hour)
+	require.NoError(t, err)
+	got, err = part.matchSeries(matchers)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	require.NoError(t, part.clean())
+}
+
+func Test_diskMetric_chunks(t *testing.T) {
+	chunked := diskMetric{
+		Chunks: []diskChunk{
+			{Offset: 0, MinTimestamp: 1, MaxTimestamp: 10},
+			{Offset: 10, MinTimestamp: 11, MaxTimestamp: 20},
+			{Offset: 20, MinTimestamp: 21, MaxTimestamp: 30},
+		},
+	}
+	legacy := diskMetric{Offset: 5, MinTimestamp: 1, MaxTimestamp: 30, NumDataPoints: 30}
+	tests := []struct {
+		name       string
+		metric     diskMetric
+		start, end int64
+		want       []diskChunk
+	}{
+		{name: "all chunks", metric: chunked, start: 0, end: 100, want: chunked.Chunks},
+		{name: "middle chunk", metric: chunked, start: 12, end: 15, want: chunked.Chunks[1:2]},
+		{name: "chunk boundaries", metric: chunked, start: 10, end: 21, want: chunked.Chunks[0:2]},
+		{name: "after all chunks", metric: chunked, start: 31, end: 40, want: nil},
+		{name: "before all chunks", metric: chunked, start: -10, end: 1, want: nil},
+		{name: "legacy series", metric: legacy, start: 12, end: 15, want: []diskChunk{{Offset: 5, MinTimestamp: 1, MaxTimestamp: 30, NumDataPoints: 30}}},
+		{name: "legacy series out of range", metric: legacy, start: 31, end: 40, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.metric.chunks(tt.start, tt.end))
+		})
+	}
+}
+
+func Test_chunkedEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	w := &countingWriter{w: &buf}
+	encoder := newSeriesEncoder(w)
+	defer putSeriesEncoder(encoder)
+	chunked := newChunkedEncoder(encoder, w)
+	numPoints := 2*maxPointsPerChunk + 10
+	for i := 1; i <= numPoints; i++ {
+		require.NoError(t, chunked.encodePoint(&DataPoint{Timestamp: int64(i), Value: float64(i)}))
+	}
+	require.NoError(t, chunked.flush())
+
+	require.Len(t, chunked.chunks, 3)
+	assert.Equal(t, int64(buf.Len()), w.n)
+	assert.Equal(t, int64(0), chunked.chunks[0].Offset)
+	assert.Equal(t, diskChunk{
+		Offset:        chunked.chunks[2].Offset,
+		MinTimestamp:  2*maxPointsPerChunk + 1,
+		MaxTimestamp:  int64(numPoints),
+		NumDataPoints: 10,
+		Length:        int64(buf.Len()) - chunked.chunks[2].Offset,
+		Checksum:      crc32.Checksum(buf.Bytes()[chunked.chunks[2].Offset:], castagnoliTable),
+		Summary:       &chunkSummary{Sum: 2455, Min: 241, Max: 250, First: 241, Last: 250},
+	}, chunked.chunks[2])
+	// Chunks are laid out back to back.
+	for i := 1; i < len(chunked.chunks); i++ {
+		assert.Equal(t, chunked.chunks[i].Offset, chunked.chunks[i-1].Offset+chunked.chunks[i-1].Length)
+	}
+
+	// Every chunk can be decoded independently.
+	for _, chunk := range chunked.chunks {
+		decoder := newBytesSeriesDecoder(buf.Bytes()[chunk.Offset:])
+		for i := chunk.MinTimestamp; i <= chunk.MaxTimestamp; i++ {
+			var p DataPoint
+			require.NoError(t, decoder.decodePoint(&p))
+			assert.Equal(t, DataPoint{Timestamp: i, Value: float64(i)}, p)
+		}
+	}
+}
+
+func Test_diskPartition_selectDataPoints_legacy(t *testing.T) {
+	// Partitions flushed before chunks were introduced have the whole series as a single stream.
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	encoder := newSeriesEncoder(&buf)
+	defer putSeriesEncoder(encoder)
+	for i := int64(1); i <= 300; i++ {
+		require.NoError(t, encoder.encodePoint(&DataPoint{Timestamp: i, Value: float64(i)}))
+	}
+	require.NoError(t, encoder.flush())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, dataFileName), buf.Bytes(), 0644))
+	b, err := json.Marshal(&meta{
+		MinTimestamp:  1,
+		MaxTimestamp:  300,
+		NumDataPoints: 300,
+		Metrics: map[string]diskMetric{
+			"metric1": {Name: "metric1", Offset: 0, MinTimestamp: 1, MaxTimestamp: 300, NumDataPoints: 300},
+		},
+		CreatedAt: time.Now(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, metaFileName), b, 0644))
+
+	part, err := openDiskPartition(dir, 24*time.Hour)
+	require.NoError(t, err)
+	defer part.clean()
+	got, err := part.selectDataPoints("metric1", nil, 150, 153)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{
+		{Timestamp: 150, Value: 150},
+		{Timestamp: 151, Value: 151},
+		{Timestamp: 152, Value: 152},
+	}, got)
+}
+
+func Test_chunkedEncoder_nonFiniteSummary(t *testing.T) {
+	var buf bytes.Buffer
+	w := &countingWriter{w: &buf}
+	encoder := newSeriesEncoder(w)
+	defer putSeriesEncoder(encoder)
+	chunked := newChunkedEncoder(encoder, w)
+	require.NoError(t, chunked.encodePoint(&DataPoint{Timestamp: 1, Value: 1}))
+	require.NoError(t, chunked.encodePoint(&DataPoint{Timestamp: 2, Value: math.NaN()}))
+	require.NoError(t, chunked.flush())
+	require.Len(t, chunked.chunks, 1)
+	assert.Nil(t, chunked.chunks[0].Summary)
+}
+
+func Test_diskPartition_aggregate(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "p-1-240")
+	mem := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+	for i := int64(1); i <= 2*maxPointsPerChunk; i++ {
+		_, err := mem.insertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: i, Value: float64(i)}}})
+		require.NoError(t, err)
+	}
+	s := &storage{logger: &nopLogger{}}
+	require.NoError(t, s.flush(dir, mem))
+
+	// Break the data file so that any attempt to decode fails.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, dataFileName), []byte{0}, 0644))
+
+	part, err := openDiskPartition(dir, 24*time.Hour)
+	require.NoError(t, err)
+	defer part.clean()
+
+	// Buckets covering whole chunks are computed from their summaries.
+	q := &AggregateQuery{Start: 1, End: 2*maxPointsPerChunk + 1, Step: maxPointsPerChunk, Func: AggregateSum}
+	buckets := make([]aggregation, q.numBuckets())
+	require.NoError(t, part.(*diskPartition).aggregate("metric1", q, buckets))
+	assert.Equal(t, float64(maxPointsPerChunk*(maxPointsPerChunk+1)/2), buckets[0].value(AggregateSum))
+	assert.Equal(t, float64(maxPointsPerChunk), buckets[0].value(AggregateCount))
+	assert.Equal(t, float64(1), buckets[0].value(AggregateFirst))
+	assert.Equal(t, float64(2*maxPointsPerChunk), buckets[1].value(AggregateLast))
+	assert.Equal(t, float64(maxPointsPerChunk+1), buckets[1].value(AggregateMin))
+
+	// Buckets splitting a chunk need to decode it.
+	q = &AggregateQuery{Start: 1, End: 2*maxPointsPerChunk + 1, Step: 10, Func: AggregateSum}
+	buckets = make([]aggregation, q.numBuckets())
+	assert.Error(t, part.(*diskPartition).aggregate("metric1", q, buckets))
+}
+
+func Test_diskPartition_selectDataPoints_corruptedChunk(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "p-1-240")
+	mem := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+	for i := int64(1); i <= 2*maxPointsPerChunk; i++ {
+		_, err := mem.insertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: i, Value: float64(i)}}})
+		require.NoError(t, err)
+	}
+	s := &storage{logger: &nopLogger{}}
+	require.NoError(t, s.flush(dir, mem))
+
+	// Flip a bit in the second chunk.
+	m, err := readMeta(dir)
+	require.NoError(t, err)
+	chunk := m.Metrics["metric1"].Chunks[1]
+	dataPath := filepath.Join(dir, dataFileName)
+	b, err := os.ReadFile(dataPath)
+	require.NoError(t, err)
+	b[chunk.Offset+chunk.Length/2] ^= 0x01
+	require.NoError(t, os.WriteFile(dataPath, b, 0644))
+
+	part, err := openDiskPartition(dir, 24*time.Hour)
+	require.NoError(t, err)
+	defer part.clean()
+
+	// The first chunk is still readable.
+	got, err := part.selectDataPoints("metric1", nil, 1, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1, Value: 1}, {Timestamp: 2, Value: 2}}, got)
+
+	_, err = part.selectDataPoints("metric1", nil, 1, 2*maxPointsPerChunk+1)
+	var checksumErr *ChecksumError
+	require.ErrorAs(t, err, &checksumErr)
+	assert.Equal(t, dataPath, checksumErr.Path)
+	assert.Equal(t, chunk.Offset, checksumErr.Offset)
+}
+
+func TestOpenDiskPartition_tamperedMeta(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "p-1-2")
+	mem := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+	_, err := mem.insertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 1}}})
+	require.NoError(t, err)
+	s := &storage{logger: &nopLogger{}}
+	require.NoError(t, s.flush(dir, mem))
+
+	metaPath := filepath.Join(dir, metaFileName)
+	b, err := os.ReadFile(metaPath)
+	require.NoError(t, err)
+	b = bytes.Replace(b, []byte(`"numDataPoints":1`), []byte(`"numDataPoints":2`), 1)
+	require.NoError(t, os.WriteFile(metaPath, b, 0644))
+
+	_, err = openDiskPartition(dir, 24*time.Hour)
+	var checksumErr *ChecksumError
+	require.ErrorAs(t, err, &checksumErr)
+	assert.Equal(t, metaPath, checksumErr.Path)
+}
+
+func Test_diskPartition_delete(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "p-1-240")
+	mem := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+	for i := int64(1); i <= 2*maxPointsPerChunk; i++ {
+		_, err := mem.insertRows([]Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: i, Value: float64(i)}},
+			{Metric: "metric2", DataPoint: DataPoint{Timestamp: i, Value: float64(i)}},
+		})
+		require.NoError(t, err)
+	}
+	s := &storage{logger: &nopLogger{}}
+	require.NoError(t, s.flush(dir, mem))
+
+	part, err := openDiskPartition(dir, 24*time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, part.delete([]*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "metric1")}, 2, maxPointsPerChunk))
+	require.NoError(t, part.delete([]*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "metric2")}, 0, 1000))
+	require.NoError(t, part.(*diskPartition).f.Close())
+
+	// Tombstones survive reopening.
+	part, err = openDiskPartition(dir, 24*time.Hour)
+	require.NoError(t, err)
+	defer part.clean()
+	got, err := part.selectDataPoints("metric1", nil, 0, 4)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1, Value: 1}}, got)
+	got, err = part.selectDataPoints("metric1", nil, maxPointsPerChunk-1, maxPointsPerChunk+1)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: maxPointsPerChunk, Value: maxPointsPerChunk}}, got)
+
+	// Series all of whose data points are deleted don't match.
+	names, err := part.matchSeries([]*Matcher{MustNewMatcher(MatchRegexp, MetricNameLabel, "metric.")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"metric1"}, names)
+
+	// The summary of the chunk having deleted data points isn't used.
+	q := &AggregateQuery{Start: 1, End: 2*maxPointsPerChunk + 1, Step: maxPointsPerChunk, Func: AggregateSum}
+	buckets := make([]aggregation, q.numBuckets())
+	require.NoError(t, part.(*diskPartition).aggregate("metric1", q, buckets))
+	assert.Equal(t, float64(1+maxPointsPerChunk), buckets[0].value(AggregateSum))
+	assert.Equal(t, float64(2), buckets[0].value(AggregateCount))
+	assert.Equal(t, float64(maxPointsPerChunk), buckets[1].value(AggregateCount))
+}
@@ -2,28 +2,36 @@ package embedtsdb
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/fs"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
 )
 
 // WAL buffer pool for reducing allocations
 var walBufferPool = sync.Pool{
 	New: func() interface{} {
-		return make([]byte, binary.MaxVarintLen64)
+		return make([]byte, 0, 64)
 	},
 }
 
-// diskWAL contains multiple segment files. One segment is responsible for one partition.
-// They can be easily sorted because they are named using the created timestamp.
+// diskWAL contains multiple segment files, which are cut whenever a new partition is created, or the active one
+// exceeds the maximum size or age. Each segment belongs to the checkpoint it was created in, which is incremented
+// by punctuate, so that it can be removed once all partitions created until then are persisted.
+// They are named using the numbering index, in the order they were created.
 // Macro layout is like:
 /*
   .wal/
@@ -33,147 +41,410 @@ var walBufferPool = sync.Pool{
 type diskWAL struct {
 	dir          string
 	bufferedSize int
+	syncMode     WALSyncMode
+	compression  WALCompression
+	// The limits of the active segment, which are unlimited if zero.
+	maxSegmentSize int64
+	maxSegmentAge  time.Duration
 	// Buffered-writer to the active segment
 	w *bufio.Writer
 	// File descriptor to the active segment
 	fd    *os.File
 	index uint32
 	mu    sync.Mutex
+
+	// current is the checkpoint segments are being cut in.
+	current uint64
+	// segments are all segment files but the recovered ones, from the oldest. The last one is the active segment.
+	segments []walSegmentFile
+	// recovered are segment files found when opening, which are removed by refresh.
+	recovered []string
+	// The size and the created time of the active segment.
+	segmentSize    int64
+	segmentCreated time.Time
+	// refs are the references assigned to series in the active segment.
+	refs map[string]uint64
+
+	// syncMu serializes syncs, so that appenders waiting for it while a sync is in progress
+	// are all covered by the next one. It must be acquired before mu.
+	syncMu sync.Mutex
+	// appended is the number of appends so far, and synced is how many of them have been synced.
+	appended uint64
+	synced   uint64
+	// fsync makes the given file durable, which can be replaced in tests.
+	fsync func(f *os.File) error
+}
+
+// walSegmentFile is a segment file along with the checkpoint it belongs to.
+type walSegmentFile struct {
+	name       string
+	checkpoint uint64
+}
+
+// diskWALOption is an optional setting for newDiskWAL.
+type diskWALOption func(*diskWAL)
+
+// withWALSyncMode specifies when the WAL is synced. See WithWALSync.
+func withWALSyncMode(mode WALSyncMode) diskWALOption {
+	return func(w *diskWAL) {
+		w.syncMode = mode
+	}
+}
+
+// withWALCompression specifies how records are compressed. See WithWALCompression.
+func withWALCompression(compression WALCompression) diskWALOption {
+	return func(w *diskWAL) {
+		w.compression = compression
+	}
+}
+
+// withWALSegmentLimits specifies the maximum size and age of a segment. See WithWALSegmentSize and WithWALSegmentAge.
+func withWALSegmentLimits(size int64, age time.Duration) diskWALOption {
+	return func(w *diskWAL) {
+		w.maxSegmentSize = size
+		w.maxSegmentAge = age
+	}
 }
 
-func newDiskWAL(dir string, bufferedSize int) (wal, error) {
+func newDiskWAL(dir string, bufferedSize int, opts ...diskWALOption) (wal, error) {
 	if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
 		return nil, fmt.Errorf("failed to make WAL dir: %w", err)
 	}
 	w := &diskWAL{
 		dir:          dir,
 		bufferedSize: bufferedSize,
+		syncMode:     WALSyncNever,
+		fsync:        (*os.File).Sync,
 	}
-	f, err := w.createSegmentFile(dir)
+	for _, opt := range opts {
+		opt(w)
+	}
+	// Leave segments left behind to be recovered as they are, and number new ones after them.
+	files, err := os.ReadDir(dir)
 	if err != nil {
+		return nil, fmt.Errorf("failed to read the WAL dir: %w", err)
+	}
+	for _, file := range files {
+		index, err := strconv.ParseUint(file.Name(), 10, 32)
+		if err != nil || file.IsDir() {
+			continue
+		}
+		w.recovered = append(w.recovered, file.Name())
+		if uint32(index) >= w.index {
+			w.index = uint32(index) + 1
+		}
+	}
+	if err := w.cutSegment(); err != nil {
 		return nil, err
 	}
-	w.fd = f
-	w.w = bufio.NewWriterSize(f, bufferedSize)
-
 	return w, nil
 }
 
 // append appends the given entry to the end of a file via the file descriptor it has.
+// With WALSyncBatch, it doesn't return until the entry is synced.
 func (w *diskWAL) append(op walOperation, rows []Row) error {
+	n, full, err := w.write(op, rows)
+	if err != nil {
+		return err
+	}
+	return w.commit(n, full)
+}
+
+// appendDelete appends a record of operationDelete in the same way as append.
+func (w *diskWAL) appendDelete(matchers []*Matcher, start, end int64) error {
+	record := make([]byte, 0, 64)
+	record = append(record, byte(operationDelete))
+	record = binary.AppendVarint(record, start)
+	record = binary.AppendVarint(record, end)
+	record = binary.AppendUvarint(record, uint64(len(matchers)))
+	for _, m := range matchers {
+		record = append(record, byte(m.Type))
+		record = binary.AppendUvarint(record, uint64(len(m.Name)))
+		record = append(record, m.Name...)
+		record = binary.AppendUvarint(record, uint64(len(m.Value)))
+		record = append(record, m.Value...)
+	}
+	record = binary.LittleEndian.AppendUint32(record, crc32.Checksum(record, castagnoliTable))
+
+	w.mu.Lock()
+	n, full, err := w.writeRecords(record)
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return w.commit(n, full)
+}
+
+// commit waits for the first n appends to be synced with WALSyncBatch, and then rotates the active segment
+// if it's full.
+func (w *diskWAL) commit(n uint64, full bool) error {
+	if w.syncMode == WALSyncBatch {
+		if err := w.syncUpTo(n); err != nil {
+			return err
+		}
+	}
+	if full {
+		return w.rotate()
+	}
+	return nil
+}
+
+// write writes the given entry into the buffered-writer, and gives back the number of appends including it,
+// along with whether the active segment exceeds its limits.
+func (w *diskWAL) write(op walOperation, rows []Row) (uint64, bool, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
 	switch op {
 	case operationInsert:
-		// Get a shared buffer from pool for all varint encodings
-		buf := walBufferPool.Get().([]byte)
-		defer walBufferPool.Put(buf)
+		// Get shared buffers from pool to build records in
+		series := walBufferPool.Get().([]byte)[:0]
+		samples := walBufferPool.Get().([]byte)[:0]
+		defer func() {
+			walBufferPool.Put(series[:0])
+			walBufferPool.Put(samples[:0])
+		}()
+		if w.refs == nil {
+			w.refs = make(map[string]uint64)
+		}
 
+		// Series seen for the first time in this segment are assigned references, and the whole batch
+		// of samples follows them as one record.
+		samples = append(samples, byte(operationSamples))
+		samples = binary.AppendUvarint(samples, uint64(len(rows)))
+		var prev int64
 		for _, row := range rows {
-			// Write the operation type
-			if err := w.w.WriteByte(byte(op)); err != nil {
-				return fmt.Errorf("failed to write operation: %w", err)
-			}
 			name := marshalMetricName(row.Metric, row.Labels)
-			// Write the length of the metric name
-			n := binary.PutUvarint(buf, uint64(len(name)))
-			if _, err := w.w.Write(buf[:n]); err != nil {
-				return fmt.Errorf("failed to write the length of the metric name: %w", err)
-			}
-			// Write the metric name
-			if _, err := w.w.WriteString(name); err != nil {
-				return fmt.Errorf("failed to write the metric name: %w", err)
-			}
-			// Write the timestamp
-			n = binary.PutVarint(buf, row.DataPoint.Timestamp)
-			if _, err := w.w.Write(buf[:n]); err != nil {
-				return fmt.Errorf("failed to write the timestamp: %w", err)
-			}
-			// Write the value
-			n = binary.PutUvarint(buf, math.Float64bits(row.DataPoint.Value))
-			if _, err := w.w.Write(buf[:n]); err != nil {
-				return fmt.Errorf("failed to write the value: %w", err)
+			ref, ok := w.refs[name]
+			if !ok {
+				ref = uint64(len(w.refs))
+				w.refs[name] = ref
+				start := len(series)
+				series = append(series, byte(operationSeries))
+				series = binary.AppendUvarint(series, ref)
+				series = binary.AppendUvarint(series, uint64(len(name)))
+				series = append(series, name...)
+				series = binary.LittleEndian.AppendUint32(series, crc32.Checksum(series[start:], castagnoliTable))
 			}
+			samples = binary.AppendUvarint(samples, ref)
+			samples = binary.AppendVarint(samples, row.DataPoint.Timestamp-prev)
+			samples = binary.LittleEndian.AppendUint64(samples, math.Float64bits(row.DataPoint.Value))
+			prev = row.DataPoint.Timestamp
 		}
+		samples = binary.LittleEndian.AppendUint32(samples, crc32.Checksum(samples, castagnoliTable))
+		batch := [][]byte{series, samples}
+		if w.compression == WALCompressionSnappy {
+			compressed := snappy.Encode(nil, append(series, samples...))
+			record := make([]byte, 0, len(compressed)+binary.MaxVarintLen64+5)
+			record = append(record, byte(operationSnappyBatch))
+			record = binary.AppendUvarint(record, uint64(len(compressed)))
+			record = append(record, compressed...)
+			record = binary.LittleEndian.AppendUint32(record, crc32.Checksum(record, castagnoliTable))
+			batch = [][]byte{record}
+		}
+		return w.writeRecords(batch...)
 	default:
-		return fmt.Errorf("unknown operation %v given", op)
+		return 0, false, fmt.Errorf("unknown operation %v given", op)
 	}
+}
+
+// writeRecords writes the given records of an append into the buffered-writer in the same way as write.
+// The caller must hold mu.
+func (w *diskWAL) writeRecords(records ...[]byte) (uint64, bool, error) {
+	for _, b := range records {
+		if _, err := w.w.Write(b); err != nil {
+			return 0, false, fmt.Errorf("failed to write the record: %w", err)
+		}
+		w.segmentSize += int64(len(b))
+	}
+	w.appended++
 	if w.bufferedSize == 0 {
-		return w.flush()
+		return w.appended, w.full(), w.flushBuffer()
 	}
 
-	return nil
+	return w.appended, w.full(), nil
+}
+
+// full tells if the active segment exceeds its limits. The caller must hold mu.
+func (w *diskWAL) full() bool {
+	if w.segmentSize == 0 {
+		return false
+	}
+	if w.maxSegmentSize > 0 && w.segmentSize >= w.maxSegmentSize {
+		return true
+	}
+	return w.maxSegmentAge > 0 && time.Since(w.segmentCreated) >= w.maxSegmentAge
 }
 
 // flush flushes all buffered entries to the underlying file.
 func (w *diskWAL) flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.flushBuffer()
+}
+
+// flushBuffer is the same as flush but the caller must hold mu.
+func (w *diskWAL) flushBuffer() error {
 	if err := w.w.Flush(); err != nil {
 		return fmt.Errorf("failed to flush buffered-data into the underlying WAL file: %w", err)
 	}
 	return nil
 }
 
-// punctuate set boundary and creates a new segment.
-func (w *diskWAL) punctuate() error {
+// sync flushes all buffered entries and syncs the active segment.
+func (w *diskWAL) sync() error {
+	w.mu.Lock()
+	n := w.appended
+	w.mu.Unlock()
+	return w.syncUpTo(n)
+}
+
+// syncUpTo makes sure the first n appends are synced. Appends made while waiting for
+// another sync are synced together by one of their callers, which is known as group commit.
+func (w *diskWAL) syncUpTo(n uint64) error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	if w.synced >= n {
+		return nil
+	}
+	w.mu.Lock()
+	appended := w.appended
+	err := w.flushBuffer()
+	fd := w.fd
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Appends can go on while syncing, since the active segment is switched only under syncMu.
+	if err := w.fsync(fd); err != nil {
+		return fmt.Errorf("failed to sync the WAL file: %w", err)
+	}
+	w.synced = appended
+	return nil
+}
+
+// punctuate sets a boundary for a new partition by cutting a new segment in a new checkpoint,
+// and gives back the checkpoint.
+func (w *diskWAL) punctuate() (uint64, error) {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.closeSegment(); err != nil {
+		return 0, err
+	}
+	w.current++
+	if err := w.cutSegment(); err != nil {
+		return 0, err
+	}
+	return w.current, nil
+}
+
+// checkpoint gives back the checkpoint segments are being cut in.
+func (w *diskWAL) checkpoint() uint64 {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	if err := w.flush(); err != nil {
+	return w.current
+}
+
+// rotate cuts a new segment in the same checkpoint if the active one exceeds its limits.
+func (w *diskWAL) rotate() error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Another appender may have rotated it already.
+	if !w.full() {
+		return nil
+	}
+	if err := w.closeSegment(); err != nil {
 		return err
 	}
-	if err := w.fd.Close(); err != nil {
+	return w.cutSegment()
+}
+
+// closeSegment flushes and closes the active segment. The caller must hold both syncMu and mu.
+func (w *diskWAL) closeSegment() error {
+	if err := w.flushBuffer(); err != nil {
 		return err
 	}
+	if w.syncMode != WALSyncNever && w.synced < w.appended {
+		// Appends to the segment being closed are synced here, because later syncs are made only on the new one.
+		if err := w.fsync(w.fd); err != nil {
+			return fmt.Errorf("failed to sync the WAL file: %w", err)
+		}
+		w.synced = w.appended
+	}
+	return w.fd.Close()
+}
+
+// cutSegment creates a new active segment in the current checkpoint. The caller must hold mu,
+// or have the only reference to it.
+func (w *diskWAL) cutSegment() error {
 	f, err := w.createSegmentFile(w.dir)
 	if err != nil {
 		return err
 	}
 	w.fd = f
 	w.w = bufio.NewWriterSize(f, w.bufferedSize)
+	w.segments = append(w.segments, walSegmentFile{name: filepath.Base(f.Name()), checkpoint: w.current})
+	w.segmentSize = 0
+	w.segmentCreated = time.Now()
+	// References are valid only within a segment, so that each one can be read on its own.
+	w.refs = make(map[string]uint64)
 	return nil
 }
 
-// truncateOldest removes only the oldest segment.
-func (w *diskWAL) removeOldest() error {
+// removeBefore removes segments that belong to checkpoints before the given one, except for the active segment.
+// Records for a partition are written to segments in the checkpoint it was created in or later ones,
+// hence the given checkpoint should be the oldest one of partitions not persisted yet.
+func (w *diskWAL) removeBefore(checkpoint uint64) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	files, err := os.ReadDir(w.dir)
-	if err != nil {
-		return fmt.Errorf("failed to read WAL directory: %w", err)
-	}
-	if len(files) == 0 {
-		return fmt.Errorf("no segment found")
+	kept := w.segments[:0]
+	for i, seg := range w.segments {
+		if seg.checkpoint >= checkpoint || i == len(w.segments)-1 {
+			kept = append(kept, seg)
+			continue
+		}
+		if err := os.Remove(filepath.Join(w.dir, seg.name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			w.segments = append(kept, w.segments[i:]...)
+			return fmt.Errorf("failed to remove WAL segment: %w", err)
+		}
 	}
-	return os.RemoveAll(filepath.Join(w.dir, files[0].Name()))
+	w.segments = kept
+	return nil
 }
 
 // removeAll removes all segment files.
 func (w *diskWAL) removeAll() error {
+	w.syncMu.Lock()
+	defer w.syncMu.Unlock()
 	w.mu.Lock()
 	defer w.mu.Unlock()
 	if err := w.fd.Close(); err != nil {
 		return err
 	}
+	// Nothing is left to be synced.
+	w.synced = w.appended
+	w.segments = nil
+	w.recovered = nil
 	if err := os.RemoveAll(w.dir); err != nil {
 		return fmt.Errorf("failed to remove files under %q: %w", w.dir, err)
 	}
 	return os.MkdirAll(w.dir, fs.ModePerm)
 }
 
-// refresh removes all segment files and make a new segment.
+// refresh removes segment files found when opening, of which records have been inserted again.
 func (w *diskWAL) refresh() error {
-	if err := w.removeAll(); err != nil {
-		return err
-	}
 	w.mu.Lock()
 	defer w.mu.Unlock()
-
-	f, err := w.createSegmentFile(w.dir)
-	if err != nil {
-		return err
+	for _, name := range w.recovered {
+		if err := os.Remove(filepath.Join(w.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove recovered WAL segment: %w", err)
+		}
 	}
-	w.fd = f
-	w.w = bufio.NewWriterSize(f, w.bufferedSize)
+	w.recovered = nil
 	return nil
 }
 
@@ -189,14 +460,38 @@ func (w *diskWAL) createSegmentFile(dir string) (*os.File, error) {
 }
 
 type walRecord struct {
-	op  walOperation
-	row Row
+	op   walOperation
+	rows []Row
+	// deletion is set for operationDelete.
+	deletion walDeletion
+}
+
+// walDeletion is a deletion recorded in the WAL.
+type walDeletion struct {
+	matchers   []*Matcher
+	start, end int64
+	// afterRows is the number of rows to insert before applying it.
+	afterRows int
 }
 
 type diskWALReader struct {
 	dir          string
 	files        []os.DirEntry
 	rowsToInsert []Row
+	// deletions are in the order they were recorded, which are applied in between rowsToInsert.
+	deletions []walDeletion
+	// segments tells how each segment was recovered, in the order they were read.
+	segments []walSegmentRecovery
+}
+
+// walSegmentRecovery tells how many records were recovered from a segment.
+type walSegmentRecovery struct {
+	name      string
+	recovered int
+	// skipped is the number of records discarded, which is the torn one at the tail if any.
+	skipped int
+	// tornBytes is the size of the discarded tail.
+	tornBytes int64
 }
 
 func newDiskWALReader(dir string) (*diskWALReader, error) {
@@ -204,6 +499,7 @@ func newDiskWALReader(dir string) (*diskWALReader, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to read the WAL dir: %w", err)
 	}
+	sortSegmentFiles(files)
 
 	return &diskWALReader{
 		dir:          dir,
@@ -212,103 +508,436 @@ func newDiskWALReader(dir string) (*diskWALReader, error) {
 	}, nil
 }
 
+// sortSegmentFiles sorts the given segment files in the order they were created.
+// Segments are numbered in that order, which differs from the lexical order after "9".
+func sortSegmentFiles(files []os.DirEntry) {
+	sort.SliceStable(files, func(i, j int) bool {
+		a, errA := strconv.Atoi(files[i].Name())
+		b, errB := strconv.Atoi(files[j].Name())
+		if errA != nil || errB != nil {
+			return files[i].Name() < files[j].Name()
+		}
+		return a < b
+	})
+}
+
 // readAll reads all segment files and caches the result for each operation.
+// Each segment is read independently, so that a torn record at the tail of a segment,
+// which is left when the process terminated in the middle of writing to it, discards only that record.
 func (f *diskWALReader) readAll() error {
-	for _, file := range f.files {
+	for i, file := range f.files {
 		if file.IsDir() {
 			return fmt.Errorf("unexpected directory found under the WAL directory: %s", file.Name())
 		}
-		fd, err := os.Open(filepath.Join(f.dir, file.Name()))
+		recovery, err := f.readSegment(file.Name(), i == len(f.files)-1)
 		if err != nil {
-			return fmt.Errorf("failed to open WAL segment file: %w", err)
-		}
-		segment := &segment{
-			file: fd,
-			r:    bufio.NewReader(fd),
-		}
-		for segment.next() {
-			rec := segment.record()
-			switch rec.op {
-			case operationInsert:
-				f.rowsToInsert = append(f.rowsToInsert, rec.row)
-			}
-		}
-		if err := segment.close(); err != nil {
-			return err
+			return fmt.Errorf("encounter an error while reading WAL segment file %q: %w", file.Name(), err)
 		}
+		f.segments = append(f.segments, recovery)
+	}
+	return nil
+}
 
-		err = segment.error()
-		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
-			// It is not unusual for a line to be invalid, as it may well terminate in the middle of writing to the WAL.
-			return nil
-		}
-		if err != nil {
-			return fmt.Errorf("encounter an error while reading WAL segment file %q: %w", file.Name(), segment.error())
+// readSegment reads all records in the given segment file, discarding the torn one at the tail.
+// The final record of the last segment is taken for a torn one as well if its checksum doesn't match.
+func (f *diskWALReader) readSegment(name string, last bool) (walSegmentRecovery, error) {
+	recovery := walSegmentRecovery{name: name}
+	fd, err := os.Open(filepath.Join(f.dir, name))
+	if err != nil {
+		return recovery, fmt.Errorf("failed to open WAL segment file: %w", err)
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return recovery, fmt.Errorf("failed to fetch file info: %w", err)
+	}
+	segment := &segment{
+		path: fd.Name(),
+		r:    bufio.NewReader(fd),
+		size: info.Size(),
+		last: last,
+	}
+	for segment.next() {
+		rec := segment.record()
+		switch rec.op {
+		case operationInsert:
+			f.rowsToInsert = append(f.rowsToInsert, rec.rows...)
+		case operationDelete:
+			deletion := rec.deletion
+			deletion.afterRows = len(f.rowsToInsert)
+			f.deletions = append(f.deletions, deletion)
 		}
+		recovery.recovered++
 	}
-	return nil
+	err = segment.error()
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		// It is not unusual for a record to be incomplete, as it may well terminate in the middle of writing to the WAL.
+		recovery.skipped = 1
+		recovery.tornBytes = info.Size() - segment.offset
+		return recovery, nil
+	}
+	return recovery, err
+}
+
+// walReader is what a segment reads records from.
+type walReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// checksumReader computes the CRC32C of bytes read through it, and counts them.
+type checksumReader struct {
+	r   walReader
+	crc uint32
+	n   int64
+	// limit is the number of bytes left in the segment where the record begins.
+	limit int64
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc = crc32.Update(c.crc, castagnoliTable, p[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+// readBytes reads a field of n bytes, whose length precedes it in the record.
+// The length is checked against the bytes left in the segment before allocating, so that
+// a corrupted one can't exhaust memory.
+func (c *checksumReader) readBytes(n uint64) ([]byte, error) {
+	if left := c.limit - c.n; left < 0 || n > uint64(left) {
+		// The field would run past the end of the segment, which is what a torn write looks like.
+		return nil, fmt.Errorf("length %d exceeds the %d bytes left in the segment: %w", n, left, io.ErrUnexpectedEOF)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (c *checksumReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.crc = crc32.Update(c.crc, castagnoliTable, []byte{b})
+		c.n++
+	}
+	return b, err
 }
 
 // segment represents a segment file.
 type segment struct {
+	// file is nil if the segment is read from memory.
 	file *os.File
-	r    *bufio.Reader
-	// FIXME: Use interface to support other operation type
+	// path is used to report checksum mismatches.
+	path string
+	r    walReader
+	// size is the number of bytes in the segment, which bounds the lengths read from records.
+	size int64
+	// offset is where the last record given back ends.
+	offset int64
+	// pos is where the next record begins, which is ahead of offset when series records have been read since.
+	pos int64
+	// last tells if it's the last segment, where a crash can leave the final record with a mismatched checksum.
+	last bool
+	// series are the marshaled metric names assigned to references in this segment.
+	series  map[uint64]string
 	current walRecord
 	err     error
 }
 
+// next reads the next record having data points, reading series records along the way.
 func (f *segment) next() bool {
-	op, err := f.r.ReadByte()
-	if errors.Is(err, io.EOF) {
-		return false
+	for {
+		r := &checksumReader{r: f.r, limit: f.size - f.pos}
+		b, err := r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			if f.pos > f.offset {
+				// Series records are always followed by samples, so they're left by a torn write.
+				f.err = fmt.Errorf("no samples found after series records: %w", io.ErrUnexpectedEOF)
+			}
+			return false
+		}
+		if err != nil {
+			f.err = err
+			return false
+		}
+		op := walOperation(b)
+		var (
+			ref        uint64
+			name       string
+			rows       []Row
+			compressed []byte
+			deletion   walDeletion
+		)
+		switch op {
+		case operationInsert, operationChecksummedInsert:
+			var row Row
+			row, err = readInsertRecord(r)
+			if err == nil && op == operationInsert && row.Metric == "" {
+				// A file system may leave a zero-filled tail after a crash, which reads as records of
+				// operationInsert without a metric name. Having no checksum, they're told apart only by that.
+				err = fmt.Errorf("record without a metric name found: %w", io.ErrUnexpectedEOF)
+			}
+			rows = append(f.current.rows[:0], row)
+		case operationSeries:
+			ref, name, err = readSeriesRecord(r)
+		case operationSamples:
+			rows, err = f.readSamplesRecord(r, f.current.rows[:0])
+		case operationSnappyBatch:
+			compressed, err = readSnappyBatchRecord(r)
+		case operationDelete:
+			deletion, err = readDeleteRecord(r)
+		default:
+			err = fmt.Errorf("unknown operation %v found", op)
+		}
+		if err != nil {
+			f.err = err
+			return false
+		}
+		if op != operationInsert {
+			var sum [4]byte
+			if _, err := io.ReadFull(f.r, sum[:]); err != nil {
+				f.err = fmt.Errorf("failed to read checksum: %w", err)
+				return false
+			}
+			if expected := binary.LittleEndian.Uint32(sum[:]); expected != r.crc {
+				f.err = &ChecksumError{Path: f.path, Offset: f.pos, Expected: expected, Actual: r.crc}
+				if f.last && !f.recordFollows(f.pos+r.n+int64(len(sum))) {
+					// The file system may have persisted the length of the last record but not all of its
+					// content before a crash, which is no different from a torn write.
+					f.err = fmt.Errorf("checksum mismatch in the last record: %w", io.ErrUnexpectedEOF)
+				}
+				return false
+			}
+			r.n += int64(len(sum))
+		}
+		if op == operationSnappyBatch {
+			if rows, err = f.decodeSnappyBatch(compressed, f.current.rows[:0]); err != nil {
+				f.err = err
+				return false
+			}
+		}
+		f.pos += r.n
+		if op == operationSeries {
+			if f.series == nil {
+				f.series = make(map[uint64]string)
+			}
+			f.series[ref] = name
+			continue
+		}
+		f.offset = f.pos
+		if op == operationDelete {
+			if err := deletion.compileMatchers(); err != nil {
+				f.err = err
+				return false
+			}
+			f.current = walRecord{op: operationDelete, rows: f.current.rows[:0], deletion: deletion}
+			return true
+		}
+		f.current = walRecord{op: operationInsert, rows: rows}
+		return true
+	}
+}
+
+// recordFollows tells if any valid record follows in the rest of the segment, which begins at the given position.
+// It reads through the segment, leaving the state as it is.
+func (f *segment) recordFollows(pos int64) bool {
+	err, offset := f.err, f.offset
+	defer func() {
+		f.err, f.offset, f.pos, f.last = err, offset, pos, true
+	}()
+	f.pos, f.last = pos, false
+	for {
+		if f.next() {
+			return true
+		}
+		var checksumErr *ChecksumError
+		if !errors.As(f.err, &checksumErr) {
+			return false
+		}
 	}
+}
+
+// readInsertRecord reads a record of operationInsert or operationChecksummedInsert following the operation,
+// except for the checksum.
+func readInsertRecord(r *checksumReader) (Row, error) {
+	// Read the length of metric name.
+	metricLen, err := binary.ReadUvarint(r)
 	if err != nil {
-		f.err = err
-		return false
+		return Row{}, fmt.Errorf("failed to read the length of metric name: %w", err)
 	}
-	switch walOperation(op) {
-	case operationInsert:
-		// Read the length of metric name.
-		metricLen, err := binary.ReadUvarint(f.r)
+	// Read the metric name.
+	metric, err := r.readBytes(metricLen)
+	if err != nil {
+		return Row{}, fmt.Errorf("failed to read the metric name: %w", err)
+	}
+	// Read timestamp.
+	ts, err := binary.ReadVarint(r)
+	if err != nil {
+		return Row{}, fmt.Errorf("failed to read timestamp: %w", err)
+	}
+	// Read value.
+	val, err := binary.ReadUvarint(r)
+	if err != nil {
+		return Row{}, fmt.Errorf("failed to read value: %w", err)
+	}
+	return Row{
+		Metric: string(metric),
+		DataPoint: DataPoint{
+			Timestamp: ts,
+			Value:     math.Float64frombits(val),
+		},
+	}, nil
+}
+
+// readSeriesRecord reads a record of operationSeries following the operation, except for the checksum.
+func readSeriesRecord(r *checksumReader) (uint64, string, error) {
+	ref, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read series reference: %w", err)
+	}
+	metricLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read the length of metric name: %w", err)
+	}
+	metric, err := r.readBytes(metricLen)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to read the metric name: %w", err)
+	}
+	return ref, string(metric), nil
+}
+
+// readDeleteRecord reads a record of operationDelete following the operation, except for the checksum.
+func readDeleteRecord(r *checksumReader) (walDeletion, error) {
+	var d walDeletion
+	var err error
+	if d.start, err = binary.ReadVarint(r); err != nil {
+		return d, fmt.Errorf("failed to read start: %w", err)
+	}
+	if d.end, err = binary.ReadVarint(r); err != nil {
+		return d, fmt.Errorf("failed to read end: %w", err)
+	}
+	num, err := binary.ReadUvarint(r)
+	if err != nil {
+		return d, fmt.Errorf("failed to read the number of matchers: %w", err)
+	}
+	readString := func() (string, error) {
+		n, err := binary.ReadUvarint(r)
 		if err != nil {
-			f.err = fmt.Errorf("failed to read the length of metric name: %w", err)
-			return false
+			return "", err
 		}
-		// Read the metric name.
-		metric := make([]byte, int(metricLen))
-		if _, err := io.ReadFull(f.r, metric); err != nil {
-			f.err = fmt.Errorf("failed to read the metric name: %w", err)
-			return false
+		b, err := r.readBytes(n)
+		if err != nil {
+			return "", err
 		}
-		// Read timestamp.
-		ts, err := binary.ReadVarint(f.r)
+		return string(b), nil
+	}
+	for i := uint64(0); i < num; i++ {
+		t, err := r.ReadByte()
 		if err != nil {
-			f.err = fmt.Errorf("failed to read timestamp: %w", err)
-			return false
+			return d, fmt.Errorf("failed to read match type: %w", err)
 		}
-		// Read value.
-		val, err := binary.ReadUvarint(f.r)
+		name, err := readString()
 		if err != nil {
-			f.err = fmt.Errorf("failed to read value: %w", err)
-			return false
+			return d, fmt.Errorf("failed to read label name: %w", err)
 		}
-		f.current = walRecord{
-			op: walOperation(op),
-			row: Row{
-				Metric: string(metric),
-				DataPoint: DataPoint{
-					Timestamp: ts,
-					Value:     math.Float64frombits(val),
-				},
-			},
+		value, err := readString()
+		if err != nil {
+			return d, fmt.Errorf("failed to read label value: %w", err)
 		}
-	default:
-		f.err = fmt.Errorf("unknown operation %v found", op)
-		return false
+		// It's compiled once the checksum is verified.
+		d.matchers = append(d.matchers, &Matcher{Type: MatchType(t), Name: name, Value: value})
+	}
+	return d, nil
+}
+
+// compileMatchers builds the matchers read from a record of operationDelete.
+func (d *walDeletion) compileMatchers() error {
+	for i, m := range d.matchers {
+		compiled, err := NewMatcher(m.Type, m.Name, m.Value)
+		if err != nil {
+			return fmt.Errorf("broken matcher found: %v", err)
+		}
+		d.matchers[i] = compiled
+	}
+	return nil
+}
+
+// readSnappyBatchRecord reads a record of operationSnappyBatch following the operation except for the checksum,
+// and gives back the compressed records.
+func readSnappyBatchRecord(r *checksumReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the length of compressed records: %w", err)
+	}
+	compressed, err := r.readBytes(n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compressed records: %w", err)
+	}
+	return compressed, nil
+}
+
+// decodeSnappyBatch decompresses the given records of operationSnappyBatch, and appends their data points to rows.
+func (f *segment) decodeSnappyBatch(compressed []byte, rows []Row) ([]Row, error) {
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress records: %w", err)
+	}
+	if f.series == nil {
+		f.series = make(map[uint64]string)
 	}
+	batch := &segment{path: f.path, r: bytes.NewReader(b), size: int64(len(b)), series: f.series}
+	for batch.next() {
+		if batch.record().op != operationInsert {
+			return nil, fmt.Errorf("unexpected operation %v found in compressed records", batch.record().op)
+		}
+		rows = append(rows, batch.record().rows...)
+	}
+	if err := batch.error(); err != nil {
+		// Don't let it be taken for a torn write, since the record has been read entirely.
+		return nil, fmt.Errorf("broken compressed records: %v", err)
+	}
+	return rows, nil
+}
 
-	return true
+// readSamplesRecord reads a record of operationSamples following the operation except for the checksum,
+// and appends its data points to rows.
+func (f *segment) readSamplesRecord(r walReader, rows []Row) ([]Row, error) {
+	num, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the number of samples: %w", err)
+	}
+	var (
+		ts  int64
+		val [8]byte
+	)
+	for i := uint64(0); i < num; i++ {
+		ref, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read series reference: %w", err)
+		}
+		delta, err := binary.ReadVarint(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read timestamp: %w", err)
+		}
+		if _, err := io.ReadFull(r, val[:]); err != nil {
+			return nil, fmt.Errorf("failed to read value: %w", err)
+		}
+		name, ok := f.series[ref]
+		if !ok {
+			return nil, fmt.Errorf("unknown series reference %d found", ref)
+		}
+		ts += delta
+		rows = append(rows, Row{
+			Metric: name,
+			DataPoint: DataPoint{
+				Timestamp: ts,
+				Value:     math.Float64frombits(binary.LittleEndian.Uint64(val[:])),
+			},
+		})
+	}
+	return rows, nil
 }
 
 // error gives back an error if it has been facing an error while reading.
@@ -321,5 +950,8 @@ func (f *segment) record() *walRecord {
 }
 
 func (f *segment) close() error {
+	if f.file == nil {
+		return nil
+	}
 	return f.file.Close()
 }
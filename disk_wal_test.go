@@ -1,10 +1,20 @@
 package embedtsdb
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -33,7 +43,7 @@ func Test_diskWAL_append_read(t *testing.T) {
 	err = wal.append(op, rows[:2])
 	require.NoError(t, err)
 
-	err = wal.punctuate()
+	_, err = wal.punctuate()
 	require.NoError(t, err)
 
 	err = wal.append(op, rows[2:])
@@ -51,24 +61,584 @@ func Test_diskWAL_append_read(t *testing.T) {
 	assert.Equal(t, rows, got)
 }
 
-func Test_diskWAL_removeOldest(t *testing.T) {
-	tmpDir, err := os.MkdirTemp("", "embedtsdb-test")
+func Test_diskWAL_removeBefore(t *testing.T) {
+	dir := t.TempDir()
+	v, err := newDiskWAL(dir, 0, withWALSegmentLimits(1, 0))
+	require.NoError(t, err)
+	w := v.(*diskWAL)
+	row := Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}
+	// Every append rotates the segment, so checkpoint 0 has segments "0" and "1", checkpoint 1 has "2" and "3",
+	// and checkpoint 2 has "4" and the active one "5".
+	require.NoError(t, w.append(operationInsert, []Row{row}))
+	for i := 0; i < 2; i++ {
+		_, err := w.punctuate()
+		require.NoError(t, err)
+		require.NoError(t, w.append(operationInsert, []Row{row}))
+	}
+	names := func() []string {
+		files, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		got := []string{}
+		for _, f := range files {
+			got = append(got, f.Name())
+		}
+		return got
+	}
+	require.Equal(t, []string{"0", "1", "2", "3", "4", "5"}, names())
+
+	require.NoError(t, w.removeBefore(1))
+	assert.Equal(t, []string{"2", "3", "4", "5"}, names())
+	// The active segment is never removed.
+	require.NoError(t, w.removeBefore(3))
+	assert.Equal(t, []string{"5"}, names())
+}
+
+func Test_diskWAL_rotate(t *testing.T) {
+	rows := make([]Row, 0)
+	for i := int64(0); i < 10; i++ {
+		rows = append(rows, Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000 + i, Value: float64(i)}})
+	}
+	tests := []struct {
+		name         string
+		size         int64
+		age          time.Duration
+		wantSegments int
+	}{
+		{name: "unlimited", wantSegments: 1},
+		{name: "size", size: 60, wantSegments: 4},
+		{name: "age", age: time.Nanosecond, wantSegments: 11},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w, err := newDiskWAL(dir, 4096, withWALSegmentLimits(tt.size, tt.age))
+			require.NoError(t, err)
+			for _, row := range rows {
+				require.NoError(t, w.append(operationInsert, []Row{row}))
+			}
+			require.NoError(t, w.flush())
+			files, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Len(t, files, tt.wantSegments)
+
+			reader, err := newDiskWALReader(dir)
+			require.NoError(t, err)
+			require.NoError(t, reader.readAll())
+			assert.Equal(t, rows, reader.rowsToInsert)
+		})
+	}
+}
+
+func Test_segment_next(t *testing.T) {
+	row := Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}
+	var buf bytes.Buffer
+	w := &diskWAL{w: bufio.NewWriter(&buf)}
+	// A series record followed by a samples record, and then another samples record.
+	require.NoError(t, w.append(operationInsert, []Row{row}))
+	require.NoError(t, w.flush())
+	first := buf.Len()
+	require.NoError(t, w.append(operationInsert, []Row{row}))
+	require.NoError(t, w.flush())
+	samples := buf.Len() - first
+	series := first - samples
+
+	// Records written before checksums were introduced.
+	legacy := []byte{byte(operationInsert), byte(len(row.Metric))}
+	legacy = append(legacy, row.Metric...)
+	legacy = binary.AppendVarint(legacy, row.Timestamp)
+	legacy = binary.AppendUvarint(legacy, math.Float64bits(row.Value))
+	// Records written before series references were introduced.
+	checksummed := append([]byte{byte(operationChecksummedInsert)}, legacy[1:]...)
+	checksummed = binary.LittleEndian.AppendUint32(checksummed, crc32.Checksum(checksummed, castagnoliTable))
+
+	corrupted := bytes.Clone(buf.Bytes())
+	corrupted[first+3] ^= 0x01
+	corruptedSeries := bytes.Clone(buf.Bytes())
+	corruptedSeries[3] ^= 0x01
+
+	tests := []struct {
+		name       string
+		b          []byte
+		want       []Row
+		wantOffset int64
+		wantErr    bool
+	}{
+		{
+			name: "series references",
+			b:    buf.Bytes(),
+			want: []Row{row, row},
+		},
+		{
+			name: "version 1",
+			b:    legacy,
+			want: []Row{row},
+		},
+		{
+			name: "version 2",
+			b:    append(bytes.Clone(checksummed), checksummed...),
+			want: []Row{row, row},
+		},
+		{
+			name: "mixed",
+			b:    append(bytes.Clone(checksummed), buf.Bytes()...),
+			want: []Row{row, row, row},
+		},
+		{
+			name:       "corrupted",
+			b:          corrupted,
+			want:       []Row{row},
+			wantOffset: int64(first),
+		},
+		{
+			name:       "corrupted checksum",
+			b:          append(bytes.Clone(buf.Bytes()[:buf.Len()-1]), buf.Bytes()[buf.Len()-1]^0x01),
+			want:       []Row{row},
+			wantOffset: int64(first),
+		},
+		{
+			name:       "corrupted series",
+			b:          corruptedSeries,
+			want:       []Row{},
+			wantOffset: 0,
+			wantErr:    true,
+		},
+		{
+			name:    "unknown series reference",
+			b:       buf.Bytes()[series:],
+			want:    []Row{},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seg := &segment{path: "0", r: bytes.NewReader(tt.b), size: int64(len(tt.b))}
+			got := []Row{}
+			for seg.next() {
+				got = append(got, seg.record().rows...)
+			}
+			assert.Equal(t, tt.want, got)
+			if tt.wantOffset == 0 && !tt.wantErr {
+				assert.NoError(t, seg.error())
+				return
+			}
+			require.Error(t, seg.error())
+			var checksumErr *ChecksumError
+			if tt.name == "unknown series reference" {
+				assert.False(t, errors.As(seg.error(), &checksumErr))
+				return
+			}
+			require.ErrorAs(t, seg.error(), &checksumErr)
+			assert.Equal(t, "0", checksumErr.Path)
+			assert.Equal(t, tt.wantOffset, checksumErr.Offset)
+		})
+	}
+}
+
+func Test_segment_next_hugeLength(t *testing.T) {
+	// A corrupted length must not be allocated for, which would exhaust memory.
+	huge := binary.AppendUvarint(nil, math.MaxInt64)
+	tests := []struct {
+		name string
+		b    []byte
+	}{
+		{
+			name: "insert",
+			b:    append([]byte{byte(operationChecksummedInsert)}, huge...),
+		},
+		{
+			name: "series",
+			b:    append([]byte{byte(operationSeries), 1}, huge...),
+		},
+		{
+			name: "snappy batch",
+			b:    append([]byte{byte(operationSnappyBatch)}, huge...),
+		},
+		{
+			name: "delete",
+			b:    append([]byte{byte(operationDelete), 0, 2, 1, byte(MatchEqual)}, huge...),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seg := &segment{path: "0", r: bytes.NewReader(tt.b), size: int64(len(tt.b))}
+			assert.False(t, seg.next())
+			// It runs past the end of the segment, which can't be told apart from a torn write.
+			assert.ErrorIs(t, seg.error(), io.ErrUnexpectedEOF)
+		})
+	}
+}
+
+func Test_diskWAL_append_size(t *testing.T) {
+	// Repeating series are written only once per segment, which makes the WAL far smaller than full records.
+	var buf bytes.Buffer
+	w := &diskWAL{w: bufio.NewWriter(&buf)}
+	labels := []Label{{Name: "host", Value: "host-1"}, {Name: "region", Value: "ap-northeast-1"}}
+	var full int
+	for i := 0; i < 100; i++ {
+		rows := make([]Row, 0, 10)
+		for j := 0; j < 10; j++ {
+			row := Row{Metric: "metric-" + strconv.Itoa(j), Labels: labels, DataPoint: DataPoint{Timestamp: 1600000000 + int64(i), Value: float64(i)}}
+			rows = append(rows, row)
+			full += len(marshalMetricName(row.Metric, row.Labels)) + 1
+		}
+		require.NoError(t, w.append(operationInsert, rows))
+	}
+	require.NoError(t, w.flush())
+	assert.Less(t, buf.Len(), full/2)
+
+	seg := &segment{r: bytes.NewReader(buf.Bytes()), size: int64(buf.Len())}
+	n := 0
+	for seg.next() {
+		n += len(seg.record().rows)
+	}
+	require.NoError(t, seg.error())
+	assert.Equal(t, 1000, n)
+}
+
+func Test_diskWALReader_readAll_tornWrite(t *testing.T) {
+	rows := make([]Row, 0)
+	for i := int64(0); i < 10; i++ {
+		rows = append(rows, Row{Metric: "metric-" + strconv.Itoa(int(i%3)), DataPoint: DataPoint{Timestamp: 1600000000 + i, Value: float64(i)}})
+	}
+	// Write the first half into segment "0", recording where each record ends, and the rest into segment "1".
+	src := filepath.Join(t.TempDir(), "wal")
+	w, err := newDiskWAL(src, 0)
+	require.NoError(t, err)
+	ends := []int64{0}
+	for _, row := range rows[:5] {
+		require.NoError(t, w.append(operationInsert, []Row{row}))
+		info, err := os.Stat(filepath.Join(src, "0"))
+		require.NoError(t, err)
+		ends = append(ends, info.Size())
+	}
+	_, err = w.punctuate()
+	require.NoError(t, err)
+	require.NoError(t, w.append(operationInsert, rows[5:]))
+	require.NoError(t, w.flush())
+	segment0, err := os.ReadFile(filepath.Join(src, "0"))
+	require.NoError(t, err)
+	segment1, err := os.ReadFile(filepath.Join(src, "1"))
+	require.NoError(t, err)
+
+	// Simulate a crash at every byte offset of segment "0".
+	for offset := int64(0); offset <= int64(len(segment0)); offset++ {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "0"), segment0[:offset], 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "1"), segment1, 0644))
+
+		complete := 0
+		for complete+1 < len(ends) && ends[complete+1] <= offset {
+			complete++
+		}
+		want := walSegmentRecovery{name: "0", recovered: complete}
+		if offset > ends[complete] {
+			want.skipped = 1
+			want.tornBytes = offset - ends[complete]
+		}
+
+		reader, err := newDiskWALReader(dir)
+		require.NoError(t, err)
+		require.NoError(t, reader.readAll(), "offset %d", offset)
+		// Segment "1" has the rest in one record, since they were appended together.
+		assert.Equal(t, []walSegmentRecovery{want, {name: "1", recovered: 1}}, reader.segments, "offset %d", offset)
+		// Later segments are replayed regardless of the torn tail.
+		assert.Equal(t, append(append([]Row{}, rows[:complete]...), rows[5:]...), reader.rowsToInsert, "offset %d", offset)
+	}
+
+	// Simulate a crash leaving a zero-filled tail, which parses as records of operationInsert.
+	for _, zeros := range []int{1, 4, 64} {
+		dir := t.TempDir()
+		b := append(append([]byte{}, segment0...), make([]byte, zeros)...)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "0"), b, 0644))
+
+		reader, err := newDiskWALReader(dir)
+		require.NoError(t, err)
+		require.NoError(t, reader.readAll(), "zeros %d", zeros)
+		want := walSegmentRecovery{name: "0", recovered: 5, skipped: 1, tornBytes: int64(zeros)}
+		assert.Equal(t, []walSegmentRecovery{want}, reader.segments, "zeros %d", zeros)
+		assert.Equal(t, rows[:5], reader.rowsToInsert, "zeros %d", zeros)
+	}
+}
+
+func Test_diskWALReader_readAll_order(t *testing.T) {
+	dir := t.TempDir()
+	w := &diskWAL{dir: dir}
+	rows := make([]Row, 0)
+	for i := 0; i < 12; i++ {
+		require.NoError(t, w.cutSegment())
+		f := w.fd
+		row := Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: int64(i), Value: float64(i)}}
+		rows = append(rows, row)
+		require.NoError(t, w.append(operationInsert, []Row{row}))
+		require.NoError(t, w.flush())
+		require.NoError(t, f.Close())
+	}
+
+	reader, err := newDiskWALReader(dir)
+	require.NoError(t, err)
+	require.NoError(t, reader.readAll())
+	assert.Equal(t, rows, reader.rowsToInsert)
+	require.Len(t, reader.segments, 12)
+	assert.Equal(t, "10", reader.segments[10].name)
+}
+
+func Test_diskWALReader_readAll_corrupted(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newDiskWAL(dir, 0)
 	require.NoError(t, err)
+	row := Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}
+	ends := make([]int64, 0)
 	for i := 0; i < 3; i++ {
-		err := os.Mkdir(filepath.Join(tmpDir, strconv.Itoa(i)), os.ModePerm)
+		require.NoError(t, w.append(operationInsert, []Row{row}))
+		info, err := os.Stat(filepath.Join(dir, "0"))
 		require.NoError(t, err)
+		ends = append(ends, info.Size())
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "0"))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		// offset is where a bit gets flipped.
+		offset int64
+		// next tells if another segment follows.
+		next    bool
+		wantErr bool
+	}{
+		// Records are intact up to the tail, but one in the middle is corrupted, which isn't a torn write.
+		{name: "middle record", offset: ends[1] - 5, wantErr: true},
+		{name: "final record of the last segment", offset: ends[2] - 5},
+		{name: "final record followed by another segment", offset: ends[2] - 5, next: true, wantErr: true},
 	}
-	w := &diskWAL{
-		dir: tmpDir,
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			corrupted := append([]byte{}, b...)
+			corrupted[tt.offset] ^= 0x01
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "0"), corrupted, 0644))
+			if tt.next {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "1"), b, 0644))
+			}
+
+			reader, err := newDiskWALReader(dir)
+			require.NoError(t, err)
+			err = reader.readAll()
+			if tt.wantErr {
+				var checksumErr *ChecksumError
+				assert.ErrorAs(t, err, &checksumErr)
+				return
+			}
+			require.NoError(t, err)
+			want := walSegmentRecovery{name: "0", recovered: 2, skipped: 1, tornBytes: ends[2] - ends[1]}
+			assert.Equal(t, []walSegmentRecovery{want}, reader.segments)
+			assert.Equal(t, []Row{row, row}, reader.rowsToInsert)
+		})
+	}
+}
+
+func Test_diskWALReader_readAll_corruptedTail(t *testing.T) {
+	rows := make([]Row, 0)
+	for i := int64(0); i < 5; i++ {
+		rows = append(rows, Row{Metric: "metric-" + strconv.Itoa(int(i%3)), DataPoint: DataPoint{Timestamp: 1600000000 + i, Value: float64(i)}})
+	}
+	src := filepath.Join(t.TempDir(), "wal")
+	w, err := newDiskWAL(src, 0)
+	require.NoError(t, err)
+	ends := []int64{0}
+	for _, row := range rows {
+		require.NoError(t, w.append(operationInsert, []Row{row}))
+		info, err := os.Stat(filepath.Join(src, "0"))
+		require.NoError(t, err)
+		ends = append(ends, info.Size())
 	}
-	err = w.removeOldest()
+	segment0, err := os.ReadFile(filepath.Join(src, "0"))
 	require.NoError(t, err)
-	files, err := os.ReadDir(w.dir)
+
+	// Simulate a crash at every byte offset of the last segment, after which the file system has persisted
+	// its size but not its content, so that the tail is zero-filled instead of being cut off.
+	for offset := int64(0); offset < int64(len(segment0)); offset++ {
+		dir := t.TempDir()
+		b := append([]byte{}, segment0[:offset]...)
+		b = append(b, make([]byte, len(segment0)-int(offset))...)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "0"), b, 0644))
+
+		complete := 0
+		for complete+1 < len(ends) && ends[complete+1] <= offset {
+			complete++
+		}
+		want := walSegmentRecovery{name: "0", recovered: complete, skipped: 1, tornBytes: int64(len(b)) - ends[complete]}
+
+		reader, err := newDiskWALReader(dir)
+		require.NoError(t, err)
+		require.NoError(t, reader.readAll(), "offset %d", offset)
+		assert.Equal(t, []walSegmentRecovery{want}, reader.segments, "offset %d", offset)
+		assert.Equal(t, append([]Row{}, rows[:complete]...), reader.rowsToInsert, "offset %d", offset)
+	}
+}
+
+func Test_diskWAL_groupCommit(t *testing.T) {
+	dir := t.TempDir()
+	v, err := newDiskWAL(dir, 4096, withWALSyncMode(WALSyncBatch))
+	require.NoError(t, err)
+	w := v.(*diskWAL)
+	var syncs int32
+	w.fsync = func(f *os.File) error {
+		atomic.AddInt32(&syncs, 1)
+		return f.Sync()
+	}
+
+	// Hold the sync lock as if a sync were in progress, so that all appenders have to wait for it.
+	w.syncMu.Lock()
+	const appenders = 8
+	var wg sync.WaitGroup
+	for i := 0; i < appenders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, w.append(operationInsert, []Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: int64(i), Value: 0.1}}}))
+		}(i)
+	}
+	require.Eventually(t, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.appended == appenders
+	}, time.Second, time.Millisecond)
+	w.syncMu.Unlock()
+	wg.Wait()
+
+	// The first appender getting the lock syncs all of them.
+	assert.Equal(t, int32(1), atomic.LoadInt32(&syncs))
+	reader, err := newDiskWALReader(dir)
 	require.NoError(t, err)
-	want := []string{"1", "2"}
-	got := []string{}
-	for _, f := range files {
-		got = append(got, f.Name())
+	require.NoError(t, reader.readAll())
+	assert.Len(t, reader.rowsToInsert, appenders)
+}
+
+func Test_diskWAL_sync(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      WALSyncMode
+		wantSyncs int
+	}{
+		{name: "never", mode: WALSyncNever, wantSyncs: 1},
+		{name: "batch", mode: WALSyncBatch, wantSyncs: 2},
+		{name: "interval", mode: WALSyncInterval, wantSyncs: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := newDiskWAL(t.TempDir(), 4096, withWALSyncMode(tt.mode))
+			require.NoError(t, err)
+			w := v.(*diskWAL)
+			syncs := 0
+			w.fsync = func(f *os.File) error {
+				syncs++
+				return f.Sync()
+			}
+			row := Row{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}
+			require.NoError(t, w.append(operationInsert, []Row{row}))
+			require.NoError(t, w.append(operationInsert, []Row{row}))
+			// Punctuating syncs the segment being closed, unless it's up to the OS.
+			_, err = w.punctuate()
+			require.NoError(t, err)
+			require.NoError(t, w.sync())
+			// Nothing has been appended since the last sync.
+			require.NoError(t, w.sync())
+			assert.Equal(t, tt.wantSyncs, syncs)
+		})
+	}
+}
+
+func Test_diskWAL_compression(t *testing.T) {
+	labels := []Label{{Name: "host", Value: "host-1"}, {Name: "region", Value: "ap-northeast-1"}}
+	batches := make([][]Row, 0)
+	for i := 0; i < 10; i++ {
+		rows := make([]Row, 0)
+		for j := 0; j < 20; j++ {
+			rows = append(rows, Row{Metric: "metric-" + strconv.Itoa(j), Labels: labels, DataPoint: DataPoint{Timestamp: 1600000000 + int64(i), Value: float64(j)}})
+		}
+		batches = append(batches, rows)
 	}
+	write := func(t *testing.T, compression WALCompression) []byte {
+		var buf bytes.Buffer
+		w := &diskWAL{w: bufio.NewWriter(&buf), compression: compression}
+		for _, rows := range batches {
+			require.NoError(t, w.append(operationInsert, rows))
+		}
+		require.NoError(t, w.flush())
+		return buf.Bytes()
+	}
+	read := func(b []byte) ([]Row, *segment) {
+		seg := &segment{path: "0", r: bytes.NewReader(b), size: int64(len(b))}
+		got := []Row{}
+		for seg.next() {
+			got = append(got, seg.record().rows...)
+		}
+		return got, seg
+	}
+	want := []Row{}
+	for _, rows := range batches {
+		for _, row := range rows {
+			want = append(want, Row{Metric: marshalMetricName(row.Metric, row.Labels), DataPoint: row.DataPoint})
+		}
+	}
+
+	plain := write(t, WALCompressionNone)
+	compressed := write(t, WALCompressionSnappy)
+	assert.Less(t, len(compressed), len(plain))
+	got, seg := read(compressed)
+	require.NoError(t, seg.error())
 	assert.Equal(t, want, got)
+
+	// Compressed records are read along with uncompressed ones written by a storage without compression.
+	var buf bytes.Buffer
+	w := &diskWAL{w: bufio.NewWriter(&buf)}
+	require.NoError(t, w.append(operationInsert, batches[0]))
+	w.compression = WALCompressionSnappy
+	for _, rows := range batches[1:] {
+		require.NoError(t, w.append(operationInsert, rows))
+	}
+	require.NoError(t, w.flush())
+	got, seg = read(buf.Bytes())
+	require.NoError(t, seg.error())
+	assert.Equal(t, want, got)
+
+	// A torn compressed record at the tail.
+	got, seg = read(compressed[:len(compressed)-10])
+	assert.ErrorIs(t, seg.error(), io.ErrUnexpectedEOF)
+	assert.Equal(t, want[:len(want)-20], got)
+
+	// A corrupted compressed record.
+	corrupted := bytes.Clone(compressed)
+	corrupted[len(corrupted)-10] ^= 0x01
+	_, seg = read(corrupted)
+	var checksumErr *ChecksumError
+	assert.ErrorAs(t, seg.error(), &checksumErr)
+}
+
+func Test_diskWAL_appendDelete(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal")
+	rows := []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Value: 0.1, Timestamp: 1600000000}},
+		{Metric: "metric1", DataPoint: DataPoint{Value: 0.2, Timestamp: 1600000001}},
+	}
+	matchers := []*Matcher{
+		MustNewMatcher(MatchEqual, MetricNameLabel, "metric1"),
+		MustNewMatcher(MatchRegexp, "host", "a|b"),
+	}
+	w, err := newDiskWAL(path, 4096, withWALCompression(WALCompressionSnappy))
+	require.NoError(t, err)
+	require.NoError(t, w.appendDelete(matchers, 0, 1))
+	require.NoError(t, w.append(operationInsert, rows[:1]))
+	require.NoError(t, w.appendDelete(matchers, 1600000000, 1600000001))
+	require.NoError(t, w.append(operationInsert, rows[1:]))
+	require.NoError(t, w.flush())
+
+	reader, err := newDiskWALReader(path)
+	require.NoError(t, err)
+	require.NoError(t, reader.readAll())
+	assert.Equal(t, rows, reader.rowsToInsert)
+	assert.Equal(t, []walDeletion{
+		{matchers: matchers, start: 0, end: 1, afterRows: 0},
+		{matchers: matchers, start: 1600000000, end: 1600000001, afterRows: 1},
+	}, reader.deletions)
 }
@@ -215,6 +215,13 @@ func newSeriesDecoder(r io.Reader) (seriesDecoder, error) {
 	return decoder, nil
 }
 
+// newBytesSeriesDecoder decodes the given bytes in place, without copying them.
+func newBytesSeriesDecoder(b []byte) seriesDecoder {
+	return &gorillaDecoder{
+		br: newBReader(b),
+	}
+}
+
 func putSeriesDecoder(decoder seriesDecoder) {
 	if gorilla, ok := decoder.(*gorillaDecoder); ok {
 		decoderPool.Put(gorilla)
@@ -0,0 +1,296 @@
+package embedtsdb
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Format is a file format to export and import data points with.
+// Either format has the columns metric, labels, timestamp and value, one data point per record.
+type Format int
+
+const (
+	// FormatCSV is the comma-separated values with a header row. Labels are a JSON object in a single column:
+	//
+	//	metric,labels,timestamp,value
+	//	cpu,"{""host"":""a""}",1600000000,0.5
+	FormatCSV Format = iota
+	// FormatNDJSON is the newline-delimited JSON, also known as JSON Lines:
+	//
+	//	{"metric":"cpu","labels":{"host":"a"},"timestamp":1600000000,"value":0.5}
+	//
+	// Values that JSON can't represent are written as the strings "NaN", "+Inf" and "-Inf".
+	FormatNDJSON
+)
+
+// The number of rows to be inserted at once while importing.
+const importBatchSize = 1000
+
+var csvHeader = []string{"metric", "labels", "timestamp", "value"}
+
+func (f Format) String() string {
+	switch f {
+	case FormatCSV:
+		return "csv"
+	case FormatNDJSON:
+		return "ndjson"
+	default:
+		return fmt.Sprintf("Format(%d)", int(f))
+	}
+}
+
+// exportRecord is a data point in the NDJSON format.
+type exportRecord struct {
+	Metric    string            `json:"metric"`
+	Labels    map[string]string `json:"labels"`
+	Timestamp int64             `json:"timestamp"`
+	Value     jsonFloat         `json:"value"`
+}
+
+// jsonFloat is a float64 that can be NaN or infinity in JSON, by being quoted.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return []byte(`"` + formatValue(v) + `"`), nil
+	}
+	return []byte(formatValue(v)), nil
+}
+
+func (f *jsonFloat) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value %s", b)
+	}
+	*f = jsonFloat(v)
+	return nil
+}
+
+func (s *storage) Export(w io.Writer, matchers []*Matcher, start, end int64, format Format) error {
+	set, err := s.SelectSeriesSet(matchers, start, end)
+	if err != nil {
+		return err
+	}
+	defer set.Close()
+	var enc recordEncoder
+	switch format {
+	case FormatCSV:
+		enc = newCSVEncoder(w)
+	case FormatNDJSON:
+		enc = newNDJSONEncoder(w)
+	default:
+		return fmt.Errorf("unknown format %v", format)
+	}
+	if err := enc.writeHeader(); err != nil {
+		return fmt.Errorf("failed to write header: %w", err)
+	}
+	for set.Next() {
+		series := set.At()
+		labels := make(map[string]string, len(series.Labels()))
+		for _, l := range series.Labels() {
+			labels[l.Name] = l.Value
+		}
+		for series.Next() {
+			ts, v := series.At()
+			if err := enc.write(series.Metric(), labels, ts, v); err != nil {
+				return fmt.Errorf("failed to write data point: %w", err)
+			}
+		}
+		if err := series.Err(); err != nil {
+			return err
+		}
+	}
+	if err := set.Err(); err != nil {
+		return err
+	}
+	return enc.flush()
+}
+
+func (s *storage) Import(r io.Reader, format Format) error {
+	var dec recordDecoder
+	switch format {
+	case FormatCSV:
+		dec = newCSVDecoder(r)
+	case FormatNDJSON:
+		dec = newNDJSONDecoder(r)
+	default:
+		return fmt.Errorf("unknown format %v", format)
+	}
+	rows := make([]Row, 0, importBatchSize)
+	for {
+		row, err := dec.read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rows = append(rows, row)
+		if len(rows) == importBatchSize {
+			if err := s.InsertRows(rows); err != nil {
+				return fmt.Errorf("failed to insert rows: %w", err)
+			}
+			rows = make([]Row, 0, importBatchSize)
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := s.InsertRows(rows); err != nil {
+		return fmt.Errorf("failed to insert rows: %w", err)
+	}
+	return nil
+}
+
+type recordEncoder interface {
+	writeHeader() error
+	write(metric string, labels map[string]string, timestamp int64, value float64) error
+	flush() error
+}
+
+type recordDecoder interface {
+	// read gives back io.EOF once all records are read.
+	read() (Row, error)
+}
+
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func newCSVEncoder(w io.Writer) recordEncoder {
+	return &csvEncoder{w: csv.NewWriter(w)}
+}
+
+func (e *csvEncoder) writeHeader() error {
+	return e.w.Write(csvHeader)
+}
+
+func (e *csvEncoder) write(metric string, labels map[string]string, timestamp int64, value float64) error {
+	b, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+	return e.w.Write([]string{metric, string(b), strconv.FormatInt(timestamp, 10), formatValue(value)})
+}
+
+func (e *csvEncoder) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type csvDecoder struct {
+	r *csv.Reader
+}
+
+func newCSVDecoder(r io.Reader) recordDecoder {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(csvHeader)
+	cr.ReuseRecord = true
+	return &csvDecoder{r: cr}
+}
+
+func (d *csvDecoder) read() (Row, error) {
+	record, err := d.r.Read()
+	if err != nil {
+		return Row{}, err
+	}
+	line, _ := d.r.FieldPos(0)
+	if line == 1 && record[0] == csvHeader[0] && record[1] == csvHeader[1] {
+		// Skip the header.
+		return d.read()
+	}
+	row := Row{Metric: record[0]}
+	if row.Metric == "" {
+		return Row{}, fmt.Errorf("line %d: metric must be set", line)
+	}
+	if record[1] != "" {
+		var labels map[string]string
+		if err := json.Unmarshal([]byte(record[1]), &labels); err != nil {
+			return Row{}, fmt.Errorf("line %d: invalid labels: %w", line, err)
+		}
+		row.Labels = toLabels(labels)
+	}
+	if row.Timestamp, err = strconv.ParseInt(record[2], 10, 64); err != nil {
+		return Row{}, fmt.Errorf("line %d: invalid timestamp %q", line, record[2])
+	}
+	if row.Value, err = strconv.ParseFloat(record[3], 64); err != nil {
+		return Row{}, fmt.Errorf("line %d: invalid value %q", line, record[3])
+	}
+	return row, nil
+}
+
+type ndjsonEncoder struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newNDJSONEncoder(w io.Writer) recordEncoder {
+	bw := bufio.NewWriter(w)
+	return &ndjsonEncoder{w: bw, enc: json.NewEncoder(bw)}
+}
+
+func (e *ndjsonEncoder) writeHeader() error {
+	return nil
+}
+
+func (e *ndjsonEncoder) write(metric string, labels map[string]string, timestamp int64, value float64) error {
+	// Encode appends a newline to each record.
+	return e.enc.Encode(&exportRecord{Metric: metric, Labels: labels, Timestamp: timestamp, Value: jsonFloat(value)})
+}
+
+func (e *ndjsonEncoder) flush() error {
+	return e.w.Flush()
+}
+
+type ndjsonDecoder struct {
+	dec *json.Decoder
+	// the number of records read so far.
+	n int
+}
+
+func newNDJSONDecoder(r io.Reader) recordDecoder {
+	return &ndjsonDecoder{dec: json.NewDecoder(r)}
+}
+
+func (d *ndjsonDecoder) read() (Row, error) {
+	var record exportRecord
+	if err := d.dec.Decode(&record); err != nil {
+		if errors.Is(err, io.EOF) {
+			return Row{}, err
+		}
+		return Row{}, fmt.Errorf("record %d: %w", d.n+1, err)
+	}
+	d.n++
+	if record.Metric == "" {
+		return Row{}, fmt.Errorf("record %d: metric must be set", d.n)
+	}
+	return Row{
+		Metric:    record.Metric,
+		Labels:    toLabels(record.Labels),
+		DataPoint: DataPoint{Timestamp: record.Timestamp, Value: float64(record.Value)},
+	}, nil
+}
+
+// toLabels converts the given map into labels. The order doesn't matter as they get sorted when inserted.
+func toLabels(m map[string]string) []Label {
+	labels := make([]Label, 0, len(m))
+	for name, value := range m {
+		labels = append(labels, Label{Name: name, Value: value})
+	}
+	return labels
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
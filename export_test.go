@@ -0,0 +1,168 @@
+package embedtsdb
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_storage_Export(t *testing.T) {
+	rows := []Row{
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.5}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000001, Value: math.Inf(1)}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b,c"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 2}},
+		{Metric: "mem", DataPoint: DataPoint{Timestamp: 1600000000, Value: 3}},
+	}
+	tests := []struct {
+		name   string
+		format Format
+		want   string
+	}{
+		{
+			name:   "csv",
+			format: FormatCSV,
+			want: `metric,labels,timestamp,value
+cpu,"{""host"":""a""}",1600000000,0.5
+cpu,"{""host"":""a""}",1600000001,+Inf
+cpu,"{""host"":""b,c""}",1600000000,2
+`,
+		},
+		{
+			name:   "ndjson",
+			format: FormatNDJSON,
+			want: `{"metric":"cpu","labels":{"host":"a"},"timestamp":1600000000,"value":0.5}
+{"metric":"cpu","labels":{"host":"a"},"timestamp":1600000001,"value":"+Inf"}
+{"metric":"cpu","labels":{"host":"b,c"},"timestamp":1600000000,"value":2}
+`,
+		},
+	}
+
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows(rows))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := s.Export(&buf, []*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "cpu")}, 1600000000, 1600000002, tt.format)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, buf.String())
+		})
+	}
+
+	var buf bytes.Buffer
+	assert.Error(t, s.Export(&buf, []*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "cpu")}, 1600000000, 1600000002, Format(-1)))
+	assert.Error(t, s.Export(&buf, nil, 1600000000, 1600000002, FormatCSV))
+}
+
+func Test_storage_ExportImport(t *testing.T) {
+	for _, format := range []Format{FormatCSV, FormatNDJSON} {
+		t.Run(format.String(), func(t *testing.T) {
+			// Data points span both disk and memory partitions.
+			opts := []Option{
+				WithDataPath(t.TempDir()),
+				WithTimestampPrecision(Seconds),
+			}
+			src, err := NewStorage(opts...)
+			require.NoError(t, err)
+			require.NoError(t, src.InsertRows([]Row{
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 1}},
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: math.NaN()}},
+			}))
+			require.NoError(t, src.Close())
+			src, err = NewStorage(opts...)
+			require.NoError(t, err)
+			defer src.Close()
+			require.NoError(t, src.InsertRows([]Row{
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600003600, Value: 2}},
+			}))
+
+			matchers := []*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "cpu")}
+			var buf bytes.Buffer
+			require.NoError(t, src.Export(&buf, matchers, 1600000000, 1600003601, format))
+
+			dst, err := NewStorage(WithTimestampPrecision(Seconds))
+			require.NoError(t, err)
+			defer dst.Close()
+			require.NoError(t, dst.Import(&buf, format))
+
+			got, err := dst.SelectSeries(matchers, 1600000000, 1600003601)
+			require.NoError(t, err)
+			require.Len(t, got, 2)
+			assert.Equal(t, []Label{{Name: "host", Value: "a"}}, got[0].Labels)
+			assert.Equal(t, []*DataPoint{{Timestamp: 1600000000, Value: 1}, {Timestamp: 1600003600, Value: 2}}, got[0].Points)
+			assert.Equal(t, []Label{{Name: "host", Value: "b"}}, got[1].Labels)
+			require.Len(t, got[1].Points, 1)
+			assert.True(t, math.IsNaN(got[1].Points[0].Value))
+		})
+	}
+}
+
+func Test_storage_Import(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  Format
+		data    string
+		want    int
+		wantErr bool
+	}{
+		{
+			name:   "csv without header",
+			format: FormatCSV,
+			data:   "cpu,,1600000000,1\ncpu,{},1600000001,2\n",
+			want:   2,
+		},
+		{
+			name:   "ndjson without labels",
+			format: FormatNDJSON,
+			data:   `{"metric":"cpu","timestamp":1600000000,"value":1}` + "\n" + `{"metric":"cpu","timestamp":1600000001,"value":"-Inf"}`,
+			want:   2,
+		},
+		{name: "csv missing column", format: FormatCSV, data: "cpu,{},1600000000\n", wantErr: true},
+		{name: "csv invalid labels", format: FormatCSV, data: "cpu,host=a,1600000000,1\n", wantErr: true},
+		{name: "csv invalid timestamp", format: FormatCSV, data: "cpu,{},now,1\n", wantErr: true},
+		{name: "csv invalid value", format: FormatCSV, data: "cpu,{},1600000000,abc\n", wantErr: true},
+		{name: "csv missing metric", format: FormatCSV, data: ",{},1600000000,1\n", wantErr: true},
+		{name: "ndjson malformed", format: FormatNDJSON, data: `{"metric":"cpu",`, wantErr: true},
+		{name: "ndjson invalid value", format: FormatNDJSON, data: `{"metric":"cpu","timestamp":1,"value":"abc"}`, wantErr: true},
+		{name: "unknown format", format: Format(-1), data: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewStorage(WithTimestampPrecision(Seconds))
+			require.NoError(t, err)
+			defer s.Close()
+			err = s.Import(strings.NewReader(tt.data), tt.format)
+			assert.Equal(t, tt.wantErr, err != nil)
+			if tt.wantErr {
+				return
+			}
+			points, err := s.Select("cpu", nil, 1600000000, 1600000002)
+			require.NoError(t, err)
+			assert.Len(t, points, tt.want)
+		})
+	}
+}
+
+func Test_storage_Import_batches(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("metric,labels,timestamp,value\n")
+	n := importBatchSize*2 + 1
+	for i := 0; i < n; i++ {
+		buf.WriteString("cpu,{},")
+		buf.WriteString(strconv.Itoa(1600000000 + i))
+		buf.WriteString(",1\n")
+	}
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.Import(&buf, FormatCSV))
+	points, err := s.Select("cpu", nil, 1600000000, int64(1600000000+n))
+	require.NoError(t, err)
+	assert.Len(t, points, n)
+}
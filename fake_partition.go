@@ -13,10 +13,22 @@ func (f *fakePartition) insertRows(_ []Row) ([]Row, error) {
 	return nil, f.err
 }
 
+func (f *fakePartition) delete(_ []*Matcher, _, _ int64) error {
+	return f.err
+}
+
 func (f *fakePartition) selectDataPoints(_ string, _ []Label, _, _ int64) ([]*DataPoint, error) {
 	return nil, f.err
 }
 
+func (f *fakePartition) selectIterator(_ string, _, _ int64) (Iterator, error) {
+	return emptyIterator{}, f.err
+}
+
+func (f *fakePartition) matchSeries(_ []*Matcher) ([]string, error) {
+	return nil, f.err
+}
+
 func (f *fakePartition) minTimestamp() int64 {
 	return f.minT
 }
@@ -2,7 +2,11 @@ module github.com/yudaprama/embedtsdb
 
 go 1.24.4
 
-require github.com/stretchr/testify v1.10.0
+require (
+	github.com/golang/snappy v0.0.4
+	github.com/stretchr/testify v1.10.0
+	google.golang.org/protobuf v1.34.2
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -0,0 +1,401 @@
+package embedtsdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+)
+
+const (
+	indexFileName = "index"
+
+	// The index file format is as shown below. All integers are uvarints.
+	/*
+	   +-----------+------------+-------------------------------------------------------+
+	   | magic(4b) | version(1b)| num series | series name 0 (len, bytes) |              |
+	   |   num chunks | chunk 0 offset | chunk 0 num points | ... | series name 1 | ... |
+	   +-----------+------------+-------------------------------------------------------+
+	   | num label names | label name (len, bytes) | num values |                       |
+	   |   label value (len, bytes) | num ids | id delta 0 | id delta 1 | ... | ...      |
+	   +--------------------------------------------------------------------------------+
+	*/
+	// Chunk references locate the chunks of each series in the data file, so that the meta file can be
+	// rebuilt from the data file if it gets lost. Version 1 doesn't have them.
+	indexMagic   = "ETIX"
+	indexVersion = 2
+)
+
+// postingsIndex is an inverted index from label name/value pairs to series IDs.
+// The metric name is indexed as a label named MetricNameLabel.
+// Series IDs are assigned in ascending order, so each postings list is kept sorted just by appending.
+// It offers goroutine safe capabilities.
+type postingsIndex struct {
+	// names holds the marshaled names of series, indexed by series ID.
+	names []string
+	// postings maps label name to label value to sorted series IDs.
+	postings map[string]map[string][]uint32
+	mu       sync.RWMutex
+}
+
+func newPostingsIndex() *postingsIndex {
+	return &postingsIndex{
+		names:    make([]string, 0),
+		postings: make(map[string]map[string][]uint32),
+	}
+}
+
+// add registers the series with the given marshaled name, and gives back its ID.
+// It's caller's responsibility not to add the same series twice.
+func (p *postingsIndex) add(name string) uint32 {
+	metric, labels := unmarshalMetricName(name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := uint32(len(p.names))
+	p.names = append(p.names, name)
+	p.addPosting(MetricNameLabel, metric, id)
+	for i := range labels {
+		p.addPosting(labels[i].Name, labels[i].Value, id)
+	}
+	return id
+}
+
+func (p *postingsIndex) addPosting(name, value string, id uint32) {
+	values, ok := p.postings[name]
+	if !ok {
+		values = make(map[string][]uint32)
+		p.postings[name] = values
+	}
+	values[value] = append(values[value], id)
+}
+
+// numSeries gives back the number of series the index holds.
+func (p *postingsIndex) numSeries() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return len(p.names)
+}
+
+// match gives back the marshaled names of all series that satisfy every given matcher.
+func (p *postingsIndex) match(matchers []*Matcher) []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var (
+		ids      []uint32
+		narrowed bool
+		excluded [][]uint32
+	)
+	for _, m := range matchers {
+		// Matchers that match an empty string select series lacking the label as well,
+		// so they are evaluated as subtraction of series with non-matching values.
+		if m.Matches("") {
+			excluded = append(excluded, p.postingsFor(m.Name, func(v string) bool { return !m.Matches(v) }))
+			continue
+		}
+		var list []uint32
+		if m.Type == MatchEqual {
+			list = p.postings[m.Name][m.Value]
+		} else {
+			list = p.postingsFor(m.Name, m.Matches)
+		}
+		if !narrowed {
+			ids = list
+			narrowed = true
+		} else {
+			ids = intersectPostings(ids, list)
+		}
+		if len(ids) == 0 {
+			return []string{}
+		}
+	}
+	if !narrowed {
+		ids = make([]uint32, len(p.names))
+		for i := range ids {
+			ids[i] = uint32(i)
+		}
+	}
+	for _, list := range excluded {
+		ids = subtractPostings(ids, list)
+	}
+
+	names := make([]string, 0, len(ids))
+	for _, id := range ids {
+		names = append(names, p.names[id])
+	}
+	return names
+}
+
+// postingsFor gives back the union of postings lists of the given label whose values satisfy fn.
+func (p *postingsIndex) postingsFor(name string, fn func(value string) bool) []uint32 {
+	var lists [][]uint32
+	for value, list := range p.postings[name] {
+		if fn(value) {
+			lists = append(lists, list)
+		}
+	}
+	return mergePostings(lists)
+}
+
+// writeTo encodes the index into the given writer, along with references to chunks of the given metrics.
+func (p *postingsIndex) writeTo(w io.Writer, metrics map[string]diskMetric) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, binary.MaxVarintLen64)
+	writeUvarint := func(v uint64) {
+		n := binary.PutUvarint(buf, v)
+		bw.Write(buf[:n])
+	}
+	writeString := func(s string) {
+		writeUvarint(uint64(len(s)))
+		bw.WriteString(s)
+	}
+
+	bw.WriteString(indexMagic)
+	bw.WriteByte(indexVersion)
+	writeUvarint(uint64(len(p.names)))
+	for _, name := range p.names {
+		writeString(name)
+		chunks := metrics[name].Chunks
+		writeUvarint(uint64(len(chunks)))
+		for _, c := range chunks {
+			writeUvarint(uint64(c.Offset))
+			writeUvarint(uint64(c.NumDataPoints))
+		}
+	}
+
+	// Sort keys so that the same index always results in the same bytes.
+	labelNames := make([]string, 0, len(p.postings))
+	for name := range p.postings {
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+	writeUvarint(uint64(len(labelNames)))
+	for _, name := range labelNames {
+		writeString(name)
+		values := make([]string, 0, len(p.postings[name]))
+		for value := range p.postings[name] {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		writeUvarint(uint64(len(values)))
+		for _, value := range values {
+			writeString(value)
+			list := p.postings[name][value]
+			writeUvarint(uint64(len(list)))
+			var prev uint32
+			for _, id := range list {
+				writeUvarint(uint64(id - prev))
+				prev = id
+			}
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	return nil
+}
+
+// readPostingsIndex decodes the index encoded by writeTo.
+func readPostingsIndex(b []byte) (*postingsIndex, error) {
+	p, _, err := decodeIndex(b)
+	return p, err
+}
+
+// decodeIndex decodes the index encoded by writeTo, along with the chunk references of each series.
+// Chunks only have the offset and the number of data points. Chunk references are nil for version 1.
+func decodeIndex(b []byte) (*postingsIndex, map[string][]diskChunk, error) {
+	if len(b) < len(indexMagic)+1 || string(b[:len(indexMagic)]) != indexMagic {
+		return nil, nil, fmt.Errorf("invalid index magic number")
+	}
+	version := b[len(indexMagic)]
+	if version != 1 && version != indexVersion {
+		return nil, nil, fmt.Errorf("unsupported index version %d", version)
+	}
+	d := &indexDecoder{b: b[len(indexMagic)+1:]}
+
+	p := newPostingsIndex()
+	numSeries := d.uvarint()
+	if d.err == nil && numSeries > uint64(len(d.b)) {
+		return nil, nil, fmt.Errorf("invalid number of series: %d", numSeries)
+	}
+	p.names = make([]string, 0, numSeries)
+	var refs map[string][]diskChunk
+	if version >= 2 {
+		refs = make(map[string][]diskChunk, numSeries)
+	}
+	for i := uint64(0); i < numSeries && d.err == nil; i++ {
+		name := d.string()
+		p.names = append(p.names, name)
+		if version < 2 {
+			continue
+		}
+		numChunks := d.uvarint()
+		if d.err == nil && numChunks > uint64(len(d.b)) {
+			return nil, nil, fmt.Errorf("invalid number of chunks: %d", numChunks)
+		}
+		chunks := make([]diskChunk, 0, numChunks)
+		for j := uint64(0); j < numChunks && d.err == nil; j++ {
+			chunks = append(chunks, diskChunk{Offset: int64(d.uvarint()), NumDataPoints: int64(d.uvarint())})
+		}
+		refs[name] = chunks
+	}
+	numLabelNames := d.uvarint()
+	for i := uint64(0); i < numLabelNames && d.err == nil; i++ {
+		name := d.string()
+		numValues := d.uvarint()
+		values := make(map[string][]uint32)
+		for j := uint64(0); j < numValues && d.err == nil; j++ {
+			value := d.string()
+			numIDs := d.uvarint()
+			if d.err == nil && numIDs > uint64(len(d.b)) {
+				return nil, nil, fmt.Errorf("invalid number of postings: %d", numIDs)
+			}
+			list := make([]uint32, 0, numIDs)
+			var id uint64
+			for k := uint64(0); k < numIDs && d.err == nil; k++ {
+				id += d.uvarint()
+				if id >= numSeries {
+					return nil, nil, fmt.Errorf("series id %d out of range", id)
+				}
+				list = append(list, uint32(id))
+			}
+			values[value] = list
+		}
+		p.postings[name] = values
+	}
+	if d.err != nil {
+		return nil, nil, fmt.Errorf("failed to decode index: %w", d.err)
+	}
+	return p, refs, nil
+}
+
+type indexDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *indexDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *indexDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *indexDecoder) float64() float64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 8 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	v := math.Float64frombits(binary.BigEndian.Uint64(d.b))
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *indexDecoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.b)) < n {
+		d.err = io.ErrUnexpectedEOF
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+// intersectPostings gives back IDs contained in both sorted lists.
+func intersectPostings(a, b []uint32) []uint32 {
+	out := make([]uint32, 0)
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// subtractPostings gives back IDs in a that are not contained in b. Both must be sorted.
+func subtractPostings(a, b []uint32) []uint32 {
+	if len(b) == 0 {
+		return a
+	}
+	out := make([]uint32, 0, len(a))
+	j := 0
+	for _, id := range a {
+		for j < len(b) && b[j] < id {
+			j++
+		}
+		if j < len(b) && b[j] == id {
+			continue
+		}
+		out = append(out, id)
+	}
+	return out
+}
+
+// mergePostings gives back the sorted union of the given sorted lists.
+func mergePostings(lists [][]uint32) []uint32 {
+	switch len(lists) {
+	case 0:
+		return nil
+	case 1:
+		return lists[0]
+	}
+	size := 0
+	for _, list := range lists {
+		size += len(list)
+	}
+	out := make([]uint32, 0, size)
+	for _, list := range lists {
+		out = append(out, list...)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i] < out[j] })
+	// Remove duplicates in place.
+	n := 0
+	for i := range out {
+		if i > 0 && out[i] == out[n-1] {
+			continue
+		}
+		out[n] = out[i]
+		n++
+	}
+	return out[:n]
+}
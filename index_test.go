@@ -0,0 +1,173 @@
+package embedtsdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestPostingsIndex() *postingsIndex {
+	index := newPostingsIndex()
+	index.add(marshalMetricName("cpu", []Label{{Name: "host", Value: "a"}, {Name: "region", Value: "us"}}))
+	index.add(marshalMetricName("cpu", []Label{{Name: "host", Value: "b"}, {Name: "region", Value: "eu"}}))
+	index.add(marshalMetricName("cpu", []Label{{Name: "host", Value: "c"}}))
+	index.add(marshalMetricName("mem", []Label{{Name: "host", Value: "a"}}))
+	index.add(marshalMetricName("up", nil))
+	return index
+}
+
+func Test_postingsIndex_match(t *testing.T) {
+	tests := []struct {
+		name     string
+		matchers []*Matcher
+		want     []string
+	}{
+		{
+			name:     "no matchers",
+			matchers: nil,
+			want: []string{
+				marshalMetricName("cpu", []Label{{Name: "host", Value: "a"}, {Name: "region", Value: "us"}}),
+				marshalMetricName("cpu", []Label{{Name: "host", Value: "b"}, {Name: "region", Value: "eu"}}),
+				marshalMetricName("cpu", []Label{{Name: "host", Value: "c"}}),
+				marshalMetricName("mem", []Label{{Name: "host", Value: "a"}}),
+				"up",
+			},
+		},
+		{
+			name:     "metric name",
+			matchers: []*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "up")},
+			want:     []string{"up"},
+		},
+		{
+			name: "metric name and label",
+			matchers: []*Matcher{
+				MustNewMatcher(MatchEqual, MetricNameLabel, "cpu"),
+				MustNewMatcher(MatchEqual, "host", "b"),
+			},
+			want: []string{marshalMetricName("cpu", []Label{{Name: "host", Value: "b"}, {Name: "region", Value: "eu"}})},
+		},
+		{
+			name:     "regexp across metrics",
+			matchers: []*Matcher{MustNewMatcher(MatchRegexp, "host", "a|c")},
+			want: []string{
+				marshalMetricName("cpu", []Label{{Name: "host", Value: "a"}, {Name: "region", Value: "us"}}),
+				marshalMetricName("cpu", []Label{{Name: "host", Value: "c"}}),
+				marshalMetricName("mem", []Label{{Name: "host", Value: "a"}}),
+			},
+		},
+		{
+			name: "not equal keeps series lacking the label",
+			matchers: []*Matcher{
+				MustNewMatcher(MatchEqual, MetricNameLabel, "cpu"),
+				MustNewMatcher(MatchNotEqual, "region", "us"),
+			},
+			want: []string{
+				marshalMetricName("cpu", []Label{{Name: "host", Value: "b"}, {Name: "region", Value: "eu"}}),
+				marshalMetricName("cpu", []Label{{Name: "host", Value: "c"}}),
+			},
+		},
+		{
+			name: "any value",
+			matchers: []*Matcher{
+				MustNewMatcher(MatchEqual, MetricNameLabel, "cpu"),
+				MustNewMatcher(MatchNotEqual, "region", ""),
+			},
+			want: []string{
+				marshalMetricName("cpu", []Label{{Name: "host", Value: "a"}, {Name: "region", Value: "us"}}),
+				marshalMetricName("cpu", []Label{{Name: "host", Value: "b"}, {Name: "region", Value: "eu"}}),
+			},
+		},
+		{
+			name:     "missing label",
+			matchers: []*Matcher{MustNewMatcher(MatchEqual, "region", "")},
+			want: []string{
+				marshalMetricName("cpu", []Label{{Name: "host", Value: "c"}}),
+				marshalMetricName("mem", []Label{{Name: "host", Value: "a"}}),
+				"up",
+			},
+		},
+		{
+			name:     "negated regexp",
+			matchers: []*Matcher{MustNewMatcher(MatchNotRegexp, MetricNameLabel, "cpu|mem")},
+			want:     []string{"up"},
+		},
+		{
+			name: "nothing matches",
+			matchers: []*Matcher{
+				MustNewMatcher(MatchEqual, MetricNameLabel, "mem"),
+				MustNewMatcher(MatchEqual, "host", "b"),
+			},
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			index := newTestPostingsIndex()
+			assert.Equal(t, tt.want, index.match(tt.matchers))
+		})
+	}
+}
+
+func Test_postingsIndex_writeTo_read(t *testing.T) {
+	index := newTestPostingsIndex()
+	up := marshalMetricName("up", nil)
+	metrics := map[string]diskMetric{
+		up: {Name: up, Chunks: []diskChunk{
+			{Offset: 0, MinTimestamp: 1, MaxTimestamp: 2, NumDataPoints: 120},
+			{Offset: 100, MinTimestamp: 3, MaxTimestamp: 4, NumDataPoints: 3},
+		}},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, index.writeTo(&buf, metrics))
+
+	got, err := readPostingsIndex(buf.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, index.names, got.names)
+	assert.Equal(t, index.postings, got.postings)
+
+	// Chunk references only locate chunks.
+	_, refs, err := decodeIndex(buf.Bytes())
+	require.NoError(t, err)
+	assert.Len(t, refs, len(index.names))
+	assert.Equal(t, []diskChunk{{Offset: 0, NumDataPoints: 120}, {Offset: 100, NumDataPoints: 3}}, refs[up])
+	assert.Empty(t, refs[index.names[0]])
+
+	// Truncated index must not be read.
+	_, err = readPostingsIndex(buf.Bytes()[:buf.Len()-1])
+	assert.Error(t, err)
+	_, err = readPostingsIndex([]byte("invalid"))
+	assert.Error(t, err)
+}
+
+func Test_decodeIndex_version1(t *testing.T) {
+	// Version 1 has no chunk references.
+	b := []byte(indexMagic)
+	b = append(b, 1)
+	b = binary.AppendUvarint(b, 1)
+	b = binary.AppendUvarint(b, 2)
+	b = append(b, "up"...)
+	b = binary.AppendUvarint(b, 1)
+	b = binary.AppendUvarint(b, uint64(len(MetricNameLabel)))
+	b = append(b, MetricNameLabel...)
+	b = binary.AppendUvarint(b, 1)
+	b = binary.AppendUvarint(b, 2)
+	b = append(b, "up"...)
+	b = binary.AppendUvarint(b, 1)
+	b = binary.AppendUvarint(b, 0)
+
+	got, refs, err := decodeIndex(b)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"up"}, got.names)
+	assert.Equal(t, map[string][]uint32{"up": {0}}, got.postings[MetricNameLabel])
+	assert.Nil(t, refs)
+}
+
+func TestMergePostings(t *testing.T) {
+	got := mergePostings([][]uint32{{1, 3, 5}, {2, 3, 6}, {0}})
+	assert.Equal(t, []uint32{0, 1, 2, 3, 5, 6}, got)
+	assert.Equal(t, []uint32{3}, intersectPostings([]uint32{1, 3, 5}, []uint32{2, 3, 6}))
+	assert.Equal(t, []uint32{1, 5}, subtractPostings([]uint32{1, 3, 5}, []uint32{2, 3, 6}))
+}
@@ -0,0 +1,105 @@
+package influx
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+const (
+	// The maximum size of a decompressed request body.
+	maxRequestSize = 32 << 20
+)
+
+type writeHandler struct {
+	storage embedtsdb.Storage
+}
+
+// NewWriteHandler gives back a handler that accepts the line protocol in the same manner as InfluxDB's /write.
+// The "precision" query parameter tells the unit of timestamps in the body, which is one of
+// "ns" (or "n"), "us" (or "u"), "ms", "s", "m" and "h". Defaults to "ns".
+// Timestamps are converted into the storage's precision. Gzip-compressed bodies are accepted as well.
+//
+// All rows in a request are inserted in one batch, and nothing is inserted if any line is malformed.
+func NewWriteHandler(storage embedtsdb.Storage) http.Handler {
+	return &writeHandler{
+		storage: storage,
+	}
+}
+
+func (h *writeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	unit, err := parsePrecision(r.URL.Query().Get("precision"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "failed to decompress request body: "+err.Error())
+			return
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxRequestSize+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read request body: "+err.Error())
+		return
+	}
+	if len(data) > maxRequestSize {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body is larger than %d bytes", maxRequestSize))
+		return
+	}
+
+	rows, err := Parse(data, unit, h.storage.TimestampPrecision())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(rows) > 0 {
+		if err := h.storage.InsertRows(rows); err != nil {
+			writeError(w, http.StatusInternalServerError, "failed to insert rows: "+err.Error())
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func parsePrecision(s string) (time.Duration, error) {
+	switch s {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	default:
+		return 0, fmt.Errorf("unknown precision %q", s)
+	}
+}
+
+// writeError responds with a JSON body like InfluxDB does.
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
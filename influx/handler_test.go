@@ -0,0 +1,81 @@
+package influx
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+func TestWriteHandler(t *testing.T) {
+	storage, err := embedtsdb.NewStorage(embedtsdb.WithTimestampPrecision(embedtsdb.Seconds))
+	require.NoError(t, err)
+	defer storage.Close()
+	server := httptest.NewServer(NewWriteHandler(storage))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/write?precision=ms", "text/plain", strings.NewReader(
+		"cpu,host=a usage=0.5,temp=40i 1600000000000\ncpu,host=a usage=0.6,temp=41i 1600000010000\n",
+	))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	points, err := storage.Select("cpu_temp", []embedtsdb.Label{{Name: "host", Value: "a"}}, 1600000000, 1600000020)
+	require.NoError(t, err)
+	assert.Equal(t, []*embedtsdb.DataPoint{{Timestamp: 1600000000, Value: 40}, {Timestamp: 1600000010, Value: 41}}, points)
+
+	// Gzip-compressed body
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte("mem,host=a used=1 1600000000"))
+	gz.Close()
+	req, err := http.NewRequest(http.MethodPost, server.URL+"/write?precision=s", &buf)
+	require.NoError(t, err)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	points, err = storage.Select("mem_used", []embedtsdb.Label{{Name: "host", Value: "a"}}, 1600000000, 1600000001)
+	require.NoError(t, err)
+	assert.Equal(t, []*embedtsdb.DataPoint{{Timestamp: 1600000000, Value: 1}}, points)
+}
+
+func TestWriteHandler_badRequests(t *testing.T) {
+	storage, err := embedtsdb.NewStorage()
+	require.NoError(t, err)
+	defer storage.Close()
+	server := httptest.NewServer(NewWriteHandler(storage))
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		url  string
+		body string
+		want int
+	}{
+		{name: "unknown precision", url: "/write?precision=d", body: "cpu value=1", want: http.StatusBadRequest},
+		{name: "malformed line", url: "/write", body: "cpu value=1\ncpu", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(server.URL+tt.url, "text/plain", strings.NewReader(tt.body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want, resp.StatusCode)
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		})
+	}
+
+	// Nothing is inserted from a request having a malformed line.
+	_, err = storage.Select("cpu_value", nil, 0, 1<<62)
+	assert.ErrorIs(t, err, embedtsdb.ErrNoDataPoints)
+}
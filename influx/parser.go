@@ -0,0 +1,162 @@
+// Package influx provides ingestion of the InfluxDB line protocol into a Storage.
+package influx
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+// Parse parses data in the line protocol into rows. A line looks like:
+//
+//	measurement,tag1=value1,tag2=value2 field1=1.5,field2=3i 1600000000000000000
+//
+// Each field becomes a row whose metric is the measurement and the field key joined by "_",
+// and tags become its labels. Integer, unsigned and float fields are taken as they are,
+// booleans are taken as 1 or 0, and string fields are skipped since they can't be stored.
+//
+// Timestamps given in the unit are converted into the precision. A line without timestamp
+// results in a row with the empty timestamp, which the storage fills in with the current time.
+// Empty lines and lines beginning with "#" are ignored.
+func Parse(data []byte, unit time.Duration, precision embedtsdb.TimestampPrecision) ([]embedtsdb.Row, error) {
+	rows := make([]embedtsdb.Row, 0)
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		var err error
+		rows, err = parseLine(rows, string(line), unit, precision)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+	return rows, nil
+}
+
+// parseLine appends rows parsed from the given line to dst.
+func parseLine(dst []embedtsdb.Row, line string, unit time.Duration, precision embedtsdb.TimestampPrecision) ([]embedtsdb.Row, error) {
+	sections := splitUnescaped(line, ' ')
+	// Consecutive spaces are allowed between sections.
+	nonEmpty := sections[:0]
+	for _, s := range sections {
+		if s != "" {
+			nonEmpty = append(nonEmpty, s)
+		}
+	}
+	sections = nonEmpty
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("expected measurement, fields and optional timestamp but got %d sections", len(sections))
+	}
+
+	key := splitUnescaped(sections[0], ',')
+	measurement := unescape(key[0])
+	if measurement == "" {
+		return nil, fmt.Errorf("missing measurement")
+	}
+	labels := make([]embedtsdb.Label, 0, len(key)-1)
+	for _, tag := range key[1:] {
+		kv := splitUnescaped(tag, '=')
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		labels = append(labels, embedtsdb.Label{Name: unescape(kv[0]), Value: unescape(kv[1])})
+	}
+
+	var timestamp int64
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		timestamp = embedtsdb.ConvertTimestamp(ts, unit, precision)
+	}
+
+	for _, field := range splitUnescaped(sections[1], ',') {
+		kv := splitUnescaped(field, '=')
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+		value, ok, err := parseFieldValue(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of field %q: %w", unescape(kv[0]), err)
+		}
+		if !ok {
+			continue
+		}
+		dst = append(dst, embedtsdb.Row{
+			Metric:    measurement + "_" + unescape(kv[0]),
+			Labels:    labels,
+			DataPoint: embedtsdb.DataPoint{Timestamp: timestamp, Value: value},
+		})
+	}
+	return dst, nil
+}
+
+// parseFieldValue gives back the numeric value of a field. ok will be false for string fields.
+func parseFieldValue(s string) (value float64, ok bool, err error) {
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	switch s[len(s)-1] {
+	case '"':
+		if len(s) < 2 || s[0] != '"' {
+			return 0, false, fmt.Errorf("unterminated string %s", s)
+		}
+		return 0, false, nil
+	case 'i':
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		if err != nil {
+			return 0, false, err
+		}
+		return float64(v), true, nil
+	case 'u':
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		if err != nil {
+			return 0, false, err
+		}
+		return float64(v), true, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return v, true, nil
+}
+
+// splitUnescaped splits s by sep, except for ones escaped by a backslash or enclosed in double quotes.
+func splitUnescaped(s string, sep byte) []string {
+	parts := make([]string, 0)
+	start := 0
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			quoted = !quoted
+		case sep:
+			if !quoted {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+var unescaper = strings.NewReplacer(`\,`, `,`, `\=`, `=`, `\ `, ` `, `\"`, `"`, `\\`, `\`)
+
+func unescape(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	return unescaper.Replace(s)
+}
@@ -0,0 +1,87 @@
+package influx
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		unit      time.Duration
+		precision embedtsdb.TimestampPrecision
+		want      []embedtsdb.Row
+		wantErr   bool
+	}{
+		{
+			name:      "multiple fields",
+			data:      "cpu,host=a,region=us usage_idle=90.5,usage_user=3i 1600000000000000000",
+			unit:      time.Nanosecond,
+			precision: embedtsdb.Nanoseconds,
+			want: []embedtsdb.Row{
+				{Metric: "cpu_usage_idle", Labels: []embedtsdb.Label{{Name: "host", Value: "a"}, {Name: "region", Value: "us"}}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000000000000, Value: 90.5}},
+				{Metric: "cpu_usage_user", Labels: []embedtsdb.Label{{Name: "host", Value: "a"}, {Name: "region", Value: "us"}}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000000000000, Value: 3}},
+			},
+		},
+		{
+			name:      "timestamps converted into the precision",
+			data:      "mem used=1u 1600000000000",
+			unit:      time.Millisecond,
+			precision: embedtsdb.Seconds,
+			want: []embedtsdb.Row{
+				{Metric: "mem_used", Labels: []embedtsdb.Label{}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000, Value: 1}},
+			},
+		},
+		{
+			name:      "coarser unit than the precision",
+			data:      "mem used=1 1600000000",
+			unit:      time.Second,
+			precision: embedtsdb.Milliseconds,
+			want: []embedtsdb.Row{
+				{Metric: "mem_used", Labels: []embedtsdb.Label{}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000000, Value: 1}},
+			},
+		},
+		{
+			name:      "booleans, strings and no timestamp",
+			data:      "# comment\n\nswitch,room=a on=true,label=\"living, room\",broken=F\n",
+			unit:      time.Nanosecond,
+			precision: embedtsdb.Nanoseconds,
+			want: []embedtsdb.Row{
+				{Metric: "switch_on", Labels: []embedtsdb.Label{{Name: "room", Value: "a"}}, DataPoint: embedtsdb.DataPoint{Value: 1}},
+				{Metric: "switch_broken", Labels: []embedtsdb.Label{{Name: "room", Value: "a"}}, DataPoint: embedtsdb.DataPoint{Value: 0}},
+			},
+		},
+		{
+			name:      "escaped characters",
+			data:      `disk\ io,path=C:\\data,dev\=ice=sd\,a read\ bytes=1 1`,
+			unit:      time.Nanosecond,
+			precision: embedtsdb.Nanoseconds,
+			want: []embedtsdb.Row{
+				{Metric: "disk io_read bytes", Labels: []embedtsdb.Label{{Name: "path", Value: `C:\data`}, {Name: "dev=ice", Value: "sd,a"}}, DataPoint: embedtsdb.DataPoint{Timestamp: 1, Value: 1}},
+			},
+		},
+		{name: "missing fields", data: "cpu,host=a", wantErr: true},
+		{name: "invalid tag", data: "cpu,host value=1", wantErr: true},
+		{name: "invalid field", data: "cpu value=abc", wantErr: true},
+		{name: "invalid integer", data: "cpu value=1.5i", wantErr: true},
+		{name: "invalid timestamp", data: "cpu value=1 now", wantErr: true},
+		{name: "too many sections", data: "cpu value=1 1 1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse([]byte(tt.data), tt.unit, tt.precision)
+			assert.Equal(t, tt.wantErr, err != nil)
+			if err != nil {
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
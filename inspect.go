@@ -0,0 +1,138 @@
+package embedtsdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// PartitionInfo describes a disk partition in a data directory.
+type PartitionInfo struct {
+	// Path is the directory of the partition.
+	Path          string
+	MinTimestamp  int64
+	MaxTimestamp  int64
+	NumDataPoints int
+	NumSeries     int
+	CreatedAt     time.Time
+	// Err is set if the metadata can't be read, in which case the other fields are left empty.
+	Err error
+}
+
+// ListPartitions gives back the disk partitions in the given data directory, which is the one given to WithDataPath,
+// by reading their metadata. Partitions are sorted by their minimum timestamp, and the broken ones come first.
+// It only reads files, so it's safe to call on a directory used by a running storage.
+func ListPartitions(dataPath string) ([]PartitionInfo, error) {
+	dirs, err := os.ReadDir(dataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data directory: %w", err)
+	}
+	partitions := make([]PartitionInfo, 0, len(dirs))
+	for _, e := range dirs {
+		if !e.IsDir() || !partitionDirRegex.MatchString(e.Name()) {
+			continue
+		}
+		info := PartitionInfo{Path: filepath.Join(dataPath, e.Name())}
+		m, err := readMeta(info.Path)
+		if err != nil {
+			info.Err = err
+			partitions = append(partitions, info)
+			continue
+		}
+		info.MinTimestamp = m.MinTimestamp
+		info.MaxTimestamp = m.MaxTimestamp
+		info.NumDataPoints = m.NumDataPoints
+		info.NumSeries = len(m.Metrics)
+		info.CreatedAt = m.CreatedAt
+		partitions = append(partitions, info)
+	}
+	sort.SliceStable(partitions, func(i, j int) bool {
+		if (partitions[i].Err != nil) != (partitions[j].Err != nil) {
+			return partitions[i].Err != nil
+		}
+		return partitions[i].MinTimestamp < partitions[j].MinTimestamp
+	})
+	return partitions, nil
+}
+
+// readMeta reads the meta file in the given partition directory.
+func readMeta(dirPath string) (*meta, error) {
+	b, err := os.ReadFile(filepath.Join(dirPath, metaFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("missing %s: %w", metaFileName, errInvalidPartition)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+	return decodeMeta(b, filepath.Join(dirPath, metaFileName))
+}
+
+// WALRecord is an insertion recorded in the write-ahead log.
+type WALRecord struct {
+	// Segment is the name of the segment file the record is in.
+	Segment string
+	Metric  string
+	Labels  []Label
+	DataPoint
+}
+
+// ReadWAL calls fn with each record in the write-ahead log of the given data directory, segment by segment.
+// A record torn at the end of a segment, which is left by a crash while writing, is ignored.
+// Iteration stops at the first corrupted segment or the first error fn gives back.
+func ReadWAL(dataPath string, fn func(rec *WALRecord) error) error {
+	dir := filepath.Join(dataPath, walDirName)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read the WAL dir: %w", err)
+	}
+	sortSegmentFiles(files)
+	for i, file := range files {
+		if file.IsDir() {
+			return fmt.Errorf("unexpected directory found under the WAL directory: %s", file.Name())
+		}
+		fd, err := os.Open(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to open WAL segment file: %w", err)
+		}
+		info, err := fd.Stat()
+		if err != nil {
+			fd.Close()
+			return fmt.Errorf("failed to fetch file info: %w", err)
+		}
+		seg := &segment{
+			file: fd,
+			path: fd.Name(),
+			r:    bufio.NewReader(fd),
+			size: info.Size(),
+			last: i == len(files)-1,
+		}
+		for seg.next() {
+			for _, row := range seg.record().rows {
+				metric, labels := unmarshalMetricName(row.Metric)
+				err := fn(&WALRecord{
+					Segment:   file.Name(),
+					Metric:    metric,
+					Labels:    labels,
+					DataPoint: row.DataPoint,
+				})
+				if err != nil {
+					seg.close()
+					return err
+				}
+			}
+		}
+		if err := seg.close(); err != nil {
+			return err
+		}
+		err = seg.error()
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("failed to read WAL segment file %q: %w", file.Name(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package embedtsdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListPartitions(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 1}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}, DataPoint: DataPoint{Timestamp: 1600000010, Value: 2}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000020, Value: 3}},
+	}))
+	require.NoError(t, s.Close())
+	require.NoError(t, os.Mkdir(filepath.Join(tmpDir, "p-1-2"), 0755))
+
+	got, err := ListPartitions(tmpDir)
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.Equal(t, filepath.Join(tmpDir, "p-1-2"), got[0].Path)
+	assert.ErrorIs(t, got[0].Err, errInvalidPartition)
+	assert.Equal(t, filepath.Join(tmpDir, "p-1600000000-1600000020"), got[1].Path)
+	assert.NoError(t, got[1].Err)
+	assert.Equal(t, int64(1600000000), got[1].MinTimestamp)
+	assert.Equal(t, int64(1600000020), got[1].MaxTimestamp)
+	assert.Equal(t, 3, got[1].NumDataPoints)
+	assert.Equal(t, 2, got[1].NumSeries)
+	assert.False(t, got[1].CreatedAt.IsZero())
+
+	_, err = ListPartitions(filepath.Join(tmpDir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestReadWAL(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithWALBufferedSize(0))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 1}},
+		{Metric: "mem", DataPoint: DataPoint{Timestamp: 1600000010, Value: 2}},
+	}))
+
+	got := make([]*WALRecord, 0)
+	err = ReadWAL(tmpDir, func(rec *WALRecord) error {
+		got = append(got, rec)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []*WALRecord{
+		{Segment: "0", Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 1}},
+		{Segment: "0", Metric: "mem", DataPoint: DataPoint{Timestamp: 1600000010, Value: 2}},
+	}, got)
+	require.NoError(t, s.Close())
+
+	err = ReadWAL(filepath.Join(tmpDir, "missing"), func(rec *WALRecord) error { return nil })
+	assert.Error(t, err)
+}
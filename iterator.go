@@ -0,0 +1,297 @@
+package embedtsdb
+
+import (
+	"container/heap"
+)
+
+// Iterator iterates over data points of a series in ascending order of timestamps,
+// without materializing all of them at once. The basic usage is:
+/*
+  for it.Next() {
+    timestamp, value := it.At()
+    // Do something with the data point
+  }
+  if err := it.Err(); err != nil {
+    // Handle the error
+  }
+*/
+// An iterator holds on to the partitions it reads from until it's exhausted, so Close it if giving up halfway.
+type Iterator interface {
+	// Next advances the iterator to the next data point.
+	// The return value will be false if no more data point is left or an error occurred.
+	Next() bool
+	// At gives back the current data point.
+	At() (timestamp int64, value float64)
+	// Err gives back the error that stopped the iteration, if any.
+	Err() error
+	// Close releases resources held by the iterator. It can be called more than once.
+	Close() error
+}
+
+// SeriesIterator is an Iterator which also tells which series it belongs to.
+type SeriesIterator interface {
+	Iterator
+	// Metric gives back the metric name of the series.
+	Metric() string
+	// Labels gives back the label set of the series sorted by name.
+	Labels() []Label
+}
+
+// SeriesSet iterates over series, sorted by metric and then by labels.
+// Like Iterator, it holds on to the partitions it reads from until it's exhausted, so Close it if giving up halfway.
+type SeriesSet interface {
+	// Next advances the set to the next series.
+	Next() bool
+	// At gives back the current series, which can't be read after the set is closed.
+	At() SeriesIterator
+	// Err gives back the error that stopped the iteration, if any.
+	Err() error
+	// Close releases resources held by the set. It can be called more than once.
+	Close() error
+}
+
+// emptyIterator is an Iterator that has no data points.
+type emptyIterator struct{}
+
+func (emptyIterator) Next() bool           { return false }
+func (emptyIterator) At() (int64, float64) { return 0, 0 }
+func (emptyIterator) Err() error           { return nil }
+func (emptyIterator) Close() error         { return nil }
+
+// sliceIterator is an Iterator over data points already in memory.
+type sliceIterator struct {
+	points []*DataPoint
+	i      int
+}
+
+func newSliceIterator(points []*DataPoint) Iterator {
+	return &sliceIterator{points: points, i: -1}
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.i+1 >= len(it.points) {
+		return false
+	}
+	it.i++
+	return true
+}
+
+func (it *sliceIterator) At() (int64, float64) {
+	p := it.points[it.i]
+	return p.Timestamp, p.Value
+}
+
+func (it *sliceIterator) Err() error {
+	return nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+// mergeIterator merges the given iterators into one in ascending order of timestamps.
+// Partitions can overlap each other because out-of-order points are inserted into non-head ones.
+type mergeIterator struct {
+	its         []Iterator
+	h           iteratorHeap
+	initialized bool
+	cur         Iterator
+	err         error
+}
+
+func newMergeIterator(its []Iterator) Iterator {
+	switch len(its) {
+	case 0:
+		return emptyIterator{}
+	case 1:
+		return its[0]
+	}
+	return &mergeIterator{its: its}
+}
+
+func (it *mergeIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.initialized {
+		it.initialized = true
+		for _, i := range it.its {
+			if i.Next() {
+				it.h = append(it.h, i)
+				continue
+			}
+			if err := i.Err(); err != nil {
+				it.err = err
+				return false
+			}
+		}
+		heap.Init(&it.h)
+	} else if it.cur != nil {
+		if it.cur.Next() {
+			heap.Fix(&it.h, 0)
+		} else {
+			if err := it.cur.Err(); err != nil {
+				it.err = err
+				return false
+			}
+			heap.Pop(&it.h)
+		}
+	}
+	if len(it.h) == 0 {
+		it.cur = nil
+		return false
+	}
+	it.cur = it.h[0]
+	return true
+}
+
+func (it *mergeIterator) At() (int64, float64) {
+	return it.cur.At()
+}
+
+func (it *mergeIterator) Err() error {
+	return it.err
+}
+
+func (it *mergeIterator) Close() error {
+	var err error
+	for _, i := range it.its {
+		if e := i.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// iteratorHeap is a min-heap of iterators ordered by the timestamp they are positioned at.
+type iteratorHeap []Iterator
+
+func (h iteratorHeap) Len() int { return len(h) }
+
+func (h iteratorHeap) Less(i, j int) bool {
+	ti, _ := h[i].At()
+	tj, _ := h[j].At()
+	return ti < tj
+}
+
+func (h iteratorHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *iteratorHeap) Push(x interface{}) {
+	*h = append(*h, x.(Iterator))
+}
+
+func (h *iteratorHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// seriesIterator attaches the series identity to an Iterator.
+type seriesIterator struct {
+	Iterator
+	metric string
+	labels []Label
+}
+
+func (s *seriesIterator) Metric() string {
+	return s.metric
+}
+
+func (s *seriesIterator) Labels() []Label {
+	return s.labels
+}
+
+// seriesSet lazily builds an iterator for each series, so that only one series is decoded at a time.
+type seriesSet struct {
+	// names of series in order to be given back.
+	names []string
+	// partitions that overlap the queried range, which are released once the set is exhausted.
+	partitions []partition
+	start, end int64
+
+	cur      SeriesIterator
+	err      error
+	released bool
+}
+
+func (s *seriesSet) Next() bool {
+	if s.released {
+		return false
+	}
+	if s.err != nil || len(s.names) == 0 {
+		if err := s.Close(); err != nil && s.err == nil {
+			s.err = err
+		}
+		return false
+	}
+	name := s.names[0]
+	s.names = s.names[1:]
+	it, err := selectIterator(s.partitions, name, s.start, s.end)
+	if err != nil {
+		s.err = err
+		return false
+	}
+	metric, labels := unmarshalMetricName(name)
+	s.cur = &seriesIterator{
+		Iterator: it,
+		metric:   metric,
+		labels:   labels,
+	}
+	return true
+}
+
+func (s *seriesSet) At() SeriesIterator {
+	return s.cur
+}
+
+func (s *seriesSet) Err() error {
+	return s.err
+}
+
+func (s *seriesSet) Close() error {
+	if s.released {
+		return nil
+	}
+	s.released = true
+	return releasePartitions(s.partitions)
+}
+
+// partitionsIterator releases the partitions it reads from once it's exhausted or closed.
+type partitionsIterator struct {
+	Iterator
+	partitions []partition
+	err        error
+	released   bool
+}
+
+func (it *partitionsIterator) Next() bool {
+	if it.released {
+		return false
+	}
+	if it.Iterator.Next() {
+		return true
+	}
+	it.err = it.Close()
+	return false
+}
+
+func (it *partitionsIterator) Err() error {
+	if err := it.Iterator.Err(); err != nil {
+		return err
+	}
+	return it.err
+}
+
+func (it *partitionsIterator) Close() error {
+	if it.released {
+		return nil
+	}
+	it.released = true
+	err := it.Iterator.Close()
+	if e := releasePartitions(it.partitions); err == nil {
+		err = e
+	}
+	return err
+}
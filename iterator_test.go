@@ -0,0 +1,189 @@
+package embedtsdb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// collectPoints drains the given iterator.
+func collectPoints(t *testing.T, it Iterator) []DataPoint {
+	t.Helper()
+	points := make([]DataPoint, 0)
+	for it.Next() {
+		timestamp, value := it.At()
+		points = append(points, DataPoint{Timestamp: timestamp, Value: value})
+	}
+	require.NoError(t, it.Err())
+	return points
+}
+
+type errIterator struct {
+	emptyIterator
+	err error
+}
+
+func (e *errIterator) Err() error {
+	return e.err
+}
+
+func Test_mergeIterator(t *testing.T) {
+	tests := []struct {
+		name    string
+		its     []Iterator
+		want    []DataPoint
+		wantErr bool
+	}{
+		{
+			name: "no iterators",
+			want: []DataPoint{},
+		},
+		{
+			name: "non-overlapping",
+			its: []Iterator{
+				newSliceIterator([]*DataPoint{{Timestamp: 1}, {Timestamp: 2}}),
+				newSliceIterator([]*DataPoint{{Timestamp: 3}, {Timestamp: 4}}),
+			},
+			want: []DataPoint{{Timestamp: 1}, {Timestamp: 2}, {Timestamp: 3}, {Timestamp: 4}},
+		},
+		{
+			name: "overlapping",
+			its: []Iterator{
+				newSliceIterator([]*DataPoint{{Timestamp: 3, Value: 0.3}, {Timestamp: 6, Value: 0.6}}),
+				newSliceIterator([]*DataPoint{{Timestamp: 1, Value: 0.1}, {Timestamp: 4, Value: 0.4}, {Timestamp: 5, Value: 0.5}}),
+				newSliceIterator([]*DataPoint{}),
+				newSliceIterator([]*DataPoint{{Timestamp: 2, Value: 0.2}}),
+			},
+			want: []DataPoint{
+				{Timestamp: 1, Value: 0.1},
+				{Timestamp: 2, Value: 0.2},
+				{Timestamp: 3, Value: 0.3},
+				{Timestamp: 4, Value: 0.4},
+				{Timestamp: 5, Value: 0.5},
+				{Timestamp: 6, Value: 0.6},
+			},
+		},
+		{
+			name: "error",
+			its: []Iterator{
+				newSliceIterator([]*DataPoint{{Timestamp: 1}}),
+				&errIterator{err: errors.New("error")},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			it := newMergeIterator(tt.its)
+			if tt.wantErr {
+				for it.Next() {
+				}
+				assert.Error(t, it.Err())
+				return
+			}
+			assert.Equal(t, tt.want, collectPoints(t, it))
+		})
+	}
+}
+
+func Test_diskPartition_selectIterator(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "p-1-5")
+	mem := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+	_, err := mem.insertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1, Value: 0.1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2, Value: 0.2}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 3, Value: 0.3}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 5, Value: 0.5}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 4, Value: 0.4}},
+	})
+	require.NoError(t, err)
+	s := &storage{logger: &nopLogger{}}
+	require.NoError(t, s.flush(dir, mem))
+	part, err := openDiskPartition(dir, 24*time.Hour)
+	require.NoError(t, err)
+	defer part.clean()
+
+	it, err := part.selectIterator("metric1", 2, 5)
+	require.NoError(t, err)
+	assert.Equal(t, []DataPoint{{Timestamp: 2, Value: 0.2}, {Timestamp: 3, Value: 0.3}}, collectPoints(t, it))
+
+	it, err = part.selectIterator("unknown", 0, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []DataPoint{}, collectPoints(t, it))
+}
+
+func Test_storage_SelectIterator(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := []Option{
+		WithDataPath(tmpDir),
+		WithPartitionDuration(10 * time.Second),
+		WithTimestampPrecision(Seconds),
+	}
+	labels := []Label{{Name: "host", Value: "a"}}
+	want := make([]DataPoint, 0)
+	insert := func(s Storage, from, to int64) {
+		for timestamp := from; timestamp < to; timestamp++ {
+			row := Row{Metric: "metric1", Labels: labels, DataPoint: DataPoint{Timestamp: timestamp, Value: float64(timestamp % 7)}}
+			require.NoError(t, s.InsertRows([]Row{row}))
+			if timestamp >= 1600000005 && timestamp < 1600000045 {
+				want = append(want, row.DataPoint)
+			}
+		}
+	}
+
+	// Persist the first half into disk partitions.
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	insert(s, 1600000000, 1600000025)
+	require.NoError(t, s.Close())
+
+	// Keep the second half in memory partitions.
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	insert(s, 1600000025, 1600000050)
+	assert.Contains(t, s.(*storage).partitionList.String(), "[Disk Partition]")
+
+	it, err := s.SelectIterator("metric1", labels, 1600000005, 1600000045)
+	require.NoError(t, err)
+	assert.Equal(t, want, collectPoints(t, it))
+
+	it, err = s.SelectIterator("unknown", nil, 1600000005, 1600000045)
+	require.NoError(t, err)
+	assert.False(t, it.Next())
+}
+
+func Test_storage_SelectSeriesSet(t *testing.T) {
+	s, err := NewStorage(WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.2}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000001, Value: 0.3}},
+		{Metric: "mem", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.4}},
+	}))
+
+	set, err := s.SelectSeriesSet([]*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "cpu")}, 1600000000, 1600000010)
+	require.NoError(t, err)
+	got := make([]*Series, 0)
+	for set.Next() {
+		it := set.At()
+		series := &Series{Metric: it.Metric(), Labels: it.Labels()}
+		for _, p := range collectPoints(t, it) {
+			p := p
+			series.Points = append(series.Points, &p)
+		}
+		got = append(got, series)
+	}
+	require.NoError(t, set.Err())
+	want := []*Series{
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, Points: []*DataPoint{{Timestamp: 1600000000, Value: 0.1}, {Timestamp: 1600000001, Value: 0.3}}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}, Points: []*DataPoint{{Timestamp: 1600000000, Value: 0.2}}},
+	}
+	assert.Equal(t, want, got)
+}
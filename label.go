@@ -2,6 +2,7 @@ package embedtsdb
 
 import (
 	"sort"
+	"strings"
 	"sync"
 
 	"github.com/yudaprama/embedtsdb/internal/encoding"
@@ -83,3 +84,51 @@ func marshalMetricName(metric string, labels []Label) string {
 	// Copy bytes to string to avoid referencing pooled buffer after return
 	return string(append([]byte(nil), out...))
 }
+
+// unmarshalMetricName restores the metric and labels from the bytes built by marshalMetricName.
+// Names without any labels are kept as is by marshalMetricName, so the given name is
+// treated as a bare metric if it doesn't look like the encoded form.
+func unmarshalMetricName(name string) (string, []Label) {
+	metric, rest, ok := unmarshalLabelString(name)
+	if !ok {
+		return name, nil
+	}
+	labels := make([]Label, 0, 4)
+	for len(rest) > 0 {
+		var label Label
+		if label.Name, rest, ok = unmarshalLabelString(rest); !ok {
+			return name, nil
+		}
+		if label.Value, rest, ok = unmarshalLabelString(rest); !ok {
+			return name, nil
+		}
+		labels = append(labels, label)
+	}
+	return metric, labels
+}
+
+// unmarshalLabelString reads a string prefixed with its uint16 length, and gives back the rest.
+func unmarshalLabelString(src string) (string, string, bool) {
+	if len(src) < 2 {
+		return "", src, false
+	}
+	n := int(encoding.UnmarshalUint16([]byte(src[:2])))
+	if len(src) < 2+n {
+		return "", src, false
+	}
+	return src[2 : 2+n], src[2+n:], true
+}
+
+// CompareLabels compares two label sets sorted by name, in lexicographic order.
+// The result is negative if a sorts before b, positive if after, and zero if they're equal.
+func CompareLabels(a, b []Label) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Name != b[i].Name {
+			return strings.Compare(a[i].Name, b[i].Name)
+		}
+		if a[i].Value != b[i].Value {
+			return strings.Compare(a[i].Value, b[i].Value)
+		}
+	}
+	return len(a) - len(b)
+}
@@ -52,3 +52,44 @@ func TestMarshalMetricName(t *testing.T) {
 		})
 	}
 }
+
+func TestUnmarshalMetricName(t *testing.T) {
+	tests := []struct {
+		name       string
+		metric     string
+		labels     []Label
+		wantLabels []Label
+	}{
+		{
+			name:   "only metric",
+			metric: "metric1",
+		},
+		{
+			name:   "invalid labels only",
+			metric: "metric1",
+			labels: []Label{
+				{Name: "name1"},
+			},
+			wantLabels: []Label{},
+		},
+		{
+			name:   "multiple labels",
+			metric: "metric1",
+			labels: []Label{
+				{Name: "name2", Value: "value2"},
+				{Name: "name1", Value: "value1"},
+			},
+			wantLabels: []Label{
+				{Name: "name1", Value: "value1"},
+				{Name: "name2", Value: "value2"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotMetric, gotLabels := unmarshalMetricName(marshalMetricName(tt.metric, tt.labels))
+			assert.Equal(t, tt.metric, gotMetric)
+			assert.Equal(t, tt.wantLabels, gotLabels)
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package listener
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+// NewGraphiteServer gives back a server accepting the Graphite plaintext protocol, whose lines look like:
+//
+//	servers.web1.cpu.usage 0.5 1600000000
+//	servers.cpu.usage;host=web1;region=us 0.5 1600000000
+//
+// The path becomes the metric as it is, and tags given in the tagged syntax become labels.
+// Timestamps are in seconds; a missing or negative one means the current time.
+func NewGraphiteServer(storage embedtsdb.Storage, opts ...Option) *Server {
+	return newServer(storage, ParseGraphite, opts)
+}
+
+// ParseGraphite parses a line of the Graphite plaintext protocol into a row.
+// ok will be false for empty lines.
+func ParseGraphite(line string, precision embedtsdb.TimestampPrecision) (row embedtsdb.Row, ok bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return embedtsdb.Row{}, false, nil
+	}
+	if len(fields) < 2 || len(fields) > 3 {
+		return embedtsdb.Row{}, false, fmt.Errorf("expected path, value and optional timestamp but got %q", line)
+	}
+
+	segments := strings.Split(fields[0], ";")
+	if segments[0] == "" {
+		return embedtsdb.Row{}, false, fmt.Errorf("empty path in %q", line)
+	}
+	row.Metric = segments[0]
+	row.Labels = make([]embedtsdb.Label, 0, len(segments)-1)
+	for _, tag := range segments[1:] {
+		name, value, found := strings.Cut(tag, "=")
+		if !found || name == "" || value == "" {
+			return embedtsdb.Row{}, false, fmt.Errorf("invalid tag %q", tag)
+		}
+		row.Labels = append(row.Labels, embedtsdb.Label{Name: name, Value: value})
+	}
+
+	row.Value, err = strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return embedtsdb.Row{}, false, fmt.Errorf("invalid value %q", fields[1])
+	}
+	if len(fields) == 3 {
+		row.Timestamp, err = parseSeconds(fields[2], precision)
+		if err != nil {
+			return embedtsdb.Row{}, false, err
+		}
+	}
+	return row, true, nil
+}
+
+// parseSeconds parses a timestamp in seconds, which can be fractional, into the precision.
+// A negative timestamp results in zero, which the storage fills in with the current time.
+func parseSeconds(s string, precision embedtsdb.TimestampPrecision) (int64, error) {
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		if ts < 0 {
+			return 0, nil
+		}
+		return embedtsdb.ConvertTimestamp(ts, time.Second, precision), nil
+	}
+	ts, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(ts) || math.IsInf(ts, 0) {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	if ts < 0 {
+		return 0, nil
+	}
+	return embedtsdb.ConvertTimestamp(int64(ts*1e3), time.Millisecond, precision), nil
+}
@@ -0,0 +1,61 @@
+package listener
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+func TestParseGraphite(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    embedtsdb.Row
+		wantOK  bool
+		wantErr bool
+	}{
+		{
+			name:   "plain",
+			line:   "servers.web1.cpu 0.5 1600000000",
+			want:   embedtsdb.Row{Metric: "servers.web1.cpu", Labels: []embedtsdb.Label{}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000, Value: 0.5}},
+			wantOK: true,
+		},
+		{
+			name:   "tagged",
+			line:   "servers.cpu;host=web1;region=us 2 1600000000",
+			want:   embedtsdb.Row{Metric: "servers.cpu", Labels: []embedtsdb.Label{{Name: "host", Value: "web1"}, {Name: "region", Value: "us"}}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000, Value: 2}},
+			wantOK: true,
+		},
+		{
+			name:   "fractional timestamp",
+			line:   "cpu 1 1600000000.5",
+			want:   embedtsdb.Row{Metric: "cpu", Labels: []embedtsdb.Label{}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000, Value: 1}},
+			wantOK: true,
+		},
+		{
+			name:   "current time",
+			line:   "cpu 1 -1",
+			want:   embedtsdb.Row{Metric: "cpu", Labels: []embedtsdb.Label{}, DataPoint: embedtsdb.DataPoint{Value: 1}},
+			wantOK: true,
+		},
+		{name: "empty", line: "  "},
+		{name: "missing value", line: "cpu", wantErr: true},
+		{name: "invalid value", line: "cpu abc 1", wantErr: true},
+		{name: "invalid timestamp", line: "cpu 1 now", wantErr: true},
+		{name: "invalid tag", line: "cpu;host 1 1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := ParseGraphite(tt.line, embedtsdb.Seconds)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	got, _, err := ParseGraphite("cpu 1 1600000000", embedtsdb.Nanoseconds)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1600000000000000000), got.Timestamp)
+}
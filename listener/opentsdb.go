@@ -0,0 +1,55 @@
+package listener
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+// NewOpenTSDBServer gives back a server accepting the "put" command of the OpenTSDB telnet protocol, whose lines look like:
+//
+//	put sys.cpu.user 1600000000 42.5 host=web1 cpu=0
+//
+// Timestamps are in seconds, or in milliseconds if they have more than 10 digits. Other commands are ignored.
+func NewOpenTSDBServer(storage embedtsdb.Storage, opts ...Option) *Server {
+	return newServer(storage, ParseOpenTSDB, opts)
+}
+
+// ParseOpenTSDB parses a line of the OpenTSDB telnet protocol into a row.
+// ok will be false for empty lines and commands other than "put".
+func ParseOpenTSDB(line string, precision embedtsdb.TimestampPrecision) (row embedtsdb.Row, ok bool, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != "put" {
+		return embedtsdb.Row{}, false, nil
+	}
+	if len(fields) < 4 {
+		return embedtsdb.Row{}, false, fmt.Errorf("expected put <metric> <timestamp> <value> <tags> but got %q", line)
+	}
+
+	row.Metric = fields[1]
+	ts, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || ts < 0 {
+		return embedtsdb.Row{}, false, fmt.Errorf("invalid timestamp %q", fields[2])
+	}
+	unit := time.Second
+	if len(fields[2]) > 10 {
+		unit = time.Millisecond
+	}
+	row.Timestamp = embedtsdb.ConvertTimestamp(ts, unit, precision)
+	row.Value, err = strconv.ParseFloat(fields[3], 64)
+	if err != nil {
+		return embedtsdb.Row{}, false, fmt.Errorf("invalid value %q", fields[3])
+	}
+	row.Labels = make([]embedtsdb.Label, 0, len(fields)-4)
+	for _, tag := range fields[4:] {
+		name, value, found := strings.Cut(tag, "=")
+		if !found || name == "" || value == "" {
+			return embedtsdb.Row{}, false, fmt.Errorf("invalid tag %q", tag)
+		}
+		row.Labels = append(row.Labels, embedtsdb.Label{Name: name, Value: value})
+	}
+	return row, true, nil
+}
@@ -0,0 +1,46 @@
+package listener
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+func TestParseOpenTSDB(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    embedtsdb.Row
+		wantOK  bool
+		wantErr bool
+	}{
+		{
+			name:   "seconds",
+			line:   "put sys.cpu.user 1600000000 42.5 host=web1 cpu=0",
+			want:   embedtsdb.Row{Metric: "sys.cpu.user", Labels: []embedtsdb.Label{{Name: "host", Value: "web1"}, {Name: "cpu", Value: "0"}}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000000, Value: 42.5}},
+			wantOK: true,
+		},
+		{
+			name:   "milliseconds",
+			line:   "put sys.cpu.user 1600000000123 1",
+			want:   embedtsdb.Row{Metric: "sys.cpu.user", Labels: []embedtsdb.Label{}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000123, Value: 1}},
+			wantOK: true,
+		},
+		{name: "other command", line: "version"},
+		{name: "empty", line: ""},
+		{name: "missing value", line: "put cpu 1600000000", wantErr: true},
+		{name: "invalid timestamp", line: "put cpu now 1", wantErr: true},
+		{name: "invalid value", line: "put cpu 1600000000 abc", wantErr: true},
+		{name: "invalid tag", line: "put cpu 1600000000 1 host", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := ParseOpenTSDB(tt.line, embedtsdb.Milliseconds)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,240 @@
+// Package listener provides TCP listeners that accept line-based metrics, such as Graphite plaintext
+// and the OpenTSDB telnet protocol, and insert them into a Storage.
+package listener
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+const (
+	defaultBatchSize     = 1000
+	defaultFlushInterval = time.Second
+	// Longer lines are dropped.
+	maxLineLength = 64 * 1024
+)
+
+// ErrServerClosed is returned by Serve after the server has been closed.
+var ErrServerClosed = errors.New("listener: server closed")
+
+// Option is an optional setting for servers.
+type Option func(*Server)
+
+// WithBatchSize specifies the number of rows each connection buffers before inserting them at once.
+//
+// Defaults to 1000.
+func WithBatchSize(size int) Option {
+	return func(s *Server) {
+		s.batchSize = size
+	}
+}
+
+// WithFlushInterval specifies how long buffered rows can wait before being inserted even if the batch isn't full.
+//
+// Defaults to 1s.
+func WithFlushInterval(interval time.Duration) Option {
+	return func(s *Server) {
+		s.flushInterval = interval
+	}
+}
+
+// WithLogger specifies the logger to emit malformed lines and failed inserts.
+//
+// Defaults to a logger implementation that does nothing.
+func WithLogger(logger embedtsdb.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// parseFunc parses a line into a row. ok will be false for lines to be ignored.
+type parseFunc func(line string, precision embedtsdb.TimestampPrecision) (row embedtsdb.Row, ok bool, err error)
+
+// Server accepts newline-delimited metrics over TCP, and inserts them into the storage in batches.
+// Timestamps are converted into the storage's precision.
+//
+// Each connection is read sequentially, and InsertRows blocks while the storage is busy for up to its write timeout,
+// given by embedtsdb.WithWriteTimeout. So overloaded storage slows down reading, which pushes back on senders through TCP.
+// A batch that couldn't be inserted in time is dropped and logged.
+type Server struct {
+	storage       embedtsdb.Storage
+	parse         parseFunc
+	precision     embedtsdb.TimestampPrecision
+	batchSize     int
+	flushInterval time.Duration
+	logger        embedtsdb.Logger
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+func newServer(storage embedtsdb.Storage, parse parseFunc, opts []Option) *Server {
+	s := &Server{
+		storage:       storage,
+		parse:         parse,
+		precision:     storage.TimestampPrecision(),
+		batchSize:     defaultBatchSize,
+		flushInterval: defaultFlushInterval,
+		logger:        log.New(io.Discard, "", 0),
+		listeners:     make(map[net.Listener]struct{}),
+		conns:         make(map[net.Conn]struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// ListenAndServe listens on the given TCP address and then calls Serve.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the given listener, and handles each of them in a new goroutine.
+// It always returns a non-nil error, which is ErrServerClosed after Close.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			delete(s.listeners, l)
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections, closes active ones, and waits for their buffered rows to be inserted.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	batch := make([]embedtsdb.Row, 0, s.batchSize)
+	lastFlush := time.Now()
+	flush := func() {
+		lastFlush = time.Now()
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.storage.InsertRows(batch); err != nil {
+			s.logger.Printf("failed to insert %d rows from %s: %v\n", len(batch), conn.RemoteAddr(), err)
+		}
+		batch = make([]embedtsdb.Row, 0, s.batchSize)
+	}
+	parseLine := func(line []byte) {
+		row, ok, err := s.parse(string(line), s.precision)
+		if err != nil {
+			s.logger.Printf("malformed line from %s: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+		if ok {
+			batch = append(batch, row)
+		}
+	}
+
+	var (
+		line     []byte
+		tooLong  bool
+		deadline = func() time.Time { return lastFlush.Add(s.flushInterval) }
+	)
+	for {
+		conn.SetReadDeadline(deadline())
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+		}
+		if len(line) > maxLineLength {
+			tooLong = true
+			line = line[:0]
+		}
+		switch {
+		case err == nil:
+			if tooLong {
+				s.logger.Printf("dropped a line longer than %d bytes from %s\n", maxLineLength, conn.RemoteAddr())
+			} else {
+				parseLine(line)
+			}
+			line, tooLong = line[:0], false
+			if len(batch) >= s.batchSize || !time.Now().Before(deadline()) {
+				flush()
+			}
+		case errors.Is(err, bufio.ErrBufferFull):
+			// The rest of the line is yet to be read.
+		case isTimeout(err):
+			flush()
+		default:
+			// The last line may lack the newline.
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				s.logger.Printf("failed to read from %s: %v\n", conn.RemoteAddr(), err)
+			}
+			if len(line) > 0 && !tooLong {
+				parseLine(line)
+			}
+			flush()
+			return
+		}
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
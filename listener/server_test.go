@@ -0,0 +1,147 @@
+package listener
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+// startServer serves the given server on a random port, and gives back its address.
+func startServer(t *testing.T, s *Server) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(l) }()
+	t.Cleanup(func() {
+		s.Close()
+		assert.ErrorIs(t, <-done, ErrServerClosed)
+	})
+	return l.Addr().String()
+}
+
+func send(t *testing.T, addr, data string) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+}
+
+func TestGraphiteServer(t *testing.T) {
+	storage, err := embedtsdb.NewStorage(embedtsdb.WithTimestampPrecision(embedtsdb.Seconds))
+	require.NoError(t, err)
+	defer storage.Close()
+	logger := &testLogger{}
+	addr := startServer(t, NewGraphiteServer(storage, WithLogger(logger)))
+
+	// The last line lacks the newline.
+	send(t, addr, "cpu;host=a 1 1600000000\nmalformed\ncpu;host=a 2 1600000010")
+
+	require.Eventually(t, func() bool {
+		points, err := storage.Select("cpu", []embedtsdb.Label{{Name: "host", Value: "a"}}, 1600000000, 1600000020)
+		return err == nil && len(points) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, logger.String(), "malformed line")
+}
+
+func TestOpenTSDBServer_flushInterval(t *testing.T) {
+	storage, err := embedtsdb.NewStorage(embedtsdb.WithTimestampPrecision(embedtsdb.Seconds))
+	require.NoError(t, err)
+	defer storage.Close()
+	addr := startServer(t, NewOpenTSDBServer(storage,
+		WithFlushInterval(10*time.Millisecond),
+	))
+
+	// Rows must be inserted while the connection is still open.
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("put sys.cpu 1600000000 42 host=a\n"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		points, err := storage.Select("sys.cpu", []embedtsdb.Label{{Name: "host", Value: "a"}}, 1600000000, 1600000001)
+		return err == nil && len(points) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestServer_batchSize(t *testing.T) {
+	storage, err := embedtsdb.NewStorage(embedtsdb.WithTimestampPrecision(embedtsdb.Seconds))
+	require.NoError(t, err)
+	defer storage.Close()
+	counting := &countingStorage{Storage: storage}
+	addr := startServer(t, NewGraphiteServer(counting,
+		WithBatchSize(10),
+		WithFlushInterval(time.Hour),
+	))
+
+	var b strings.Builder
+	for i := 0; i < 25; i++ {
+		fmt.Fprintf(&b, "cpu %d %d\n", i, 1600000000+i)
+	}
+	send(t, addr, b.String())
+
+	require.Eventually(t, func() bool {
+		points, err := storage.Select("cpu", nil, 1600000000, 1600000025)
+		return err == nil && len(points) == 25
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []int{10, 10, 5}, counting.batches())
+}
+
+func TestServer_insertFailure(t *testing.T) {
+	storage, err := embedtsdb.NewStorage()
+	require.NoError(t, err)
+	require.NoError(t, storage.Close())
+	logger := &testLogger{}
+	addr := startServer(t, NewGraphiteServer(storage, WithLogger(logger)))
+
+	send(t, addr, "cpu 1 1600000000\n")
+	require.Eventually(t, func() bool {
+		return strings.Contains(logger.String(), "failed to insert 1 rows")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+type testLogger struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (l *testLogger) Printf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(&l.b, format, v...)
+}
+
+func (l *testLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.b.String()
+}
+
+// countingStorage records the size of each batch inserted.
+type countingStorage struct {
+	embedtsdb.Storage
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (s *countingStorage) InsertRows(rows []embedtsdb.Row) error {
+	s.mu.Lock()
+	s.sizes = append(s.sizes, len(rows))
+	s.mu.Unlock()
+	return s.Storage.InsertRows(rows)
+}
+
+func (s *countingStorage) batches() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.sizes...)
+}
@@ -0,0 +1,131 @@
+package embedtsdb
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// MetricNameLabel is the reserved label name that lets a Matcher refer to the metric name.
+const MetricNameLabel = "__name__"
+
+// MatchType is an enum for label matching types.
+type MatchType int
+
+const (
+	// MatchEqual selects series whose label value is exactly the given one.
+	MatchEqual MatchType = iota
+	// MatchNotEqual selects series whose label value differs from the given one.
+	MatchNotEqual
+	// MatchRegexp selects series whose label value fully matches the given regular expression.
+	MatchRegexp
+	// MatchNotRegexp selects series whose label value doesn't fully match the given regular expression.
+	MatchNotRegexp
+)
+
+func (t MatchType) String() string {
+	switch t {
+	case MatchEqual:
+		return "="
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	default:
+		return fmt.Sprintf("MatchType(%d)", int(t))
+	}
+}
+
+// Matcher models the matching of a label, in the same manner as Prometheus does.
+// A series that lacks the label is treated as having the label with an empty value.
+// So {Name: "host", Type: MatchNotEqual, Value: ""} selects series having any host,
+// and so does {Name: "host", Type: MatchRegexp, Value: ".+"}.
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+// NewMatcher gives back a matcher for the given label name.
+// Use MetricNameLabel as the name to match metric names.
+// Regular expressions are fully anchored.
+func NewMatcher(t MatchType, name, value string) (*Matcher, error) {
+	if name == "" {
+		return nil, fmt.Errorf("label name must be set")
+	}
+	m := &Matcher{
+		Type:  t,
+		Name:  name,
+		Value: value,
+	}
+	switch t {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", value, err)
+		}
+		m.re = re
+	default:
+		return nil, fmt.Errorf("unknown match type %v given", t)
+	}
+	return m, nil
+}
+
+// MustNewMatcher is like NewMatcher but panics if the matcher can't be built.
+func MustNewMatcher(t MatchType, name, value string) *Matcher {
+	m, err := NewMatcher(t, name, value)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Matches reports whether the given label value satisfies the matcher.
+func (m *Matcher) Matches(v string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	default:
+		return false
+	}
+}
+
+func (m *Matcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Name, m.Type, m.Value)
+}
+
+// matchLabels reports whether the series identified by the given metric and labels satisfies all matchers.
+func matchLabels(metric string, labels []Label, matchers []*Matcher) bool {
+	for _, m := range matchers {
+		if m.Name == MetricNameLabel {
+			if !m.Matches(metric) {
+				return false
+			}
+			continue
+		}
+		if !m.Matches(labelValue(labels, m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// labelValue gives back the value of the label with the given name, or an empty string if none.
+func labelValue(labels []Label, name string) string {
+	for i := range labels {
+		if labels[i].Name == name {
+			return labels[i].Value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,98 @@
+package embedtsdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatcher_Matches(t *testing.T) {
+	tests := []struct {
+		name      string
+		matchType MatchType
+		value     string
+		input     string
+		want      bool
+	}{
+		{name: "equal", matchType: MatchEqual, value: "a", input: "a", want: true},
+		{name: "not equal", matchType: MatchEqual, value: "a", input: "b", want: false},
+		{name: "negated equal", matchType: MatchNotEqual, value: "a", input: "b", want: true},
+		{name: "any value", matchType: MatchNotEqual, value: "", input: "b", want: true},
+		{name: "any value with missing label", matchType: MatchNotEqual, value: "", input: "", want: false},
+		{name: "regexp", matchType: MatchRegexp, value: "server-.*", input: "server-1", want: true},
+		{name: "regexp is anchored", matchType: MatchRegexp, value: "server", input: "server-1", want: false},
+		{name: "regexp alternation is anchored", matchType: MatchRegexp, value: "a|b", input: "ab", want: false},
+		{name: "negated regexp", matchType: MatchNotRegexp, value: "server-.*", input: "db-1", want: true},
+		{name: "negated regexp matching", matchType: MatchNotRegexp, value: "server-.*", input: "server-1", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMatcher(tt.matchType, "host", tt.value)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, m.Matches(tt.input))
+		})
+	}
+}
+
+func TestNewMatcher(t *testing.T) {
+	tests := []struct {
+		name      string
+		matchType MatchType
+		label     string
+		value     string
+		wantErr   bool
+	}{
+		{name: "valid", matchType: MatchEqual, label: "host", value: "a"},
+		{name: "empty label name", matchType: MatchEqual, value: "a", wantErr: true},
+		{name: "invalid regexp", matchType: MatchRegexp, label: "host", value: "(", wantErr: true},
+		{name: "unknown match type", matchType: MatchType(100), label: "host", value: "a", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMatcher(tt.matchType, tt.label, tt.value)
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func TestMatchLabels(t *testing.T) {
+	labels := []Label{{Name: "host", Value: "server-1"}, {Name: "region", Value: "us"}}
+	tests := []struct {
+		name     string
+		matchers []*Matcher
+		want     bool
+	}{
+		{
+			name:     "metric name",
+			matchers: []*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "cpu")},
+			want:     true,
+		},
+		{
+			name: "metric name and label",
+			matchers: []*Matcher{
+				MustNewMatcher(MatchEqual, MetricNameLabel, "cpu"),
+				MustNewMatcher(MatchRegexp, "host", "server-.+"),
+			},
+			want: true,
+		},
+		{
+			name: "one of the matchers fails",
+			matchers: []*Matcher{
+				MustNewMatcher(MatchEqual, MetricNameLabel, "cpu"),
+				MustNewMatcher(MatchNotEqual, "region", "us"),
+			},
+			want: false,
+		},
+		{
+			name:     "missing label is empty",
+			matchers: []*Matcher{MustNewMatcher(MatchEqual, "zone", "")},
+			want:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, matchLabels("cpu", labels, tt.matchers))
+		})
+	}
+}
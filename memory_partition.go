@@ -19,9 +19,16 @@ type memoryPartition struct {
 
 	// A hash map from metric name to memoryMetric.
 	metrics sync.Map
+	// An inverted index to look up metric names by labels.
+	index *postingsIndex
+	// Deleted data points, which are dropped when flushing.
+	tombstones *tombstones
 
 	// Write ahead log.
 	wal wal
+	// walCheckpoint is the WAL checkpoint this partition was created in.
+	// WAL segments in checkpoints before it have no records for this partition.
+	walCheckpoint uint64
 	// The timestamp range of partitions after which they get persisted
 	partitionDuration  int64
 	timestampPrecision TimestampPrecision
@@ -32,21 +39,10 @@ func newMemoryPartition(wal wal, partitionDuration time.Duration, precision Time
 	if wal == nil {
 		wal = &nopWAL{}
 	}
-	var d int64
-	switch precision {
-	case Nanoseconds:
-		d = partitionDuration.Nanoseconds()
-	case Microseconds:
-		d = partitionDuration.Microseconds()
-	case Milliseconds:
-		d = partitionDuration.Milliseconds()
-	case Seconds:
-		d = int64(partitionDuration.Seconds())
-	default:
-		d = partitionDuration.Nanoseconds()
-	}
 	return &memoryPartition{
-		partitionDuration:  d,
+		index:              newPostingsIndex(),
+		tombstones:         newTombstones(),
+		partitionDuration:  toPrecision(partitionDuration, precision),
 		wal:                wal,
 		timestampPrecision: precision,
 	}
@@ -126,26 +122,105 @@ func toUnix(t time.Time, precision TimestampPrecision) int64 {
 	}
 }
 
+// delete records tombstones clipped to the latest data point each series has so far,
+// so that data points inserted later are hidden only if they're older than that one.
+// The earliest data point doesn't clip them, so that the outcome doesn't depend on when older ones arrive.
+func (m *memoryPartition) delete(matchers []*Matcher, start, end int64) error {
+	for _, name := range m.index.match(matchers) {
+		value, ok := m.metrics.Load(name)
+		if !ok {
+			continue
+		}
+		_, max, ok := value.(*memoryMetric).bounds()
+		if !ok || max < start {
+			continue
+		}
+		r := timeRange{min: start, max: end - 1}
+		if r.max > max {
+			r.max = max
+		}
+		m.tombstones.add(name, r)
+	}
+	return nil
+}
+
 func (m *memoryPartition) selectDataPoints(metric string, labels []Label, start, end int64) ([]*DataPoint, error) {
 	name := marshalMetricName(metric, labels)
-	mt := m.getMetric(name)
-	return mt.selectPoints(start, end), nil
+	value, ok := m.metrics.Load(name)
+	if !ok {
+		return []*DataPoint{}, nil
+	}
+	points := value.(*memoryMetric).selectPoints(start, end)
+	ranges := m.tombstones.get(name)
+	if len(ranges) == 0 {
+		return points, nil
+	}
+	kept := make([]*DataPoint, 0, len(points))
+	for _, p := range points {
+		if !deletedAt(ranges, p.Timestamp) {
+			kept = append(kept, p)
+		}
+	}
+	return kept, nil
+}
+
+func (m *memoryPartition) selectIterator(name string, start, end int64) (Iterator, error) {
+	value, ok := m.metrics.Load(name)
+	if !ok {
+		return emptyIterator{}, nil
+	}
+	return withTombstones(newSliceIterator(value.(*memoryMetric).selectPoints(start, end)), m.tombstones.get(name)), nil
+}
+
+func (m *memoryPartition) matchSeries(matchers []*Matcher) ([]string, error) {
+	names := m.index.match(matchers)
+	if m.tombstones.empty() {
+		return names, nil
+	}
+	// Leave out series all of whose data points are deleted.
+	kept := names[:0]
+	for _, name := range names {
+		ranges := m.tombstones.get(name)
+		if len(ranges) > 0 {
+			if value, ok := m.metrics.Load(name); ok {
+				if min, max, ok := value.(*memoryMetric).bounds(); ok && covering(ranges, min, max) {
+					continue
+				}
+			}
+		}
+		kept = append(kept, name)
+	}
+	return kept, nil
+}
+
+// encodeSeries encodes all data points of the given series in order by timestamp, except for deleted ones.
+func (m *memoryPartition) encodeSeries(mt *memoryMetric, encoder seriesEncoder) error {
+	if ranges := m.tombstones.get(mt.name); len(ranges) > 0 {
+		encoder = &tombstoneEncoder{seriesEncoder: encoder, ranges: ranges}
+	}
+	return mt.encodeAllPoints(encoder)
 }
 
 // getMetric gives back the reference to the metrics list whose name is the given one.
 // If none, it creates a new one.
 func (m *memoryPartition) getMetric(name string) *memoryMetric {
 	value, ok := m.metrics.Load(name)
-	if !ok {
-		points := dataPointSlicePool.Get().([]*DataPoint)
-		points = points[:0] // Reset length but keep capacity
-		value = &memoryMetric{
-			name:             name,
-			points:           points,
-			outOfOrderPoints: make([]*DataPoint, 0, 100), // Pre-allocate out-of-order capacity
-		}
-		m.metrics.Store(name, value)
+	if ok {
+		return value.(*memoryMetric)
+	}
+	points := dataPointSlicePool.Get().([]*DataPoint)
+	points = points[:0] // Reset length but keep capacity
+	value, loaded := m.metrics.LoadOrStore(name, &memoryMetric{
+		name:             name,
+		points:           points,
+		outOfOrderPoints: make([]*DataPoint, 0, 100), // Pre-allocate out-of-order capacity
+	})
+	if loaded {
+		// Another goroutine has created it in the meantime.
+		dataPointSlicePool.Put(points)
+		return value.(*memoryMetric)
 	}
+	m.index.add(name)
 	return value.(*memoryMetric)
 }
 
@@ -274,6 +349,26 @@ func (m *memoryMetric) selectPoints(start, end int64) []*DataPoint {
 	return m.points[startIdx:endIdx]
 }
 
+// bounds gives back the minimum and maximum timestamps of all data points including out-of-order ones.
+// ok is false if it has none.
+func (m *memoryMetric) bounds() (min, max int64, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if len(m.points) == 0 {
+		return 0, 0, false
+	}
+	min, max = m.points[0].Timestamp, m.points[len(m.points)-1].Timestamp
+	for _, p := range m.outOfOrderPoints {
+		if p.Timestamp < min {
+			min = p.Timestamp
+		}
+		if p.Timestamp > max {
+			max = p.Timestamp
+		}
+	}
+	return min, max, true
+}
+
 // encodeAllPoints uses the given seriesEncoder to encode all metric data points in order by timestamp,
 // including outOfOrderPoints.
 func (m *memoryMetric) encodeAllPoints(encoder seriesEncoder) error {
@@ -233,3 +233,46 @@ func Test_toUnix(t *testing.T) {
 		})
 	}
 }
+
+func Test_memoryPartition_delete(t *testing.T) {
+	m := newMemoryPartition(nil, time.Hour, Seconds).(*memoryPartition)
+	_, err := m.insertRows([]Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 2}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 3}},
+		{Metric: "metric2", DataPoint: DataPoint{Timestamp: 2}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, m.delete([]*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "metric1")}, 2, 100))
+	require.NoError(t, m.delete([]*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "metric2")}, 0, 100))
+
+	// Data points inserted after the deleted ones aren't hidden.
+	_, err = m.insertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 4}}})
+	require.NoError(t, err)
+	got, err := m.selectDataPoints("metric1", nil, 0, 100)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1}, {Timestamp: 4}}, got)
+
+	// Data points inserted into the range later are hidden as long as they're older than the latest one
+	// at the time of deleting, even if they're older than every data point the series had.
+	_, err = m.insertRows([]Row{{Metric: "metric2", DataPoint: DataPoint{Timestamp: 1}}})
+	require.NoError(t, err)
+
+	names, err := m.matchSeries([]*Matcher{MustNewMatcher(MatchRegexp, MetricNameLabel, "metric.")})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"metric1"}, names)
+
+	// Deleted data points are left out when encoding.
+	value, _ := m.metrics.Load("metric1")
+	var encoded []int64
+	encoder := &fakeEncoder{encodePointFunc: func(p *DataPoint) error {
+		encoded = append(encoded, p.Timestamp)
+		return nil
+	}}
+	require.NoError(t, m.encodeSeries(value.(*memoryMetric), encoder))
+	assert.Equal(t, []int64{1, 4}, encoded)
+	encoded = nil
+	value, _ = m.metrics.Load("metric2")
+	require.NoError(t, m.encodeSeries(value.(*memoryMetric), encoder))
+	assert.Empty(t, encoded)
+}
@@ -19,6 +19,9 @@ type partition interface {
 	// If data points older than its min timestamp were given, they won't be
 	// ingested, instead, gave back as a first returned value.
 	insertRows(rows []Row) (outdatedRows []Row, err error)
+	// delete records tombstones for data points of series that satisfy every given matcher within the given
+	// start-end range, which hide them from queries until they're dropped physically.
+	delete(matchers []*Matcher, start, end int64) error
 	// clean removes everything managed by this partition.
 	clean() error
 
@@ -26,6 +29,10 @@ type partition interface {
 	//
 	// selectDataPoints gives back certain metric's data points within the given range.
 	selectDataPoints(metric string, labels []Label, start, end int64) ([]*DataPoint, error)
+	// selectIterator gives back an iterator over data points of the series with the given marshaled name within the given range.
+	selectIterator(name string, start, end int64) (Iterator, error)
+	// matchSeries gives back the marshaled names of all series that satisfy every given matcher.
+	matchSeries(matchers []*Matcher) ([]string, error)
 	// minTimestamp returns the minimum Unix timestamp in milliseconds.
 	minTimestamp() int64
 	// maxTimestamp returns the maximum Unix timestamp in milliseconds.
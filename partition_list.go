@@ -21,6 +21,9 @@ type partitionList interface {
 	remove(partition partition) error
 	// swap replaces the old partition with the new one.
 	swap(old, new partition) error
+	// replace replaces the given adjacent partitions, ordered from the newest one, with the new one at once.
+	// They're just removed if the new one is nil. Unlike remove, it doesn't clean them.
+	replace(olds []partition, new partition) error
 	// getHead gives back the head node which is the newest one.
 	getHead() partition
 	// size returns the number of partitions of itself.
@@ -188,6 +191,59 @@ func (p *partitionListImpl) swap(old, new partition) error {
 	return fmt.Errorf("the given partition was not found")
 }
 
+func (p *partitionListImpl) replace(olds []partition, new partition) error {
+	if len(olds) == 0 {
+		return fmt.Errorf("no partitions given")
+	}
+
+	// Iterate over itself from the head.
+	var prev *partitionNode
+	iterator := p.newIterator()
+	for iterator.next() {
+		current := iterator.currentNode()
+		if !samePartitions(current.value(), olds[0]) {
+			prev = current
+			continue
+		}
+
+		last := current
+		for _, old := range olds[1:] {
+			last = last.getNext()
+			if last == nil || !samePartitions(last.value(), old) {
+				return fmt.Errorf("the given partitions are not adjacent")
+			}
+		}
+		next := last.getNext()
+		removed := int64(len(olds))
+		if new != nil {
+			next = &partitionNode{
+				val:  new,
+				next: next,
+			}
+			removed--
+		}
+		switch {
+		case prev == nil:
+			// replacing from the head node
+			p.setHead(next)
+		default:
+			prev.setNext(next)
+		}
+		if last.getNext() == nil {
+			// replacing until the tail node
+			if next != nil {
+				p.setTail(next)
+			} else {
+				p.setTail(prev)
+			}
+		}
+		atomic.AddInt64(&p.numPartitions, -removed)
+		return nil
+	}
+
+	return fmt.Errorf("the given partition was not found")
+}
+
 func samePartitions(x, y partition) bool {
 	return x.minTimestamp() == y.minTimestamp()
 }
@@ -422,3 +422,83 @@ func Test_partitionList_Swap(t *testing.T) {
 		})
 	}
 }
+
+func Test_partitionList_Replace(t *testing.T) {
+	newList := func() partitionListImpl {
+		third := &partitionNode{val: &fakePartition{minT: 1}}
+		second := &partitionNode{val: &fakePartition{minT: 2}, next: third}
+		first := &partitionNode{val: &fakePartition{minT: 3}, next: second}
+		return partitionListImpl{
+			numPartitions: 3,
+			head:          first,
+			tail:          third,
+		}
+	}
+	tests := []struct {
+		name              string
+		olds              []partition
+		new               partition
+		wantErr           bool
+		wantPartitionList partitionListImpl
+	}{
+		{
+			name:    "no partitions given",
+			wantErr: true,
+		},
+		{
+			name:    "not adjacent",
+			olds:    []partition{&fakePartition{minT: 3}, &fakePartition{minT: 1}},
+			new:     &fakePartition{minT: 1},
+			wantErr: true,
+		},
+		{
+			name: "replace until the tail node",
+			olds: []partition{&fakePartition{minT: 2}, &fakePartition{minT: 1}},
+			new:  &fakePartition{minT: 1, maxT: 2},
+			wantPartitionList: partitionListImpl{
+				numPartitions: 2,
+				head: &partitionNode{
+					val:  &fakePartition{minT: 3},
+					next: &partitionNode{val: &fakePartition{minT: 1, maxT: 2}},
+				},
+				tail: &partitionNode{val: &fakePartition{minT: 1, maxT: 2}},
+			},
+		},
+		{
+			name: "replace from the head node",
+			olds: []partition{&fakePartition{minT: 3}, &fakePartition{minT: 2}},
+			new:  &fakePartition{minT: 2, maxT: 3},
+			wantPartitionList: partitionListImpl{
+				numPartitions: 2,
+				head: &partitionNode{
+					val:  &fakePartition{minT: 2, maxT: 3},
+					next: &partitionNode{val: &fakePartition{minT: 1}},
+				},
+				tail: &partitionNode{val: &fakePartition{minT: 1}},
+			},
+		},
+		{
+			name: "remove the tail nodes",
+			olds: []partition{&fakePartition{minT: 2}, &fakePartition{minT: 1}},
+			wantPartitionList: partitionListImpl{
+				numPartitions: 1,
+				head:          &partitionNode{val: &fakePartition{minT: 3}},
+				tail:          &partitionNode{val: &fakePartition{minT: 3}},
+			},
+		},
+	}
+	for i := range tests {
+		tt := &tests[i] // use pointer to avoid copying
+		t.Run(tt.name, func(t *testing.T) {
+			list := newList()
+			err := list.replace(tt.olds, tt.new)
+			assert.Equal(t, tt.wantErr, err != nil)
+			if tt.wantErr {
+				return
+			}
+			// Reset headCache for comparison since it's an internal optimization
+			list.headCache = nil
+			assert.Equal(t, &tt.wantPartitionList, &list)
+		})
+	}
+}
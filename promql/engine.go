@@ -0,0 +1,437 @@
+package promql
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+const (
+	defaultLookbackDelta = 5 * time.Minute
+	// The maximum number of steps a range query can evaluate, the same as Prometheus.
+	maxSteps = 11000
+)
+
+// Engine evaluates a subset of PromQL against a Reader, typically a Storage.
+// It supports:
+//   - selectors with label matchers, like `http_requests_total{code=~"5.."}`, optionally with `offset`
+//   - rate, irate, increase and delta over range vectors, like `rate(http_requests_total[5m])`
+//   - sum, avg, min, max and count aggregations with `by` or `without`
+//   - arithmetic operators +, -, *, /, % and ^ between scalars and vectors
+//
+// Vectors are matched by their label sets, ignoring metric names, when an operator is applied between them.
+// It offers goroutine safe capabilities as long as the Reader does.
+type Engine struct {
+	reader        embedtsdb.Reader
+	precision     embedtsdb.TimestampPrecision
+	lookbackDelta time.Duration
+}
+
+// Option is an optional setting for NewEngine.
+type Option func(*Engine)
+
+// WithLookbackDelta specifies how far back an instant vector selector looks for the latest data point.
+//
+// Defaults to 5m.
+func WithLookbackDelta(delta time.Duration) Option {
+	return func(e *Engine) {
+		e.lookbackDelta = delta
+	}
+}
+
+// NewEngine gives back a new engine that reads data points from the given reader.
+// Durations in queries are converted into the reader's timestamp precision.
+func NewEngine(reader embedtsdb.Reader, opts ...Option) *Engine {
+	e := &Engine{
+		reader:        reader,
+		precision:     reader.TimestampPrecision(),
+		lookbackDelta: defaultLookbackDelta,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// InstantQuery evaluates the given query at the given timestamp.
+// Each resulting series has a single data point timestamped with it, and a scalar result
+// is given back as a series without metric and labels.
+// Metric names are dropped from series that went through functions, aggregations or operators.
+func (e *Engine) InstantQuery(query string, timestamp int64) ([]*embedtsdb.Series, error) {
+	return e.RangeQuery(query, timestamp, timestamp+1, 1)
+}
+
+// RangeQuery evaluates the given query at each step from start to end.
+// Keep in mind that start is inclusive, end is exclusive.
+// Each resulting series has data points timestamped with the steps it had a value at.
+func (e *Engine) RangeQuery(query string, start, end, step int64) ([]*embedtsdb.Series, error) {
+	if start >= end {
+		return nil, fmt.Errorf("the given start is greater than end")
+	}
+	if step <= 0 {
+		return nil, fmt.Errorf("step must be positive")
+	}
+	if end-start <= 0 {
+		// The number of steps would overflow.
+		return nil, fmt.Errorf("the range between start and end is too wide")
+	}
+	numSteps := (end-start-1)/step + 1
+	if numSteps > maxSteps {
+		return nil, fmt.Errorf("too many steps: step %d is too small for the range", step)
+	}
+	root, err := parse(query)
+	if err != nil {
+		return nil, err
+	}
+
+	ev := &evaluator{
+		engine: e,
+		series: make(map[*vectorSelector][]*embedtsdb.Series),
+	}
+	// The last step to be evaluated.
+	last := start + (numSteps-1)*step
+	if err := ev.prepare(root, start, last); err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*embedtsdb.Series)
+	for i := int64(0); i < numSteps; i++ {
+		// Advance by the index, since adding step to the last one may overflow.
+		ts := start + i*step
+		v, err := ev.eval(root, ts)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := v.(scalar); ok {
+			v = vector{{value: float64(s)}}
+		}
+		seen := make(map[string]struct{})
+		for _, smp := range v.(vector) {
+			key := seriesKey(smp.metric, smp.labels)
+			if _, ok := seen[key]; ok {
+				return nil, fmt.Errorf("vector cannot contain series with the same label set %v", smp.labels)
+			}
+			seen[key] = struct{}{}
+			series, ok := result[key]
+			if !ok {
+				series = &embedtsdb.Series{Metric: smp.metric, Labels: smp.labels}
+				result[key] = series
+			}
+			series.Points = append(series.Points, &embedtsdb.DataPoint{Timestamp: ts, Value: smp.value})
+		}
+	}
+
+	list := make([]*embedtsdb.Series, 0, len(result))
+	for _, s := range result {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Metric != list[j].Metric {
+			return list[i].Metric < list[j].Metric
+		}
+		return embedtsdb.CompareLabels(list[i].Labels, list[j].Labels) < 0
+	})
+	return list, nil
+}
+
+// value is the result of an expression at a timestamp, either scalar or vector.
+type value interface{}
+
+type scalar float64
+
+type sample struct {
+	metric string
+	labels []embedtsdb.Label
+	value  float64
+}
+
+type vector []sample
+
+type evaluator struct {
+	engine *Engine
+	// series holds data points of series selected by each selector, sorted by timestamp.
+	series map[*vectorSelector][]*embedtsdb.Series
+}
+
+// prepare fetches data points needed to evaluate the given expression from first to last,
+// so that each series is read only once regardless of the number of steps.
+func (ev *evaluator) prepare(node expr, first, last int64) error {
+	var (
+		vs     *vectorSelector
+		window int64
+	)
+	switch n := node.(type) {
+	case *vectorSelector:
+		vs, window = n, ev.duration(ev.engine.lookbackDelta)
+	case *matrixSelector:
+		vs, window = n.vectorSelector, ev.duration(n.rng)
+	case *call:
+		return ev.prepare(n.arg, first, last)
+	case *aggregateExpr:
+		return ev.prepare(n.expr, first, last)
+	case *unaryExpr:
+		return ev.prepare(n.expr, first, last)
+	case *binaryExpr:
+		if err := ev.prepare(n.lhs, first, last); err != nil {
+			return err
+		}
+		return ev.prepare(n.rhs, first, last)
+	default:
+		return nil
+	}
+
+	offset := ev.duration(vs.offset)
+	series, err := ev.engine.reader.SelectSeries(vs.matchers, first-offset-window+1, last-offset+1)
+	if errors.Is(err, embedtsdb.ErrNoDataPoints) {
+		series = nil
+	} else if err != nil {
+		return fmt.Errorf("failed to select series: %w", err)
+	}
+	for _, s := range series {
+		// Data points from overlapping partitions may come out of order.
+		less := func(i, j int) bool { return s.Points[i].Timestamp < s.Points[j].Timestamp }
+		if !sort.SliceIsSorted(s.Points, less) {
+			s.Points = append([]*embedtsdb.DataPoint(nil), s.Points...)
+			sort.SliceStable(s.Points, less)
+		}
+	}
+	ev.series[vs] = series
+	return nil
+}
+
+func (ev *evaluator) eval(node expr, ts int64) (value, error) {
+	switch n := node.(type) {
+	case *numberLiteral:
+		return scalar(n.val), nil
+	case *vectorSelector:
+		return ev.evalVectorSelector(n, ts), nil
+	case *call:
+		return ev.evalCall(n, ts)
+	case *aggregateExpr:
+		v, err := ev.eval(n.expr, ts)
+		if err != nil {
+			return nil, err
+		}
+		return aggregate(n, v.(vector)), nil
+	case *unaryExpr:
+		v, err := ev.eval(n.expr, ts)
+		if err != nil {
+			return nil, err
+		}
+		return negate(v), nil
+	case *binaryExpr:
+		lhs, err := ev.eval(n.lhs, ts)
+		if err != nil {
+			return nil, err
+		}
+		rhs, err := ev.eval(n.rhs, ts)
+		if err != nil {
+			return nil, err
+		}
+		return binaryOp(n.op, lhs, rhs)
+	default:
+		return nil, fmt.Errorf("unexpected expression %T", node)
+	}
+}
+
+// evalVectorSelector gives back the latest data point of each series within the lookback delta.
+func (ev *evaluator) evalVectorSelector(vs *vectorSelector, ts int64) vector {
+	ts -= ev.duration(vs.offset)
+	lookback := ev.duration(ev.engine.lookbackDelta)
+	out := make(vector, 0)
+	for _, s := range ev.series[vs] {
+		// Index of the first data point after ts.
+		i := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].Timestamp > ts })
+		if i == 0 {
+			continue
+		}
+		p := s.Points[i-1]
+		if p.Timestamp <= ts-lookback {
+			continue
+		}
+		out = append(out, sample{metric: s.Metric, labels: s.Labels, value: p.Value})
+	}
+	return out
+}
+
+func (ev *evaluator) evalCall(c *call, ts int64) (value, error) {
+	vs := c.arg.vectorSelector
+	// The window is (ts-range, ts], which is [start, end) in terms of the storage.
+	end := ts - ev.duration(vs.offset) + 1
+	start := end - ev.duration(c.arg.rng)
+	out := make(vector, 0)
+	for _, s := range ev.series[vs] {
+		lo := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].Timestamp >= start })
+		hi := sort.Search(len(s.Points), func(i int) bool { return s.Points[i].Timestamp >= end })
+		v, err := c.fn.call(ev.engine, s.Points[lo:hi], start, end)
+		if errors.Is(err, embedtsdb.ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to evaluate %s(): %w", c.fn.name, err)
+		}
+		out = append(out, sample{labels: s.Labels, value: v})
+	}
+	return out, nil
+}
+
+// duration converts the given duration into the timestamp precision.
+func (ev *evaluator) duration(d time.Duration) int64 {
+	return embedtsdb.ConvertTimestamp(int64(d), time.Nanosecond, ev.engine.precision)
+}
+
+func aggregate(agg *aggregateExpr, v vector) vector {
+	type group struct {
+		labels []embedtsdb.Label
+		value  float64
+		count  int
+	}
+	groups := make(map[string]*group)
+	order := make([]string, 0)
+	for _, smp := range v {
+		labels := groupLabels(smp.labels, agg.grouping, agg.without)
+		key := seriesKey("", labels)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{labels: labels, value: smp.value}
+			groups[key] = g
+			order = append(order, key)
+		} else {
+			switch agg.op {
+			case "sum", "avg":
+				g.value += smp.value
+			case "min":
+				g.value = math.Min(g.value, smp.value)
+			case "max":
+				g.value = math.Max(g.value, smp.value)
+			}
+		}
+		g.count++
+	}
+
+	out := make(vector, 0, len(groups))
+	for _, key := range order {
+		g := groups[key]
+		switch agg.op {
+		case "avg":
+			g.value /= float64(g.count)
+		case "count":
+			g.value = float64(g.count)
+		}
+		out = append(out, sample{labels: g.labels, value: g.value})
+	}
+	return out
+}
+
+// groupLabels gives back labels that remain after grouping by, or without, the given names.
+func groupLabels(labels []embedtsdb.Label, names []string, without bool) []embedtsdb.Label {
+	grouped := make([]embedtsdb.Label, 0, len(labels))
+	for _, l := range labels {
+		listed := false
+		for _, name := range names {
+			if l.Name == name {
+				listed = true
+				break
+			}
+		}
+		if listed != without {
+			grouped = append(grouped, l)
+		}
+	}
+	return grouped
+}
+
+func negate(v value) value {
+	if s, ok := v.(scalar); ok {
+		return -s
+	}
+	out := make(vector, 0, len(v.(vector)))
+	for _, smp := range v.(vector) {
+		out = append(out, sample{labels: smp.labels, value: -smp.value})
+	}
+	return out
+}
+
+// binaryOp applies the operator between scalars and vectors.
+// Between two vectors, samples are paired by their label sets, and those without a pair are dropped.
+func binaryOp(op tokenType, lhs, rhs value) (value, error) {
+	ls, lok := lhs.(scalar)
+	rs, rok := rhs.(scalar)
+	switch {
+	case lok && rok:
+		return scalar(arithmetic(op, float64(ls), float64(rs))), nil
+	case rok:
+		out := make(vector, 0, len(lhs.(vector)))
+		for _, smp := range lhs.(vector) {
+			out = append(out, sample{labels: smp.labels, value: arithmetic(op, smp.value, float64(rs))})
+		}
+		return out, nil
+	case lok:
+		out := make(vector, 0, len(rhs.(vector)))
+		for _, smp := range rhs.(vector) {
+			out = append(out, sample{labels: smp.labels, value: arithmetic(op, float64(ls), smp.value)})
+		}
+		return out, nil
+	}
+
+	right := make(map[string]sample, len(rhs.(vector)))
+	for _, smp := range rhs.(vector) {
+		key := seriesKey("", smp.labels)
+		if _, ok := right[key]; ok {
+			return nil, fmt.Errorf("found duplicate series for the match group %v on the right hand-side of the operation", smp.labels)
+		}
+		right[key] = smp
+	}
+	matched := make(map[string]struct{}, len(lhs.(vector)))
+	out := make(vector, 0)
+	for _, smp := range lhs.(vector) {
+		key := seriesKey("", smp.labels)
+		r, ok := right[key]
+		if !ok {
+			continue
+		}
+		if _, ok := matched[key]; ok {
+			return nil, fmt.Errorf("found duplicate series for the match group %v on the left hand-side of the operation", smp.labels)
+		}
+		matched[key] = struct{}{}
+		out = append(out, sample{labels: smp.labels, value: arithmetic(op, smp.value, r.value)})
+	}
+	return out, nil
+}
+
+func arithmetic(op tokenType, a, b float64) float64 {
+	switch op {
+	case tokenAdd:
+		return a + b
+	case tokenSub:
+		return a - b
+	case tokenMul:
+		return a * b
+	case tokenDiv:
+		return a / b
+	case tokenMod:
+		return math.Mod(a, b)
+	case tokenPow:
+		return math.Pow(a, b)
+	default:
+		return math.NaN()
+	}
+}
+
+// seriesKey builds a key that uniquely identifies the given series. Labels must be sorted by name.
+func seriesKey(metric string, labels []embedtsdb.Label) string {
+	var b strings.Builder
+	b.WriteString(metric)
+	for _, l := range labels {
+		b.WriteByte(0xff)
+		b.WriteString(l.Name)
+		b.WriteByte(0xfe)
+		b.WriteString(l.Value)
+	}
+	return b.String()
+}
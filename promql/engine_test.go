@@ -0,0 +1,250 @@
+package promql
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+const base = 1600000000
+
+func newTestEngine(t *testing.T) *Engine {
+	storage, err := embedtsdb.NewStorage(embedtsdb.WithTimestampPrecision(embedtsdb.Seconds))
+	require.NoError(t, err)
+	t.Cleanup(func() { storage.Close() })
+
+	rows := make([]embedtsdb.Row, 0)
+	for i := 0; i <= 12; i++ {
+		ts := int64(base + i*10)
+		rows = append(rows,
+			embedtsdb.Row{Metric: "http_requests_total", Labels: []embedtsdb.Label{{Name: "code", Value: "200"}, {Name: "host", Value: "a"}}, DataPoint: embedtsdb.DataPoint{Timestamp: ts, Value: float64(i * 10)}},
+			embedtsdb.Row{Metric: "http_requests_total", Labels: []embedtsdb.Label{{Name: "code", Value: "200"}, {Name: "host", Value: "b"}}, DataPoint: embedtsdb.DataPoint{Timestamp: ts, Value: float64(i * 20)}},
+			embedtsdb.Row{Metric: "http_requests_total", Labels: []embedtsdb.Label{{Name: "code", Value: "500"}, {Name: "host", Value: "a"}}, DataPoint: embedtsdb.DataPoint{Timestamp: ts, Value: float64(i * 5)}},
+			embedtsdb.Row{Metric: "cpu", Labels: []embedtsdb.Label{{Name: "host", Value: "a"}}, DataPoint: embedtsdb.DataPoint{Timestamp: ts, Value: float64(i)}},
+			embedtsdb.Row{Metric: "cpu", Labels: []embedtsdb.Label{{Name: "host", Value: "b"}}, DataPoint: embedtsdb.DataPoint{Timestamp: ts, Value: float64(2 * i)}},
+			embedtsdb.Row{Metric: "cores", Labels: []embedtsdb.Label{{Name: "host", Value: "a"}}, DataPoint: embedtsdb.DataPoint{Timestamp: ts, Value: 2}},
+			embedtsdb.Row{Metric: "cores", Labels: []embedtsdb.Label{{Name: "host", Value: "c"}}, DataPoint: embedtsdb.DataPoint{Timestamp: ts, Value: 4}},
+		)
+	}
+	require.NoError(t, storage.InsertRows(rows))
+	return NewEngine(storage)
+}
+
+func point(ts int64, v float64) []*embedtsdb.DataPoint {
+	return []*embedtsdb.DataPoint{{Timestamp: ts, Value: v}}
+}
+
+func TestEngine_InstantQuery(t *testing.T) {
+	e := newTestEngine(t)
+	hostA := []embedtsdb.Label{{Name: "host", Value: "a"}}
+	hostB := []embedtsdb.Label{{Name: "host", Value: "b"}}
+	tests := []struct {
+		name      string
+		query     string
+		timestamp int64
+		want      []*embedtsdb.Series
+		wantErr   bool
+	}{
+		{
+			name:      "selector",
+			query:     `cpu`,
+			timestamp: base + 65,
+			want: []*embedtsdb.Series{
+				{Metric: "cpu", Labels: hostA, Points: point(base+65, 6)},
+				{Metric: "cpu", Labels: hostB, Points: point(base+65, 12)},
+			},
+		},
+		{
+			name:      "selector with matchers",
+			query:     `http_requests_total{host="a", code!~"2.."}`,
+			timestamp: base + 120,
+			want: []*embedtsdb.Series{
+				{Metric: "http_requests_total", Labels: []embedtsdb.Label{{Name: "code", Value: "500"}, {Name: "host", Value: "a"}}, Points: point(base+120, 60)},
+			},
+		},
+		{
+			name:      "offset",
+			query:     `cpu{host="a"} offset 30s`,
+			timestamp: base + 100,
+			want: []*embedtsdb.Series{
+				{Metric: "cpu", Labels: hostA, Points: point(base+100, 7)},
+			},
+		},
+		{
+			name:      "beyond the lookback delta",
+			query:     `cpu`,
+			timestamp: base + 120 + 300,
+			want:      []*embedtsdb.Series{},
+		},
+		{
+			name:      "rate",
+			query:     `rate(http_requests_total{code="200"}[1m])`,
+			timestamp: base + 120,
+			want: []*embedtsdb.Series{
+				{Labels: []embedtsdb.Label{{Name: "code", Value: "200"}, {Name: "host", Value: "a"}}, Points: point(base+120, 1)},
+				{Labels: []embedtsdb.Label{{Name: "code", Value: "200"}, {Name: "host", Value: "b"}}, Points: point(base+120, 2)},
+			},
+		},
+		{
+			name:      "sum by",
+			query:     `sum by (host) (rate(http_requests_total[1m]))`,
+			timestamp: base + 120,
+			want: []*embedtsdb.Series{
+				{Labels: hostA, Points: point(base+120, 1.5)},
+				{Labels: hostB, Points: point(base+120, 2)},
+			},
+		},
+		{
+			name:      "sum of everything",
+			query:     `sum(increase(http_requests_total[1m]))`,
+			timestamp: base + 120,
+			want: []*embedtsdb.Series{
+				{Labels: []embedtsdb.Label{}, Points: point(base+120, 210)},
+			},
+		},
+		{
+			name:      "count without",
+			query:     `count without (code) (http_requests_total)`,
+			timestamp: base + 120,
+			want: []*embedtsdb.Series{
+				{Labels: hostA, Points: point(base+120, 2)},
+				{Labels: hostB, Points: point(base+120, 1)},
+			},
+		},
+		{
+			name:      "min, max and avg",
+			query:     `max(cpu) - min(cpu) + avg(cpu)`,
+			timestamp: base + 20,
+			want: []*embedtsdb.Series{
+				{Labels: []embedtsdb.Label{}, Points: point(base+20, 2+3)},
+			},
+		},
+		{
+			name:      "arithmetic between vectors",
+			query:     `cpu / cores * 100`,
+			timestamp: base + 20,
+			want: []*embedtsdb.Series{
+				{Labels: hostA, Points: point(base+20, 100)},
+			},
+		},
+		{
+			name:      "scalar",
+			query:     `(1 + 2) * -3`,
+			timestamp: base,
+			want: []*embedtsdb.Series{
+				{Points: point(base, -9)},
+			},
+		},
+		{
+			name:      "duplicate label sets",
+			query:     `rate({__name__=~"cpu|cores", host="a"}[1m])`,
+			timestamp: base + 120,
+			wantErr:   true,
+		},
+		{
+			name:      "invalid query",
+			query:     `sum(`,
+			timestamp: base,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := e.InstantQuery(tt.query, tt.timestamp)
+			assert.Equal(t, tt.wantErr, err != nil)
+			if err != nil {
+				return
+			}
+			require.Len(t, got, len(tt.want))
+			for i := range tt.want {
+				assert.Equal(t, tt.want[i].Metric, got[i].Metric)
+				assert.Equal(t, tt.want[i].Labels, got[i].Labels)
+				require.Len(t, got[i].Points, len(tt.want[i].Points))
+				for j := range tt.want[i].Points {
+					assert.Equal(t, tt.want[i].Points[j].Timestamp, got[i].Points[j].Timestamp)
+					assert.InDelta(t, tt.want[i].Points[j].Value, got[i].Points[j].Value, 1e-9)
+				}
+			}
+		})
+	}
+}
+
+func TestEngine_InstantQuery_duplicates(t *testing.T) {
+	opts := []embedtsdb.Option{embedtsdb.WithDataPath(t.TempDir()), embedtsdb.WithTimestampPrecision(embedtsdb.Seconds)}
+	storage, err := embedtsdb.NewStorage(opts...)
+	require.NoError(t, err)
+	// Data points sent again, such as by a retrying client, are kept as duplicates once flushed.
+	for i := 0; i <= 6; i++ {
+		rows := []embedtsdb.Row{
+			{Metric: "requests_total", Labels: []embedtsdb.Label{{Name: "host", Value: "a"}}, DataPoint: embedtsdb.DataPoint{Timestamp: int64(base + i*10), Value: float64(i * 10)}},
+			{Metric: "requests_total", Labels: []embedtsdb.Label{{Name: "host", Value: "b"}}, DataPoint: embedtsdb.DataPoint{Timestamp: int64(base + i*10), Value: float64(i * 20)}},
+		}
+		require.NoError(t, storage.InsertRows(rows))
+		require.NoError(t, storage.InsertRows(rows[:1]))
+	}
+	require.NoError(t, storage.Close())
+	storage, err = embedtsdb.NewStorage(opts...)
+	require.NoError(t, err)
+	defer storage.Close()
+	e := NewEngine(storage)
+
+	for query, want := range map[string][]float64{
+		`irate(requests_total[1m])`: {1, 2},
+		`rate(requests_total[1m])`:  {1, 2},
+		// A window having only duplicates of a data point gives nothing rather than failing the query.
+		`irate(requests_total[5s])`: {},
+	} {
+		t.Run(query, func(t *testing.T) {
+			got, err := e.InstantQuery(query, base+60)
+			require.NoError(t, err)
+			require.Len(t, got, len(want))
+			for i := range want {
+				require.Len(t, got[i].Points, 1)
+				assert.InDelta(t, want[i], got[i].Points[0].Value, 1e-9)
+			}
+		})
+	}
+}
+
+func TestEngine_RangeQuery(t *testing.T) {
+	e := newTestEngine(t)
+
+	got, err := e.RangeQuery(`sum(cpu)`, base, base+30, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []*embedtsdb.Series{
+		{Labels: []embedtsdb.Label{}, Points: []*embedtsdb.DataPoint{
+			{Timestamp: base, Value: 0},
+			{Timestamp: base + 10, Value: 3},
+			{Timestamp: base + 20, Value: 6},
+		}},
+	}, got)
+
+	// Series appear only at steps they have values at.
+	got, err = e.RangeQuery(`cpu{host="a"} offset 1m`, base+50, base+80, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []*embedtsdb.Series{
+		{Metric: "cpu", Labels: []embedtsdb.Label{{Name: "host", Value: "a"}}, Points: []*embedtsdb.DataPoint{
+			{Timestamp: base + 60, Value: 0},
+			{Timestamp: base + 70, Value: 1},
+		}},
+	}, got)
+
+	_, err = e.RangeQuery(`cpu`, base+10, base, 10)
+	assert.Error(t, err)
+	_, err = e.RangeQuery(`cpu`, base, base+10, 0)
+	assert.Error(t, err)
+	_, err = e.RangeQuery(`cpu`, base, base+maxSteps+1, 1)
+	assert.Error(t, err)
+	_, err = e.RangeQuery(`cpu`, math.MinInt64, math.MaxInt64, math.MaxInt64)
+	assert.Error(t, err)
+
+	// The step after the last one lies beyond the maximum timestamp.
+	got, err = e.RangeQuery(`1`, math.MaxInt64-10, math.MaxInt64, 100)
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, []*embedtsdb.DataPoint{{Timestamp: math.MaxInt64 - 10, Value: 1}}, got[0].Points)
+}
@@ -0,0 +1,39 @@
+package promql
+
+import (
+	"github.com/yudaprama/embedtsdb"
+)
+
+// function is a function that takes a range vector and gives back an instant vector.
+type function struct {
+	name string
+	// call computes the value of a series from its data points within [start, end).
+	call func(e *Engine, points []*embedtsdb.DataPoint, start, end int64) (float64, error)
+}
+
+var functions = map[string]*function{
+	"rate": {
+		name: "rate",
+		call: func(e *Engine, points []*embedtsdb.DataPoint, start, end int64) (float64, error) {
+			return embedtsdb.Rate(points, start, end, e.precision)
+		},
+	},
+	"irate": {
+		name: "irate",
+		call: func(e *Engine, points []*embedtsdb.DataPoint, start, end int64) (float64, error) {
+			return embedtsdb.IRate(points, start, end, e.precision)
+		},
+	},
+	"increase": {
+		name: "increase",
+		call: func(_ *Engine, points []*embedtsdb.DataPoint, start, end int64) (float64, error) {
+			return embedtsdb.Increase(points, start, end)
+		},
+	},
+	"delta": {
+		name: "delta",
+		call: func(_ *Engine, points []*embedtsdb.DataPoint, start, end int64) (float64, error) {
+			return embedtsdb.Delta(points, start, end)
+		},
+	},
+}
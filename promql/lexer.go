@@ -0,0 +1,216 @@
+package promql
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type tokenType int
+
+const (
+	tokenEOF tokenType = iota
+	tokenIdentifier
+	tokenNumber
+	tokenString
+	tokenDuration
+	tokenLeftParen
+	tokenRightParen
+	tokenLeftBrace
+	tokenRightBrace
+	tokenLeftBracket
+	tokenRightBracket
+	tokenComma
+	tokenEqual
+	tokenNotEqual
+	tokenRegexMatch
+	tokenRegexNotMatch
+	tokenAdd
+	tokenSub
+	tokenMul
+	tokenDiv
+	tokenMod
+	tokenPow
+)
+
+type token struct {
+	typ tokenType
+	val string
+	// pos is the byte offset of the token in the query.
+	pos int
+}
+
+var (
+	durationRegex = regexp.MustCompile(`^(\d+(ms|s|m|h|d|w|y))+`)
+	numberRegex   = regexp.MustCompile(`^(\d+\.?\d*|\.\d+)([eE][+-]?\d+)?`)
+
+	// Two-character operators must be tried before single-character ones.
+	operators = []struct {
+		s   string
+		typ tokenType
+	}{
+		{"!=", tokenNotEqual},
+		{"=~", tokenRegexMatch},
+		{"!~", tokenRegexNotMatch},
+		{"(", tokenLeftParen},
+		{")", tokenRightParen},
+		{"{", tokenLeftBrace},
+		{"}", tokenRightBrace},
+		{"[", tokenLeftBracket},
+		{"]", tokenRightBracket},
+		{",", tokenComma},
+		{"=", tokenEqual},
+		{"+", tokenAdd},
+		{"-", tokenSub},
+		{"*", tokenMul},
+		{"/", tokenDiv},
+		{"%", tokenMod},
+		{"^", tokenPow},
+	}
+)
+
+// lex splits the given query into tokens, terminated by tokenEOF.
+func lex(input string) ([]token, error) {
+	tokens := make([]token, 0)
+	pos := 0
+	for pos < len(input) {
+		c := input[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+			continue
+		case c == '#':
+			// Comments run until the end of the line.
+			for pos < len(input) && input[pos] != '\n' {
+				pos++
+			}
+			continue
+		case isDigit(c) || (c == '.' && pos+1 < len(input) && isDigit(input[pos+1])):
+			// A number directly followed by a unit is a duration, like "5m" or "1h30m".
+			if d := durationRegex.FindString(input[pos:]); d != "" && !isIdentifierChar(charAt(input, pos+len(d))) {
+				tokens = append(tokens, token{typ: tokenDuration, val: d, pos: pos})
+				pos += len(d)
+				continue
+			}
+			n := numberRegex.FindString(input[pos:])
+			if n == "" || isIdentifierChar(charAt(input, pos+len(n))) {
+				return nil, fmt.Errorf("bad number or duration at position %d", pos)
+			}
+			tokens = append(tokens, token{typ: tokenNumber, val: n, pos: pos})
+			pos += len(n)
+			continue
+		case isIdentifierStart(c):
+			start := pos
+			for pos < len(input) && isIdentifierChar(input[pos]) {
+				pos++
+			}
+			tokens = append(tokens, token{typ: tokenIdentifier, val: input[start:pos], pos: start})
+			continue
+		case c == '"' || c == '\'' || c == '`':
+			s, n, err := lexString(input[pos:])
+			if err != nil {
+				return nil, fmt.Errorf("bad string at position %d: %w", pos, err)
+			}
+			tokens = append(tokens, token{typ: tokenString, val: s, pos: pos})
+			pos += n
+			continue
+		}
+
+		matched := false
+		for _, op := range operators {
+			if strings.HasPrefix(input[pos:], op.s) {
+				tokens = append(tokens, token{typ: op.typ, val: op.s, pos: pos})
+				pos += len(op.s)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return nil, fmt.Errorf("unexpected character %q at position %d", c, pos)
+		}
+	}
+	return append(tokens, token{typ: tokenEOF, pos: pos}), nil
+}
+
+// lexString gives back the unquoted string at the beginning of the given input, along with the length it occupies.
+func lexString(input string) (string, int, error) {
+	quote := input[0]
+	for i := 1; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			raw := input[:i+1]
+			if quote == '\'' {
+				// Turn it into a double-quoted string so that strconv can unquote it.
+				inner := strings.ReplaceAll(raw[1:len(raw)-1], `\'`, `'`)
+				inner = strings.ReplaceAll(inner, `"`, `\"`)
+				raw = `"` + inner + `"`
+			}
+			s, err := strconv.Unquote(raw)
+			if err != nil {
+				return "", 0, err
+			}
+			return s, i + 1, nil
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// parseDuration parses durations such as "5m" and "1h30m". Unlike time.ParseDuration, days, weeks and years are accepted.
+func parseDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"ms": time.Millisecond,
+		"s":  time.Second,
+		"m":  time.Minute,
+		"h":  time.Hour,
+		"d":  24 * time.Hour,
+		"w":  7 * 24 * time.Hour,
+		"y":  365 * 24 * time.Hour,
+	}
+	var d time.Duration
+	for s != "" {
+		i := 0
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+		j := i
+		for j < len(s) && !isDigit(s[j]) {
+			j++
+		}
+		n, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		unit, ok := units[s[i:j]]
+		if !ok {
+			return 0, fmt.Errorf("unknown unit %q in duration", s[i:j])
+		}
+		d += time.Duration(n) * unit
+		s = s[j:]
+	}
+	return d, nil
+}
+
+func charAt(s string, i int) byte {
+	if i >= len(s) {
+		return 0
+	}
+	return s[i]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifierStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':'
+}
+
+func isIdentifierChar(c byte) bool {
+	return isIdentifierStart(c) || isDigit(c)
+}
@@ -0,0 +1,441 @@
+package promql
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+// expr is a node of the syntax tree.
+type expr interface {
+	// exprType tells what the expression evaluates to, either "scalar", "vector" or "matrix".
+	exprType() string
+}
+
+type numberLiteral struct {
+	val float64
+}
+
+// vectorSelector selects the latest data point of each matching series within the lookback delta.
+type vectorSelector struct {
+	matchers []*embedtsdb.Matcher
+	offset   time.Duration
+}
+
+// matrixSelector selects all data points of each matching series within the range.
+type matrixSelector struct {
+	vectorSelector *vectorSelector
+	rng            time.Duration
+}
+
+type call struct {
+	fn  *function
+	arg *matrixSelector
+}
+
+type aggregateExpr struct {
+	op       string
+	expr     expr
+	grouping []string
+	without  bool
+}
+
+type binaryExpr struct {
+	op  tokenType
+	lhs expr
+	rhs expr
+}
+
+type unaryExpr struct {
+	expr expr
+}
+
+func (*numberLiteral) exprType() string  { return "scalar" }
+func (*vectorSelector) exprType() string { return "vector" }
+func (*matrixSelector) exprType() string { return "matrix" }
+func (*call) exprType() string           { return "vector" }
+func (*aggregateExpr) exprType() string  { return "vector" }
+func (u *unaryExpr) exprType() string    { return u.expr.exprType() }
+
+func (b *binaryExpr) exprType() string {
+	if b.lhs.exprType() == "scalar" && b.rhs.exprType() == "scalar" {
+		return "scalar"
+	}
+	return "vector"
+}
+
+var aggregateOps = map[string]bool{
+	"sum":   true,
+	"avg":   true,
+	"min":   true,
+	"max":   true,
+	"count": true,
+}
+
+// Binding power of binary operators. "^" is right-associative.
+var precedences = map[tokenType]int{
+	tokenAdd: 1,
+	tokenSub: 1,
+	tokenMul: 2,
+	tokenDiv: 2,
+	tokenMod: 2,
+	tokenPow: 3,
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse builds the syntax tree of the given query, which must evaluate to a scalar or an instant vector.
+func parse(query string) (expr, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	e, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.typ != tokenEOF {
+		return nil, p.errorf(t, "unexpected %q", t.val)
+	}
+	if e.exprType() == "matrix" {
+		return nil, fmt.Errorf("a range vector can only be given to functions")
+	}
+	return e, nil
+}
+
+// ParseSelector parses a vector selector such as `http_requests_total{code=~"5.."}` into matchers,
+// which can be given to SelectSeries and the like.
+func ParseSelector(selector string) ([]*embedtsdb.Matcher, error) {
+	tokens, err := lex(selector)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	var metric string
+	t := p.peek()
+	switch t.typ {
+	case tokenIdentifier:
+		p.next()
+		metric = t.val
+	case tokenLeftBrace:
+	default:
+		return nil, p.errorf(t, "expected a vector selector but got %q", t.val)
+	}
+	e, err := p.parseSelector(metric)
+	if err != nil {
+		return nil, err
+	}
+	vs, ok := e.(*vectorSelector)
+	if t := p.peek(); !ok || vs.offset != 0 || t.typ != tokenEOF {
+		return nil, p.errorf(t, "expected a vector selector only")
+	}
+	return vs.matchers, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.typ != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(typ tokenType, what string) (token, error) {
+	t := p.next()
+	if t.typ != typ {
+		return t, p.errorf(t, "expected %s but got %q", what, t.val)
+	}
+	return t, nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("parse error at position %d: %s", t.pos, fmt.Sprintf(format, args...))
+}
+
+// parseExpr parses binary expressions whose operators bind tighter than or equal to minPrecedence.
+func (p *parser) parseExpr(minPrecedence int) (expr, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		prec, ok := precedences[t.typ]
+		if !ok || prec < minPrecedence {
+			return lhs, nil
+		}
+		p.next()
+		next := prec + 1
+		if t.typ == tokenPow {
+			next = prec
+		}
+		rhs, err := p.parseExpr(next)
+		if err != nil {
+			return nil, err
+		}
+		for _, operand := range []expr{lhs, rhs} {
+			if operand.exprType() == "matrix" {
+				return nil, p.errorf(t, "a range vector can't be an operand of %q", t.val)
+			}
+		}
+		lhs = &binaryExpr{op: t.typ, lhs: lhs, rhs: rhs}
+	}
+}
+
+func (p *parser) parseUnary() (expr, error) {
+	t := p.peek()
+	if t.typ != tokenSub && t.typ != tokenAdd {
+		return p.parsePrimary()
+	}
+	p.next()
+	// Unary operators bind looser than "^", so "-2^2" is -4.
+	e, err := p.parseExpr(precedences[tokenPow])
+	if err != nil {
+		return nil, err
+	}
+	if e.exprType() == "matrix" {
+		return nil, p.errorf(t, "a range vector can't be an operand of %q", t.val)
+	}
+	if t.typ == tokenAdd {
+		return e, nil
+	}
+	if n, ok := e.(*numberLiteral); ok {
+		return &numberLiteral{val: -n.val}, nil
+	}
+	return &unaryExpr{expr: e}, nil
+}
+
+func (p *parser) parsePrimary() (expr, error) {
+	t := p.peek()
+	switch t.typ {
+	case tokenNumber:
+		p.next()
+		v, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number %q", t.val)
+		}
+		return &numberLiteral{val: v}, nil
+	case tokenLeftParen:
+		p.next()
+		e, err := p.parseExpr(0)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRightParen, `")"`); err != nil {
+			return nil, err
+		}
+		return e, nil
+	case tokenLeftBrace:
+		return p.parseSelector("")
+	case tokenIdentifier:
+		p.next()
+		if aggregateOps[t.val] {
+			return p.parseAggregate(t.val)
+		}
+		if p.peek().typ == tokenLeftParen {
+			return p.parseCall(t)
+		}
+		return p.parseSelector(t.val)
+	default:
+		return nil, p.errorf(t, "unexpected %q", t.val)
+	}
+}
+
+func (p *parser) parseAggregate(op string) (expr, error) {
+	agg := &aggregateExpr{op: op}
+	parseGrouping := func() error {
+		t := p.peek()
+		if t.typ != tokenIdentifier || (t.val != "by" && t.val != "without") {
+			return nil
+		}
+		p.next()
+		agg.without = t.val == "without"
+		labels, err := p.parseLabelList()
+		if err != nil {
+			return err
+		}
+		agg.grouping = labels
+		return nil
+	}
+
+	// The grouping clause can be placed either before or after the argument.
+	if err := parseGrouping(); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(tokenLeftParen, `"("`); err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	e, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	if e.exprType() != "vector" {
+		return nil, p.errorf(t, "expected an instant vector in %s aggregation", op)
+	}
+	agg.expr = e
+	if _, err := p.expect(tokenRightParen, `")"`); err != nil {
+		return nil, err
+	}
+	if agg.grouping == nil {
+		if err := parseGrouping(); err != nil {
+			return nil, err
+		}
+	}
+	return agg, nil
+}
+
+func (p *parser) parseLabelList() ([]string, error) {
+	if _, err := p.expect(tokenLeftParen, `"("`); err != nil {
+		return nil, err
+	}
+	labels := make([]string, 0)
+	for p.peek().typ != tokenRightParen {
+		t, err := p.expect(tokenIdentifier, "label name")
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, t.val)
+		if p.peek().typ != tokenComma {
+			break
+		}
+		p.next()
+	}
+	if _, err := p.expect(tokenRightParen, `")"`); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+func (p *parser) parseCall(name token) (expr, error) {
+	fn, ok := functions[name.val]
+	if !ok {
+		return nil, p.errorf(name, "unknown function %q", name.val)
+	}
+	p.next() // "("
+	t := p.peek()
+	e, err := p.parseExpr(0)
+	if err != nil {
+		return nil, err
+	}
+	ms, ok := e.(*matrixSelector)
+	if !ok {
+		return nil, p.errorf(t, "expected a range vector in %s()", name.val)
+	}
+	if _, err := p.expect(tokenRightParen, `")"`); err != nil {
+		return nil, err
+	}
+	return &call{fn: fn, arg: ms}, nil
+}
+
+func (p *parser) parseSelector(metric string) (expr, error) {
+	vs := &vectorSelector{}
+	if metric != "" {
+		vs.matchers = append(vs.matchers, embedtsdb.MustNewMatcher(embedtsdb.MatchEqual, embedtsdb.MetricNameLabel, metric))
+	}
+	if p.peek().typ == tokenLeftBrace {
+		p.next()
+		for p.peek().typ != tokenRightBrace {
+			m, err := p.parseMatcher()
+			if err != nil {
+				return nil, err
+			}
+			vs.matchers = append(vs.matchers, m)
+			if p.peek().typ != tokenComma {
+				break
+			}
+			p.next()
+		}
+		if _, err := p.expect(tokenRightBrace, `"}"`); err != nil {
+			return nil, err
+		}
+	}
+
+	// Like Prometheus, selecting every series by matchers that all match an empty string is refused.
+	nonEmpty := false
+	for _, m := range vs.matchers {
+		if !m.Matches("") {
+			nonEmpty = true
+		}
+	}
+	if !nonEmpty {
+		return nil, p.errorf(p.peek(), "vector selector must contain at least one matcher that doesn't match an empty string")
+	}
+
+	var e expr = vs
+	if p.peek().typ == tokenLeftBracket {
+		p.next()
+		rng, err := p.parseDuration()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRightBracket, `"]"`); err != nil {
+			return nil, err
+		}
+		e = &matrixSelector{vectorSelector: vs, rng: rng}
+	}
+	if t := p.peek(); t.typ == tokenIdentifier && t.val == "offset" {
+		p.next()
+		offset, err := p.parseDuration()
+		if err != nil {
+			return nil, err
+		}
+		vs.offset = offset
+	}
+	return e, nil
+}
+
+func (p *parser) parseMatcher() (*embedtsdb.Matcher, error) {
+	name, err := p.expect(tokenIdentifier, "label name")
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	var typ embedtsdb.MatchType
+	switch op.typ {
+	case tokenEqual:
+		typ = embedtsdb.MatchEqual
+	case tokenNotEqual:
+		typ = embedtsdb.MatchNotEqual
+	case tokenRegexMatch:
+		typ = embedtsdb.MatchRegexp
+	case tokenRegexNotMatch:
+		typ = embedtsdb.MatchNotRegexp
+	default:
+		return nil, p.errorf(op, "expected a match operator but got %q", op.val)
+	}
+	value, err := p.expect(tokenString, "label value")
+	if err != nil {
+		return nil, err
+	}
+	m, err := embedtsdb.NewMatcher(typ, name.val, value.val)
+	if err != nil {
+		return nil, p.errorf(value, "%v", err)
+	}
+	return m, nil
+}
+
+func (p *parser) parseDuration() (time.Duration, error) {
+	t, err := p.expect(tokenDuration, "duration")
+	if err != nil {
+		return 0, err
+	}
+	d, err := parseDuration(t.val)
+	if err != nil {
+		return 0, p.errorf(t, "%v", err)
+	}
+	if d <= 0 {
+		return 0, p.errorf(t, "duration must be positive")
+	}
+	return d, nil
+}
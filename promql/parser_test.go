@@ -0,0 +1,169 @@
+package promql
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+func Test_lex(t *testing.T) {
+	tokens, err := lex(`rate(http_requests_total{code=~"5..", method!='GET'}[1h30m] offset 5m) * 2.5e1`)
+	require.NoError(t, err)
+	want := []struct {
+		typ tokenType
+		val string
+	}{
+		{tokenIdentifier, "rate"},
+		{tokenLeftParen, "("},
+		{tokenIdentifier, "http_requests_total"},
+		{tokenLeftBrace, "{"},
+		{tokenIdentifier, "code"},
+		{tokenRegexMatch, "=~"},
+		{tokenString, "5.."},
+		{tokenComma, ","},
+		{tokenIdentifier, "method"},
+		{tokenNotEqual, "!="},
+		{tokenString, "GET"},
+		{tokenRightBrace, "}"},
+		{tokenLeftBracket, "["},
+		{tokenDuration, "1h30m"},
+		{tokenRightBracket, "]"},
+		{tokenIdentifier, "offset"},
+		{tokenDuration, "5m"},
+		{tokenRightParen, ")"},
+		{tokenMul, "*"},
+		{tokenNumber, "2.5e1"},
+		{tokenEOF, ""},
+	}
+	require.Len(t, tokens, len(want))
+	for i := range want {
+		assert.Equal(t, want[i].typ, tokens[i].typ, "token %d", i)
+		assert.Equal(t, want[i].val, tokens[i].val, "token %d", i)
+	}
+
+	for _, query := range []string{`foo{a="b}`, `foo @ 1`, `1x`} {
+		_, err := lex(query)
+		assert.Error(t, err, query)
+	}
+}
+
+func Test_parseDuration(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "5m", want: 5 * time.Minute},
+		{in: "1h30m", want: 90 * time.Minute},
+		{in: "2d", want: 48 * time.Hour},
+		{in: "1w", want: 7 * 24 * time.Hour},
+		{in: "100ms", want: 100 * time.Millisecond},
+		{in: "5x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseDuration(tt.in)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_parse(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{name: "number", query: "1.5", want: "scalar"},
+		{name: "selector", query: `cpu{host="a"}`, want: "vector"},
+		{name: "selector by name matcher", query: `{__name__=~"cpu|mem"}`, want: "vector"},
+		{name: "function", query: `rate(cpu[5m] offset 1h)`, want: "vector"},
+		{name: "aggregation with trailing grouping", query: `sum(cpu) by (host)`, want: "vector"},
+		{name: "aggregation with leading grouping", query: `avg without (host) (cpu)`, want: "vector"},
+		{name: "arithmetic between scalars", query: `-2 ^ 2 + 1`, want: "scalar"},
+		{name: "arithmetic between vectors", query: `cpu / on_cpu * 100`, want: "vector"},
+		{name: "range vector at top level", query: `cpu[5m]`, wantErr: true},
+		{name: "range vector as an operand", query: `cpu[5m] * 2`, wantErr: true},
+		{name: "instant vector given to function", query: `rate(cpu)`, wantErr: true},
+		{name: "unknown function", query: `foo(cpu[5m])`, wantErr: true},
+		{name: "scalar aggregation", query: `sum(1)`, wantErr: true},
+		{name: "empty matchers", query: `{host=""}`, wantErr: true},
+		{name: "unclosed paren", query: `(cpu`, wantErr: true},
+		{name: "trailing token", query: `cpu cpu`, wantErr: true},
+		{name: "invalid regexp", query: `cpu{host=~"("}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parse(tt.query)
+			assert.Equal(t, tt.wantErr, err != nil)
+			if err == nil {
+				assert.Equal(t, tt.want, got.exprType())
+			}
+		})
+	}
+}
+
+func Test_parse_precedence(t *testing.T) {
+	e, err := parse(`1 + 2 * 3 ^ 2 ^ 0.5`)
+	require.NoError(t, err)
+	ev := &evaluator{}
+	v, err := ev.eval(e, 0)
+	require.NoError(t, err)
+	// "^" is right-associative.
+	assert.InDelta(t, 1+2*math.Pow(3, math.Sqrt2), float64(v.(scalar)), 1e-9)
+
+	e, err = parse(`-2 ^ 2`)
+	require.NoError(t, err)
+	v, err = ev.eval(e, 0)
+	require.NoError(t, err)
+	assert.Equal(t, scalar(-4), v)
+}
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		want     []*embedtsdb.Matcher
+		wantErr  bool
+	}{
+		{
+			name:     "metric only",
+			selector: "cpu",
+			want:     []*embedtsdb.Matcher{embedtsdb.MustNewMatcher(embedtsdb.MatchEqual, embedtsdb.MetricNameLabel, "cpu")},
+		},
+		{
+			name:     "metric and labels",
+			selector: `cpu{host!="a",region=~"us-.*"}`,
+			want: []*embedtsdb.Matcher{
+				embedtsdb.MustNewMatcher(embedtsdb.MatchEqual, embedtsdb.MetricNameLabel, "cpu"),
+				embedtsdb.MustNewMatcher(embedtsdb.MatchNotEqual, "host", "a"),
+				embedtsdb.MustNewMatcher(embedtsdb.MatchRegexp, "region", "us-.*"),
+			},
+		},
+		{
+			name:     "labels only",
+			selector: `{__name__=~".+"}`,
+			want:     []*embedtsdb.Matcher{embedtsdb.MustNewMatcher(embedtsdb.MatchRegexp, embedtsdb.MetricNameLabel, ".+")},
+		},
+		{name: "range", selector: "cpu[5m]", wantErr: true},
+		{name: "offset", selector: "cpu offset 5m", wantErr: true},
+		{name: "expression", selector: "cpu * 2", wantErr: true},
+		{name: "function", selector: "rate(cpu[5m])", wantErr: true},
+		{name: "empty matchers", selector: `{host=""}`, wantErr: true},
+		{name: "empty", selector: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSelector(tt.selector)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
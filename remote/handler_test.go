@@ -0,0 +1,208 @@
+package remote
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+func post(t *testing.T, url string, body []byte) *http.Response {
+	resp, err := http.Post(url, "application/x-protobuf", bytes.NewReader(snappy.Encode(nil, body)))
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestHandlers(t *testing.T) {
+	storage, err := embedtsdb.NewStorage(embedtsdb.WithTimestampPrecision(embedtsdb.Seconds))
+	require.NoError(t, err)
+	defer storage.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/write", NewWriteHandler(storage))
+	mux.Handle("/api/v1/read", NewReadHandler(storage))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	write := WriteRequest{Timeseries: []TimeSeries{
+		{
+			Labels: []embedtsdb.Label{{Name: "__name__", Value: "cpu"}, {Name: "host", Value: "a"}},
+			Samples: []Sample{
+				{Value: 0.1, Timestamp: 1600000000000},
+				{Value: 0.2, Timestamp: 1600000010000},
+				{Value: math.Float64frombits(staleNaNBits), Timestamp: 1600000020000},
+			},
+		},
+		{
+			Labels:  []embedtsdb.Label{{Name: "host", Value: "b"}, {Name: "__name__", Value: "cpu"}},
+			Samples: []Sample{{Value: 0.3, Timestamp: 1600000000000}},
+		},
+	}}
+	resp := post(t, server.URL+"/api/v1/write", write.Marshal())
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	points, err := storage.Select("cpu", []embedtsdb.Label{{Name: "host", Value: "a"}}, 1600000000, 1600000030)
+	require.NoError(t, err)
+	assert.Equal(t, []*embedtsdb.DataPoint{{Timestamp: 1600000000, Value: 0.1}, {Timestamp: 1600000010, Value: 0.2}}, points)
+
+	read := ReadRequest{Queries: []Query{
+		{
+			StartTimestampMs: 1600000000000,
+			EndTimestampMs:   1600000010000,
+			Matchers: []LabelMatcher{
+				{Type: embedtsdb.MatchEqual, Name: "__name__", Value: "cpu"},
+			},
+		},
+		{
+			StartTimestampMs: 1500000000000,
+			EndTimestampMs:   1500000010000,
+			Matchers: []LabelMatcher{
+				{Type: embedtsdb.MatchEqual, Name: "__name__", Value: "cpu"},
+			},
+		},
+	}}
+	resp = post(t, server.URL+"/api/v1/read", read.Marshal())
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "snappy", resp.Header.Get("Content-Encoding"))
+	compressed, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	b, err := snappy.Decode(nil, compressed)
+	require.NoError(t, err)
+	var got ReadResponse
+	require.NoError(t, got.Unmarshal(b))
+	assert.Equal(t, ReadResponse{Results: []QueryResult{
+		{Timeseries: []TimeSeries{
+			{
+				Labels:  []embedtsdb.Label{{Name: "__name__", Value: "cpu"}, {Name: "host", Value: "a"}},
+				Samples: []Sample{{Value: 0.1, Timestamp: 1600000000000}, {Value: 0.2, Timestamp: 1600000010000}},
+			},
+			{
+				Labels:  []embedtsdb.Label{{Name: "__name__", Value: "cpu"}, {Name: "host", Value: "b"}},
+				Samples: []Sample{{Value: 0.3, Timestamp: 1600000000000}},
+			},
+		}},
+		{},
+	}}, got)
+}
+
+func TestHandlers_badRequests(t *testing.T) {
+	storage, err := embedtsdb.NewStorage()
+	require.NoError(t, err)
+	defer storage.Close()
+	writeServer := httptest.NewServer(NewWriteHandler(storage))
+	defer writeServer.Close()
+	readServer := httptest.NewServer(NewReadHandler(storage))
+	defer readServer.Close()
+
+	tests := []struct {
+		name string
+		url  string
+		body []byte
+		raw  bool
+		want int
+	}{
+		{
+			name: "not compressed",
+			url:  writeServer.URL,
+			body: []byte("not snappy"),
+			raw:  true,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "invalid protobuf",
+			url:  writeServer.URL,
+			body: []byte{0xff},
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "missing metric name",
+			url:  writeServer.URL,
+			body: (&WriteRequest{Timeseries: []TimeSeries{{
+				Labels:  []embedtsdb.Label{{Name: "host", Value: "a"}},
+				Samples: []Sample{{Value: 1, Timestamp: 1}},
+			}}}).Marshal(),
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "streamed chunks only",
+			url:  readServer.URL,
+			body: (&ReadRequest{AcceptedResponseTypes: []ResponseType{ResponseTypeStreamedXORChunks}}).Marshal(),
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "no matchers",
+			url:  readServer.URL,
+			body: (&ReadRequest{Queries: []Query{{StartTimestampMs: 1, EndTimestampMs: 2}}}).Marshal(),
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "start after end",
+			url:  readServer.URL,
+			body: (&ReadRequest{Queries: []Query{{
+				StartTimestampMs: 2,
+				EndTimestampMs:   1,
+				Matchers:         []LabelMatcher{{Type: embedtsdb.MatchEqual, Name: embedtsdb.MetricNameLabel, Value: "cpu"}},
+			}}}).Marshal(),
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "invalid matcher",
+			url:  readServer.URL,
+			body: (&ReadRequest{Queries: []Query{{
+				Matchers: []LabelMatcher{{Type: embedtsdb.MatchRegexp, Name: "host", Value: "("}},
+			}}}).Marshal(),
+			want: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := tt.body
+			if !tt.raw {
+				body = snappy.Encode(nil, body)
+			}
+			resp, err := http.Post(tt.url, "application/x-protobuf", bytes.NewReader(body))
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			assert.Equal(t, tt.want, resp.StatusCode)
+		})
+	}
+
+	resp, err := http.Get(writeServer.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+// failingReader fails every selection, as a broken storage would.
+type failingReader struct {
+	embedtsdb.Reader
+}
+
+func (r *failingReader) SelectSeries(_ []*embedtsdb.Matcher, _, _ int64) ([]*embedtsdb.Series, error) {
+	return nil, errors.New("disk failure")
+}
+
+func TestReadHandler_storageError(t *testing.T) {
+	storage, err := embedtsdb.NewStorage()
+	require.NoError(t, err)
+	defer storage.Close()
+	server := httptest.NewServer(NewReadHandler(&failingReader{Reader: storage}))
+	defer server.Close()
+
+	resp := post(t, server.URL, (&ReadRequest{Queries: []Query{{
+		StartTimestampMs: 1,
+		EndTimestampMs:   2,
+		Matchers:         []LabelMatcher{{Type: embedtsdb.MatchEqual, Name: embedtsdb.MetricNameLabel, Value: "cpu"}},
+	}}}).Marshal())
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
@@ -0,0 +1,328 @@
+package remote
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+// The messages below are wire-compatible with the ones defined in Prometheus's prompb package.
+// Only fields needed to exchange float samples are modeled; others are skipped while decoding.
+
+// WriteRequest is the body of a remote-write request.
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+// TimeSeries is a series identified by labels, including the metric name labeled as "__name__".
+type TimeSeries struct {
+	Labels  []embedtsdb.Label
+	Samples []Sample
+}
+
+// Sample is a data point of which timestamp is in milliseconds.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// ReadRequest is the body of a remote-read request.
+type ReadRequest struct {
+	Queries []Query
+	// AcceptedResponseTypes lists the response types the client accepts, in order of preference.
+	AcceptedResponseTypes []ResponseType
+}
+
+// ResponseType is the type of remote-read responses.
+type ResponseType int32
+
+const (
+	// ResponseTypeSamples is a ReadResponse holding all samples at once.
+	ResponseTypeSamples ResponseType = 0
+	// ResponseTypeStreamedXORChunks is a stream of chunked responses, which isn't supported.
+	ResponseTypeStreamedXORChunks ResponseType = 1
+)
+
+// Query selects series by matchers within the time range in milliseconds. Both ends are inclusive.
+type Query struct {
+	StartTimestampMs int64
+	EndTimestampMs   int64
+	Matchers         []LabelMatcher
+}
+
+// LabelMatcher is a matcher on the wire.
+// The values of Type are the same as Prometheus's, as well as embedtsdb.MatchType.
+type LabelMatcher struct {
+	Type  embedtsdb.MatchType
+	Name  string
+	Value string
+}
+
+// ReadResponse is the body of a remote-read response, holding a result for each query in the same order.
+type ReadResponse struct {
+	Results []QueryResult
+}
+
+// QueryResult holds series that satisfy a query.
+type QueryResult struct {
+	Timeseries []TimeSeries
+}
+
+// Marshal encodes the request in the protobuf wire format.
+func (r *WriteRequest) Marshal() []byte {
+	var b []byte
+	for i := range r.Timeseries {
+		b = appendMessage(b, 1, r.Timeseries[i].marshal())
+	}
+	return b
+}
+
+// Unmarshal decodes the request from the protobuf wire format.
+func (r *WriteRequest) Unmarshal(b []byte) error {
+	*r = WriteRequest{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		var ts TimeSeries
+		if err := ts.unmarshal(v); err != nil {
+			return fmt.Errorf("invalid time series: %w", err)
+		}
+		r.Timeseries = append(r.Timeseries, ts)
+		return nil
+	})
+}
+
+// Marshal encodes the request in the protobuf wire format.
+func (r *ReadRequest) Marshal() []byte {
+	var b []byte
+	for i := range r.Queries {
+		b = appendMessage(b, 1, r.Queries[i].marshal())
+	}
+	for _, t := range r.AcceptedResponseTypes {
+		b = protowire.AppendTag(b, 2, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(t))
+	}
+	return b
+}
+
+// Unmarshal decodes the request from the protobuf wire format.
+func (r *ReadRequest) Unmarshal(b []byte) error {
+	*r = ReadRequest{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var q Query
+			if err := q.unmarshal(v); err != nil {
+				return fmt.Errorf("invalid query: %w", err)
+			}
+			r.Queries = append(r.Queries, q)
+		case num == 2 && typ == protowire.VarintType:
+			t, _ := protowire.ConsumeVarint(v)
+			r.AcceptedResponseTypes = append(r.AcceptedResponseTypes, ResponseType(t))
+		case num == 2 && typ == protowire.BytesType:
+			// Packed repeated enum.
+			for len(v) > 0 {
+				t, n := protowire.ConsumeVarint(v)
+				if n < 0 {
+					return protowire.ParseError(n)
+				}
+				r.AcceptedResponseTypes = append(r.AcceptedResponseTypes, ResponseType(t))
+				v = v[n:]
+			}
+		}
+		return nil
+	})
+}
+
+// Marshal encodes the response in the protobuf wire format.
+func (r *ReadResponse) Marshal() []byte {
+	var b []byte
+	for i := range r.Results {
+		var result []byte
+		for j := range r.Results[i].Timeseries {
+			result = appendMessage(result, 1, r.Results[i].Timeseries[j].marshal())
+		}
+		b = appendMessage(b, 1, result)
+	}
+	return b
+}
+
+// Unmarshal decodes the response from the protobuf wire format.
+func (r *ReadResponse) Unmarshal(b []byte) error {
+	*r = ReadResponse{}
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+		var result QueryResult
+		err := consumeFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+			if num != 1 || typ != protowire.BytesType {
+				return nil
+			}
+			var ts TimeSeries
+			if err := ts.unmarshal(v); err != nil {
+				return err
+			}
+			result.Timeseries = append(result.Timeseries, ts)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("invalid query result: %w", err)
+		}
+		r.Results = append(r.Results, result)
+		return nil
+	})
+}
+
+func (ts *TimeSeries) marshal() []byte {
+	var b []byte
+	for _, l := range ts.Labels {
+		var label []byte
+		label = appendString(label, 1, l.Name)
+		label = appendString(label, 2, l.Value)
+		b = appendMessage(b, 1, label)
+	}
+	for _, s := range ts.Samples {
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.Value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(s.Timestamp))
+		b = appendMessage(b, 2, sample)
+	}
+	return b
+}
+
+func (ts *TimeSeries) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			var l embedtsdb.Label
+			err := consumeFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				if typ != protowire.BytesType {
+					return nil
+				}
+				switch num {
+				case 1:
+					l.Name = string(v)
+				case 2:
+					l.Value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Labels = append(ts.Labels, l)
+		case 2:
+			var s Sample
+			err := consumeFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == 1 && typ == protowire.Fixed64Type:
+					bits, _ := protowire.ConsumeFixed64(v)
+					s.Value = math.Float64frombits(bits)
+				case num == 2 && typ == protowire.VarintType:
+					t, _ := protowire.ConsumeVarint(v)
+					s.Timestamp = int64(t)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, s)
+		}
+		return nil
+	})
+}
+
+func (q *Query) marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(q.StartTimestampMs))
+	b = protowire.AppendTag(b, 2, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(q.EndTimestampMs))
+	for _, m := range q.Matchers {
+		var matcher []byte
+		matcher = protowire.AppendTag(matcher, 1, protowire.VarintType)
+		matcher = protowire.AppendVarint(matcher, uint64(m.Type))
+		matcher = appendString(matcher, 2, m.Name)
+		matcher = appendString(matcher, 3, m.Value)
+		b = appendMessage(b, 3, matcher)
+	}
+	return b
+}
+
+func (q *Query) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			t, _ := protowire.ConsumeVarint(v)
+			q.StartTimestampMs = int64(t)
+		case num == 2 && typ == protowire.VarintType:
+			t, _ := protowire.ConsumeVarint(v)
+			q.EndTimestampMs = int64(t)
+		case num == 3 && typ == protowire.BytesType:
+			var m LabelMatcher
+			err := consumeFields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == 1 && typ == protowire.VarintType:
+					t, _ := protowire.ConsumeVarint(v)
+					m.Type = embedtsdb.MatchType(t)
+				case num == 2 && typ == protowire.BytesType:
+					m.Name = string(v)
+				case num == 3 && typ == protowire.BytesType:
+					m.Value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			q.Matchers = append(q.Matchers, m)
+		}
+		return nil
+	})
+}
+
+// consumeFields calls fn with each field in the given message.
+// v is the raw value for varint and fixed types, and the content for length-delimited ones.
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		v := b[:n]
+		if typ == protowire.BytesType {
+			v, _ = protowire.ConsumeBytes(v)
+		}
+		if err := fn(num, typ, v); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+func appendMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
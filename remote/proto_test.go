@@ -0,0 +1,71 @@
+package remote
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+func TestWriteRequest_MarshalUnmarshal(t *testing.T) {
+	want := WriteRequest{Timeseries: []TimeSeries{
+		{
+			Labels:  []embedtsdb.Label{{Name: "__name__", Value: "cpu"}, {Name: "host", Value: "a"}},
+			Samples: []Sample{{Value: 0.5, Timestamp: 1600000000000}, {Value: -1, Timestamp: -1}},
+		},
+		{
+			Labels:  []embedtsdb.Label{{Name: "__name__", Value: "mem"}},
+			Samples: []Sample{{Value: 2, Timestamp: 1600000000000}},
+		},
+	}}
+	b := want.Marshal()
+	// Fields that aren't modeled, like metadata, must be skipped.
+	b = appendMessage(b, 3, appendString(nil, 4, "help text"))
+
+	var got WriteRequest
+	require.NoError(t, got.Unmarshal(b))
+	assert.Equal(t, want, got)
+
+	assert.Error(t, got.Unmarshal(b[:len(b)-1]))
+}
+
+func TestReadRequest_MarshalUnmarshal(t *testing.T) {
+	want := ReadRequest{
+		Queries: []Query{{
+			StartTimestampMs: 1600000000000,
+			EndTimestampMs:   1600000060000,
+			Matchers: []LabelMatcher{
+				{Type: embedtsdb.MatchEqual, Name: "__name__", Value: "cpu"},
+				{Type: embedtsdb.MatchNotRegexp, Name: "host", Value: "b.*"},
+			},
+		}},
+		AcceptedResponseTypes: []ResponseType{ResponseTypeStreamedXORChunks, ResponseTypeSamples},
+	}
+	var got ReadRequest
+	require.NoError(t, got.Unmarshal(want.Marshal()))
+	assert.Equal(t, want, got)
+
+	// Repeated enums are packed by Prometheus.
+	var packed []byte
+	packed = protowire.AppendVarint(packed, uint64(ResponseTypeSamples))
+	packed = protowire.AppendVarint(packed, uint64(ResponseTypeStreamedXORChunks))
+	b := appendMessage(nil, 2, packed)
+	require.NoError(t, got.Unmarshal(b))
+	assert.Equal(t, []ResponseType{ResponseTypeSamples, ResponseTypeStreamedXORChunks}, got.AcceptedResponseTypes)
+}
+
+func TestReadResponse_MarshalUnmarshal(t *testing.T) {
+	want := ReadResponse{Results: []QueryResult{
+		{Timeseries: []TimeSeries{{
+			Labels:  []embedtsdb.Label{{Name: "__name__", Value: "cpu"}},
+			Samples: []Sample{{Value: 1, Timestamp: 1000}},
+		}}},
+		{},
+	}}
+	var got ReadResponse
+	require.NoError(t, got.Unmarshal(want.Marshal()))
+	assert.Equal(t, want, got)
+}
@@ -0,0 +1,131 @@
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/golang/snappy"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+type readHandler struct {
+	reader embedtsdb.Reader
+}
+
+// NewReadHandler gives back a handler that serves remote-read requests from the given reader.
+// Only the SAMPLES response type is supported, so clients asking for streamed chunks alone are refused.
+// Timestamps on the wire are always in milliseconds, and are converted from and into the reader's precision.
+func NewReadHandler(reader embedtsdb.Reader) http.Handler {
+	return &readHandler{
+		reader: reader,
+	}
+}
+
+func (h *readHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := readSnappy(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req ReadRequest
+	if err := req.Unmarshal(b); err != nil {
+		http.Error(w, "failed to decode read request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !acceptsSamples(req.AcceptedResponseTypes) {
+		http.Error(w, "only the SAMPLES response type is supported", http.StatusBadRequest)
+		return
+	}
+
+	resp := ReadResponse{Results: make([]QueryResult, 0, len(req.Queries))}
+	for _, q := range req.Queries {
+		matchers, start, end, err := h.parseQuery(&q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result, err := h.query(matchers, start, end)
+		if err != nil {
+			http.Error(w, "failed to select series: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp.Results = append(resp.Results, result)
+	}
+
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	w.Write(snappy.Encode(nil, resp.Marshal()))
+}
+
+// parseQuery gives back the matchers and the start-end range of the given query, in the reader's precision.
+func (h *readHandler) parseQuery(q *Query) (matchers []*embedtsdb.Matcher, start, end int64, err error) {
+	if len(q.Matchers) == 0 {
+		return nil, 0, 0, fmt.Errorf("at least one matcher must be given")
+	}
+	if q.StartTimestampMs > q.EndTimestampMs {
+		return nil, 0, 0, fmt.Errorf("the given start is greater than end")
+	}
+	matchers = make([]*embedtsdb.Matcher, 0, len(q.Matchers))
+	for _, m := range q.Matchers {
+		matcher, err := embedtsdb.NewMatcher(m.Type, m.Name, m.Value)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		matchers = append(matchers, matcher)
+	}
+	// The end is inclusive on the wire, while exclusive in the storage.
+	precision := h.reader.TimestampPrecision()
+	return matchers, fromMillis(q.StartTimestampMs, precision), fromMillis(q.EndTimestampMs, precision) + 1, nil
+}
+
+func (h *readHandler) query(matchers []*embedtsdb.Matcher, start, end int64) (QueryResult, error) {
+	series, err := h.reader.SelectSeries(matchers, start, end)
+	if errors.Is(err, embedtsdb.ErrNoDataPoints) {
+		return QueryResult{}, nil
+	}
+	if err != nil {
+		return QueryResult{}, err
+	}
+
+	precision := h.reader.TimestampPrecision()
+	result := QueryResult{Timeseries: make([]TimeSeries, 0, len(series))}
+	for _, s := range series {
+		ts := TimeSeries{
+			Labels:  append([]embedtsdb.Label{{Name: embedtsdb.MetricNameLabel, Value: s.Metric}}, s.Labels...),
+			Samples: make([]Sample, 0, len(s.Points)),
+		}
+		// Prometheus expects labels sorted by name.
+		sort.Slice(ts.Labels, func(i, j int) bool {
+			return ts.Labels[i].Name < ts.Labels[j].Name
+		})
+		for _, p := range s.Points {
+			ts.Samples = append(ts.Samples, Sample{Value: p.Value, Timestamp: toMillis(p.Timestamp, precision)})
+		}
+		sort.Slice(ts.Samples, func(i, j int) bool {
+			return ts.Samples[i].Timestamp < ts.Samples[j].Timestamp
+		})
+		result.Timeseries = append(result.Timeseries, ts)
+	}
+	return result, nil
+}
+
+// acceptsSamples tells if the client accepts the SAMPLES response type. Older clients send none.
+func acceptsSamples(types []ResponseType) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, t := range types {
+		if t == ResponseTypeSamples {
+			return true
+		}
+	}
+	return false
+}
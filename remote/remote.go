@@ -0,0 +1,45 @@
+// Package remote provides http.Handler implementations of the Prometheus remote-write and remote-read protocols,
+// so that Prometheus, or any compatible agent like the OpenTelemetry Collector, can ship metrics into a Storage.
+package remote
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/golang/snappy"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+const (
+	// The maximum size of a compressed request body.
+	maxRequestSize = 32 << 20
+)
+
+// fromMillis converts the given timestamp in milliseconds into the precision.
+func fromMillis(ms int64, precision embedtsdb.TimestampPrecision) int64 {
+	return embedtsdb.ConvertTimestamp(ms, time.Millisecond, precision)
+}
+
+// toMillis converts the given timestamp in the precision into milliseconds.
+func toMillis(ts int64, precision embedtsdb.TimestampPrecision) int64 {
+	return embedtsdb.ConvertTimestamp(ts, precision.Unit(), embedtsdb.Milliseconds)
+}
+
+// readSnappy reads the snappy-compressed request body.
+func readSnappy(r *http.Request) ([]byte, error) {
+	compressed, err := io.ReadAll(io.LimitReader(r.Body, maxRequestSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	if len(compressed) > maxRequestSize {
+		return nil, fmt.Errorf("request body is larger than %d bytes", maxRequestSize)
+	}
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress request body: %w", err)
+	}
+	return b, nil
+}
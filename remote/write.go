@@ -0,0 +1,79 @@
+package remote
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+// Prometheus marks series that disappeared with this special NaN.
+const staleNaNBits uint64 = 0x7ff0000000000002
+
+type writeHandler struct {
+	storage embedtsdb.Storage
+}
+
+// NewWriteHandler gives back a handler that accepts remote-write requests, which are snappy-compressed protobuf
+// WriteRequests, and inserts their samples into the given storage.
+// The "__name__" label of each series is taken as its metric. Stale markers are dropped.
+// Timestamps on the wire are always in milliseconds, and are converted into the storage's precision.
+func NewWriteHandler(storage embedtsdb.Storage) http.Handler {
+	return &writeHandler{
+		storage: storage,
+	}
+}
+
+func (h *writeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	b, err := readSnappy(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req WriteRequest
+	if err := req.Unmarshal(b); err != nil {
+		http.Error(w, "failed to decode write request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	precision := h.storage.TimestampPrecision()
+	rows := make([]embedtsdb.Row, 0)
+	for _, ts := range req.Timeseries {
+		metric := ""
+		labels := make([]embedtsdb.Label, 0, len(ts.Labels))
+		for _, l := range ts.Labels {
+			switch {
+			case l.Name == embedtsdb.MetricNameLabel:
+				metric = l.Value
+			case l.Value != "":
+				labels = append(labels, l)
+			}
+		}
+		if metric == "" {
+			http.Error(w, "a time series without the metric name given", http.StatusBadRequest)
+			return
+		}
+		for _, s := range ts.Samples {
+			if math.Float64bits(s.Value) == staleNaNBits {
+				continue
+			}
+			rows = append(rows, embedtsdb.Row{
+				Metric:    metric,
+				Labels:    labels,
+				DataPoint: embedtsdb.DataPoint{Timestamp: fromMillis(s.Timestamp, precision), Value: s.Value},
+			})
+		}
+	}
+	if len(rows) > 0 {
+		if err := h.storage.InsertRows(rows); err != nil {
+			http.Error(w, "failed to insert rows: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,530 @@
+package embedtsdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	rollupsDirName = "rollups"
+
+	// The rollup file format is as shown below. Integers are varints except for values, which are big-endian float64.
+	// Timestamps of buckets are deltas from the previous bucket; first and last timestamps are offsets within the bucket.
+	/*
+	   +-----------+-------------+------------+--------------------------+-------------+
+	   | magic(4b) | version(1b) | num series | series name (len, bytes) | num buckets |
+	   +-----------+-------------+------------+--------------------------+-------------+
+	   | timestamp | count | first offset | last offset | sum | min | max | first | last | ...
+	   +-------------------------------------------------------------------------------+
+	*/
+	rollupMagic   = "ETRU"
+	rollupVersion = 1
+)
+
+var rollupFileRegex = regexp.MustCompile(`^r-(-?\d+)-(-?\d+)$`)
+
+// RollupTier describes a tier of downsampled data kept alongside raw data points.
+type RollupTier struct {
+	// Resolution is the width of each rollup bucket.
+	Resolution time.Duration
+	// Retention is how long rollups are kept after they were produced, regardless of WithRetention.
+	// Zero means they are never removed.
+	Retention time.Duration
+}
+
+// WithRollupTiers specifies tiers of downsampled data to be kept on disk, such as 5-minute and 1-hour ones.
+// Whenever an in-memory partition is flushed, its data points are summarized into buckets of each tier
+// holding min, max, sum, count, first and last values.
+//
+// Aggregate picks the coarsest tier whose resolution evenly divides both Start and Step, so that
+// history can still be aggregated after raw data points have been removed by WithRetention.
+// When a tier is used, the last step may include data points up to the end of its rollup bucket.
+//
+// It takes effect only with WithDataPath. Defaults to no tiers.
+func WithRollupTiers(tiers ...RollupTier) Option {
+	return func(s *storage) {
+		s.rollupTierConfigs = tiers
+	}
+}
+
+// rollupTier manages rollup files of a tier, stored under a directory named after its resolution.
+type rollupTier struct {
+	RollupTier
+	// resolution is the width of buckets in the timestamp precision.
+	resolution int64
+	dirPath    string
+}
+
+// openRollupTiers prepares directories for the given tiers, and gives them back sorted by resolution in descending order.
+func openRollupTiers(dataPath string, tiers []RollupTier, precision TimestampPrecision) ([]*rollupTier, error) {
+	opened := make([]*rollupTier, 0, len(tiers))
+	for _, t := range tiers {
+		resolution := toPrecision(t.Resolution, precision)
+		if resolution <= 0 {
+			return nil, fmt.Errorf("rollup resolution %s is too small for the timestamp precision", t.Resolution)
+		}
+		dirPath := filepath.Join(dataPath, rollupsDirName, t.Resolution.String())
+		if err := os.MkdirAll(dirPath, fs.ModePerm); err != nil {
+			return nil, fmt.Errorf("failed to make rollup directory %s: %w", dirPath, err)
+		}
+		opened = append(opened, &rollupTier{
+			RollupTier: t,
+			resolution: resolution,
+			dirPath:    dirPath,
+		})
+	}
+	sort.Slice(opened, func(i, j int) bool {
+		return opened[i].resolution > opened[j].resolution
+	})
+	return opened, nil
+}
+
+// rollupTierFor gives back the coarsest tier that can serve the given query, or nil if none.
+func (s *storage) rollupTierFor(q *AggregateQuery) *rollupTier {
+	for _, t := range s.rollupTiers {
+		if q.Step%t.resolution == 0 && alignTimestamp(q.Start, t.resolution) == q.Start {
+			return t
+		}
+	}
+	return nil
+}
+
+// write summarizes all data points in the given partition into a rollup file.
+// The file is named after the time range of the partition, so that the disk partition flushed from it can be told.
+func (t *rollupTier) write(m *memoryPartition) error {
+	series := make(map[string][]rollupBucket)
+	var err error
+	m.metrics.Range(func(key, value interface{}) bool {
+		mt, ok := value.(*memoryMetric)
+		if !ok {
+			return true
+		}
+		encoder := &rollupEncoder{resolution: t.resolution}
+		if err = m.encodeSeries(mt, encoder); err != nil {
+			return false
+		}
+		if len(encoder.buckets) > 0 {
+			series[mt.name] = encoder.buckets
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("failed to summarize data points: %w", err)
+	}
+	return writeRollupFile(t.path(m.minTimestamp(), m.maxTimestamp()), series)
+}
+
+// rewrite summarizes data points of the given disk partition into the rollups produced when it was flushed
+// again, or the rollups of all partitions it was compacted from, so that deleted data points drop out of them.
+// Rollups that don't exist are left as is, and the others keep their modification time for the retention.
+func (t *rollupTier) rewrite(d *diskPartition) error {
+	keys := [][2]int64{{d.minTimestamp(), d.maxTimestamp()}}
+	if d.meta.Compaction != nil {
+		keys = d.meta.Compaction.Flushed
+	}
+	for _, key := range keys {
+		path := t.path(key[0], key[1])
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to stat rollup file: %w", err)
+		}
+		series := make(map[string][]rollupBucket)
+		for name := range d.meta.Metrics {
+			it, err := d.iterator(name, key[0], key[1]+1)
+			if err != nil {
+				return err
+			}
+			encoder := &rollupEncoder{resolution: t.resolution}
+			for it.Next() {
+				timestamp, value := it.At()
+				if err := encoder.encodePoint(&DataPoint{Timestamp: timestamp, Value: value}); err != nil {
+					return fmt.Errorf("failed to summarize data points: %w", err)
+				}
+			}
+			if err := it.Err(); err != nil {
+				return fmt.Errorf("failed to summarize data points: %w", err)
+			}
+			if len(encoder.buckets) > 0 {
+				series[name] = encoder.buckets
+			}
+		}
+		if err := writeRollupFile(path, series); err != nil {
+			return err
+		}
+		if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+			return fmt.Errorf("failed to restore the modification time of rollup file: %w", err)
+		}
+	}
+	return nil
+}
+
+// path gives back the path to the rollup file of a partition, which is named after its time range.
+func (t *rollupTier) path(minTimestamp, maxTimestamp int64) string {
+	return filepath.Join(t.dirPath, fmt.Sprintf("r-%d-%d", minTimestamp, maxTimestamp))
+}
+
+// writeRollupFile writes the given series into a rollup file at the given path, replacing the existing one.
+func writeRollupFile(path string, series map[string][]rollupBucket) error {
+	// Write to a temporary file first so that a half-written rollup never gets read.
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create rollup file: %w", err)
+	}
+	defer f.Close()
+	if err := writeRollup(f, series); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync rollup file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close rollup file: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename rollup file: %w", err)
+	}
+	// A rollup being rewritten must survive a crash before its partition is removed.
+	return syncDir(filepath.Dir(path))
+}
+
+// blocks gives back rollup files that may hold buckets within the given range.
+func (t *rollupTier) blocks(start, end int64) ([]*rollupBlock, error) {
+	files, err := os.ReadDir(t.dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rollup directory: %w", err)
+	}
+	blocks := make([]*rollupBlock, 0)
+	for _, f := range files {
+		matches := rollupFileRegex.FindStringSubmatch(f.Name())
+		if matches == nil {
+			continue
+		}
+		minTimestamp, err1 := strconv.ParseInt(matches[1], 10, 64)
+		maxTimestamp, err2 := strconv.ParseInt(matches[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if !t.overlaps(minTimestamp, maxTimestamp, start, end) {
+			continue
+		}
+		blocks = append(blocks, &rollupBlock{
+			minTimestamp: minTimestamp,
+			maxTimestamp: maxTimestamp,
+			path:         filepath.Join(t.dirPath, f.Name()),
+		})
+	}
+	return blocks, nil
+}
+
+// overlaps tells if buckets of a rollup file over the given time range may lie within the given start-end range.
+func (t *rollupTier) overlaps(minTimestamp, maxTimestamp, start, end int64) bool {
+	return alignTimestamp(maxTimestamp, t.resolution) >= start && alignTimestamp(minTimestamp, t.resolution) < end
+}
+
+// selectBlocks picks rollups to be used in place of the given partitions.
+// A disk partition is replaced with the rollup produced when it was flushed, or the rollups of all partitions
+// it was compacted from, while in-memory ones are kept as is.
+// Rollups whose partitions have been already removed are given back as well, which have been rewritten
+// if the partitions had deleted data points.
+func (t *rollupTier) selectBlocks(partitions []partition, start, end int64) ([]partition, []*rollupBlock, error) {
+	blocks, err := t.blocks(start, end)
+	if err != nil {
+		return nil, nil, err
+	}
+	byRange := make(map[[2]int64]*rollupBlock, len(blocks))
+	for _, b := range blocks {
+		byRange[[2]int64{b.minTimestamp, b.maxTimestamp}] = b
+	}
+
+	raw := make([]partition, 0, len(partitions))
+	for _, part := range partitions {
+		keys := [][2]int64{{part.minTimestamp(), part.maxTimestamp()}}
+		if d, ok := part.(*diskPartition); ok && d.meta.Compaction != nil {
+			// A compacted partition is replaced with the rollups of all partitions it was merged from.
+			keys = keys[:0]
+			for _, key := range d.meta.Compaction.Flushed {
+				if t.overlaps(key[0], key[1], start, end) {
+					keys = append(keys, key)
+				}
+			}
+		}
+		found := 0
+		for _, key := range keys {
+			if _, ok := byRange[key]; ok {
+				found++
+			}
+		}
+		if found == 0 {
+			raw = append(raw, part)
+			continue
+		}
+		_, isMemory := part.(*memoryPartition)
+		d, isDisk := part.(*diskPartition)
+		if isMemory || found < len(keys) || isDisk && !d.tombstones.empty() {
+			// It's about to be flushed, some rollups are missing, or some data points have been deleted since
+			// the rollups were written; prefer the raw data points.
+			for _, key := range keys {
+				delete(byRange, key)
+			}
+			raw = append(raw, part)
+			continue
+		}
+		for _, key := range keys {
+			byRange[key].replaced = true
+		}
+	}
+
+	selected := make([]*rollupBlock, 0, len(byRange))
+	for _, b := range blocks {
+		if _, ok := byRange[[2]int64{b.minTimestamp, b.maxTimestamp}]; !ok {
+			continue
+		}
+		err := b.load()
+		if errors.Is(err, os.ErrNotExist) && !b.replaced {
+			// Removed due to the retention in the meantime.
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		selected = append(selected, b)
+	}
+	return raw, selected, nil
+}
+
+// rewriteRollups rewrites the rollups of the given partitions having deleted data points, which must be
+// done before the partitions are removed since their tombstones are gone along with them.
+func (s *storage) rewriteRollups(partitions []partition) error {
+	for _, part := range partitions {
+		d, ok := part.(*diskPartition)
+		if !ok || d.tombstones.empty() {
+			continue
+		}
+		for _, tier := range s.rollupTiers {
+			if err := tier.rewrite(d); err != nil {
+				return fmt.Errorf("failed to rewrite %s rollup of %s: %w", tier.Resolution, d.dirPath, err)
+			}
+		}
+	}
+	return nil
+}
+
+// removeExpired removes rollup files that were produced before the retention period.
+func (t *rollupTier) removeExpired() error {
+	if t.Retention <= 0 {
+		return nil
+	}
+	files, err := os.ReadDir(t.dirPath)
+	if err != nil {
+		return fmt.Errorf("failed to read rollup directory: %w", err)
+	}
+	for _, f := range files {
+		if !rollupFileRegex.MatchString(f.Name()) {
+			continue
+		}
+		info, err := f.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to stat rollup file: %w", err)
+		}
+		if time.Since(info.ModTime()) <= t.Retention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(t.dirPath, f.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove expired rollup file: %w", err)
+		}
+	}
+	return nil
+}
+
+// rollupBucket is the summary of data points within a bucket beginning at the timestamp.
+type rollupBucket struct {
+	timestamp int64
+	aggregation
+}
+
+// rollupEncoder is a seriesEncoder that summarizes data points into buckets instead of encoding them.
+// Data points must be given in ascending order of timestamps.
+type rollupEncoder struct {
+	resolution int64
+	buckets    []rollupBucket
+}
+
+func (e *rollupEncoder) encodePoint(point *DataPoint) error {
+	timestamp := alignTimestamp(point.Timestamp, e.resolution)
+	if n := len(e.buckets); n == 0 || e.buckets[n-1].timestamp != timestamp {
+		e.buckets = append(e.buckets, rollupBucket{timestamp: timestamp})
+	}
+	e.buckets[len(e.buckets)-1].add(point.Timestamp, point.Value)
+	return nil
+}
+
+func (e *rollupEncoder) flush() error {
+	return nil
+}
+
+// rollupBlock is a rollup file produced from a single partition.
+type rollupBlock struct {
+	minTimestamp int64
+	maxTimestamp int64
+	path         string
+	// replaced tells if the block stands in for a disk partition in the query.
+	replaced bool
+	// series is populated by load.
+	series map[string][]rollupBucket
+}
+
+func (b *rollupBlock) load() error {
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return fmt.Errorf("failed to read rollup file: %w", err)
+	}
+	series, err := readRollup(data)
+	if err != nil {
+		return fmt.Errorf("failed to decode rollup file %s: %w", b.path, err)
+	}
+	b.series = series
+	return nil
+}
+
+// matchSeries gives back the marshaled names of series in the block that satisfy all the given matchers.
+func (b *rollupBlock) matchSeries(matchers []*Matcher) []string {
+	names := make([]string, 0)
+	for name := range b.series {
+		metric, labels := unmarshalMetricName(name)
+		if matchLabels(metric, labels, matchers) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// aggregate merges buckets of the given series that begin within the queried range into the query buckets.
+func (b *rollupBlock) aggregate(name string, q *AggregateQuery, buckets []aggregation) {
+	rollups := b.series[name]
+	for i := range rollups {
+		if rollups[i].timestamp < q.Start || rollups[i].timestamp >= q.End {
+			continue
+		}
+		buckets[q.bucket(rollups[i].timestamp)].merge(&rollups[i].aggregation)
+	}
+}
+
+func writeRollup(w io.Writer, series map[string][]rollupBucket) error {
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, binary.MaxVarintLen64)
+	writeUvarint := func(v uint64) {
+		n := binary.PutUvarint(buf, v)
+		bw.Write(buf[:n])
+	}
+	writeVarint := func(v int64) {
+		n := binary.PutVarint(buf, v)
+		bw.Write(buf[:n])
+	}
+	writeFloat := func(v float64) {
+		binary.BigEndian.PutUint64(buf, math.Float64bits(v))
+		bw.Write(buf[:8])
+	}
+
+	bw.WriteString(rollupMagic)
+	bw.WriteByte(rollupVersion)
+	names := make([]string, 0, len(series))
+	for name := range series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeUvarint(uint64(len(names)))
+	for _, name := range names {
+		writeUvarint(uint64(len(name)))
+		bw.WriteString(name)
+		buckets := series[name]
+		writeUvarint(uint64(len(buckets)))
+		var prev int64
+		for i := range buckets {
+			b := &buckets[i]
+			writeVarint(b.timestamp - prev)
+			prev = b.timestamp
+			writeUvarint(uint64(b.count))
+			writeUvarint(uint64(b.firstT - b.timestamp))
+			writeUvarint(uint64(b.lastT - b.timestamp))
+			for _, v := range []float64{b.sum, b.min, b.max, b.firstV, b.lastV} {
+				writeFloat(v)
+			}
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write rollup: %w", err)
+	}
+	return nil
+}
+
+// readRollup decodes buckets of each series encoded by writeRollup.
+func readRollup(b []byte) (map[string][]rollupBucket, error) {
+	if len(b) < len(rollupMagic)+1 || string(b[:len(rollupMagic)]) != rollupMagic {
+		return nil, fmt.Errorf("invalid rollup magic number")
+	}
+	if v := b[len(rollupMagic)]; v != rollupVersion {
+		return nil, fmt.Errorf("unsupported rollup version %d", v)
+	}
+	d := &indexDecoder{b: b[len(rollupMagic)+1:]}
+
+	numSeries := d.uvarint()
+	if d.err == nil && numSeries > uint64(len(d.b)) {
+		return nil, fmt.Errorf("invalid number of series: %d", numSeries)
+	}
+	series := make(map[string][]rollupBucket, numSeries)
+	for i := uint64(0); i < numSeries && d.err == nil; i++ {
+		name := d.string()
+		numBuckets := d.uvarint()
+		if d.err == nil && numBuckets > uint64(len(d.b)) {
+			return nil, fmt.Errorf("invalid number of buckets: %d", numBuckets)
+		}
+		buckets := make([]rollupBucket, 0, numBuckets)
+		var timestamp int64
+		for j := uint64(0); j < numBuckets && d.err == nil; j++ {
+			timestamp += d.varint()
+			b := rollupBucket{timestamp: timestamp}
+			b.count = int64(d.uvarint())
+			b.firstT = timestamp + int64(d.uvarint())
+			b.lastT = timestamp + int64(d.uvarint())
+			b.sum = d.float64()
+			b.min = d.float64()
+			b.max = d.float64()
+			b.firstV = d.float64()
+			b.lastV = d.float64()
+			b.hasValue = b.count > 0
+			buckets = append(buckets, b)
+		}
+		series[name] = buckets
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("failed to decode rollup: %w", d.err)
+	}
+	return series, nil
+}
+
+// alignTimestamp gives back the beginning of the bucket of the given width that the timestamp falls into.
+func alignTimestamp(timestamp, width int64) int64 {
+	r := timestamp % width
+	if r < 0 {
+		r += width
+	}
+	return timestamp - r
+}
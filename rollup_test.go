@@ -0,0 +1,264 @@
+package embedtsdb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_alignTimestamp(t *testing.T) {
+	tests := []struct {
+		name      string
+		timestamp int64
+		width     int64
+		want      int64
+	}{
+		{name: "aligned", timestamp: 300, width: 300, want: 300},
+		{name: "within a bucket", timestamp: 599, width: 300, want: 300},
+		{name: "zero", timestamp: 0, width: 300, want: 0},
+		{name: "negative", timestamp: -1, width: 300, want: -300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, alignTimestamp(tt.timestamp, tt.width))
+		})
+	}
+}
+
+func Test_rollup_encodeDecode(t *testing.T) {
+	encoder := &rollupEncoder{resolution: 10}
+	for _, p := range []*DataPoint{
+		{Timestamp: 1, Value: 4},
+		{Timestamp: 5, Value: 2},
+		{Timestamp: 9, Value: 6},
+		{Timestamp: 25, Value: -1},
+	} {
+		require.NoError(t, encoder.encodePoint(p))
+	}
+	want := []rollupBucket{
+		{timestamp: 0, aggregation: aggregation{count: 3, sum: 12, min: 2, max: 6, firstT: 1, firstV: 4, lastT: 9, lastV: 6, hasValue: true}},
+		{timestamp: 20, aggregation: aggregation{count: 1, sum: -1, min: -1, max: -1, firstT: 25, firstV: -1, lastT: 25, lastV: -1, hasValue: true}},
+	}
+	assert.Equal(t, want, encoder.buckets)
+
+	var buf bytes.Buffer
+	require.NoError(t, writeRollup(&buf, map[string][]rollupBucket{"metric1": encoder.buckets}))
+	got, err := readRollup(buf.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]rollupBucket{"metric1": want}, got)
+
+	_, err = readRollup(buf.Bytes()[:buf.Len()-1])
+	assert.Error(t, err)
+	_, err = readRollup([]byte("invalid"))
+	assert.Error(t, err)
+}
+
+func Test_storage_Aggregate_rollups(t *testing.T) {
+	rows := []Row{
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 1}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000005, Value: 3}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000012, Value: 5}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}, DataPoint: DataPoint{Timestamp: 1600000001, Value: 10}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}, DataPoint: DataPoint{Timestamp: 1600000019, Value: 20}},
+	}
+	cpu := MustNewMatcher(MatchEqual, MetricNameLabel, "cpu")
+	tests := []struct {
+		name    string
+		query   AggregateQuery
+		want    []*Series
+		wantErr bool
+	}{
+		{
+			name:  "finest tier",
+			query: AggregateQuery{Matchers: []*Matcher{cpu}, Start: 1600000000, End: 1600000020, Step: 10, Func: AggregateAvg, GroupBy: []string{"host"}},
+			want: []*Series{
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, Points: []*DataPoint{
+					{Timestamp: 1600000000, Value: 2},
+					{Timestamp: 1600000010, Value: 5},
+				}},
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}, Points: []*DataPoint{
+					{Timestamp: 1600000000, Value: 10},
+					{Timestamp: 1600000010, Value: 20},
+				}},
+			},
+		},
+		{
+			name:  "coarsest tier",
+			query: AggregateQuery{Matchers: []*Matcher{cpu}, Start: 1600000000, End: 1600000020, Step: 20, Func: AggregateLast, Group: true},
+			want: []*Series{
+				{Metric: "cpu", Labels: []Label{}, Points: []*DataPoint{
+					{Timestamp: 1600000000, Value: 20},
+				}},
+			},
+		},
+		{
+			name:  "count",
+			query: AggregateQuery{Matchers: []*Matcher{cpu, MustNewMatcher(MatchEqual, "host", "a")}, Start: 1600000000, End: 1600000020, Step: 20, Func: AggregateCount},
+			want: []*Series{
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, Points: []*DataPoint{
+					{Timestamp: 1600000000, Value: 3},
+				}},
+			},
+		},
+	}
+
+	tmpDir := t.TempDir()
+	opts := []Option{
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithRollupTiers(RollupTier{Resolution: 10 * time.Second}, RollupTier{Resolution: 20 * time.Second}),
+	}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows(rows))
+	require.NoError(t, s.Close())
+
+	// Rollups stand in for disk partitions, so data points must not be counted twice.
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	for _, tt := range tests {
+		t.Run("with raw/"+tt.name, func(t *testing.T) {
+			got, err := s.Aggregate(tt.query)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	require.NoError(t, s.Close())
+
+	// Remove raw data points as if they were expired.
+	dirs, err := filepath.Glob(filepath.Join(tmpDir, "p-*"))
+	require.NoError(t, err)
+	require.NotEmpty(t, dirs)
+	for _, dir := range dirs {
+		require.NoError(t, os.RemoveAll(dir))
+	}
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	for _, tt := range tests {
+		t.Run("without raw/"+tt.name, func(t *testing.T) {
+			got, err := s.Aggregate(tt.query)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	// No tier serves a step that isn't a multiple of any resolution.
+	_, err = s.Aggregate(AggregateQuery{Matchers: []*Matcher{cpu}, Start: 1600000000, End: 1600000020, Step: 3, Func: AggregateSum})
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+}
+
+func Test_storage_rollupTierFor(t *testing.T) {
+	tiers, err := openRollupTiers(t.TempDir(), []RollupTier{
+		{Resolution: 5 * time.Minute},
+		{Resolution: time.Hour},
+	}, Seconds)
+	require.NoError(t, err)
+	s := &storage{rollupTiers: tiers}
+
+	tests := []struct {
+		name  string
+		start int64
+		step  int64
+		want  time.Duration
+	}{
+		{name: "hourly step", start: 7200, step: 3600, want: time.Hour},
+		{name: "unaligned start for hourly tier", start: 300, step: 3600, want: 5 * time.Minute},
+		{name: "5 minutes step", start: 7200, step: 600, want: 5 * time.Minute},
+		{name: "too fine step", start: 7200, step: 60, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tier := s.rollupTierFor(&AggregateQuery{Start: tt.start, End: tt.start + tt.step, Step: tt.step})
+			if tt.want == 0 {
+				assert.Nil(t, tier)
+				return
+			}
+			require.NotNil(t, tier)
+			assert.Equal(t, tt.want, tier.Resolution)
+		})
+	}
+
+	_, err = openRollupTiers(t.TempDir(), []RollupTier{{Resolution: time.Millisecond}}, Seconds)
+	assert.Error(t, err)
+}
+
+func Test_rollupTier_removeExpired(t *testing.T) {
+	tiers, err := openRollupTiers(t.TempDir(), []RollupTier{{Resolution: time.Minute, Retention: time.Hour}}, Seconds)
+	require.NoError(t, err)
+	tier := tiers[0]
+
+	oldPath := filepath.Join(tier.dirPath, "r-0-59")
+	newPath := filepath.Join(tier.dirPath, "r-60-119")
+	require.NoError(t, os.WriteFile(oldPath, nil, 0o644))
+	require.NoError(t, os.WriteFile(newPath, nil, 0o644))
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(oldPath, old, old))
+
+	require.NoError(t, tier.removeExpired())
+	_, err = os.Stat(oldPath)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(newPath)
+	assert.NoError(t, err)
+}
+
+func Test_storage_Aggregate_rollups_delete(t *testing.T) {
+	tmpDir := t.TempDir()
+	opts := []Option{
+		WithDataPath(tmpDir),
+		WithTimestampPrecision(Seconds),
+		WithPartitionDuration(10 * time.Second),
+		WithCompactionRanges(40 * time.Second),
+		WithRollupTiers(RollupTier{Resolution: 10 * time.Second}),
+	}
+	s, err := NewStorage(opts...)
+	require.NoError(t, err)
+	for i := int64(0); i < 40; i++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "cpu", DataPoint: DataPoint{Timestamp: 1600000000 + i, Value: 1}}}))
+	}
+	require.NoError(t, s.Close())
+
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	require.NoError(t, s.Delete([]*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "cpu")}, 1600000005, 1600000015))
+	query := AggregateQuery{
+		Matchers: []*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "cpu")},
+		Start:    1600000000,
+		End:      1600000040,
+		Step:     10,
+		Func:     AggregateSum,
+	}
+	want := []*Series{{Metric: "cpu", Points: []*DataPoint{
+		{Timestamp: 1600000000, Value: 5},
+		{Timestamp: 1600000010, Value: 5},
+		{Timestamp: 1600000020, Value: 10},
+		{Timestamp: 1600000030, Value: 10},
+	}}}
+	// Partitions having deleted data points aren't replaced with their rollups.
+	got, err := s.Aggregate(query)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	// The rollups are rewritten once the tombstones are gone by compaction.
+	require.NoError(t, s.(*storage).compactPartitions())
+	got, err = s.Aggregate(query)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+	require.NoError(t, s.Close())
+
+	dirs, err := filepath.Glob(filepath.Join(tmpDir, "p-*"))
+	require.NoError(t, err)
+	require.Len(t, dirs, 1)
+	require.NoError(t, os.RemoveAll(dirs[0]))
+	s, err = NewStorage(opts...)
+	require.NoError(t, err)
+	defer s.Close()
+	got, err = s.Aggregate(query)
+	require.NoError(t, err)
+	assert.Equal(t, want, got)
+}
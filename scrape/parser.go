@@ -0,0 +1,157 @@
+package scrape
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+// Sample is a sample parsed from the text exposition format.
+type Sample struct {
+	Metric string
+	Labels []embedtsdb.Label
+	Value  float64
+	// Timestamp is in milliseconds, which is valid only if HasTimestamp is true.
+	Timestamp int64
+	// HasTimestamp tells if the sample came with a timestamp, which can be zero.
+	HasTimestamp bool
+}
+
+// Parse parses the Prometheus text exposition format, or OpenMetrics if openMetrics is true.
+// They differ in the unit of timestamps, which is milliseconds in the former and seconds in the latter.
+// Comments including HELP and TYPE are skipped, and so is everything after "# EOF".
+func Parse(data []byte, openMetrics bool) ([]Sample, error) {
+	samples := make([]Sample, 0)
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '#' {
+			if string(line) == "# EOF" {
+				break
+			}
+			continue
+		}
+		s, err := parseSample(string(line), openMetrics)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+func parseSample(line string, openMetrics bool) (Sample, error) {
+	var s Sample
+	i := strings.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return s, fmt.Errorf("invalid sample %q", line)
+	}
+	s.Metric = line[:i]
+	rest := line[i:]
+	if rest[0] == '{' {
+		labels, n, err := parseLabels(rest)
+		if err != nil {
+			return s, err
+		}
+		s.Labels = labels
+		rest = rest[n:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 || len(fields) > 2 {
+		return s, fmt.Errorf("expected value and optional timestamp in %q", line)
+	}
+	v, err := parseValue(fields[0])
+	if err != nil {
+		return s, err
+	}
+	s.Value = v
+	if len(fields) == 2 {
+		if openMetrics {
+			ts, err := strconv.ParseFloat(fields[1], 64)
+			if err != nil {
+				return s, fmt.Errorf("invalid timestamp %q", fields[1])
+			}
+			s.Timestamp = int64(math.Round(ts * 1e3))
+		} else {
+			ts, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return s, fmt.Errorf("invalid timestamp %q", fields[1])
+			}
+			s.Timestamp = ts
+		}
+		s.HasTimestamp = true
+	}
+	return s, nil
+}
+
+// parseLabels parses labels enclosed in braces at the beginning of s, and gives back the length it occupies.
+func parseLabels(s string) ([]embedtsdb.Label, int, error) {
+	labels := make([]embedtsdb.Label, 0)
+	i := 1
+	for {
+		for i < len(s) && (s[i] == ' ' || s[i] == ',') {
+			i++
+		}
+		if i >= len(s) {
+			return nil, 0, fmt.Errorf("unterminated labels in %q", s)
+		}
+		if s[i] == '}' {
+			return labels, i + 1, nil
+		}
+		eq := strings.IndexByte(s[i:], '=')
+		if eq <= 0 {
+			return nil, 0, fmt.Errorf("invalid label in %q", s)
+		}
+		name := strings.TrimSpace(s[i : i+eq])
+		i += eq + 1
+		for i < len(s) && s[i] == ' ' {
+			i++
+		}
+		if i >= len(s) || s[i] != '"' {
+			return nil, 0, fmt.Errorf("label value of %q must be quoted", name)
+		}
+		var value strings.Builder
+		i++
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] != '\\' || i+1 >= len(s) {
+				value.WriteByte(s[i])
+				continue
+			}
+			i++
+			switch s[i] {
+			case 'n':
+				value.WriteByte('\n')
+			default:
+				value.WriteByte(s[i])
+			}
+		}
+		if i >= len(s) {
+			return nil, 0, fmt.Errorf("unterminated label value of %q", name)
+		}
+		i++
+		labels = append(labels, embedtsdb.Label{Name: name, Value: value.String()})
+	}
+}
+
+func parseValue(s string) (float64, error) {
+	switch s {
+	case "+Inf", "Inf":
+		return math.Inf(1), nil
+	case "-Inf":
+		return math.Inf(-1), nil
+	case "NaN":
+		return math.NaN(), nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	return v, nil
+}
@@ -0,0 +1,94 @@
+package scrape
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		openMetrics bool
+		want        []Sample
+		wantErr     bool
+	}{
+		{
+			name: "text format",
+			data: `# HELP http_requests_total The total number of requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",code="400"}    3 1395066363000
+
+go_goroutines 12
+`,
+			want: []Sample{
+				{Metric: "http_requests_total", Labels: []embedtsdb.Label{{Name: "method", Value: "post"}, {Name: "code", Value: "200"}}, Value: 1027, Timestamp: 1395066363000, HasTimestamp: true},
+				{Metric: "http_requests_total", Labels: []embedtsdb.Label{{Name: "method", Value: "post"}, {Name: "code", Value: "400"}}, Value: 3, Timestamp: 1395066363000, HasTimestamp: true},
+				{Metric: "go_goroutines", Value: 12},
+			},
+		},
+		{
+			name: "openmetrics",
+			data: `# TYPE foo counter
+foo_total{a="b"} 1.5 1395066363.5
+# EOF
+ignored 1
+`,
+			openMetrics: true,
+			want: []Sample{
+				{Metric: "foo_total", Labels: []embedtsdb.Label{{Name: "a", Value: "b"}}, Value: 1.5, Timestamp: 1395066363500, HasTimestamp: true},
+			},
+		},
+		{
+			name: "escaped label values",
+			data: `msdos_file_access_time_seconds{path="C:\\DIR\\FILE.TXT",error="Cannot find file:\n\"FILE.TXT\"",} 1.458255915e9` + "\n",
+			want: []Sample{
+				{Metric: "msdos_file_access_time_seconds", Labels: []embedtsdb.Label{{Name: "path", Value: `C:\DIR\FILE.TXT`}, {Name: "error", Value: "Cannot find file:\n\"FILE.TXT\""}}, Value: 1.458255915e9},
+			},
+		},
+		{
+			name: "infinity",
+			data: "histogram_bucket{le=\"+Inf\"} +Inf\nneg -Inf\n",
+			want: []Sample{
+				{Metric: "histogram_bucket", Labels: []embedtsdb.Label{{Name: "le", Value: "+Inf"}}, Value: math.Inf(1)},
+				{Metric: "neg", Value: math.Inf(-1)},
+			},
+		},
+		{
+			name: "zero timestamp",
+			data: "foo 1 0\n",
+			want: []Sample{
+				{Metric: "foo", Value: 1, HasTimestamp: true},
+			},
+		},
+		{name: "missing value", data: "foo\n", wantErr: true},
+		{name: "invalid value", data: "foo bar\n", wantErr: true},
+		{name: "invalid timestamp", data: "foo 1 now\n", wantErr: true},
+		{name: "unquoted label value", data: "foo{a=b} 1\n", wantErr: true},
+		{name: "unterminated labels", data: `foo{a="b" 1` + "\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse([]byte(tt.data), tt.openMetrics)
+			assert.Equal(t, tt.wantErr, err != nil)
+			if tt.wantErr {
+				return
+			}
+			for i := range got {
+				if len(got[i].Labels) == 0 {
+					got[i].Labels = nil
+				}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	got, err := Parse([]byte("foo NaN\n"), false)
+	assert.NoError(t, err)
+	assert.True(t, math.IsNaN(got[0].Value))
+}
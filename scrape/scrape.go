@@ -0,0 +1,249 @@
+// Package scrape periodically scrapes HTTP targets exposing metrics in the Prometheus or OpenMetrics text format,
+// and inserts the samples into a Storage.
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+const (
+	defaultInterval = time.Minute
+	defaultTimeout  = 10 * time.Second
+	// The maximum size of a response body.
+	maxBodySize = 64 << 20
+
+	acceptHeader = `application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1`
+
+	jobLabel      = "job"
+	instanceLabel = "instance"
+)
+
+// Option is an optional setting for NewScraper.
+type Option func(*Scraper)
+
+// WithInterval specifies how often each target is scraped.
+//
+// Defaults to 1m.
+func WithInterval(interval time.Duration) Option {
+	return func(s *Scraper) {
+		s.interval = interval
+	}
+}
+
+// WithTimeout specifies the timeout of each scrape.
+//
+// Defaults to 10s.
+func WithTimeout(timeout time.Duration) Option {
+	return func(s *Scraper) {
+		s.timeout = timeout
+	}
+}
+
+// WithHTTPClient specifies the client to scrape targets with.
+//
+// Defaults to http.DefaultClient.
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *Scraper) {
+		s.client = client
+	}
+}
+
+// WithLogger specifies the logger to emit failed scrapes.
+//
+// Defaults to a logger implementation that does nothing.
+func WithLogger(logger embedtsdb.Logger) Option {
+	return func(s *Scraper) {
+		s.logger = logger
+	}
+}
+
+// Scraper scrapes targets of a job in the same manner as Prometheus does.
+// Each sample is labeled with "job" and "instance", which is the host and port of the target.
+// Labels of the same names exposed by targets are renamed to "exported_job" and "exported_instance".
+// Timestamps are converted into the storage's precision.
+//
+// Along with samples, the following series are recorded for each scrape:
+//   - up: 1 if the scrape succeeded, 0 otherwise
+//   - scrape_duration_seconds: how long the scrape took
+//   - scrape_samples_scraped: the number of samples exposed by the target
+type Scraper struct {
+	storage   embedtsdb.Storage
+	job       string
+	targets   []*url.URL
+	interval  time.Duration
+	timeout   time.Duration
+	precision embedtsdb.TimestampPrecision
+	client    *http.Client
+	logger    embedtsdb.Logger
+}
+
+// NewScraper gives back a scraper for the given job, which scrapes the given URLs.
+func NewScraper(storage embedtsdb.Storage, job string, targets []string, opts ...Option) (*Scraper, error) {
+	if job == "" {
+		return nil, fmt.Errorf("job name must be set")
+	}
+	s := &Scraper{
+		storage:   storage,
+		job:       job,
+		targets:   make([]*url.URL, 0, len(targets)),
+		interval:  defaultInterval,
+		timeout:   defaultTimeout,
+		precision: storage.TimestampPrecision(),
+		client:    http.DefaultClient,
+		logger:    log.New(io.Discard, "", 0),
+	}
+	for _, target := range targets {
+		u, err := url.Parse(target)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid target %q", target)
+		}
+		s.targets = append(s.targets, u)
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive")
+	}
+	return s, nil
+}
+
+// Run scrapes every target right away and then at each interval, until the given context is done.
+// Failed scrapes are logged, and recorded as up being 0.
+func (s *Scraper) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, target := range s.targets {
+		wg.Add(1)
+		go func(target *url.URL) {
+			defer wg.Done()
+			ticker := time.NewTicker(s.interval)
+			defer ticker.Stop()
+			for {
+				if err := s.scrape(ctx, target); err != nil {
+					s.logger.Printf("failed to scrape %s: %v\n", target, err)
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}(target)
+	}
+	wg.Wait()
+}
+
+// ScrapeOnce scrapes all targets once, and gives back the first error occurred if any.
+func (s *Scraper) ScrapeOnce(ctx context.Context) error {
+	var firstErr error
+	for _, target := range s.targets {
+		if err := s.scrape(ctx, target); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to scrape %s: %w", target, err)
+		}
+	}
+	return firstErr
+}
+
+func (s *Scraper) scrape(ctx context.Context, target *url.URL) error {
+	start := time.Now()
+	samples, scrapeErr := s.fetch(ctx, target)
+	duration := time.Since(start)
+
+	timestamp := s.timestamp(start)
+	rows := make([]embedtsdb.Row, 0, len(samples)+3)
+	for _, smp := range samples {
+		ts := timestamp
+		if smp.HasTimestamp {
+			ts = s.fromMillis(smp.Timestamp)
+		}
+		rows = append(rows, embedtsdb.Row{
+			Metric:    smp.Metric,
+			Labels:    s.targetLabels(target, smp.Labels),
+			DataPoint: embedtsdb.DataPoint{Timestamp: ts, Value: smp.Value},
+		})
+	}
+	up := 1.0
+	if scrapeErr != nil {
+		up = 0
+	}
+	for _, m := range []struct {
+		metric string
+		value  float64
+	}{
+		{"up", up},
+		{"scrape_duration_seconds", duration.Seconds()},
+		{"scrape_samples_scraped", float64(len(samples))},
+	} {
+		rows = append(rows, embedtsdb.Row{
+			Metric:    m.metric,
+			Labels:    s.targetLabels(target, nil),
+			DataPoint: embedtsdb.DataPoint{Timestamp: timestamp, Value: m.value},
+		})
+	}
+	if err := s.storage.InsertRows(rows); err != nil {
+		return fmt.Errorf("failed to insert rows: %w", err)
+	}
+	return scrapeErr
+}
+
+func (s *Scraper) fetch(ctx context.Context, target *url.URL) ([]Sample, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", acceptHeader)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server returned HTTP status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	if len(body) > maxBodySize {
+		return nil, fmt.Errorf("response body is larger than %d bytes", maxBodySize)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return Parse(body, mediaType == "application/openmetrics-text")
+}
+
+// targetLabels attaches the job and instance labels to the given ones.
+func (s *Scraper) targetLabels(target *url.URL, labels []embedtsdb.Label) []embedtsdb.Label {
+	out := make([]embedtsdb.Label, 0, len(labels)+2)
+	for _, l := range labels {
+		if l.Name == jobLabel || l.Name == instanceLabel {
+			l.Name = "exported_" + l.Name
+		}
+		out = append(out, l)
+	}
+	return append(out,
+		embedtsdb.Label{Name: jobLabel, Value: s.job},
+		embedtsdb.Label{Name: instanceLabel, Value: target.Host},
+	)
+}
+
+// timestamp converts the given time into the precision.
+func (s *Scraper) timestamp(t time.Time) int64 {
+	return embedtsdb.ConvertTimestamp(t.UnixNano(), time.Nanosecond, s.precision)
+}
+
+// fromMillis converts the given timestamp in milliseconds into the precision.
+func (s *Scraper) fromMillis(ms int64) int64 {
+	return embedtsdb.ConvertTimestamp(ms, time.Millisecond, s.precision)
+}
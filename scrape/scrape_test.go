@@ -0,0 +1,194 @@
+package scrape
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/yudaprama/embedtsdb"
+)
+
+func TestScraper_ScrapeOnce(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.Header.Get("Accept"), "text/plain")
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(`# TYPE requests_total counter
+requests_total{code="200"} 10
+requests_total{code="500",job="exporter"} 2 1600000000000
+`))
+	}))
+	defer target.Close()
+	u, err := url.Parse(target.URL)
+	require.NoError(t, err)
+
+	storage, err := embedtsdb.NewStorage(embedtsdb.WithTimestampPrecision(embedtsdb.Milliseconds))
+	require.NoError(t, err)
+	defer storage.Close()
+	s, err := NewScraper(storage, "app", []string{target.URL})
+	require.NoError(t, err)
+
+	start := time.Now().UnixMilli()
+	require.NoError(t, s.ScrapeOnce(context.Background()))
+	end := time.Now().UnixMilli() + 1
+
+	targetLabels := []embedtsdb.Label{{Name: "job", Value: "app"}, {Name: "instance", Value: u.Host}}
+	points, err := storage.Select("requests_total", append([]embedtsdb.Label{{Name: "code", Value: "200"}}, targetLabels...), start, end)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, 10.0, points[0].Value)
+
+	// The exposed timestamp is respected, and the conflicting label is renamed.
+	points, err = storage.Select("requests_total", append([]embedtsdb.Label{{Name: "code", Value: "500"}, {Name: "exported_job", Value: "exporter"}}, targetLabels...), 1600000000000, 1600000000001)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, 2.0, points[0].Value)
+
+	points, err = storage.Select("up", targetLabels, start, end)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, points[0].Value)
+	points, err = storage.Select("scrape_samples_scraped", targetLabels, start, end)
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, points[0].Value)
+	points, err = storage.Select("scrape_duration_seconds", targetLabels, start, end)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, points[0].Value, 0.0)
+}
+
+func TestScraper_ScrapeOnce_openMetrics(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		w.Write([]byte("foo_total 3 1600000000.25\n# EOF\n"))
+	}))
+	defer target.Close()
+	u, err := url.Parse(target.URL)
+	require.NoError(t, err)
+
+	storage, err := embedtsdb.NewStorage(embedtsdb.WithTimestampPrecision(embedtsdb.Milliseconds))
+	require.NoError(t, err)
+	defer storage.Close()
+	s, err := NewScraper(storage, "app", []string{target.URL})
+	require.NoError(t, err)
+	require.NoError(t, s.ScrapeOnce(context.Background()))
+
+	points, err := storage.Select("foo_total", []embedtsdb.Label{{Name: "job", Value: "app"}, {Name: "instance", Value: u.Host}}, 1600000000250, 1600000000251)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, 3.0, points[0].Value)
+}
+
+// recordingStorage records rows given to InsertRows.
+type recordingStorage struct {
+	embedtsdb.Storage
+	rows []embedtsdb.Row
+}
+
+func (s *recordingStorage) InsertRows(rows []embedtsdb.Row) error {
+	s.rows = append(s.rows, rows...)
+	return nil
+}
+
+func TestScraper_ScrapeOnce_zeroTimestamp(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("foo 1 0\n"))
+	}))
+	defer target.Close()
+
+	storage, err := embedtsdb.NewStorage(embedtsdb.WithTimestampPrecision(embedtsdb.Milliseconds))
+	require.NoError(t, err)
+	defer storage.Close()
+	recording := &recordingStorage{Storage: storage}
+	s, err := NewScraper(recording, "app", []string{target.URL})
+	require.NoError(t, err)
+	require.NoError(t, s.ScrapeOnce(context.Background()))
+
+	// The explicit timestamp is kept rather than replaced with the scrape time.
+	require.NotEmpty(t, recording.rows)
+	assert.Equal(t, "foo", recording.rows[0].Metric)
+	assert.Equal(t, int64(0), recording.rows[0].Timestamp)
+}
+
+func TestScraper_ScrapeOnce_down(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+	defer target.Close()
+	u, err := url.Parse(target.URL)
+	require.NoError(t, err)
+
+	storage, err := embedtsdb.NewStorage(embedtsdb.WithTimestampPrecision(embedtsdb.Milliseconds))
+	require.NoError(t, err)
+	defer storage.Close()
+	s, err := NewScraper(storage, "app", []string{target.URL})
+	require.NoError(t, err)
+
+	start := time.Now().UnixMilli()
+	assert.Error(t, s.ScrapeOnce(context.Background()))
+	points, err := storage.Select("up", []embedtsdb.Label{{Name: "job", Value: "app"}, {Name: "instance", Value: u.Host}}, start, time.Now().UnixMilli()+1)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, 0.0, points[0].Value)
+}
+
+func TestScraper_Run(t *testing.T) {
+	scrapes := make(chan struct{}, 10)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("foo 1\n"))
+		select {
+		case scrapes <- struct{}{}:
+		default:
+		}
+	}))
+	defer target.Close()
+
+	storage, err := embedtsdb.NewStorage()
+	require.NoError(t, err)
+	defer storage.Close()
+	s, err := NewScraper(storage, "app", []string{target.URL}, WithInterval(10*time.Millisecond))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-scrapes:
+		case <-time.After(5 * time.Second):
+			t.Fatal("target wasn't scraped")
+		}
+	}
+	cancel()
+	<-done
+}
+
+func TestNewScraper(t *testing.T) {
+	tests := []struct {
+		name    string
+		job     string
+		targets []string
+		opts    []Option
+		wantErr bool
+	}{
+		{name: "valid", job: "app", targets: []string{"http://localhost:9090/metrics"}},
+		{name: "missing job", targets: []string{"http://localhost:9090/metrics"}, wantErr: true},
+		{name: "missing scheme", job: "app", targets: []string{"localhost:9090"}, wantErr: true},
+		{name: "non-positive interval", job: "app", opts: []Option{WithInterval(0)}, wantErr: true},
+	}
+	storage, err := embedtsdb.NewStorage()
+	require.NoError(t, err)
+	defer storage.Close()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewScraper(storage, tt.job, tt.targets, tt.opts...)
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
@@ -1,7 +1,7 @@
 package embedtsdb
 
 import (
-	"encoding/json"
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
@@ -29,6 +30,8 @@ var (
 
 	partitionDirRegex = regexp.MustCompile(`^p-.+`)
 
+	defaultCompactionRanges = []time.Duration{12 * time.Hour, 48 * time.Hour}
+
 	// Object pools for memory optimization
 	rowSlicePool = sync.Pool{
 		New: func() interface{} {
@@ -42,12 +45,6 @@ var (
 		},
 	}
 
-	dataPointPool = sync.Pool{
-		New: func() interface{} {
-			return &DataPoint{}
-		},
-	}
-
 	stringBuilderPool = sync.Pool{
 		New: func() interface{} {
 			return &strings.Builder{}
@@ -58,6 +55,29 @@ var (
 // TimestampPrecision represents precision of timestamps. See WithTimestampPrecision
 type TimestampPrecision string
 
+// WALSyncMode represents when the WAL is synced to the disk. See WithWALSync
+type WALSyncMode string
+
+const (
+	// WALSyncNever leaves it up to the OS to write the WAL back to the disk, so data points
+	// written shortly before a power failure can be lost.
+	WALSyncNever WALSyncMode = "never"
+	// WALSyncBatch syncs the WAL before InsertRows returns. Concurrent callers share one sync.
+	WALSyncBatch WALSyncMode = "batch"
+	// WALSyncInterval syncs the WAL periodically, so that at most one interval of data points can be lost.
+	WALSyncInterval WALSyncMode = "interval"
+)
+
+// WALCompression represents how WAL records are compressed. See WithWALCompression
+type WALCompression string
+
+const (
+	// WALCompressionNone writes WAL records as they are.
+	WALCompressionNone WALCompression = "none"
+	// WALCompressionSnappy compresses the records of each insertion with Snappy.
+	WALCompressionSnappy WALCompression = "snappy"
+)
+
 const (
 	Nanoseconds  TimestampPrecision = "ns"
 	Microseconds TimestampPrecision = "us"
@@ -69,9 +89,14 @@ const (
 	defaultTimestampPrecision = Nanoseconds
 	defaultWriteTimeout       = 30 * time.Second
 	defaultWALBufferedSize    = 4096
+	defaultWALSegmentSize     = 64 * 1024 * 1024
+	defaultWALCompression     = WALCompressionNone
+	defaultWALSyncMode        = WALSyncNever
+	defaultWALSyncInterval    = 100 * time.Millisecond
 
 	writablePartitionsNum = 2
 	checkExpiredInterval  = time.Hour
+	compactInterval       = 5 * time.Minute
 
 	walDirName = "wal"
 )
@@ -83,6 +108,15 @@ type Storage interface {
 	// If the timestamp is empty, it uses the machine's local timestamp in UTC.
 	// The precision of timestamps is nanoseconds by default. It can be changed using WithTimestampPrecision.
 	InsertRows(rows []Row) error
+	// Import reads data points written by Export in the given format from r, and inserts them in batches.
+	// An invalid record aborts the import, while batches inserted before it are kept.
+	Import(r io.Reader, format Format) error
+	// Delete deletes data points of series that satisfy every given matcher within the given start-end range.
+	// Keep in mind that start is inclusive and end is exclusive. Deleted data points are hidden from queries
+	// right away, and dropped physically when they get flushed to disk or their disk partition gets compacted.
+	// Data points inserted into the range after deleting it are kept, unless they're older than the latest one
+	// of the series at that time.
+	Delete(matchers []*Matcher, start, end int64) error
 	// Close gracefully shutdowns by flushing any unwritten data to the underlying disk partition.
 	Close() error
 }
@@ -93,6 +127,38 @@ type Reader interface {
 	// labels within the given start-end range. Keep in mind that start is inclusive, end is exclusive,
 	// and both must be Unix timestamp. ErrNoDataPoints will be returned if no data points found.
 	Select(metric string, labels []Label, start, end int64) (points []*DataPoint, err error)
+	// SelectSeries gives back all series that satisfy every given matcher, along with their data points
+	// within the given start-end range. Each series comes with its full label set, and the series are sorted
+	// by metric and labels. Use MetricNameLabel to match metric names. At least one matcher must be given.
+	// ErrNoDataPoints will be returned if no data points found.
+	SelectSeries(matchers []*Matcher, start, end int64) (series []*Series, err error)
+	// SelectIterator is like Select but gives back an iterator that decodes data points lazily, instead of
+	// materializing all of them. Data points across partitions are merged in ascending order of timestamps.
+	// An iterator having no data points will be returned if no data points found.
+	// The iterator keeps the partitions it reads from until it's exhausted or closed.
+	SelectIterator(metric string, labels []Label, start, end int64) (Iterator, error)
+	// SelectSeriesSet is like SelectSeries but gives back a set that iterates over series one by one,
+	// and decodes data points of each series lazily. The set keeps the partitions it reads from until
+	// it's exhausted or closed.
+	SelectSeriesSet(matchers []*Matcher, start, end int64) (SeriesSet, error)
+	// Aggregate downsamples series that satisfy the given matchers into one value per step, computed while
+	// decoding data points. Series can also be aggregated across each other by labels.
+	// ErrNoDataPoints will be returned if no data points found.
+	Aggregate(query AggregateQuery) (series []*Series, err error)
+	// Metrics gives back the sorted names of metrics that have data points within the given start-end range.
+	// The range is examined at the granularity of partitions, so metrics slightly outside of it may be included.
+	Metrics(start, end int64) (metrics []string, err error)
+	// LabelNames gives back the sorted label names used by the given metric within the given start-end range.
+	// An empty metric means all metrics.
+	LabelNames(metric string, start, end int64) (names []string, err error)
+	// LabelValues gives back the sorted values of the given label of the given metric within the given start-end range.
+	// An empty metric means all metrics.
+	LabelValues(metric, labelName string, start, end int64) (values []string, err error)
+	// Export writes data points of series that satisfy the given matchers within the given start-end range
+	// to w in the given format. Series are written one by one, so that the whole result isn't held in memory.
+	Export(w io.Writer, matchers []*Matcher, start, end int64, format Format) error
+	// TimestampPrecision gives back the precision of timestamps given by WithTimestampPrecision.
+	TimestampPrecision() TimestampPrecision
 }
 
 // Row includes a data point along with properties to identify a kind of metrics.
@@ -106,6 +172,15 @@ type Row struct {
 	DataPoint
 }
 
+// Series represents a unique combination of metric and labels, along with its data points.
+type Series struct {
+	Metric string
+	// Labels are sorted by name.
+	Labels []Label
+	// Points are sorted by timestamp.
+	Points []*DataPoint
+}
+
 // DataPoint represents a data point, the smallest unit of time series data.
 type DataPoint struct {
 	// The actual value. This field must be set.
@@ -183,7 +258,7 @@ func WithLogger(logger Logger) Option {
 
 // WithWAL specifies the buffered byte size before flushing a WAL file.
 // The larger the size, the less frequently the file is written and more write performance at the expense of durability.
-// Giving 0 means it writes to a file whenever data point comes in.
+// Giving 0 means it writes to a file whenever data point comes in, though it doesn't sync the file. See WithWALSync.
 // Giving -1 disables using WAL.
 //
 // Defaults to 4096.
@@ -193,6 +268,63 @@ func WithWALBufferedSize(size int) Option {
 	}
 }
 
+// WithWALCompression specifies how WAL records are compressed, which reduces the amount of data written
+// at the expense of CPU. Records are decompressed transparently when they are replayed, regardless of this setting.
+//
+// Defaults to WALCompressionNone.
+func WithWALCompression(compression WALCompression) Option {
+	return func(s *storage) {
+		s.walCompression = compression
+	}
+}
+
+// WithWALSync specifies when the WAL is synced to the disk, which is what makes data points
+// survive a power failure, not just a crash of the process.
+// The interval is used only by WALSyncInterval, and defaults to 100ms if not positive.
+//
+// Defaults to WALSyncNever.
+func WithWALSync(mode WALSyncMode, interval time.Duration) Option {
+	return func(s *storage) {
+		s.walSyncMode = mode
+		s.walSyncInterval = interval
+	}
+}
+
+// WithWALSegmentSize specifies the maximum byte size of a WAL segment file. Once the active segment exceeds it,
+// a new one gets cut, so that segments whose data points have all been persisted can be removed
+// even if a partition lasts long. Giving 0 means it's unlimited.
+//
+// Defaults to 64MiB.
+func WithWALSegmentSize(size int64) Option {
+	return func(s *storage) {
+		s.walSegmentSize = size
+	}
+}
+
+// WithWALSegmentAge specifies the maximum time a WAL segment file is written to. Once the active segment gets older,
+// a new one gets cut when data points are written next. Giving 0 means it's unlimited.
+//
+// Defaults to 0.
+func WithWALSegmentAge(age time.Duration) Option {
+	return func(s *storage) {
+		s.walSegmentAge = age
+	}
+}
+
+// WithCompactionRanges specifies the time ranges of blocks that disk partitions are merged into in the background.
+// Adjacent disk partitions lying in the same block of the smallest range get merged into one once no in-memory
+// partition can have data points in it, and then merged ones get merged again into blocks of the next range,
+// and so on. Merging drops deleted data points physically, and reduces the number of memory-mapped files
+// that queries go through. A merged partition is removed by the retention along with its newest data points.
+// Giving nothing disables compaction.
+//
+// Defaults to 12h and 48h.
+func WithCompactionRanges(ranges ...time.Duration) Option {
+	return func(s *storage) {
+		s.compactionRanges = ranges
+	}
+}
+
 // NewStorage gives back a new storage, which stores time-series data in the process memory by default.
 //
 // Give the WithDataPath option for running as a on-disk storage. Specify a directory with data already exists,
@@ -206,6 +338,11 @@ func NewStorage(opts ...Option) (Storage, error) {
 		timestampPrecision: defaultTimestampPrecision,
 		writeTimeout:       defaultWriteTimeout,
 		walBufferedSize:    defaultWALBufferedSize,
+		walSegmentSize:     defaultWALSegmentSize,
+		walCompression:     defaultWALCompression,
+		walSyncMode:        defaultWALSyncMode,
+		walSyncInterval:    defaultWALSyncInterval,
+		compactionRanges:   defaultCompactionRanges,
 		wal:                &nopWAL{},
 		logger:             &nopLogger{},
 		doneCh:             make(chan struct{}, 0),
@@ -213,6 +350,28 @@ func NewStorage(opts ...Option) (Storage, error) {
 	for _, opt := range opts {
 		opt(s)
 	}
+	switch s.walSyncMode {
+	case WALSyncNever, WALSyncBatch, WALSyncInterval:
+	default:
+		return nil, fmt.Errorf("unknown WAL sync mode %q given", s.walSyncMode)
+	}
+	switch s.walCompression {
+	case WALCompressionNone, WALCompressionSnappy:
+	default:
+		return nil, fmt.Errorf("unknown WAL compression %q given", s.walCompression)
+	}
+	if s.walSyncInterval <= 0 {
+		s.walSyncInterval = defaultWALSyncInterval
+	}
+	for _, r := range s.compactionRanges {
+		if r <= 0 {
+			return nil, fmt.Errorf("compaction range must be positive: %v given", r)
+		}
+	}
+	s.compactionRanges = append([]time.Duration(nil), s.compactionRanges...)
+	sort.Slice(s.compactionRanges, func(i, j int) bool {
+		return s.compactionRanges[i] < s.compactionRanges[j]
+	})
 
 	if s.inMemoryMode() {
 		s.newPartition(nil, false)
@@ -223,9 +382,17 @@ func NewStorage(opts ...Option) (Storage, error) {
 		return nil, fmt.Errorf("failed to make data directory %s: %w", s.dataPath, err)
 	}
 
+	tiers, err := openRollupTiers(s.dataPath, s.rollupTierConfigs, s.timestampPrecision)
+	if err != nil {
+		return nil, err
+	}
+	s.rollupTiers = tiers
+
 	walDir := filepath.Join(s.dataPath, walDirName)
 	if s.walBufferedSize >= 0 {
-		wal, err := newDiskWAL(walDir, s.walBufferedSize)
+		wal, err := newDiskWAL(walDir, s.walBufferedSize,
+			withWALSyncMode(s.walSyncMode), withWALSegmentLimits(s.walSegmentSize, s.walSegmentAge),
+			withWALCompression(s.walCompression))
 		if err != nil {
 			return nil, err
 		}
@@ -237,10 +404,6 @@ func NewStorage(opts ...Option) (Storage, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to open data directory: %w", err)
 	}
-	if len(dirs) == 0 {
-		s.newPartition(nil, false)
-		return s, nil
-	}
 	isPartitionDir := func(f fs.DirEntry) bool {
 		return f.IsDir() && partitionDirRegex.MatchString(f.Name())
 	}
@@ -263,6 +426,10 @@ func NewStorage(opts ...Option) (Storage, error) {
 		}
 		partitions = append(partitions, part)
 	}
+	partitions, err = removeCompactedSources(s.dataPath, partitions)
+	if err != nil {
+		return nil, err
+	}
 	sort.Slice(partitions, func(i, j int) bool {
 		return partitions[i].minTimestamp() < partitions[j].minTimestamp()
 	})
@@ -275,6 +442,23 @@ func NewStorage(opts ...Option) (Storage, error) {
 	}
 	s.newPartition(nil, false)
 
+	if s.walSyncMode == WALSyncInterval && s.walBufferedSize >= 0 {
+		go func() {
+			ticker := time.NewTicker(s.walSyncInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-s.doneCh:
+					return
+				case <-ticker.C:
+					if err := s.wal.sync(); err != nil {
+						s.logger.Printf("failed to sync WAL: %v\n", err)
+					}
+				}
+			}
+		}()
+	}
+
 	// periodically check and permanently remove expired partitions.
 	go func() {
 		ticker := time.NewTicker(checkExpiredInterval)
@@ -291,6 +475,22 @@ func NewStorage(opts ...Option) (Storage, error) {
 			}
 		}
 	}()
+
+	// periodically merge small disk partitions.
+	go func() {
+		ticker := time.NewTicker(compactInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.doneCh:
+				return
+			case <-ticker.C:
+				if err := s.compactPartitions(); err != nil {
+					s.logger.Printf("%v\n", err)
+				}
+			}
+		}
+	}()
 	return s, nil
 }
 
@@ -298,17 +498,32 @@ type storage struct {
 	partitionList partitionList
 
 	walBufferedSize    int
+	walSyncMode        WALSyncMode
+	walSyncInterval    time.Duration
+	walSegmentSize     int64
+	walSegmentAge      time.Duration
+	walCompression     WALCompression
 	wal                wal
+	compactionRanges   []time.Duration
 	partitionDuration  time.Duration
 	retention          time.Duration
 	timestampPrecision TimestampPrecision
 	dataPath           string
 	writeTimeout       time.Duration
+	rollupTierConfigs  []RollupTier
+	// rollupTiers are sorted by resolution in descending order.
+	rollupTiers []*rollupTier
 
 	logger         Logger
 	workersLimitCh chan struct{}
 	// wg must be incremented to guarantee all writes are done gracefully.
 	wg sync.WaitGroup
+	// flushMu serializes changes of disk partitions in the partition list, which are made by flushing,
+	// compacting and removing expired partitions.
+	flushMu sync.Mutex
+	// compactMu is held during compaction. Deleting shares it, and removing expired partitions holds it,
+	// so that partitions being compacted are never changed.
+	compactMu sync.RWMutex
 
 	doneCh chan struct{}
 	// shutdown indicates whether the storage is shutting down
@@ -404,12 +619,181 @@ func (s *storage) Select(metric string, labels []Label, start, end int64) ([]*Da
 	points = points[:0] // Reset length but keep capacity
 	defer dataPointSlicePool.Put(points)
 
-	// Iterate over all partitions from the newest one.
+	partitions, err := s.overlappingPartitions(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer releasePartitions(partitions)
+	// Iterate over all partitions from the oldest one, in order to keep the order in ascending.
+	for _, part := range partitions {
+		ps, err := part.selectDataPoints(metric, labels, start, end)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to select data points: %w", err)
+		}
+		points = append(points, ps...)
+	}
+	if len(points) == 0 {
+		return nil, ErrNoDataPoints
+	}
+	// Copy points before returning since we'll put the slice back to pool
+	result := make([]*DataPoint, len(points))
+	copy(result, points)
+	return result, nil
+}
+
+func (s *storage) SelectSeries(matchers []*Matcher, start, end int64) ([]*Series, error) {
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("at least one matcher must be given")
+	}
+	if start >= end {
+		return nil, fmt.Errorf("the given start is greater than end")
+	}
+
+	partitions, err := s.overlappingPartitions(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer releasePartitions(partitions)
+	seriesMap := make(map[string]*Series)
+	for _, part := range partitions {
+		names, err := part.matchSeries(matchers)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to match series: %w", err)
+		}
+		for _, name := range names {
+			metric, labels := unmarshalMetricName(name)
+			ps, err := part.selectDataPoints(metric, labels, start, end)
+			if errors.Is(err, ErrNoDataPoints) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to select data points: %w", err)
+			}
+			if len(ps) == 0 {
+				continue
+			}
+			series, ok := seriesMap[name]
+			if !ok {
+				series = &Series{Metric: metric, Labels: labels}
+				seriesMap[name] = series
+			}
+			series.Points = append(series.Points, ps...)
+		}
+	}
+	if len(seriesMap) == 0 {
+		return nil, ErrNoDataPoints
+	}
+	result := make([]*Series, 0, len(seriesMap))
+	for _, series := range seriesMap {
+		result = append(result, series)
+	}
+	sortSeries(result)
+	return result, nil
+}
+
+func (s *storage) SelectIterator(metric string, labels []Label, start, end int64) (Iterator, error) {
+	if metric == "" {
+		return nil, fmt.Errorf("metric must be set")
+	}
+	if start >= end {
+		return nil, fmt.Errorf("the given start is greater than end")
+	}
+	partitions, err := s.overlappingPartitions(start, end)
+	if err != nil {
+		return nil, err
+	}
+	it, err := selectIterator(partitions, marshalMetricName(metric, labels), start, end)
+	if err != nil {
+		releasePartitions(partitions)
+		return nil, err
+	}
+	return &partitionsIterator{Iterator: it, partitions: partitions}, nil
+}
+
+func (s *storage) SelectSeriesSet(matchers []*Matcher, start, end int64) (SeriesSet, error) {
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("at least one matcher must be given")
+	}
+	if start >= end {
+		return nil, fmt.Errorf("the given start is greater than end")
+	}
+	partitions, err := s.overlappingPartitions(start, end)
+	if err != nil {
+		return nil, err
+	}
+	names, err := matchSeriesNames(partitions, matchers)
+	if err != nil {
+		releasePartitions(partitions)
+		return nil, err
+	}
+	return &seriesSet{
+		names:      names,
+		partitions: partitions,
+		start:      start,
+		end:        end,
+	}, nil
+}
+
+func (s *storage) Delete(matchers []*Matcher, start, end int64) error {
+	if len(matchers) == 0 {
+		return fmt.Errorf("at least one matcher must be given")
+	}
+	if start >= end {
+		return fmt.Errorf("the given start is greater than end")
+	}
+	if atomic.LoadInt32(&s.shutdown) != 0 {
+		return fmt.Errorf("storage is shutting down, cannot accept new writes")
+	}
+	s.wg.Add(1)
+	defer s.wg.Done()
+	s.compactMu.RLock()
+	defer s.compactMu.RUnlock()
+
+	// Log it first so that deletions from in-memory partitions survive a crash.
+	if err := s.wal.appendDelete(matchers, start, end); err != nil {
+		return fmt.Errorf("failed to write to WAL: %w", err)
+	}
+	partitions, err := s.overlappingPartitions(start, end)
+	if err != nil {
+		return err
+	}
+	defer releasePartitions(partitions)
+	for _, part := range partitions {
+		if err := part.delete(matchers, start, end); err != nil {
+			return fmt.Errorf("failed to delete data points: %w", err)
+		}
+	}
+	return nil
+}
+
+// overlappingPartitions gives back partitions that may have data points within the given range, from the oldest one.
+// Disk partitions among them are acquired so that they stay readable, which must be released with releasePartitions.
+func (s *storage) overlappingPartitions(start, end int64) ([]partition, error) {
+	for {
+		partitions, ok, err := s.acquireOverlappingPartitions(start, end)
+		if err != nil || ok {
+			return partitions, err
+		}
+		// A partition has been removed from the list in the meantime, so look it up again.
+	}
+}
+
+// acquireOverlappingPartitions is like overlappingPartitions, but gives back false if any partition has
+// been released by everything already.
+func (s *storage) acquireOverlappingPartitions(start, end int64) ([]partition, bool, error) {
+	partitions := make([]partition, 0)
 	iterator := s.partitionList.newIterator()
 	for iterator.next() {
 		part := iterator.value()
 		if part == nil {
-			return nil, fmt.Errorf("unexpected empty partition found")
+			releasePartitions(partitions)
+			return nil, false, fmt.Errorf("unexpected empty partition found")
 		}
 		if part.minTimestamp() == 0 {
 			// Skip the partition that has no points.
@@ -422,23 +806,215 @@ func (s *storage) Select(metric string, labels []Label, start, end int64) ([]*Da
 		if part.minTimestamp() > end {
 			continue
 		}
-		ps, err := part.selectDataPoints(metric, labels, start, end)
+		if d, ok := part.(*diskPartition); ok && !d.acquire() {
+			if err := releasePartitions(partitions); err != nil {
+				return nil, false, err
+			}
+			return nil, false, nil
+		}
+		partitions = append(partitions, part)
+	}
+	// in order to keep the order in ascending.
+	for i, j := 0, len(partitions)-1; i < j; i, j = i+1, j-1 {
+		partitions[i], partitions[j] = partitions[j], partitions[i]
+	}
+	return partitions, true, nil
+}
+
+// releasePartitions releases the disk partitions acquired by overlappingPartitions.
+func releasePartitions(partitions []partition) error {
+	var err error
+	for _, part := range partitions {
+		d, ok := part.(*diskPartition)
+		if !ok {
+			continue
+		}
+		if e := d.release(); e != nil && err == nil {
+			err = fmt.Errorf("failed to release partition: %w", e)
+		}
+	}
+	return err
+}
+
+// matchSeriesNames gives back the marshaled names of series that satisfy all the given matchers
+// in any of the given partitions, sorted by metric and then by labels.
+func matchSeriesNames(partitions []partition, matchers []*Matcher) ([]string, error) {
+	seen := make(map[string]struct{})
+	series := make([]*Series, 0)
+	for _, part := range partitions {
+		names, err := part.matchSeries(matchers)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to match series: %w", err)
+		}
+		for _, name := range names {
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			metric, labels := unmarshalMetricName(name)
+			series = append(series, &Series{Metric: metric, Labels: labels})
+		}
+	}
+	sortSeries(series)
+	names := make([]string, 0, len(series))
+	for _, s := range series {
+		names = append(names, marshalMetricName(s.Metric, s.Labels))
+	}
+	return names, nil
+}
+
+// selectIterator merges iterators over the given series in all given partitions.
+func selectIterator(partitions []partition, name string, start, end int64) (Iterator, error) {
+	its := make([]Iterator, 0, len(partitions))
+	for _, part := range partitions {
+		it, err := part.selectIterator(name, start, end)
 		if errors.Is(err, ErrNoDataPoints) {
 			continue
 		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to select data points: %w", err)
 		}
-		// in order to keep the order in ascending.
-		points = append(ps, points...)
+		if _, ok := it.(emptyIterator); ok {
+			continue
+		}
+		its = append(its, it)
 	}
-	if len(points) == 0 {
-		return nil, ErrNoDataPoints
+	return newMergeIterator(its), nil
+}
+
+func (s *storage) TimestampPrecision() TimestampPrecision {
+	return s.timestampPrecision
+}
+
+func (s *storage) Metrics(start, end int64) ([]string, error) {
+	metrics := make(map[string]struct{})
+	err := s.matchSeries(nil, start, end, func(metric string, _ []Label) {
+		metrics[metric] = struct{}{}
+	})
+	if err != nil {
+		return nil, err
 	}
-	// Copy points before returning since we'll put the slice back to pool
-	result := make([]*DataPoint, len(points))
-	copy(result, points)
-	return result, nil
+	return sortedKeys(metrics), nil
+}
+
+func (s *storage) LabelNames(metric string, start, end int64) ([]string, error) {
+	names := make(map[string]struct{})
+	err := s.matchSeries(metricMatchers(metric), start, end, func(_ string, labels []Label) {
+		for i := range labels {
+			names[labels[i].Name] = struct{}{}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeys(names), nil
+}
+
+func (s *storage) LabelValues(metric, labelName string, start, end int64) ([]string, error) {
+	if labelName == "" {
+		return nil, fmt.Errorf("label name must be set")
+	}
+	values := make(map[string]struct{})
+	err := s.matchSeries(metricMatchers(metric), start, end, func(metric string, labels []Label) {
+		if labelName == MetricNameLabel {
+			values[metric] = struct{}{}
+			return
+		}
+		if v := labelValue(labels, labelName); v != "" {
+			values[v] = struct{}{}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeys(values), nil
+}
+
+// matchSeries calls fn for every series that satisfies all the given matchers,
+// within partitions overlapping the given start-end range. A series living in
+// multiple partitions can be given more than once.
+func (s *storage) matchSeries(matchers []*Matcher, start, end int64, fn func(metric string, labels []Label)) error {
+	if start >= end {
+		return fmt.Errorf("the given start is greater than end")
+	}
+	partitions, err := s.overlappingPartitions(start, end)
+	if err != nil {
+		return err
+	}
+	defer releasePartitions(partitions)
+	for _, part := range partitions {
+		names, err := part.matchSeries(matchers)
+		if errors.Is(err, ErrNoDataPoints) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to match series: %w", err)
+		}
+		for _, name := range names {
+			fn(unmarshalMetricName(name))
+		}
+	}
+	return nil
+}
+
+// metricMatchers gives back matchers to select the given metric, or nil to select all metrics.
+func metricMatchers(metric string) []*Matcher {
+	if metric == "" {
+		return nil
+	}
+	return []*Matcher{{Type: MatchEqual, Name: MetricNameLabel, Value: metric}}
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// toPrecision converts the given duration into the number of units of the given timestamp precision.
+func toPrecision(d time.Duration, precision TimestampPrecision) int64 {
+	return ConvertTimestamp(int64(d), time.Nanosecond, precision)
+}
+
+// Unit gives the duration of one unit of the precision, such as time.Millisecond for Milliseconds.
+// Unknown precisions are treated as Nanoseconds.
+func (p TimestampPrecision) Unit() time.Duration {
+	switch p {
+	case Microseconds:
+		return time.Microsecond
+	case Milliseconds:
+		return time.Millisecond
+	case Seconds:
+		return time.Second
+	default:
+		return time.Nanosecond
+	}
+}
+
+// ConvertTimestamp converts the given timestamp in the unit, such as time.Millisecond, into the precision.
+// It's meant for protocols carrying timestamps in a fixed unit.
+func ConvertTimestamp(ts int64, unit time.Duration, precision TimestampPrecision) int64 {
+	p := precision.Unit()
+	if unit >= p {
+		return ts * int64(unit/p)
+	}
+	return ts / int64(p/unit)
+}
+
+// sortSeries sorts the given series by metric, and then by labels.
+func sortSeries(series []*Series) {
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].Metric != series[j].Metric {
+			return series[i].Metric < series[j].Metric
+		}
+		return CompareLabels(series[i].Labels, series[j].Labels) < 0
+	})
 }
 
 func (s *storage) Close() error {
@@ -472,19 +1048,29 @@ func (s *storage) Close() error {
 }
 
 func (s *storage) newPartition(p partition, punctuateWal bool) error {
+	// Punctuate first, so that records for the new partition are never written to segments in earlier checkpoints.
+	checkpoint := s.wal.checkpoint()
+	if punctuateWal {
+		c, err := s.wal.punctuate()
+		if err != nil {
+			return err
+		}
+		checkpoint = c
+	}
 	if p == nil {
-		p = newMemoryPartition(s.wal, s.partitionDuration, s.timestampPrecision)
+		memPart := newMemoryPartition(s.wal, s.partitionDuration, s.timestampPrecision).(*memoryPartition)
+		memPart.walCheckpoint = checkpoint
+		p = memPart
 	}
 	s.partitionList.insert(p)
-	if punctuateWal {
-		return s.wal.punctuate()
-	}
 	return nil
 }
 
 // flushPartitions persists all in-memory partitions ready to persisted.
 // For the in-memory mode, just removes it from the partition list.
 func (s *storage) flushPartitions() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
 	// Keep the first two partitions as is even if they are inactive,
 	// to accept out-of-order data points.
 	i := 0
@@ -510,6 +1096,14 @@ func (s *storage) flushPartitions() error {
 			continue
 		}
 
+		if memPart.size() == 0 {
+			// Don't leave an empty directory behind.
+			if err := s.partitionList.remove(part); err != nil {
+				return fmt.Errorf("failed to remove partition: %w", err)
+			}
+			continue
+		}
+
 		// Start swapping in-memory partition for disk one.
 		// The disk partition will place at where in-memory one existed.
 
@@ -519,6 +1113,10 @@ func (s *storage) flushPartitions() error {
 		}
 		newPart, err := openDiskPartition(dir, s.retention)
 		if errors.Is(err, ErrNoDataPoints) {
+			// All data points have been deleted.
+			if err := os.RemoveAll(dir); err != nil {
+				return fmt.Errorf("failed to remove empty partition %s: %w", dir, err)
+			}
 			if err := s.partitionList.remove(part); err != nil {
 				return fmt.Errorf("failed to remove partition: %w", err)
 			}
@@ -527,14 +1125,29 @@ func (s *storage) flushPartitions() error {
 		if err != nil {
 			return fmt.Errorf("failed to generate disk partition for %s: %w", dir, err)
 		}
+		for _, tier := range s.rollupTiers {
+			if err := tier.write(memPart); err != nil {
+				return fmt.Errorf("failed to write %s rollup: %w", tier.Resolution, err)
+			}
+		}
 		if err := s.partitionList.swap(part, newPart); err != nil {
 			return fmt.Errorf("failed to swap partitions: %w", err)
 		}
-
-		if err := s.wal.removeOldest(); err != nil {
-			return fmt.Errorf("failed to remove oldest WAL segment: %w", err)
+	}
+	if s.inMemoryMode() {
+		return nil
+	}
+	// Records for partitions created before the oldest in-memory one have all been persisted.
+	oldest := s.wal.checkpoint()
+	iterator = s.partitionList.newIterator()
+	for iterator.next() {
+		if memPart, ok := iterator.value().(*memoryPartition); ok && memPart.walCheckpoint < oldest {
+			oldest = memPart.walCheckpoint
 		}
 	}
+	if err := s.wal.removeBefore(oldest); err != nil {
+		return fmt.Errorf("failed to remove persisted WAL segments: %w", err)
+	}
 	return nil
 }
 
@@ -553,47 +1166,75 @@ func (s *storage) flush(dirPath string, m *memoryPartition) error {
 		return fmt.Errorf("failed to create file %q: %w", dirPath, err)
 	}
 	defer f.Close()
-	encoder := newSeriesEncoder(f)
+	bw := bufio.NewWriter(f)
+	w := &countingWriter{w: bw}
+	encoder := newSeriesEncoder(w)
 	defer putSeriesEncoder(encoder)
 
 	metrics := map[string]diskMetric{}
+	var numPoints int
 	m.metrics.Range(func(key, value interface{}) bool {
 		mt, ok := value.(*memoryMetric)
 		if !ok {
 			s.logger.Printf("unknown value found\n")
 			return false
 		}
-		offset, err := f.Seek(0, io.SeekCurrent)
-		if err != nil {
-			s.logger.Printf("failed to set file offset of metric %q: %v\n", mt.name, err)
-			return false
-		}
 
-		if err := mt.encodeAllPoints(encoder); err != nil {
+		// Cut the series into chunks so that queries can seek straight to the range.
+		chunked := newChunkedEncoder(encoder, w)
+		if err := m.encodeSeries(mt, chunked); err != nil {
 			s.logger.Printf("failed to encode a data point that metric is %q: %v\n", mt.name, err)
 			return false
 		}
 
-		if err := encoder.flush(); err != nil {
+		if err := chunked.flush(); err != nil {
 			s.logger.Printf("failed to flush data points that metric is %q: %v\n", mt.name, err)
 			return false
 		}
+		if len(chunked.chunks) == 0 {
+			return true
+		}
 
-		totalNumPoints := mt.size + int64(len(mt.outOfOrderPoints))
+		// Count what were encoded since deleted data points are left out.
+		var totalNumPoints int64
+		for _, c := range chunked.chunks {
+			totalNumPoints += c.NumDataPoints
+		}
+		numPoints += int(totalNumPoints)
 		metrics[mt.name] = diskMetric{
 			Name:          mt.name,
-			Offset:        offset,
-			MinTimestamp:  mt.minTimestamp,
-			MaxTimestamp:  mt.maxTimestamp,
+			Offset:        chunked.chunks[0].Offset,
+			MinTimestamp:  chunked.chunks[0].MinTimestamp,
+			MaxTimestamp:  chunked.chunks[len(chunked.chunks)-1].MaxTimestamp,
 			NumDataPoints: totalNumPoints,
+			Chunks:        chunked.chunks,
 		}
 		return true
 	})
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write data file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync data file: %w", err)
+	}
+
+	// Persist the inverted index next to the data file.
+	indexFile, err := os.Create(filepath.Join(dirPath, indexFileName))
+	if err != nil {
+		return fmt.Errorf("failed to create index file: %w", err)
+	}
+	defer indexFile.Close()
+	if err := m.index.writeTo(indexFile, metrics); err != nil {
+		return err
+	}
+	if err := indexFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync index file: %w", err)
+	}
 
-	b, err := json.Marshal(&meta{
+	b, err := encodeMeta(&meta{
 		MinTimestamp:  m.minTimestamp(),
 		MaxTimestamp:  m.maxTimestamp(),
-		NumDataPoints: m.size(),
+		NumDataPoints: numPoints,
 		Metrics:       metrics,
 		CreatedAt:     time.Now(),
 	})
@@ -603,13 +1244,55 @@ func (s *storage) flush(dirPath string, m *memoryPartition) error {
 
 	// It should write the meta file at last because what valid meta file exists proves the disk partition is valid.
 	metaPath := filepath.Join(dirPath, metaFileName)
-	if err := os.WriteFile(metaPath, b, fs.ModePerm); err != nil {
+	if err := writeFileSync(metaPath, b); err != nil {
 		return fmt.Errorf("failed to write metadata to %s: %w", metaPath, err)
 	}
+	// The WAL records of the partition are removed once it's flushed, so make sure it survives a crash.
+	if err := syncDir(dirPath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dirPath))
+}
+
+// writeFileSync writes data to the named file as os.WriteFile does, and syncs it to the disk.
+func writeFileSync(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fs.ModePerm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir syncs the given directory to the disk, which makes files created, renamed or removed in it durable.
+func syncDir(dirPath string) error {
+	if runtime.GOOS == "windows" {
+		// Directories can't be opened for syncing on Windows.
+		return nil
+	}
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %q: %w", dirPath, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory %q: %w", dirPath, err)
+	}
 	return nil
 }
 
 func (s *storage) removeExpiredPartitions() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
 	expiredList := make([]partition, 0)
 	iterator := s.partitionList.newIterator()
 	for iterator.next() {
@@ -622,11 +1305,19 @@ func (s *storage) removeExpiredPartitions() error {
 		}
 	}
 
+	if err := s.rewriteRollups(expiredList); err != nil {
+		return err
+	}
 	for i := range expiredList {
 		if err := s.partitionList.remove(expiredList[i]); err != nil {
 			return fmt.Errorf("failed to remove expired partition")
 		}
 	}
+	for _, tier := range s.rollupTiers {
+		if err := tier.removeExpired(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -643,12 +1334,36 @@ func (s *storage) recoverWAL(walDir string) error {
 	if err := reader.readAll(); err != nil {
 		return fmt.Errorf("failed to read WAL: %w", err)
 	}
+	for _, seg := range reader.segments {
+		if seg.recovered == 0 && seg.skipped == 0 {
+			continue
+		}
+		s.logger.Printf("recovered %d records from WAL segment %q, skipped %d torn records of %d bytes at the tail\n",
+			seg.recovered, seg.name, seg.skipped, seg.tornBytes)
+	}
 
-	if len(reader.rowsToInsert) == 0 {
-		return nil
+	if len(reader.rowsToInsert) == 0 && len(reader.deletions) == 0 {
+		// Segments having only a torn record would otherwise be left behind new ones.
+		return s.wal.refresh()
 	}
-	if err := s.InsertRows(reader.rowsToInsert); err != nil {
-		return fmt.Errorf("failed to insert rows recovered from WAL: %w", err)
+	// Apply deletions in between insertions in the order they were recorded.
+	rows := reader.rowsToInsert
+	var inserted int
+	for _, d := range reader.deletions {
+		if d.afterRows > inserted {
+			if err := s.InsertRows(rows[inserted:d.afterRows]); err != nil {
+				return fmt.Errorf("failed to insert rows recovered from WAL: %w", err)
+			}
+			inserted = d.afterRows
+		}
+		if err := s.Delete(d.matchers, d.start, d.end); err != nil {
+			return fmt.Errorf("failed to apply deletion recovered from WAL: %w", err)
+		}
+	}
+	if inserted < len(rows) {
+		if err := s.InsertRows(rows[inserted:]); err != nil {
+			return fmt.Errorf("failed to insert rows recovered from WAL: %w", err)
+		}
 	}
 	return s.wal.refresh()
 }
@@ -1,6 +1,7 @@
 package embedtsdb
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -115,3 +116,38 @@ func BenchmarkWAL_Append(b *testing.B) {
 		wal.append(operationInsert, rows)
 	}
 }
+
+func BenchmarkPostingsIndex_match(b *testing.B) {
+	index := newPostingsIndex()
+	for i := 0; i < 200000; i++ {
+		index.add(marshalMetricName("cpu_usage", []Label{
+			{Name: "host", Value: fmt.Sprintf("server-%d", i)},
+			{Name: "region", Value: fmt.Sprintf("region-%d", i%10)},
+		}))
+	}
+	matchers := []*Matcher{
+		MustNewMatcher(MatchEqual, MetricNameLabel, "cpu_usage"),
+		MustNewMatcher(MatchEqual, "host", "server-100"),
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.match(matchers)
+	}
+}
+
+func BenchmarkStorage_SelectIteratorAmongMillionPoints(b *testing.B) {
+	storage, err := NewStorage()
+	require.NoError(b, err)
+	for i := 1; i < 1000000; i++ {
+		storage.InsertRows([]Row{
+			{Metric: "metric1", DataPoint: DataPoint{Timestamp: int64(i), Value: 0.1}},
+		})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it, _ := storage.SelectIterator("metric1", nil, 10, 100)
+		for it.Next() {
+			it.At()
+		}
+	}
+}
@@ -491,7 +491,7 @@ func ExampleStorage_Select_from_memory_out_of_order() {
 	if err != nil {
 		panic(err)
 	}
-	points, err := storage.Select("metric1", nil, 1600000000, 1600000003)
+	points, err := storage.Select("metric1", nil, 1600000000, 1600000004)
 	if err != nil {
 		panic(err)
 	}
@@ -776,3 +776,106 @@ func ExampleStorage_InsertRows_concurrent() {
 		fmt.Printf("timestamp: %v, value: %v\n", p.Timestamp, p.Value)
 	}
 }
+
+// Selects every series of a metric regardless of the label values, even after they are flushed to disk.
+func ExampleStorage_SelectSeries() {
+	tmpDir, err := os.MkdirTemp("", "embedtsdb-example")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	storage, err := embedtsdb.NewStorage(
+		embedtsdb.WithDataPath(tmpDir),
+		embedtsdb.WithTimestampPrecision(embedtsdb.Seconds),
+	)
+	if err != nil {
+		panic(err)
+	}
+	err = storage.InsertRows([]embedtsdb.Row{
+		{Metric: "cpu_usage", Labels: []embedtsdb.Label{{Name: "host", Value: "server-1"}}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000, Value: 0.1}},
+		{Metric: "cpu_usage", Labels: []embedtsdb.Label{{Name: "host", Value: "server-2"}}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000, Value: 0.2}},
+		{Metric: "cpu_usage", Labels: []embedtsdb.Label{{Name: "host", Value: "db-1"}}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000, Value: 0.3}},
+		{Metric: "memory_usage", Labels: []embedtsdb.Label{{Name: "host", Value: "server-1"}}, DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000, Value: 0.4}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	// Flush all data points
+	if err := storage.Close(); err != nil {
+		panic(err)
+	}
+
+	// Re-open storage from the persisted data
+	storage, err = embedtsdb.NewStorage(
+		embedtsdb.WithDataPath(tmpDir),
+		embedtsdb.WithTimestampPrecision(embedtsdb.Seconds),
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		if err := storage.Close(); err != nil {
+			panic(err)
+		}
+	}()
+
+	series, err := storage.SelectSeries([]*embedtsdb.Matcher{
+		embedtsdb.MustNewMatcher(embedtsdb.MatchEqual, embedtsdb.MetricNameLabel, "cpu_usage"),
+		embedtsdb.MustNewMatcher(embedtsdb.MatchRegexp, "host", "server-.+"),
+	}, 1600000000, 1600000001)
+	if err != nil {
+		panic(err)
+	}
+	for _, s := range series {
+		for _, p := range s.Points {
+			fmt.Printf("metric: %s, labels: %v, timestamp: %v, value: %v\n", s.Metric, s.Labels, p.Timestamp, p.Value)
+		}
+	}
+	// Output:
+	// metric: cpu_usage, labels: [{host server-1}], timestamp: 1600000000, value: 0.1
+	// metric: cpu_usage, labels: [{host server-2}], timestamp: 1600000000, value: 0.2
+}
+
+func ExampleRate() {
+	storage, err := embedtsdb.NewStorage(
+		embedtsdb.WithTimestampPrecision(embedtsdb.Seconds),
+		// Spread data points across multiple partitions.
+		embedtsdb.WithPartitionDuration(20*time.Second),
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer storage.Close()
+
+	// The counter gets reset after 1600000030.
+	values := []float64{0, 10, 20, 30, 5, 15}
+	for i, v := range values {
+		err := storage.InsertRows([]embedtsdb.Row{
+			{Metric: "http_requests_total", DataPoint: embedtsdb.DataPoint{Timestamp: 1600000000 + int64(i)*10, Value: v}},
+		})
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	points, err := storage.Select("http_requests_total", nil, 1600000000, 1600000060)
+	if err != nil {
+		panic(err)
+	}
+	increase, err := embedtsdb.Increase(points, 1600000000, 1600000060)
+	if err != nil {
+		panic(err)
+	}
+	rate, err := embedtsdb.Rate(points, 1600000000, 1600000060, embedtsdb.Seconds)
+	if err != nil {
+		panic(err)
+	}
+	irate, err := embedtsdb.IRate(points, 1600000000, 1600000060, embedtsdb.Seconds)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("increase: %.1f, rate: %.1f, irate: %.1f\n", increase, rate, irate)
+	// Output:
+	// increase: 54.0, rate: 0.9, irate: 1.0
+}
@@ -1,10 +1,14 @@
 package embedtsdb
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_storage_Select(t *testing.T) {
@@ -111,3 +115,372 @@ func Test_storage_Select(t *testing.T) {
 		})
 	}
 }
+
+func Test_storage_SelectSeries(t *testing.T) {
+	newStorage := func() storage {
+		part1 := newMemoryPartition(nil, 1*time.Hour, Seconds)
+		_, err := part1.insertRows([]Row{
+			{DataPoint: DataPoint{Timestamp: 1}, Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}},
+			{DataPoint: DataPoint{Timestamp: 2}, Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}},
+			{DataPoint: DataPoint{Timestamp: 3}, Metric: "mem", Labels: []Label{{Name: "host", Value: "a"}}},
+		})
+		if err != nil {
+			panic(err)
+		}
+		part2 := newMemoryPartition(nil, 1*time.Hour, Seconds)
+		_, err = part2.insertRows([]Row{
+			{DataPoint: DataPoint{Timestamp: 4}, Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}},
+			{DataPoint: DataPoint{Timestamp: 5}, Metric: "cpu"},
+		})
+		if err != nil {
+			panic(err)
+		}
+		list := newPartitionList()
+		list.insert(part1)
+		list.insert(part2)
+		return storage{
+			partitionList:  list,
+			workersLimitCh: make(chan struct{}, defaultWorkersLimit),
+		}
+	}
+	tests := []struct {
+		name     string
+		matchers []*Matcher
+		start    int64
+		end      int64
+		want     []*Series
+		wantErr  bool
+	}{
+		{
+			name:     "no matchers given",
+			matchers: nil,
+			start:    1,
+			end:      10,
+			wantErr:  true,
+		},
+		{
+			name:     "every series of a metric across partitions",
+			matchers: []*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "cpu")},
+			start:    1,
+			end:      10,
+			want: []*Series{
+				{Metric: "cpu", Points: []*DataPoint{{Timestamp: 5}}},
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, Points: []*DataPoint{{Timestamp: 1}, {Timestamp: 4}}},
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}, Points: []*DataPoint{{Timestamp: 2}}},
+			},
+		},
+		{
+			name: "any host",
+			matchers: []*Matcher{
+				MustNewMatcher(MatchEqual, MetricNameLabel, "cpu"),
+				MustNewMatcher(MatchNotEqual, "host", ""),
+			},
+			start: 1,
+			end:   10,
+			want: []*Series{
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, Points: []*DataPoint{{Timestamp: 1}, {Timestamp: 4}}},
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}, Points: []*DataPoint{{Timestamp: 2}}},
+			},
+		},
+		{
+			name:     "regexp on label across metrics",
+			matchers: []*Matcher{MustNewMatcher(MatchRegexp, "host", "a|c")},
+			start:    1,
+			end:      4,
+			want: []*Series{
+				{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, Points: []*DataPoint{{Timestamp: 1}}},
+				{Metric: "mem", Labels: []Label{{Name: "host", Value: "a"}}, Points: []*DataPoint{{Timestamp: 3}}},
+			},
+		},
+		{
+			name:     "nothing matches",
+			matchers: []*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "disk")},
+			start:    1,
+			end:      10,
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStorage()
+			got, err := s.SelectSeries(tt.matchers, tt.start, tt.end)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_storage_discovery(t *testing.T) {
+	tmpDir := t.TempDir()
+	rows := []Row{
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}, {Name: "region", Value: "us"}}, DataPoint: DataPoint{Timestamp: 1600000000}},
+		{Metric: "cpu", Labels: []Label{{Name: "host", Value: "b"}}, DataPoint: DataPoint{Timestamp: 1600000001}},
+		{Metric: "mem", Labels: []Label{{Name: "host", Value: "c"}, {Name: "zone", Value: "z1"}}, DataPoint: DataPoint{Timestamp: 1600000002}},
+		{Metric: "up", DataPoint: DataPoint{Timestamp: 1600000003}},
+	}
+	assertDiscovery := func(t *testing.T, s Storage) {
+		metrics, err := s.Metrics(1600000000, 1600000010)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"cpu", "mem", "up"}, metrics)
+
+		names, err := s.LabelNames("cpu", 1600000000, 1600000010)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"host", "region"}, names)
+
+		names, err = s.LabelNames("", 1600000000, 1600000010)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"host", "region", "zone"}, names)
+
+		values, err := s.LabelValues("cpu", "host", 1600000000, 1600000010)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a", "b"}, values)
+
+		values, err = s.LabelValues("", "host", 1600000000, 1600000010)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a", "b", "c"}, values)
+
+		values, err = s.LabelValues("unknown", "host", 1600000000, 1600000010)
+		require.NoError(t, err)
+		assert.Equal(t, []string{}, values)
+
+		metrics, err = s.Metrics(1500000000, 1500000010)
+		require.NoError(t, err)
+		assert.Equal(t, []string{}, metrics)
+	}
+
+	// From memory partitions
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows(rows))
+	assertDiscovery(t, s)
+	require.NoError(t, s.Close())
+
+	// From disk partitions
+	s, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	assertDiscovery(t, s)
+}
+
+func Test_storage_Close_emptyPartition(t *testing.T) {
+	tmpDir := t.TempDir()
+	s, err := NewStorage(WithDataPath(tmpDir))
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	dirs, err := filepath.Glob(filepath.Join(tmpDir, "p-*"))
+	require.NoError(t, err)
+	assert.Empty(t, dirs)
+}
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func Test_storage_recoverWAL_tornSegment(t *testing.T) {
+	tmpDir := t.TempDir()
+	walDir := filepath.Join(tmpDir, walDirName)
+	w, err := newDiskWAL(walDir, 0)
+	require.NoError(t, err)
+	require.NoError(t, w.append(operationInsert, []Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 1}}}))
+	require.NoError(t, w.append(operationInsert, []Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 2}}}))
+	_, err = w.punctuate()
+	require.NoError(t, err)
+	require.NoError(t, w.append(operationInsert, []Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000002, Value: 3}}}))
+	require.NoError(t, w.flush())
+	// The process crashed in the middle of writing the second record of segment "0".
+	info, err := os.Stat(filepath.Join(walDir, "0"))
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(filepath.Join(walDir, "0"), info.Size()-3))
+
+	logger := &recordingLogger{}
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithLogger(logger))
+	require.NoError(t, err)
+	defer s.Close()
+	got, err := s.Select("metric1", nil, 1600000000, 1600000003)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{{Timestamp: 1600000000, Value: 1}, {Timestamp: 1600000002, Value: 3}}, got)
+	assert.Contains(t, logger.lines, "recovered 1 records from WAL segment \"0\", skipped 1 torn records of 17 bytes at the tail\n")
+	assert.Contains(t, logger.lines, "recovered 1 records from WAL segment \"1\", skipped 0 torn records of 0 bytes at the tail\n")
+}
+
+func Test_storage_WithWALSync(t *testing.T) {
+	_, err := NewStorage(WithWALSync("sometimes", 0))
+	assert.Error(t, err)
+
+	for _, mode := range []WALSyncMode{WALSyncNever, WALSyncBatch, WALSyncInterval} {
+		t.Run(string(mode), func(t *testing.T) {
+			tmpDir := t.TempDir()
+			s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithWALSync(mode, time.Millisecond))
+			require.NoError(t, err)
+			require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 0.1}}}))
+			if mode != WALSyncNever {
+				// Synced data points are on the file without flushing the buffer.
+				require.Eventually(t, func() bool {
+					info, err := os.Stat(filepath.Join(tmpDir, walDirName, "0"))
+					return err == nil && info.Size() > 0
+				}, time.Second, time.Millisecond)
+			}
+			require.NoError(t, s.Close())
+		})
+	}
+}
+
+func Test_storage_WithWALSegmentSize(t *testing.T) {
+	tmpDir := t.TempDir()
+	walDir := filepath.Join(tmpDir, walDirName)
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithPartitionDuration(100*time.Second),
+		WithWALBufferedSize(0), WithWALSegmentSize(100))
+	require.NoError(t, err)
+	for i := int64(0); i < 20; i++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000 + i, Value: 0.1}}}))
+	}
+	// Segments get cut within a partition.
+	files, err := os.ReadDir(walDir)
+	require.NoError(t, err)
+	assert.Greater(t, len(files), 2)
+
+	// Make the first partition flushed, which no longer needs its segments.
+	for i := int64(1); i <= 4; i++ {
+		require.NoError(t, s.InsertRows([]Row{{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000 + 200*i, Value: 0.1}}}))
+	}
+	require.NoError(t, s.(*storage).flushPartitions())
+	rest, err := os.ReadDir(walDir)
+	require.NoError(t, err)
+	assert.Less(t, len(rest), len(files))
+	require.NoError(t, s.Close())
+}
+
+func Test_storage_recoverWAL_twice(t *testing.T) {
+	tmpDir := t.TempDir()
+	rows := []Row{
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000000, Value: 1}},
+		{Metric: "metric1", DataPoint: DataPoint{Timestamp: 1600000001, Value: 2}},
+	}
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithWALBufferedSize(0))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows(rows))
+
+	// Crash twice without closing, the second time right after recovering.
+	for i := 0; i < 2; i++ {
+		s, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithWALBufferedSize(0))
+		require.NoError(t, err)
+		got, err := s.Select("metric1", nil, 1600000000, 1600000002)
+		require.NoError(t, err)
+		assert.Equal(t, []*DataPoint{&rows[0].DataPoint, &rows[1].DataPoint}, got)
+	}
+	require.NoError(t, s.Close())
+}
+
+func Test_storage_WithWALCompression(t *testing.T) {
+	_, err := NewStorage(WithWALCompression("zip"))
+	assert.Error(t, err)
+
+	tmpDir := t.TempDir()
+	s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithWALBufferedSize(0),
+		WithWALCompression(WALCompressionSnappy))
+	require.NoError(t, err)
+	rows := []Row{
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "host-1"}}, DataPoint: DataPoint{Timestamp: 1600000000, Value: 1}},
+		{Metric: "metric1", Labels: []Label{{Name: "host", Value: "host-1"}}, DataPoint: DataPoint{Timestamp: 1600000001, Value: 2}},
+	}
+	require.NoError(t, s.InsertRows(rows))
+
+	// Recover from the compressed WAL without closing, even though compression is disabled now.
+	s, err = NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	got, err := s.Select("metric1", rows[0].Labels, 1600000000, 1600000002)
+	require.NoError(t, err)
+	assert.Equal(t, []*DataPoint{&rows[0].DataPoint, &rows[1].DataPoint}, got)
+	require.NoError(t, s.Close())
+}
+
+func Test_storage_Delete(t *testing.T) {
+	tmpDir := t.TempDir()
+	hostA := []Label{{Name: "host", Value: "a"}}
+	hostB := []Label{{Name: "host", Value: "b"}}
+	var rows []Row
+	for i := int64(0); i < 10; i++ {
+		rows = append(rows,
+			Row{Metric: "cpu", Labels: hostA, DataPoint: DataPoint{Timestamp: 1600000000 + i, Value: float64(i)}},
+			Row{Metric: "cpu", Labels: hostB, DataPoint: DataPoint{Timestamp: 1600000000 + i, Value: float64(i)}},
+		)
+	}
+	open := func() Storage {
+		s, err := NewStorage(WithDataPath(tmpDir), WithTimestampPrecision(Seconds), WithWALBufferedSize(0))
+		require.NoError(t, err)
+		return s
+	}
+	hostAMatchers := []*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "cpu"), MustNewMatcher(MatchEqual, "host", "a")}
+	assertDeleted := func(t *testing.T, s Storage) {
+		got, err := s.Select("cpu", hostA, 1600000000, 1600000010)
+		require.NoError(t, err)
+		assert.Equal(t, []*DataPoint{
+			{Timestamp: 1600000000}, {Timestamp: 1600000001, Value: 1}, {Timestamp: 1600000008, Value: 8}, {Timestamp: 1600000009, Value: 9},
+		}, got)
+		got, err = s.Select("cpu", hostB, 1600000000, 1600000010)
+		require.NoError(t, err)
+		assert.Len(t, got, 10)
+	}
+
+	s := open()
+	assert.Error(t, s.Delete(nil, 1600000000, 1600000010))
+	assert.Error(t, s.Delete(hostAMatchers, 1600000010, 1600000000))
+	require.NoError(t, s.InsertRows(rows[:16]))
+	require.NoError(t, s.Delete(hostAMatchers, 1600000002, 1600000009))
+	// Data points inserted after the deletion are kept even within the range.
+	require.NoError(t, s.InsertRows(rows[16:]))
+	assertDeleted(t, s)
+
+	// Deletions are replayed from the WAL in order with insertions after a crash.
+	s = open()
+	assertDeleted(t, s)
+
+	// Deleted data points are dropped when flushing.
+	require.NoError(t, s.Close())
+	s = open()
+	assertDeleted(t, s)
+	dirs, err := filepath.Glob(filepath.Join(tmpDir, "p-*"))
+	require.NoError(t, err)
+	require.Len(t, dirs, 1)
+	m, err := readMeta(dirs[0])
+	require.NoError(t, err)
+	assert.Equal(t, 14, m.NumDataPoints)
+
+	// Deletions from disk partitions are persisted as tombstones.
+	require.NoError(t, s.Delete(hostAMatchers, 1600000000, 1600000010))
+	require.NoError(t, s.Close())
+	s = open()
+	defer s.Close()
+	_, err = s.Select("cpu", hostA, 1600000000, 1600000010)
+	assert.ErrorIs(t, err, ErrNoDataPoints)
+	series, err := s.SelectSeries([]*Matcher{MustNewMatcher(MatchEqual, MetricNameLabel, "cpu")}, 1600000000, 1600000010)
+	require.NoError(t, err)
+	require.Len(t, series, 1)
+	assert.Equal(t, hostB, series[0].Labels)
+}
+
+func Test_ConvertTimestamp(t *testing.T) {
+	tests := []struct {
+		name      string
+		ts        int64
+		unit      time.Duration
+		precision TimestampPrecision
+		want      int64
+	}{
+		{name: "seconds into nanoseconds", ts: 1600000000, unit: time.Second, precision: Nanoseconds, want: 1600000000000000000},
+		{name: "milliseconds into seconds", ts: 1600000000123, unit: time.Millisecond, precision: Seconds, want: 1600000000},
+		{name: "same unit", ts: 1600000000123, unit: time.Millisecond, precision: Milliseconds, want: 1600000000123},
+		{name: "nanoseconds into microseconds", ts: 1600000000123456789, unit: time.Nanosecond, precision: Microseconds, want: 1600000000123456},
+		{name: "microseconds into milliseconds", ts: 1600000000123456, unit: Microseconds.Unit(), precision: Milliseconds, want: 1600000000123},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ConvertTimestamp(tt.ts, tt.unit, tt.precision))
+		})
+	}
+}
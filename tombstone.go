@@ -0,0 +1,195 @@
+package embedtsdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	tombstonesFileName = "tombstones.json"
+
+	tombstonesVersion = 1
+)
+
+// tombstones records time ranges of deleted data points in a partition. They're hidden from queries
+// until they're dropped physically, which happens when the partition is flushed or compacted.
+type tombstones struct {
+	mu sync.RWMutex
+	// ranges are keyed by the marshaled metric name. Both ends are inclusive.
+	ranges map[string][]timeRange
+}
+
+func newTombstones() *tombstones {
+	return &tombstones{ranges: make(map[string][]timeRange)}
+}
+
+// add records the given range of the given series. It gives back false if it's already covered.
+func (t *tombstones) add(name string, r timeRange) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, existing := range t.ranges[name] {
+		if existing.min <= r.min && r.max <= existing.max {
+			return false
+		}
+	}
+	t.ranges[name] = append(t.ranges[name], r)
+	return true
+}
+
+// get gives back the ranges of the given series, or nil if none.
+func (t *tombstones) get(name string) []timeRange {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.ranges[name]
+}
+
+func (t *tombstones) empty() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.ranges) == 0
+}
+
+// deletedAt tells if the data point at the given timestamp is deleted by any of the given ranges.
+func deletedAt(ranges []timeRange, timestamp int64) bool {
+	for _, r := range ranges {
+		if r.min <= timestamp && timestamp <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// overlapping tells if any of the given ranges overlaps the given inclusive range.
+func overlapping(ranges []timeRange, min, max int64) bool {
+	for _, r := range ranges {
+		if r.min <= max && min <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// covering tells if any of the given ranges covers the given inclusive range entirely.
+func covering(ranges []timeRange, min, max int64) bool {
+	for _, r := range ranges {
+		if r.min <= min && max <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// tombstonesFile is a mapper for the tombstones file of a disk partition.
+type tombstonesFile struct {
+	Version    int              `json:"version"`
+	Tombstones []tombstoneEntry `json:"tombstones"`
+	// Checksum is the CRC32C of the encoded file preceding it.
+	Checksum uint32 `json:"checksum,omitempty"`
+}
+
+type tombstoneEntry struct {
+	Name         string `json:"name"`
+	MinTimestamp int64  `json:"minTimestamp"`
+	MaxTimestamp int64  `json:"maxTimestamp"`
+}
+
+// readTombstones reads the tombstones file in the given partition directory. It gives back empty tombstones
+// if the partition has none.
+func readTombstones(dirPath string) (*tombstones, error) {
+	t := newTombstones()
+	path := filepath.Join(dirPath, tombstonesFileName)
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tombstones: %w", err)
+	}
+	f := &tombstonesFile{}
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, fmt.Errorf("failed to decode tombstones: %w", err)
+	}
+	if err := verifyJSONChecksum(b, f.Checksum, path); err != nil {
+		return nil, err
+	}
+	for _, e := range f.Tombstones {
+		t.ranges[e.Name] = append(t.ranges[e.Name], timeRange{min: e.MinTimestamp, max: e.MaxTimestamp})
+	}
+	return t, nil
+}
+
+// write writes the tombstones into the given partition directory, replacing the existing file atomically.
+func (t *tombstones) write(dirPath string) error {
+	t.mu.RLock()
+	f := &tombstonesFile{Version: tombstonesVersion, Tombstones: make([]tombstoneEntry, 0)}
+	for name, ranges := range t.ranges {
+		for _, r := range ranges {
+			f.Tombstones = append(f.Tombstones, tombstoneEntry{Name: name, MinTimestamp: r.min, MaxTimestamp: r.max})
+		}
+	}
+	t.mu.RUnlock()
+	sort.Slice(f.Tombstones, func(i, j int) bool {
+		if f.Tombstones[i].Name != f.Tombstones[j].Name {
+			return f.Tombstones[i].Name < f.Tombstones[j].Name
+		}
+		return f.Tombstones[i].MinTimestamp < f.Tombstones[j].MinTimestamp
+	})
+	b, err := json.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("failed to encode tombstones: %w", err)
+	}
+	b = appendJSONChecksum(b)
+
+	path := filepath.Join(dirPath, tombstonesFileName)
+	tmpPath := path + ".tmp"
+	if err := writeFileSync(tmpPath, b); err != nil {
+		return fmt.Errorf("failed to write tombstones: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to rename tombstones file: %w", err)
+	}
+	// The WAL record of the deletion may be removed at the next flush.
+	return syncDir(dirPath)
+}
+
+// tombstoneIterator skips data points deleted by tombstones.
+type tombstoneIterator struct {
+	Iterator
+	ranges []timeRange
+}
+
+// withTombstones gives back an iterator that skips data points deleted by the given ranges.
+func withTombstones(it Iterator, ranges []timeRange) Iterator {
+	if len(ranges) == 0 {
+		return it
+	}
+	return &tombstoneIterator{Iterator: it, ranges: ranges}
+}
+
+func (it *tombstoneIterator) Next() bool {
+	for it.Iterator.Next() {
+		timestamp, _ := it.At()
+		if !deletedAt(it.ranges, timestamp) {
+			return true
+		}
+	}
+	return false
+}
+
+// tombstoneEncoder is a seriesEncoder that drops data points deleted by tombstones.
+type tombstoneEncoder struct {
+	seriesEncoder
+	ranges []timeRange
+}
+
+func (e *tombstoneEncoder) encodePoint(point *DataPoint) error {
+	if deletedAt(e.ranges, point.Timestamp) {
+		return nil
+	}
+	return e.seriesEncoder.encodePoint(point)
+}
@@ -0,0 +1,61 @@
+package embedtsdb
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_tombstones_add(t *testing.T) {
+	ts := newTombstones()
+	assert.True(t, ts.empty())
+	assert.True(t, ts.add("metric1", timeRange{min: 1, max: 10}))
+	// Already covered.
+	assert.False(t, ts.add("metric1", timeRange{min: 2, max: 5}))
+	assert.True(t, ts.add("metric1", timeRange{min: 5, max: 20}))
+	assert.Equal(t, []timeRange{{min: 1, max: 10}, {min: 5, max: 20}}, ts.get("metric1"))
+	assert.Nil(t, ts.get("metric2"))
+}
+
+func Test_tombstones_write_read(t *testing.T) {
+	dir := t.TempDir()
+	got, err := readTombstones(dir)
+	require.NoError(t, err)
+	assert.True(t, got.empty())
+
+	ts := newTombstones()
+	ts.add("metric1", timeRange{min: 1, max: 10})
+	ts.add("metric2", timeRange{min: 3, max: 4})
+	ts.add("metric1", timeRange{min: 20, max: 30})
+	require.NoError(t, ts.write(dir))
+	got, err = readTombstones(dir)
+	require.NoError(t, err)
+	assert.Equal(t, ts.ranges, got.ranges)
+
+	// Tampered files are told by the checksum.
+	path := filepath.Join(dir, tombstonesFileName)
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	b = bytes.Replace(b, []byte(`"maxTimestamp":4`), []byte(`"maxTimestamp":5`), 1)
+	require.NoError(t, os.WriteFile(path, b, 0644))
+	_, err = readTombstones(dir)
+	var checksumErr *ChecksumError
+	assert.True(t, errors.As(err, &checksumErr))
+}
+
+func Test_withTombstones(t *testing.T) {
+	points := []*DataPoint{{Timestamp: 1}, {Timestamp: 2}, {Timestamp: 3}, {Timestamp: 4}, {Timestamp: 5}}
+	it := withTombstones(newSliceIterator(points), []timeRange{{min: 2, max: 3}, {min: 5, max: 5}})
+	var got []int64
+	for it.Next() {
+		timestamp, _ := it.At()
+		got = append(got, timestamp)
+	}
+	require.NoError(t, it.Err())
+	assert.Equal(t, []int64{1, 4}, got)
+}
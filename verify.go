@@ -0,0 +1,503 @@
+package embedtsdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// quarantineDirName is the directory under the data directory where Verify moves what it can't repair.
+// NewStorage doesn't look into it.
+const quarantineDirName = "quarantine"
+
+var partitionRangeRegex = regexp.MustCompile(`^p-(-?\d+)-(-?\d+)$`)
+
+// RepairAction is what Verify did to fix problems.
+type RepairAction string
+
+const (
+	// RepairRebuilt means the meta file or the index file of the partition was rebuilt from the other files.
+	RepairRebuilt RepairAction = "rebuilt"
+	// RepairQuarantined means the partition was moved into the quarantine directory.
+	RepairQuarantined RepairAction = "quarantined"
+	// RepairTruncated means the WAL segment was truncated right before the corrupted record,
+	// after the original one was copied into the quarantine directory.
+	RepairTruncated RepairAction = "truncated"
+)
+
+// VerifyReport is the result of Verify.
+type VerifyReport struct {
+	Partitions  []PartitionReport
+	WALSegments []WALSegmentReport
+}
+
+// OK tells if no problem was found.
+func (r *VerifyReport) OK() bool {
+	for _, p := range r.Partitions {
+		if len(p.Problems) > 0 {
+			return false
+		}
+	}
+	for _, s := range r.WALSegments {
+		if s.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// PartitionReport describes a disk partition examined by Verify.
+type PartitionReport struct {
+	// Path is the directory of the partition.
+	Path string
+	// NumSeries and NumDataPoints are what were decoded without problems.
+	NumSeries     int
+	NumDataPoints int
+	// Problems lists everything found wrong with the partition.
+	Problems []error
+	// Action is what the repair did, which is empty if nothing was done.
+	Action RepairAction
+}
+
+// WALSegmentReport describes a WAL segment examined by Verify.
+type WALSegmentReport struct {
+	// Path is the segment file.
+	Path       string
+	NumRecords int
+	// Err is the corruption found in the record at Offset bytes from the beginning of the segment.
+	// Records after it can't be read.
+	Err    error
+	Offset int64
+	// Torn tells if the last record at Offset is cut off, or is the final one of the last segment having
+	// a mismatched checksum. It's left by a crash in the middle of writing, so it's not regarded as corruption.
+	Torn bool
+	// Action is what the repair did, which is empty if nothing was done.
+	Action RepairAction
+}
+
+// VerifyOption is an optional setting for Verify.
+type VerifyOption func(*verifier)
+
+// WithRepair makes Verify fix problems it finds:
+//   - A partition of which meta file is missing or broken gets it rebuilt from the data file and the index file,
+//     unless its data points are still in the WAL, which happens when flushing was interrupted.
+//   - A partition of which index file is broken gets it removed, so that it's rebuilt from the meta file when opened.
+//   - A partition that can't be rebuilt is moved into the "quarantine" directory under the data directory,
+//     so that NewStorage no longer fails to open it.
+//   - A WAL segment is truncated right before the corrupted record, after a copy is put into the quarantine directory.
+//
+// The data directory must not be used by a storage while repairing.
+func WithRepair() VerifyOption {
+	return func(v *verifier) {
+		v.repair = true
+	}
+}
+
+type verifier struct {
+	dataPath string
+	repair   bool
+	// time ranges of data points in each WAL segment
+	walRanges []timeRange
+}
+
+type timeRange struct {
+	min, max int64
+}
+
+// Verify checks the integrity of the given data directory, which is the one given to WithDataPath.
+// It decodes every series in every disk partition, and checks the number of data points, the minimum and
+// maximum timestamps and the summary of each chunk against the meta file. It also reads every WAL segment
+// to find where it's corrupted. Give WithRepair to fix problems found.
+//
+// An error is given back only when it fails to examine or repair the directory; problems found are in the report.
+func Verify(dataPath string, opts ...VerifyOption) (*VerifyReport, error) {
+	v := &verifier{dataPath: dataPath}
+	for _, opt := range opts {
+		opt(v)
+	}
+	dirs, err := os.ReadDir(dataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data directory: %w", err)
+	}
+
+	report := &VerifyReport{
+		Partitions:  make([]PartitionReport, 0),
+		WALSegments: make([]WALSegmentReport, 0),
+	}
+	segments, err := v.verifyWAL()
+	if err != nil {
+		return nil, err
+	}
+	report.WALSegments = segments
+	for _, e := range dirs {
+		if !e.IsDir() || !partitionDirRegex.MatchString(e.Name()) {
+			continue
+		}
+		p, err := v.verifyPartition(filepath.Join(dataPath, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		report.Partitions = append(report.Partitions, p)
+	}
+	return report, nil
+}
+
+func (v *verifier) verifyWAL() ([]WALSegmentReport, error) {
+	dir := filepath.Join(v.dataPath, walDirName)
+	files, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return make([]WALSegmentReport, 0), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the WAL dir: %w", err)
+	}
+	sortSegmentFiles(files)
+	reports := make([]WALSegmentReport, 0, len(files))
+	for i, file := range files {
+		if file.IsDir() {
+			continue
+		}
+		r, err := v.verifyWALSegment(filepath.Join(dir, file.Name()), i == len(files)-1)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
+
+func (v *verifier) verifyWALSegment(path string, last bool) (WALSegmentReport, error) {
+	report := WALSegmentReport{Path: path}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return report, fmt.Errorf("failed to read WAL segment file: %w", err)
+	}
+	seg := &segment{path: path, r: bytes.NewReader(b), size: int64(len(b)), last: last}
+	rng := timeRange{min: math.MaxInt64, max: math.MinInt64}
+	for seg.next() {
+		report.NumRecords++
+		report.Offset = seg.offset
+		for _, row := range seg.record().rows {
+			rng.min = min(rng.min, row.Timestamp)
+			rng.max = max(rng.max, row.Timestamp)
+		}
+	}
+	if report.NumRecords > 0 {
+		v.walRanges = append(v.walRanges, rng)
+	}
+	err = seg.error()
+	if err == nil {
+		report.Offset = 0
+		return report, nil
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		report.Torn = true
+		return report, nil
+	}
+	report.Err = err
+	if !v.repair {
+		return report, nil
+	}
+	quarantined := filepath.Join(v.dataPath, quarantineDirName, walDirName+"-"+filepath.Base(path))
+	if err := os.MkdirAll(filepath.Dir(quarantined), fs.ModePerm); err != nil {
+		return report, fmt.Errorf("failed to make quarantine directory: %w", err)
+	}
+	if err := os.WriteFile(quarantined, b, 0644); err != nil {
+		return report, fmt.Errorf("failed to copy WAL segment into quarantine: %w", err)
+	}
+	if err := os.Truncate(path, report.Offset); err != nil {
+		return report, fmt.Errorf("failed to truncate WAL segment: %w", err)
+	}
+	report.Action = RepairTruncated
+	return report, nil
+}
+
+func (v *verifier) verifyPartition(dirPath string) (PartitionReport, error) {
+	report := PartitionReport{Path: dirPath}
+	m, metaErr := readMeta(dirPath)
+	if metaErr != nil {
+		report.Problems = append(report.Problems, metaErr)
+	}
+	data, dataErr := os.ReadFile(filepath.Join(dirPath, dataFileName))
+	if dataErr != nil {
+		report.Problems = append(report.Problems, fmt.Errorf("failed to read data file: %w", dataErr))
+	}
+	var refs map[string][]diskChunk
+	b, indexErr := os.ReadFile(filepath.Join(dirPath, indexFileName))
+	if errors.Is(indexErr, os.ErrNotExist) {
+		// Partitions flushed before the index was introduced don't have it.
+		indexErr = nil
+	} else if indexErr == nil {
+		if _, refs, indexErr = decodeIndex(b); indexErr != nil {
+			indexErr = fmt.Errorf("broken index: %w", indexErr)
+		}
+	}
+	if indexErr != nil {
+		report.Problems = append(report.Problems, indexErr)
+	}
+
+	var (
+		metricsErr  error
+		dataCorrupt bool
+	)
+	if m != nil && dataErr == nil {
+		names := make([]string, 0, len(m.Metrics))
+		for name := range m.Metrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			mt := m.Metrics[name]
+			if err := verifyMetric(data, filepath.Join(dirPath, dataFileName), name, &mt); err != nil {
+				report.Problems = append(report.Problems, err)
+				metricsErr = err
+				var checksumErr *ChecksumError
+				dataCorrupt = dataCorrupt || errors.As(err, &checksumErr)
+				continue
+			}
+			report.NumSeries++
+			report.NumDataPoints += int(mt.NumDataPoints)
+		}
+	}
+	if !v.repair || len(report.Problems) == 0 {
+		return report, nil
+	}
+
+	switch {
+	case metaErr != nil && v.inWAL(dirPath):
+		// Flushing was interrupted, so the data points will be recovered from the WAL.
+		return report, v.quarantine(&report)
+	case dataCorrupt:
+		// Rebuilding the meta file would take the corrupted chunks as they are.
+		return report, v.quarantine(&report)
+	case dataErr == nil && (metaErr != nil || metricsErr != nil):
+		rebuilt, err := rebuildMeta(dirPath, data, refs)
+		if err != nil {
+			report.Problems = append(report.Problems, fmt.Errorf("failed to rebuild meta file: %w", err))
+			return report, v.quarantine(&report)
+		}
+		if err := writeFileAtomically(filepath.Join(dirPath, metaFileName), rebuilt); err != nil {
+			return report, fmt.Errorf("failed to write rebuilt meta file: %w", err)
+		}
+		report.Action = RepairRebuilt
+	case dataErr == nil && indexErr != nil:
+		if err := os.Remove(filepath.Join(dirPath, indexFileName)); err != nil {
+			return report, fmt.Errorf("failed to remove broken index: %w", err)
+		}
+		report.Action = RepairRebuilt
+	default:
+		return report, v.quarantine(&report)
+	}
+	return report, nil
+}
+
+// inWAL tells if the WAL has data points within the time range of the given partition.
+func (v *verifier) inWAL(dirPath string) bool {
+	rng, ok := parsePartitionRange(filepath.Base(dirPath))
+	if !ok {
+		return false
+	}
+	for _, r := range v.walRanges {
+		if r.min <= rng.max && rng.min <= r.max {
+			return true
+		}
+	}
+	return false
+}
+
+// quarantine moves the partition into the quarantine directory.
+func (v *verifier) quarantine(report *PartitionReport) error {
+	dir := filepath.Join(v.dataPath, quarantineDirName)
+	if err := os.MkdirAll(dir, fs.ModePerm); err != nil {
+		return fmt.Errorf("failed to make quarantine directory: %w", err)
+	}
+	if err := os.Rename(report.Path, filepath.Join(dir, filepath.Base(report.Path))); err != nil {
+		return fmt.Errorf("failed to quarantine partition: %w", err)
+	}
+	report.Action = RepairQuarantined
+	return nil
+}
+
+// verifyMetric decodes all data points of the given series and checks them against its metadata.
+// path is the data file, used to report checksum mismatches.
+func verifyMetric(data []byte, path, name string, mt *diskMetric) error {
+	chunks := mt.Chunks
+	if len(chunks) == 0 {
+		// Partitions flushed before chunks were introduced have the whole series as a single stream.
+		chunks = []diskChunk{{
+			Offset:        mt.Offset,
+			MinTimestamp:  mt.MinTimestamp,
+			MaxTimestamp:  mt.MaxTimestamp,
+			NumDataPoints: mt.NumDataPoints,
+		}}
+	}
+	var total int64
+	for i, c := range chunks {
+		if err := verifyChunk(data, &c, path); err != nil {
+			return fmt.Errorf("series %q: chunk %d: %w", name, i, err)
+		}
+		got, err := decodeChunk(data, c.Offset, c.NumDataPoints)
+		if err != nil {
+			return fmt.Errorf("series %q: chunk %d: %w", name, i, err)
+		}
+		if got.MinTimestamp != c.MinTimestamp || got.MaxTimestamp != c.MaxTimestamp {
+			return fmt.Errorf("series %q: chunk %d: data points range from %d to %d, but the meta file says from %d to %d",
+				name, i, got.MinTimestamp, got.MaxTimestamp, c.MinTimestamp, c.MaxTimestamp)
+		}
+		if c.Summary != nil && (got.Summary == nil || *got.Summary != *c.Summary) {
+			return fmt.Errorf("series %q: chunk %d: summary doesn't match the data points", name, i)
+		}
+		total += c.NumDataPoints
+	}
+	if total != mt.NumDataPoints {
+		return fmt.Errorf("series %q: chunks have %d data points, but the meta file says %d", name, total, mt.NumDataPoints)
+	}
+	if chunks[0].MinTimestamp != mt.MinTimestamp || chunks[len(chunks)-1].MaxTimestamp != mt.MaxTimestamp {
+		return fmt.Errorf("series %q: chunks range from %d to %d, but the meta file says from %d to %d",
+			name, chunks[0].MinTimestamp, chunks[len(chunks)-1].MaxTimestamp, mt.MinTimestamp, mt.MaxTimestamp)
+	}
+	return nil
+}
+
+// decodeChunk decodes the given number of data points at the offset, and gives back the chunk describing them.
+func decodeChunk(data []byte, offset, numPoints int64) (diskChunk, error) {
+	c := diskChunk{Offset: offset, NumDataPoints: numPoints}
+	if offset < 0 || offset >= int64(len(data)) {
+		return c, fmt.Errorf("offset %d is out of range of the data file having %d bytes", offset, len(data))
+	}
+	if numPoints <= 0 {
+		return c, fmt.Errorf("invalid number of data points %d", numPoints)
+	}
+	decoder := newBytesSeriesDecoder(data[offset:])
+	var (
+		point   DataPoint
+		summary aggregation
+	)
+	for i := int64(0); i < numPoints; i++ {
+		if err := decoder.decodePoint(&point); err != nil {
+			return c, fmt.Errorf("failed to decode data point %d: %w", i, err)
+		}
+		if summary.hasValue && point.Timestamp < summary.lastT {
+			return c, fmt.Errorf("data point %d is out of order", i)
+		}
+		summary.add(point.Timestamp, point.Value)
+	}
+	c.MinTimestamp = summary.firstT
+	c.MaxTimestamp = summary.lastT
+	if summary.finite() {
+		c.Summary = &chunkSummary{
+			Sum:   summary.sum,
+			Min:   summary.min,
+			Max:   summary.max,
+			First: summary.firstV,
+			Last:  summary.lastV,
+		}
+	}
+	return c, nil
+}
+
+// rebuildMeta builds the encoded meta file of the given partition by decoding chunks the index refers to.
+func rebuildMeta(dirPath string, data []byte, refs map[string][]diskChunk) ([]byte, error) {
+	if refs == nil {
+		return nil, fmt.Errorf("the index doesn't have chunk references")
+	}
+	m := &meta{
+		MinTimestamp: math.MaxInt64,
+		MaxTimestamp: math.MinInt64,
+		Metrics:      make(map[string]diskMetric, len(refs)),
+	}
+	for name, chunks := range refs {
+		if len(chunks) == 0 {
+			continue
+		}
+		mt := diskMetric{
+			Name:   name,
+			Offset: chunks[0].Offset,
+			Chunks: make([]diskChunk, 0, len(chunks)),
+		}
+		for i, ref := range chunks {
+			c, err := decodeChunk(data, ref.Offset, ref.NumDataPoints)
+			if err != nil {
+				return nil, fmt.Errorf("series %q: chunk %d: %w", name, i, err)
+			}
+			mt.Chunks = append(mt.Chunks, c)
+			mt.NumDataPoints += c.NumDataPoints
+		}
+		mt.MinTimestamp = mt.Chunks[0].MinTimestamp
+		mt.MaxTimestamp = mt.Chunks[len(mt.Chunks)-1].MaxTimestamp
+		m.Metrics[name] = mt
+		m.NumDataPoints += int(mt.NumDataPoints)
+		m.MinTimestamp = min(m.MinTimestamp, mt.MinTimestamp)
+		m.MaxTimestamp = max(m.MaxTimestamp, mt.MaxTimestamp)
+	}
+	if len(m.Metrics) == 0 {
+		return nil, ErrNoDataPoints
+	}
+	setChunkChecksums(data, m.Metrics)
+	// The directory is named after the range of the partition, which may be wider because of out-of-order data points.
+	if rng, ok := parsePartitionRange(filepath.Base(dirPath)); ok {
+		m.MinTimestamp, m.MaxTimestamp = rng.min, rng.max
+	}
+	info, err := os.Stat(filepath.Join(dirPath, dataFileName))
+	if err != nil {
+		return nil, err
+	}
+	// Retention counts from when the partition was flushed.
+	m.CreatedAt = info.ModTime()
+	return encodeMeta(m)
+}
+
+// setChunkChecksums fills in the length and the checksum of each chunk.
+// Chunks are laid out back to back in the data file, so each of them ends where the next one begins.
+func setChunkChecksums(data []byte, metrics map[string]diskMetric) {
+	offsets := make([]int64, 0)
+	for _, mt := range metrics {
+		for _, c := range mt.Chunks {
+			offsets = append(offsets, c.Offset)
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for _, mt := range metrics {
+		for i := range mt.Chunks {
+			c := &mt.Chunks[i]
+			end := int64(len(data))
+			if j := sort.Search(len(offsets), func(j int) bool { return offsets[j] > c.Offset }); j < len(offsets) {
+				end = offsets[j]
+			}
+			c.Length = end - c.Offset
+			c.Checksum = crc32.Checksum(data[c.Offset:end], castagnoliTable)
+		}
+	}
+}
+
+// parsePartitionRange gives back the time range the name of a partition directory tells.
+func parsePartitionRange(name string) (timeRange, bool) {
+	sub := partitionRangeRegex.FindStringSubmatch(name)
+	if sub == nil {
+		return timeRange{}, false
+	}
+	minT, err1 := strconv.ParseInt(sub[1], 10, 64)
+	maxT, err2 := strconv.ParseInt(sub[2], 10, 64)
+	if err1 != nil || err2 != nil {
+		return timeRange{}, false
+	}
+	return timeRange{min: minT, max: maxT}, true
+}
+
+// writeFileAtomically writes data into a temporary file and renames it to the given path.
+func writeFileAtomically(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, fs.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
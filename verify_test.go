@@ -0,0 +1,256 @@
+package embedtsdb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newVerifyDataDir gives back a data directory holding a single disk partition, along with the partition's path.
+func newVerifyDataDir(t *testing.T) (string, string) {
+	dataPath := t.TempDir()
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	rows := make([]Row, 0)
+	for i := int64(0); i < 200; i++ {
+		rows = append(rows, Row{Metric: "cpu", Labels: []Label{{Name: "host", Value: "a"}}, DataPoint: DataPoint{Timestamp: 1600000000 + i, Value: float64(i)}})
+	}
+	rows = append(rows, Row{Metric: "mem", DataPoint: DataPoint{Timestamp: 1600000100, Value: 1}})
+	require.NoError(t, s.InsertRows(rows))
+	require.NoError(t, s.Close())
+	dirs, err := filepath.Glob(filepath.Join(dataPath, "p-*"))
+	require.NoError(t, err)
+	require.Len(t, dirs, 1)
+	return dataPath, dirs[0]
+}
+
+// selectAll gives back all series in the given data directory.
+func selectAll(t *testing.T, dataPath string) []*Series {
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds))
+	require.NoError(t, err)
+	defer s.Close()
+	series, err := s.SelectSeries([]*Matcher{MustNewMatcher(MatchRegexp, MetricNameLabel, ".+")}, 0, 2000000000)
+	require.NoError(t, err)
+	return series
+}
+
+func TestVerify(t *testing.T) {
+	dataPath, _ := newVerifyDataDir(t)
+	report, err := Verify(dataPath)
+	require.NoError(t, err)
+	assert.True(t, report.OK())
+	require.Len(t, report.Partitions, 1)
+	assert.Equal(t, 2, report.Partitions[0].NumSeries)
+	assert.Equal(t, 201, report.Partitions[0].NumDataPoints)
+	assert.Empty(t, report.Partitions[0].Problems)
+
+	_, err = Verify(filepath.Join(dataPath, "missing"))
+	assert.Error(t, err)
+}
+
+func TestVerify_repairPartition(t *testing.T) {
+	tests := []struct {
+		name       string
+		corrupt    func(t *testing.T, dirPath string)
+		wantAction RepairAction
+	}{
+		{
+			name: "missing meta file",
+			corrupt: func(t *testing.T, dirPath string) {
+				require.NoError(t, os.Remove(filepath.Join(dirPath, metaFileName)))
+			},
+			wantAction: RepairRebuilt,
+		},
+		{
+			name: "broken meta file",
+			corrupt: func(t *testing.T, dirPath string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dirPath, metaFileName), []byte(`{"minTimestamp":`), 0644))
+			},
+			wantAction: RepairRebuilt,
+		},
+		{
+			name: "wrong number of data points",
+			corrupt: func(t *testing.T, dirPath string) {
+				m, err := readMeta(dirPath)
+				require.NoError(t, err)
+				name := marshalMetricName("mem", nil)
+				mt := m.Metrics[name]
+				mt.NumDataPoints = 2
+				mt.Chunks[0].NumDataPoints = 2
+				m.Metrics[name] = mt
+				writeTestMeta(t, dirPath, m)
+			},
+			wantAction: RepairRebuilt,
+		},
+		{
+			name: "wrong timestamp",
+			corrupt: func(t *testing.T, dirPath string) {
+				m, err := readMeta(dirPath)
+				require.NoError(t, err)
+				name := marshalMetricName("cpu", []Label{{Name: "host", Value: "a"}})
+				mt := m.Metrics[name]
+				mt.Chunks[1].MaxTimestamp++
+				m.Metrics[name] = mt
+				writeTestMeta(t, dirPath, m)
+			},
+			wantAction: RepairRebuilt,
+		},
+		{
+			name: "tampered meta file",
+			corrupt: func(t *testing.T, dirPath string) {
+				b, err := os.ReadFile(filepath.Join(dirPath, metaFileName))
+				require.NoError(t, err)
+				b = bytes.Replace(b, []byte(`"numDataPoints":201`), []byte(`"numDataPoints":202`), 1)
+				require.NoError(t, os.WriteFile(filepath.Join(dirPath, metaFileName), b, 0644))
+			},
+			wantAction: RepairRebuilt,
+		},
+		{
+			name: "corrupted chunk",
+			corrupt: func(t *testing.T, dirPath string) {
+				path := filepath.Join(dirPath, dataFileName)
+				b, err := os.ReadFile(path)
+				require.NoError(t, err)
+				b[len(b)/2] ^= 0xff
+				require.NoError(t, os.WriteFile(path, b, 0644))
+			},
+			wantAction: RepairQuarantined,
+		},
+		{
+			name: "broken index",
+			corrupt: func(t *testing.T, dirPath string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dirPath, indexFileName), []byte("ETIX"), 0644))
+			},
+			wantAction: RepairRebuilt,
+		},
+		{
+			name: "truncated data file",
+			corrupt: func(t *testing.T, dirPath string) {
+				require.NoError(t, os.Truncate(filepath.Join(dirPath, dataFileName), 10))
+			},
+			wantAction: RepairQuarantined,
+		},
+		{
+			name: "missing data file",
+			corrupt: func(t *testing.T, dirPath string) {
+				require.NoError(t, os.Remove(filepath.Join(dirPath, dataFileName)))
+			},
+			wantAction: RepairQuarantined,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dataPath, dirPath := newVerifyDataDir(t)
+			want := selectAll(t, dataPath)
+			wantMeta, err := readMeta(dirPath)
+			require.NoError(t, err)
+			tt.corrupt(t, dirPath)
+
+			report, err := Verify(dataPath)
+			require.NoError(t, err)
+			assert.False(t, report.OK())
+			require.Len(t, report.Partitions, 1)
+			assert.NotEmpty(t, report.Partitions[0].Problems)
+			assert.Empty(t, report.Partitions[0].Action)
+
+			report, err = Verify(dataPath, WithRepair())
+			require.NoError(t, err)
+			require.Len(t, report.Partitions, 1)
+			assert.Equal(t, tt.wantAction, report.Partitions[0].Action)
+
+			report, err = Verify(dataPath)
+			require.NoError(t, err)
+			assert.True(t, report.OK())
+			switch tt.wantAction {
+			case RepairRebuilt:
+				assert.Equal(t, want, selectAll(t, dataPath))
+				m, err := readMeta(dirPath)
+				require.NoError(t, err)
+				assert.Equal(t, wantMeta.Metrics, m.Metrics)
+			case RepairQuarantined:
+				assert.Empty(t, report.Partitions)
+				assert.DirExists(t, filepath.Join(dataPath, quarantineDirName, filepath.Base(dirPath)))
+				// The storage can be opened without the partition.
+				s, err := NewStorage(WithDataPath(dataPath))
+				require.NoError(t, err)
+				require.NoError(t, s.Close())
+			}
+		})
+	}
+}
+
+func TestVerify_partitionInWAL(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithWALBufferedSize(0))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{{Metric: "cpu", DataPoint: DataPoint{Timestamp: 1600000000, Value: 1}}}))
+
+	// Flushing was interrupted before writing the meta file.
+	dirPath := filepath.Join(dataPath, "p-1600000000-1600000000")
+	require.NoError(t, os.Mkdir(dirPath, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dirPath, dataFileName), []byte{1, 2, 3}, 0644))
+
+	report, err := Verify(dataPath, WithRepair())
+	require.NoError(t, err)
+	require.Len(t, report.Partitions, 1)
+	assert.Equal(t, RepairQuarantined, report.Partitions[0].Action)
+	require.Len(t, report.WALSegments, 1)
+	assert.Equal(t, 1, report.WALSegments[0].NumRecords)
+	require.NoError(t, s.Close())
+}
+
+func TestVerify_WAL(t *testing.T) {
+	dataPath := t.TempDir()
+	s, err := NewStorage(WithDataPath(dataPath), WithTimestampPrecision(Seconds), WithWALBufferedSize(0))
+	require.NoError(t, err)
+	require.NoError(t, s.InsertRows([]Row{
+		{Metric: "cpu", DataPoint: DataPoint{Timestamp: 1600000000, Value: 1}},
+		{Metric: "cpu", DataPoint: DataPoint{Timestamp: 1600000001, Value: 2}},
+	}))
+	segmentPath := filepath.Join(dataPath, walDirName, "0")
+	info, err := os.Stat(segmentPath)
+	require.NoError(t, err)
+	size := info.Size()
+
+	// A torn record isn't corruption.
+	f, err := os.OpenFile(segmentPath, os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{byte(operationInsert), 3, 'c'})
+	require.NoError(t, err)
+	report, err := Verify(dataPath)
+	require.NoError(t, err)
+	assert.True(t, report.OK())
+	require.Len(t, report.WALSegments, 1)
+	// Rows inserted together are in one record.
+	assert.Equal(t, WALSegmentReport{Path: segmentPath, NumRecords: 1, Offset: size, Torn: true}, report.WALSegments[0])
+
+	// An unknown operation is.
+	require.NoError(t, f.Truncate(size))
+	_, err = f.Write([]byte{0xff, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	report, err = Verify(dataPath)
+	require.NoError(t, err)
+	assert.False(t, report.OK())
+	assert.Error(t, report.WALSegments[0].Err)
+	assert.Equal(t, size, report.WALSegments[0].Offset)
+
+	report, err = Verify(dataPath, WithRepair())
+	require.NoError(t, err)
+	assert.Equal(t, RepairTruncated, report.WALSegments[0].Action)
+	info, err = os.Stat(segmentPath)
+	require.NoError(t, err)
+	assert.Equal(t, size, info.Size())
+	assert.FileExists(t, filepath.Join(dataPath, quarantineDirName, walDirName+"-0"))
+	require.NoError(t, s.Close())
+}
+
+func writeTestMeta(t *testing.T, dirPath string, m *meta) {
+	b, err := encodeMeta(m)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dirPath, metaFileName), b, 0644))
+}
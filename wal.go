@@ -15,14 +15,63 @@ const (
 	   +--------+---------------------+--------+--------------------+----------------+
 	*/
 	operationInsert walOperation = iota
+	// operationChecksummedInsert is the same as operationInsert, followed by the CRC32C of the preceding bytes:
+	/*
+	   +--------+---------------------+--------+--------------------+----------------+------------+
+	   | op(1b) | len metric(varints) | metric | timestamp(varints) | value(varints) | crc32c(4b) |
+	   +--------+---------------------+--------+--------------------+----------------+------------+
+	*/
+	// It was written before series references were introduced.
+	operationChecksummedInsert
+	// operationSeries assigns a reference to a series, which is valid until the end of the segment:
+	/*
+	   +--------+--------------+---------------------+--------+------------+
+	   | op(1b) | ref(varints) | len metric(varints) | metric | crc32c(4b) |
+	   +--------+--------------+---------------------+--------+------------+
+	*/
+	operationSeries
+	// operationSamples holds all data points of an insertion, each of which refers to a series assigned before it
+	// in the same segment. The timestamp is the delta from the previous sample's, or from zero for the first one:
+	/*
+	   +--------+--------------+--------------+--------------------------+-----------+-----+------------+
+	   | op(1b) | num(varints) | ref(varints) | timestamp delta(varints) | value(8b) | ... | crc32c(4b) |
+	   +--------+--------------+--------------+--------------------------+-----------+-----+------------+
+	*/
+	// Rows are written as operationSeries and operationSamples, while records of operationInsert and
+	// operationChecksummedInsert written by older versions are still read.
+	operationSamples
+	// operationSnappyBatch holds the records of operationSeries and operationSamples written for an insertion,
+	// compressed with Snappy:
+	/*
+	   +--------+----------------------+-----------------+------------+
+	   | op(1b) | len records(varints) | records(snappy) | crc32c(4b) |
+	   +--------+----------------------+-----------------+------------+
+	*/
+	operationSnappyBatch
+	// operationDelete records a deletion of data points within the range [start, end) of series that satisfy
+	// all the matchers, each of which consists of its type, label name and value:
+	/*
+	   +--------+----------------+--------------+-----------------------+----------+-------------------+------+--------------------+-------+-----+------------+
+	   | op(1b) | start(varints) | end(varints) | num matchers(varints) | type(1b) | len name(varints) | name | len value(varints) | value | ... | crc32c(4b) |
+	   +--------+----------------+--------------+-----------------------+----------+-------------------+------+--------------------+-------+-----+------------+
+	*/
+	operationDelete
 )
 
 // wal represents a write-ahead log, which offers durability guarantees.
 type wal interface {
 	append(op walOperation, rows []Row) error
+	// appendDelete appends a deletion, which is replayed in order with insertions.
+	appendDelete(matchers []*Matcher, start, end int64) error
 	flush() error
-	punctuate() error
-	removeOldest() error
+	// sync flushes buffered entries and then makes them durable on the disk.
+	sync() error
+	// punctuate sets a boundary for a new partition, and gives back the checkpoint the partition is created in.
+	punctuate() (uint64, error)
+	// checkpoint gives back the current checkpoint.
+	checkpoint() uint64
+	// removeBefore removes records written in checkpoints before the given one.
+	removeBefore(checkpoint uint64) error
 	removeAll() error
 	refresh() error
 }
@@ -37,15 +86,27 @@ func (f *nopWAL) append(_ walOperation, _ []Row) error {
 	return nil
 }
 
+func (f *nopWAL) appendDelete(_ []*Matcher, _, _ int64) error {
+	return nil
+}
+
 func (f *nopWAL) flush() error {
 	return nil
 }
 
-func (f *nopWAL) punctuate() error {
+func (f *nopWAL) sync() error {
 	return nil
 }
 
-func (f *nopWAL) removeOldest() error {
+func (f *nopWAL) punctuate() (uint64, error) {
+	return 0, nil
+}
+
+func (f *nopWAL) checkpoint() uint64 {
+	return 0
+}
+
+func (f *nopWAL) removeBefore(_ uint64) error {
 	return nil
 }
 